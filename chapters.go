@@ -0,0 +1,287 @@
+package url2epub
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	epubChapterFilenameTemplate = "article-%02d.xhtml"
+
+	// The prefix added to the paths of the chapters of each section, with the
+	// 1-based index of the section.
+	epubSectionPrefixTemplate = "section-%02d-"
+)
+
+// epubChapter is an xhtml file of the article in the epub.
+type epubChapter struct {
+	// The path of the xhtml file, relative to the content dir.
+	Path string
+
+	// The title used by the nav when there's no table of contents.
+	Title string
+
+	// Space separated manifest properties of the chapter, if any.
+	Properties string
+
+	node *html.Node
+}
+
+// epubChapters returns the chapters of root.
+//
+// When maxNodes > 0 and the body of root has more than maxNodes nodes, root is
+// split into multiple chapters, otherwise root is returned as the only chapter.
+// root is not modified by the split.
+func epubChapters(root *html.Node, maxNodes int) []*epubChapter {
+	var nodes []*html.Node
+	if maxNodes > 0 {
+		nodes = splitChapters(root, maxNodes)
+	}
+	if len(nodes) <= 1 {
+		return []*epubChapter{{
+			Path:       epubArticleFilename,
+			Title:      "Content",
+			Properties: chapterProperties(root),
+			node:       root,
+		}}
+	}
+	chapters := make([]*epubChapter, 0, len(nodes))
+	for i, node := range nodes {
+		chapters = append(chapters, &epubChapter{
+			Path:       fmt.Sprintf(epubChapterFilenameTemplate, i+1),
+			Title:      fmt.Sprintf("Part %d", i+1),
+			Properties: chapterProperties(node),
+			node:       node,
+		})
+	}
+	return chapters
+}
+
+// epubSections returns the table of contents and the chapters of sections.
+//
+// Each section has a top level item in the table of contents, pointing to its
+// first chapter, with the headings of the section as its children.
+func epubSections(sections []EpubSection, maxNodes int) ([]*epubTOCItem, []*epubChapter) {
+	toc := make([]*epubTOCItem, 0, len(sections))
+	var chapters []*epubChapter
+	for i, section := range sections {
+		// This needs to be done before splitting the chapters, as it assigns ids
+		// to the headings.
+		children := buildEpubTOC(section.Node)
+		sectionChapters := epubChapters(
+			linkEpubStylesheet(wrapEpubXMLnsNode(section.Node)),
+			maxNodes,
+		)
+		prefix := fmt.Sprintf(epubSectionPrefixTemplate, i+1)
+		for _, chapter := range sectionChapters {
+			chapter.Path = prefix + chapter.Path
+			chapter.Title = section.Title
+		}
+		// The ids are only unique within the section.
+		setEpubTOCHrefs(children, chapterPaths(sectionChapters))
+		toc = append(toc, &epubTOCItem{
+			Title:    html.EscapeString(section.Title),
+			Href:     html.EscapeString(sectionChapters[0].Path),
+			Children: children,
+		})
+		chapters = append(chapters, sectionChapters...)
+	}
+	return toc, chapters
+}
+
+// chapterProperties returns the manifest properties of the chapter node.
+func chapterProperties(node *html.Node) string {
+	if FromNode(node).FindFirstAtomNode(atom.Svg) != nil {
+		// Required by epub 3 for xhtml with inline svg.
+		return "svg"
+	}
+	return ""
+}
+
+// chapterPaths returns the map of the ids in the chapters to the path of the
+// chapter containing them.
+func chapterPaths(chapters []*epubChapter) map[string]string {
+	paths := make(map[string]string)
+	for _, chapter := range chapters {
+		var walk func(n *html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode {
+				if id := getAttr(n, "id"); id != "" {
+					if _, ok := paths[id]; !ok {
+						paths[id] = chapter.Path
+					}
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(chapter.node)
+	}
+	return paths
+}
+
+// splitChapters splits root into multiple html nodes, each with the body
+// having roughly at most maxNodes nodes.
+//
+// The split happens between the children of the content container, which is
+// body, or its only child element (recursively) if body only wraps a single
+// element (e.g. article). It prefers splitting before headings and sections.
+// A single child with more than maxNodes nodes is not split further.
+//
+// It returns nil if root doesn't need to be split.
+func splitChapters(root *html.Node, maxNodes int) []*html.Node {
+	htmlNode := firstHTMLNode(root)
+	if htmlNode == nil {
+		return nil
+	}
+	var head, body *html.Node
+	for c := htmlNode.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Head:
+			head = c
+		case atom.Body:
+			body = c
+		}
+	}
+	if body == nil || countNodes(body) <= maxNodes {
+		return nil
+	}
+
+	// The chain of elements from body to the content container.
+	wrappers := []*html.Node{body}
+	for {
+		only := onlyChildElement(wrappers[len(wrappers)-1])
+		if only == nil || headingAtoms[only.DataAtom] {
+			break
+		}
+		wrappers = append(wrappers, only)
+	}
+	container := wrappers[len(wrappers)-1]
+
+	// Group the children into segments, each starting with a heading or section.
+	var segments [][]*html.Node
+	for c := container.FirstChild; c != nil; c = c.NextSibling {
+		if len(segments) == 0 || (c.Type == html.ElementNode && (headingAtoms[c.DataAtom] || c.DataAtom == atom.Section)) {
+			segments = append(segments, nil)
+		}
+		segments[len(segments)-1] = append(segments[len(segments)-1], c)
+	}
+
+	// Pack the segments into chunks, splitting the segments too large on their
+	// own.
+	var chunks [][]*html.Node
+	var current []*html.Node
+	var currentNodes int
+	add := func(nodes []*html.Node, count int) {
+		if len(current) > 0 && currentNodes+count > maxNodes {
+			chunks = append(chunks, current)
+			current = nil
+			currentNodes = 0
+		}
+		current = append(current, nodes...)
+		currentNodes += count
+	}
+	for _, segment := range segments {
+		var count int
+		for _, n := range segment {
+			count += countNodes(n)
+		}
+		if count <= maxNodes {
+			add(segment, count)
+			continue
+		}
+		for _, n := range segment {
+			add([]*html.Node{n}, countNodes(n))
+		}
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	if len(chunks) <= 1 {
+		return nil
+	}
+
+	nodes := make([]*html.Node, 0, len(chunks))
+	for _, chunk := range chunks {
+		chapterHTML := shallowCloneNode(htmlNode)
+		if head != nil {
+			chapterHTML.AppendChild(cloneNode(head))
+		}
+		parent := chapterHTML
+		for _, wrapper := range wrappers {
+			clone := shallowCloneNode(wrapper)
+			parent.AppendChild(clone)
+			parent = clone
+		}
+		for _, n := range chunk {
+			parent.AppendChild(cloneNode(n))
+		}
+		nodes = append(nodes, chapterHTML)
+	}
+	return nodes
+}
+
+var headingAtoms = map[atom.Atom]bool{
+	atom.H1: true,
+	atom.H2: true,
+	atom.H3: true,
+	atom.H4: true,
+	atom.H5: true,
+	atom.H6: true,
+}
+
+// onlyChildElement returns the only child element of n, if n has exactly one
+// child element and no non-whitespace text.
+func onlyChildElement(n *html.Node) *html.Node {
+	var only *html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.ElementNode:
+			if only != nil {
+				return nil
+			}
+			only = c
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return nil
+			}
+		}
+	}
+	return only
+}
+
+// countNodes returns the number of nodes in n, including n itself.
+func countNodes(n *html.Node) int {
+	count := 1
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		count += countNodes(c)
+	}
+	return count
+}
+
+// shallowCloneNode returns a copy of n without parent, siblings, or children.
+func shallowCloneNode(n *html.Node) *html.Node {
+	return &html.Node{
+		Type:      n.Type,
+		DataAtom:  n.DataAtom,
+		Data:      n.Data,
+		Namespace: n.Namespace,
+		Attr:      append([]html.Attribute(nil), n.Attr...),
+	}
+}
+
+// cloneNode returns a deep copy of n without parent or siblings.
+func cloneNode(n *html.Node) *html.Node {
+	clone := shallowCloneNode(n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		clone.AppendChild(cloneNode(c))
+	}
+	return clone
+}
@@ -1,12 +1,15 @@
 package url2epub
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
@@ -16,19 +19,73 @@ type lastURLKeyType struct{}
 
 var lastURLKey lastURLKeyType
 
-var client = &http.Client{
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		if len(via) >= 10 {
-			// Copied from:
-			// https://go.googlesource.com/go/+/go1.15.6/src/net/http/client.go#805
-			return errors.New("stopped after 10 redirects")
+// ErrUnsupportedScheme is the error returned when the url (or any of its
+// redirects) is not http or https.
+var ErrUnsupportedScheme = errors.New("url2epub: unsupported url scheme")
+
+// client is the http client shared by GetHTML and Readable by default.
+var client = NewClient(DefaultTransportTimeouts)
+
+// NewClient returns an http client with transport from NewTransport, which
+// tracks redirects for GetHTML and enforces the HostPolicy on them.
+//
+// It's suitable to be used as GetHTMLArgs.Client and ReadableArgs.Client.
+func NewClient(timeouts TransportTimeouts) *http.Client {
+	return &http.Client{
+		Transport:     NewTransport(timeouts),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		// Copied from:
+		// https://go.googlesource.com/go/+/go1.15.6/src/net/http/client.go#805
+		return errors.New("stopped after 10 redirects")
+	}
+	if err := checkScheme(req.URL); err != nil {
+		return err
+	}
+	if p, _ := req.Context().Value(hostPolicyKey).(*HostPolicy); p != nil {
+		if err := p.checkURL(req.URL); err != nil {
+			return err
+		}
+	}
+	value := req.Context().Value(lastURLKey)
+	if ptr, ok := value.(**url.URL); ok {
+		*ptr = req.URL
+	}
+	return nil
+}
+
+// httpClient returns the client to be used by get, based on the custom client
+// c (optional) and jar (optional).
+//
+// The redirect tracking and HostPolicy checks are always added, before the
+// CheckRedirect of c (if any).
+func httpClient(c *http.Client, jar http.CookieJar) *http.Client {
+	if c == nil {
+		if jar == nil {
+			return client
+		}
+		withJar := *client
+		withJar.Jar = jar
+		return &withJar
+	}
+	custom := *c
+	if jar != nil {
+		custom.Jar = jar
+	}
+	custom.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := checkRedirect(req, via); err != nil {
+			return err
 		}
-		value := req.Context().Value(lastURLKey)
-		if ptr, ok := value.(**url.URL); ok {
-			*ptr = req.URL
+		if c.CheckRedirect != nil {
+			return c.CheckRedirect(req, via)
 		}
 		return nil
-	},
+	}
+	return &custom
 }
 
 // GetHTMLArgs define the arguments used by GetHTML function.
@@ -38,6 +95,30 @@ type GetHTMLArgs struct {
 
 	// The User-Agent header to use, optional.
 	UserAgent string
+
+	// The cookie jar to use, optional.
+	CookieJar http.CookieJar
+
+	// The policy of the hosts allowed to be fetched from, including redirects,
+	// optional.
+	//
+	// When the url is blocked, the returned error wraps ErrBlockedHost.
+	HostPolicy *HostPolicy
+
+	// The rate limiter to throttle the request, optional.
+	RateLimiter *HostRateLimiter
+
+	// The http client to use, optional.
+	//
+	// When it's nil, a shared client with transport from NewTransport is used,
+	// see SetTransportTimeouts. The addresses resolved are only checked against
+	// HostPolicy when the Transport of the client is from NewTransport.
+	Client *http.Client
+
+	// The timeout of the whole request including reading the body, optional.
+	//
+	// <=0 means only relying on the deadline of the ctx.
+	Timeout time.Duration
 }
 
 // GetHTML does HTTP get requests on HTML content.
@@ -51,21 +132,42 @@ type GetHTMLArgs struct {
 // Type being ElementNode and DataAtom being Html (instead of root node, which
 // is usually DoctypeNode).
 //
+// - Only http and https urls are supported, for other schemes the returned
+// error wraps ErrUnsupportedScheme.
+//
+// - If the content is an RSS or Atom feed instead of html, the returned error
+// wraps ErrFeed.
+//
 // - The client used by Get does not have timeout set. It's expected that a
-// deadline is set in the ctx passed in.
+// deadline is set in the ctx passed in, or Timeout is set in args.
 func GetHTML(ctx context.Context, args GetHTMLArgs) (*Node, *url.URL, error) {
 	src, err := url.Parse(args.URL)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to parse url %q: %w", args.URL, err)
 	}
 
-	body, lastURL, err := get(ctx, src, args.UserAgent)
+	if args.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.Timeout)
+		defer cancel()
+	}
+	body, lastURL, err := get(ctx, src, getArgs{
+		userAgent:   args.UserAgent,
+		cookieJar:   args.CookieJar,
+		hostPolicy:  args.HostPolicy,
+		rateLimiter: args.RateLimiter,
+		client:      args.Client,
+	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to get %q: %w", args.URL, err)
 	}
 	defer DrainAndClose(body)
 	src = lastURL
-	root, err := html.Parse(body)
+	br := bufio.NewReaderSize(body, feedSniffLen)
+	if isFeed(br) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrFeed, src)
+	}
+	root, err := html.Parse(br)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to parse %q: %w", src, err)
 	}
@@ -78,7 +180,44 @@ func DrainAndClose(r io.ReadCloser) error {
 	return r.Close()
 }
 
-func get(ctx context.Context, src *url.URL, ua string) (io.ReadCloser, *url.URL, error) {
+// statusCodeError is the error returned by get when the http status code is
+// not 200.
+type statusCodeError int
+
+func (code statusCodeError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", int(code))
+}
+
+type getArgs struct {
+	userAgent   string
+	referer     string
+	cookieJar   http.CookieJar
+	hostPolicy  *HostPolicy
+	rateLimiter *HostRateLimiter
+	client      *http.Client
+}
+
+// checkScheme returns an error wrapping ErrUnsupportedScheme if u is not http
+// or https.
+func checkScheme(u *url.URL) error {
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+}
+
+func get(ctx context.Context, src *url.URL, args getArgs) (io.ReadCloser, *url.URL, error) {
+	if err := checkScheme(src); err != nil {
+		return nil, nil, err
+	}
+	if err := args.hostPolicy.checkURL(src); err != nil {
+		return nil, nil, err
+	}
+	if err := args.rateLimiter.Wait(ctx, src); err != nil {
+		return nil, nil, err
+	}
+	ctx = withHostPolicy(ctx, args.hostPolicy)
 	req := &http.Request{
 		Method: http.MethodGet,
 		URL:    src,
@@ -89,17 +228,20 @@ func get(ctx context.Context, src *url.URL, ua string) (io.ReadCloser, *url.URL,
 	*lastURL = src
 	ctx = context.WithValue(ctx, lastURLKey, lastURL)
 	req = req.WithContext(ctx)
-	if ua != "" {
-		req.Header.Set("user-agent", ua)
+	if args.userAgent != "" {
+		req.Header.Set("user-agent", args.userAgent)
+	}
+	if args.referer != "" {
+		req.Header.Set("referer", args.referer)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := httpClient(args.client, args.cookieJar).Do(req)
 	if err != nil {
 		return nil, nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
 		DrainAndClose(resp.Body)
-		return nil, nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, nil, statusCodeError(resp.StatusCode)
 	}
 	return resp.Body, *lastURL, nil
 }
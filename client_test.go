@@ -0,0 +1,140 @@
+package url2epub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// countingTransport is an http.RoundTripper counting the requests sent through
+// it.
+type countingTransport struct {
+	count atomic.Int64
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.count.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGetHTMLCustomClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body><p>Hello</p></body></html>`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	transport := new(countingTransport)
+	var redirects atomic.Int64
+	_, lastURL, err := GetHTML(context.Background(), GetHTMLArgs{
+		URL: srv.URL + "/old",
+		Client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				redirects.Add(1)
+				return nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("GetHTML failed: %v", err)
+	}
+	if got, want := transport.count.Load(), int64(2); got != want {
+		t.Errorf("custom client got %d requests, want %d", got, want)
+	}
+	if got, want := redirects.Load(), int64(1); got != want {
+		t.Errorf("CheckRedirect of the custom client got called %d times, want %d", got, want)
+	}
+	if got, want := lastURL.String(), srv.URL+"/new"; got != want {
+		t.Errorf("lastURL got %q, want %q", got, want)
+	}
+}
+
+func TestReadableCustomClient(t *testing.T) {
+	data := testPNGImage(t, 4, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := html.Parse(strings.NewReader(`<html><body><article><p><img src="/a.png"></p></article></body></html>`))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+
+	transport := new(countingTransport)
+	_, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+		BaseURL: baseURL,
+		Client: &http.Client{
+			Transport: transport,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Readable failed: %v", err)
+	}
+	if got, want := len(images), 1; got != want {
+		t.Errorf("got %d images, want %d: %v", got, want, images)
+	}
+	if got, want := transport.count.Load(), int64(1); got != want {
+		t.Errorf("custom client got %d requests, want %d", got, want)
+	}
+}
+
+func TestGetHTMLScheme(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body><p>Hello</p></body></html>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, c := range []struct {
+		label string
+		url   string
+		want  error
+	}{
+		{
+			label: "file",
+			url:   "file:///etc/passwd",
+			want:  ErrUnsupportedScheme,
+		},
+		{
+			label: "ftp",
+			url:   "ftp://example.com/index.html",
+			want:  ErrUnsupportedScheme,
+		},
+		{
+			label: "https",
+			url:   srv.URL,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			_, _, err := GetHTML(context.Background(), GetHTMLArgs{
+				URL:    c.url,
+				Client: srv.Client(),
+			})
+			if c.want == nil {
+				if err != nil {
+					t.Errorf("GetHTML(%q) failed: %v", c.url, err)
+				}
+				return
+			}
+			if !errors.Is(err, c.want) {
+				t.Errorf("GetHTML(%q) got error %v, want %v", c.url, err, c.want)
+			}
+		})
+	}
+}
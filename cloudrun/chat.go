@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 
 	"cloud.google.com/go/datastore"
@@ -71,11 +72,64 @@ func (at *AccountType) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// OutputFormat is the preferred output format of a chat.
+type OutputFormat int
+
+const (
+	// OutputFormatDefault means the chat doesn't have a preference,
+	// which is the same as OutputFormatEpub.
+	OutputFormatDefault OutputFormat = iota
+	OutputFormatEpub
+	OutputFormatPDF
+	OutputFormatLink
+)
+
+func (f OutputFormat) String() string {
+	switch f {
+	default:
+		return fmt.Sprintf("<UNKNOWN-%d>", f)
+	case OutputFormatDefault:
+		return "default (epub)"
+	case OutputFormatEpub:
+		return "epub"
+	case OutputFormatPDF:
+		return "pdf"
+	case OutputFormatLink:
+		return "link"
+	}
+}
+
+// ParseOutputFormat parses the user input into OutputFormat.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	default:
+		return OutputFormatDefault, fmt.Errorf("unknown output format %q", s)
+	case "epub":
+		return OutputFormatEpub, nil
+	case "pdf":
+		return OutputFormatPDF, nil
+	case "link":
+		return OutputFormatLink, nil
+	}
+}
+
 // EntityChatToken is the entity rmapi token for a chat stored in datastore.
 type EntityChatToken struct {
-	Chat     int64       `datastore:"chat" json:"chat"`
-	Type     AccountType `datastore:"type" json:"type"`
-	FitImage int         `datastore:"fit_image" json:"fit_image"`
+	Chat int64 `datastore:"chat" json:"chat"`
+	// The most recently linked account type.
+	Type AccountType `datastore:"type" json:"type"`
+	// All the linked account types, the urls are sent to all of them.
+	//
+	// It's empty for the chats linked before multiple accounts were supported,
+	// use GetTargets instead.
+	Targets  []AccountType `datastore:"targets" json:"targets"`
+	FitImage int           `datastore:"fit_image" json:"fit_image"`
+
+	Format     OutputFormat `datastore:"format" json:"format"`
+	SkipImages bool         `datastore:"skip_images" json:"skip_images"`
+	// Stored as the negation so that the zero value means quoting,
+	// use GetQuoteReplies instead.
+	NoQuote bool `datastore:"no_quote" json:"no_quote"`
 
 	// reMarkable related fields
 	RMToken    string `datastore:"token" json:"token"`
@@ -108,6 +162,103 @@ func (e *EntityChatToken) GetFont() string {
 	return strings.TrimPrefix(e.RMFont, fontPrefix)
 }
 
+// GetFormat returns the output format to use, with default resolved.
+func (e *EntityChatToken) GetFormat() OutputFormat {
+	if e.Format == OutputFormatDefault {
+		return OutputFormatEpub
+	}
+	return e.Format
+}
+
+// GetQuoteReplies returns whether the replies should quote the original
+// messages.
+//
+// It's safe to be called on nil entity, which returns the default (true).
+func (e *EntityChatToken) GetQuoteReplies() bool {
+	return e == nil || !e.NoQuote
+}
+
+// GetTargets returns all the linked account types of the chat.
+//
+// For the chats linked before multiple accounts were supported, it returns Type
+// as the only target.
+func (e *EntityChatToken) GetTargets() []AccountType {
+	if len(e.Targets) > 0 {
+		return e.Targets
+	}
+	return []AccountType{e.Type}
+}
+
+// dirTarget returns the linked account type to be used by the dir command,
+// preferring the most recently linked one.
+//
+// It returns Type if none of the linked accounts support dirs.
+func (e *EntityChatToken) dirTarget() AccountType {
+	switch e.Type {
+	case AccountTypeRM, AccountTypeDropbox:
+		return e.Type
+	}
+	targets := e.GetTargets()
+	for i := len(targets) - 1; i >= 0; i-- {
+		switch targets[i] {
+		case AccountTypeRM, AccountTypeDropbox:
+			return targets[i]
+		}
+	}
+	return e.Type
+}
+
+// linkAccount links the chat to the account of type t with credential (token
+// for reMarkable and Dropbox, email for kindle), in addition to the already
+// linked accounts of other types.
+//
+// The other settings (e.g. dir, font, fit) are kept intact, so that they
+// survive re-linking after a token expiry.
+func (e *EntityChatToken) linkAccount(t AccountType, credential string) {
+	if len(e.Targets) == 0 && e.Type != 0 {
+		// Migrate from the chats linked before multiple accounts were supported.
+		e.Targets = []AccountType{e.Type}
+	}
+	if !slices.Contains(e.Targets, t) {
+		e.Targets = append(e.Targets, t)
+	}
+	e.Type = t
+	e.setCredential(t, credential)
+}
+
+// unlinkAccount unlinks the account of type t from the chat.
+//
+// It returns false if the account of type t was not linked.
+// When the last account is unlinked, the chat should be deleted instead of
+// saved.
+func (e *EntityChatToken) unlinkAccount(t AccountType) bool {
+	targets := e.GetTargets()
+	if !slices.Contains(targets, t) {
+		return false
+	}
+	e.Targets = slices.DeleteFunc(slices.Clone(targets), func(target AccountType) bool {
+		return target == t
+	})
+	if len(e.Targets) > 0 {
+		e.Type = e.Targets[len(e.Targets)-1]
+	} else {
+		e.Type = 0
+	}
+	e.setCredential(t, "")
+	return true
+}
+
+func (e *EntityChatToken) setCredential(t AccountType, credential string) {
+	switch t {
+	case AccountTypeRM:
+		e.RMToken = credential
+	case AccountTypeKindle:
+		e.KindleEmail = credential
+	case AccountTypeDropbox:
+		e.DropboxToken = credential
+	}
+}
+
 // SaveDatastore saves this entity into datastore.
 func (e *EntityChatToken) SaveDatastore(ctx context.Context) error {
 	key := e.datastoreKey()
@@ -135,20 +286,49 @@ func (e *EntityChatToken) Delete(ctx context.Context) {
 
 // GetChat gets an entity from db.
 func GetChat(ctx context.Context, id int64) *EntityChatToken {
+	e, err := getChat(ctx, id)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to get datastore key",
+			"err", err,
+			"chat", id,
+		)
+		return nil
+	}
+	return e
+}
+
+// getChat is GetChat but returns the datastore errors other than
+// datastore.ErrNoSuchEntity.
+//
+// It returns nil, nil when the chat doesn't exist.
+func getChat(ctx context.Context, id int64) (*EntityChatToken, error) {
 	e := &EntityChatToken{
 		Chat: id,
 	}
-	key := e.datastoreKey()
-	if err := dsClient.Get(ctx, key, e); err != nil {
-		if !errors.Is(err, datastore.ErrNoSuchEntity) {
-			slog.ErrorContext(
-				ctx,
-				"Failed to get datastore key",
-				"err", err,
-				"key", key,
-			)
+	if err := dsClient.Get(ctx, e.datastoreKey(), e); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil, nil
 		}
-		return nil
+		return nil, err
 	}
-	return e
+	return e, nil
+}
+
+// getChatForStart returns the existing chat or a new one for /start.
+//
+// Unlike GetChat, it returns an error instead of nil when it failed to read the
+// existing chat, so that the settings are not overwritten by a new chat.
+func getChatForStart(ctx context.Context, id int64) (*EntityChatToken, error) {
+	e, err := getChat(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		e = &EntityChatToken{
+			Chat: id,
+		}
+	}
+	return e, nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	corsAllowMethods = "GET, POST, OPTIONS"
+	corsAllowHeaders = "content-type, " + headerIdempotencyKey
+	// The headers of the REST responses the browser callers might need.
+	corsExposeHeaders = "content-disposition, retry-after, " + headerIdempotentReplayed
+
+	corsMaxAge = time.Hour
+)
+
+// corsPolicy is the CORS policy of the REST endpoints.
+//
+// A nil *corsPolicy is valid and does not allow any cross-origin requests.
+type corsPolicy struct {
+	// When true, all origins are allowed.
+	any     bool
+	origins []string
+}
+
+// corsOrigins is the CORS policy of the REST endpoints.
+var corsOrigins *corsPolicy
+
+// getCORSPolicy returns the CORS policy of the REST endpoints, configured by
+// CORS_ALLOWED_ORIGINS env as comma separated origins (e.g.
+// "https://example.com"), or "*" to allow all origins.
+//
+// It returns nil (no CORS) when the env is empty.
+func getCORSPolicy() *corsPolicy {
+	return parseCORSPolicy(os.Getenv("CORS_ALLOWED_ORIGINS"))
+}
+
+func parseCORSPolicy(s string) *corsPolicy {
+	var p corsPolicy
+	for _, origin := range strings.Split(s, ",") {
+		switch origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin {
+		case "":
+		case "*":
+			p.any = true
+		default:
+			p.origins = append(p.origins, strings.ToLower(origin))
+		}
+	}
+	if !p.any && len(p.origins) == 0 {
+		return nil
+	}
+	return &p
+}
+
+func (p *corsPolicy) allowed(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+	return p.any || slices.Contains(p.origins, strings.ToLower(origin))
+}
+
+// withCORS wraps a REST endpoint handler to handle CORS with corsOrigins,
+// including the preflight requests.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := corsOrigins
+		origin := r.Header.Get("origin")
+		if p != nil {
+			w.Header().Add("vary", "origin")
+		}
+		allowed := p.allowed(origin)
+		if allowed {
+			w.Header().Set("access-control-allow-origin", origin)
+			w.Header().Set("access-control-expose-headers", corsExposeHeaders)
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("access-control-request-method") != "" {
+			// Preflight request.
+			if allowed {
+				w.Header().Set("access-control-allow-methods", corsAllowMethods)
+				w.Header().Set("access-control-allow-headers", corsAllowHeaders)
+				w.Header().Set("access-control-max-age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCORSPolicy(t *testing.T) {
+	if p := parseCORSPolicy(""); p != nil {
+		t.Errorf("parseCORSPolicy(\"\") got %+v, want nil", p)
+	}
+	if p := parseCORSPolicy(" , "); p != nil {
+		t.Errorf("parseCORSPolicy(\" , \") got %+v, want nil", p)
+	}
+
+	p := parseCORSPolicy("https://Example.com/, https://foo.example.com")
+	for origin, want := range map[string]bool{
+		"https://example.com":     true,
+		"https://foo.example.com": true,
+		"http://example.com":      false,
+		"https://bar.example.com": false,
+		"":                        false,
+	} {
+		if got := p.allowed(origin); got != want {
+			t.Errorf("allowed(%q) got %v, want %v", origin, got, want)
+		}
+	}
+
+	if p := parseCORSPolicy("*"); !p.allowed("https://example.com") {
+		t.Error("parseCORSPolicy(\"*\") does not allow https://example.com")
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	t.Cleanup(func() {
+		corsOrigins = nil
+	})
+	var called bool
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	for _, c := range []struct {
+		label      string
+		policy     string
+		method     string
+		origin     string
+		preflight  bool
+		wantOrigin string
+		wantCalled bool
+	}{
+		{
+			label:      "disabled",
+			method:     http.MethodGet,
+			origin:     "https://example.com",
+			wantCalled: true,
+		},
+		{
+			label:      "allowed",
+			policy:     "https://example.com",
+			method:     http.MethodGet,
+			origin:     "https://example.com",
+			wantOrigin: "https://example.com",
+			wantCalled: true,
+		},
+		{
+			label:      "not-allowed",
+			policy:     "https://example.com",
+			method:     http.MethodPost,
+			origin:     "https://evil.example.com",
+			wantCalled: true,
+		},
+		{
+			label:      "preflight-allowed",
+			policy:     "*",
+			method:     http.MethodOptions,
+			origin:     "https://example.com",
+			preflight:  true,
+			wantOrigin: "https://example.com",
+		},
+		{
+			label:     "preflight-not-allowed",
+			policy:    "https://example.com",
+			method:    http.MethodOptions,
+			origin:    "https://evil.example.com",
+			preflight: true,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			corsOrigins = parseCORSPolicy(c.policy)
+			called = false
+			req := httptest.NewRequest(c.method, epubEndpoint, nil)
+			req.Header.Set("origin", c.origin)
+			if c.preflight {
+				req.Header.Set("access-control-request-method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if called != c.wantCalled {
+				t.Errorf("handler called got %v, want %v", called, c.wantCalled)
+			}
+			if got := rec.Header().Get("access-control-allow-origin"); got != c.wantOrigin {
+				t.Errorf("access-control-allow-origin got %q, want %q", got, c.wantOrigin)
+			}
+			if c.preflight {
+				if rec.Code != http.StatusNoContent {
+					t.Errorf("preflight got status %d, want %d", rec.Code, http.StatusNoContent)
+				}
+				gotMethods := rec.Header().Get("access-control-allow-methods")
+				if wantMethods := c.wantOrigin != ""; (gotMethods != "") != wantMethods {
+					t.Errorf("access-control-allow-methods got %q", gotMethods)
+				}
+			}
+		})
+	}
+}
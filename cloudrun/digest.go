@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+
+	"go.yhsif.com/url2epub"
+	"go.yhsif.com/url2epub/tgbot"
+)
+
+const (
+	pendingKind = "pending-urls"
+
+	// The max number of urls in the pending list of a chat.
+	maxPendingURLs = 20
+
+	// The deadline of building the digest from all the pending urls,
+	// including uploading it.
+	digestTimeout = 5 * time.Minute
+
+	// The deadline of updating the pending list after building the digest,
+	// which could be after digestTimeout already ran out.
+	pendingUpdateTimeout = 10 * time.Second
+
+	digestTitleFormat = "Digest 2006-01-02"
+)
+
+var (
+	errPendingFull      = errors.New("pending list is full")
+	errPendingDuplicate = errors.New("url is already in the pending list")
+)
+
+// PendingURL is an url added to the pending list of a chat, to be included in
+// the next digest.
+type PendingURL struct {
+	URL  string    `datastore:"url,noindex" json:"url"`
+	Time time.Time `datastore:"time,noindex" json:"time"`
+	// The text of the link in the telegram message, if any.
+	TitleHint string `datastore:"title_hint,noindex" json:"title_hint"`
+}
+
+// EntityPendingURLs is the pending list of a chat stored in datastore.
+//
+// Like EntityUploadHistory, it's stored separately from EntityChatToken.
+type EntityPendingURLs struct {
+	Chat int64 `datastore:"chat" json:"chat"`
+	// The oldest url comes first.
+	URLs []PendingURL `datastore:"urls,noindex" json:"urls"`
+}
+
+func pendingDatastoreKey(chat int64) *datastore.Key {
+	return datastore.NameKey(pendingKind, fmt.Sprintf(chatKey, chat), nil)
+}
+
+// getPendingURLs returns the pending list of the chat, oldest first.
+func getPendingURLs(ctx context.Context, chat int64) ([]PendingURL, error) {
+	e := &EntityPendingURLs{
+		Chat: chat,
+	}
+	if err := dsClient.Get(ctx, pendingDatastoreKey(chat), e); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return e.URLs, nil
+}
+
+// savePendingURLs replaces the pending list of the chat with urls.
+func savePendingURLs(ctx context.Context, chat int64, urls []PendingURL) error {
+	if len(urls) == 0 {
+		return dsClient.Delete(ctx, pendingDatastoreKey(chat))
+	}
+	e := &EntityPendingURLs{
+		Chat: chat,
+		URLs: urls,
+	}
+	_, err := dsClient.Put(ctx, pendingDatastoreKey(chat), e)
+	return err
+}
+
+// deletePendingURLs deletes the pending list of the chat.
+func deletePendingURLs(ctx context.Context, chat int64) {
+	key := pendingDatastoreKey(chat)
+	if err := dsClient.Delete(ctx, key); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to delete datastore key",
+			"err", err,
+			"key", key,
+		)
+	}
+}
+
+// addPending returns the pending list with p added as the newest url.
+//
+// It returns errPendingDuplicate if p.URL is already in the list, or
+// errPendingFull if the list already has maxPendingURLs urls.
+func addPending(pending []PendingURL, p PendingURL) ([]PendingURL, error) {
+	for _, existing := range pending {
+		if existing.URL == p.URL {
+			return pending, errPendingDuplicate
+		}
+	}
+	if len(pending) >= maxPendingURLs {
+		return pending, errPendingFull
+	}
+	return append(pending, p), nil
+}
+
+// removePending returns the pending list with the urls in done removed.
+//
+// It's used instead of clearing the whole list after the digest, to keep the
+// urls added while building the digest.
+func removePending(pending []PendingURL, done []PendingURL) []PendingURL {
+	remove := make(map[string]bool, len(done))
+	for _, p := range done {
+		remove[p.URL] = true
+	}
+	var kept []PendingURL
+	for _, p := range pending {
+		if !remove[p.URL] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// digestArticle is an article included in the digest.
+type digestArticle struct {
+	url   string
+	title string
+}
+
+// buildDigest prepares a single epub with every pending url as a section.
+//
+// The urls failed to be fetched are skipped and returned as failed. The urls
+// not tried before ctx is done, or failed temporarily (e.g. overloaded), are
+// returned as kept to be retried by the next digest. The returned epub is nil
+// when none of the urls succeeded.
+func buildDigest(
+	ctx context.Context,
+	pending []PendingURL,
+	chat *EntityChatToken,
+	now time.Time,
+) (p *preparedEpub, included []digestArticle, failed []string, kept []PendingURL) {
+	var sections []url2epub.EpubSection
+	images := make(map[string]io.Reader)
+	for i, pu := range pending {
+		if ctx.Err() != nil {
+			slog.WarnContext(ctx, "buildDigest: Timed out", "done", i, "total", len(pending))
+			kept = append(kept, pending[i:]...)
+			break
+		}
+		article, err := prepareEpub(ctx, getEpubArgs{
+			url:        pu.URL,
+			userAgent:  defaultUserAgent,
+			gray:       true,
+			fit:        chat.FitImage,
+			skipImages: chat.SkipImages,
+			titleHint:  pu.TitleHint,
+			// Each article has its own images dir to avoid conflicts.
+			imagesDir: fmt.Sprintf("%s/%02d", defaultImagesDir, i+1),
+		})
+		if err != nil {
+			if isTemporaryDigestErr(err) {
+				kept = append(kept, pu)
+			} else {
+				failed = append(failed, pu.URL)
+			}
+			continue
+		}
+		sections = append(sections, url2epub.EpubSection{
+			Title: article.title,
+			Node:  article.args.Node,
+		})
+		maps.Copy(images, article.args.Images)
+		included = append(included, digestArticle{
+			url:   pu.URL,
+			title: article.title,
+		})
+	}
+	if len(sections) == 0 {
+		return nil, nil, failed, kept
+	}
+
+	title := now.Format(digestTitleFormat)
+	id := uuid.NewString()
+	return &preparedEpub{
+		id:    id,
+		title: title,
+		args: url2epub.EpubArgs{
+			Title:           title,
+			Description:     fmt.Sprintf("%d articles", len(sections)),
+			Sections:        sections,
+			Images:          images,
+			DeterministicID: id,
+			ModTime:         now,
+		},
+	}, included, failed, kept
+}
+
+// isTemporaryDigestErr returns whether err from prepareEpub is worth retrying
+// in the next digest.
+func isTemporaryDigestErr(err error) bool {
+	return errors.Is(err, errOverloaded) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+// digestMessage formats the html reply of what's included in the digest.
+func digestMessage(title string, included []digestArticle, failed []string, kept []PendingURL) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, digestHeader, tgbot.EscapeHTML(title), len(included))
+	for i, article := range included {
+		fmt.Fprintf(
+			&sb,
+			"\n%d. <a href=\"%s\">%s</a>",
+			i+1,
+			tgbot.EscapeHTML(article.url),
+			tgbot.EscapeHTML(article.title),
+		)
+	}
+	if len(failed) > 0 {
+		sb.WriteString("\n\n")
+		sb.WriteString(digestFailedHeader)
+		for _, url := range failed {
+			fmt.Fprintf(&sb, "\n- %s", tgbot.EscapeHTML(url))
+		}
+	}
+	if len(kept) > 0 {
+		sb.WriteString("\n\n")
+		sb.WriteString(digestKeptHeader)
+		for _, p := range kept {
+			fmt.Fprintf(&sb, "\n- %s", tgbot.EscapeHTML(p.URL))
+		}
+	}
+	return sb.String()
+}
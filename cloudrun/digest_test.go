@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.yhsif.com/url2epub"
+)
+
+func TestAddPending(t *testing.T) {
+	var pending []PendingURL
+	for i := range maxPendingURLs {
+		var err error
+		pending, err = addPending(pending, PendingURL{
+			URL: fmt.Sprintf("https://example.com/%d", i),
+		})
+		if err != nil {
+			t.Fatalf("addPending #%d got error %v", i, err)
+		}
+	}
+	if _, err := addPending(pending, PendingURL{URL: "https://example.com/0"}); !errors.Is(err, errPendingDuplicate) {
+		t.Errorf("addPending duplicate got error %v, want %v", err, errPendingDuplicate)
+	}
+	got, err := addPending(pending, PendingURL{URL: "https://example.com/new"})
+	if !errors.Is(err, errPendingFull) {
+		t.Errorf("addPending on full list got error %v, want %v", err, errPendingFull)
+	}
+	if len(got) != maxPendingURLs {
+		t.Errorf("addPending on full list got %d urls, want %d", len(got), maxPendingURLs)
+	}
+}
+
+func TestRemovePending(t *testing.T) {
+	pending := []PendingURL{
+		{URL: "https://example.com/a"},
+		{URL: "https://example.com/b"},
+		{URL: "https://example.com/c"},
+	}
+	got := removePending(pending, []PendingURL{
+		{URL: "https://example.com/a"},
+		{URL: "https://example.com/c"},
+		{URL: "https://example.com/not-there"},
+	})
+	if len(got) != 1 || got[0].URL != "https://example.com/b" {
+		t.Errorf("removePending got %+v, want only https://example.com/b", got)
+	}
+}
+
+func TestDigestMessage(t *testing.T) {
+	msg := digestMessage(
+		"Digest 2024-01-02",
+		[]digestArticle{
+			{
+				url:   "https://example.com/?a=1&b=2",
+				title: "<b>Foo</b>",
+			},
+			{
+				url:   "https://example.com/bar",
+				title: "Bar",
+			},
+		},
+		[]string{"https://example.com/fail"},
+		[]PendingURL{{URL: "https://example.com/later"}},
+	)
+	want := `📰 Your digest <b>Digest 2024-01-02</b> includes 2 articles:
+1. <a href="https://example.com/?a=1&amp;b=2">&lt;b&gt;Foo&lt;/b&gt;</a>
+2. <a href="https://example.com/bar">Bar</a>
+
+` + digestFailedHeader + `
+- https://example.com/fail
+
+` + digestKeptHeader + `
+- https://example.com/later`
+	if msg != want {
+		t.Errorf("got:\n%s\nwant:\n%s", msg, want)
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	})
+	mux.HandleFunc("/js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testJSShellHTML)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	p, included, failed, kept := buildDigest(
+		context.Background(),
+		[]PendingURL{
+			{URL: srv.URL + "/article"},
+			{URL: srv.URL + "/js"},
+			{URL: srv.URL + "/article?again", TitleHint: "Again"},
+		},
+		&EntityChatToken{},
+		now,
+	)
+	if p == nil {
+		t.Fatal("buildDigest returned nil epub")
+	}
+	if got, want := p.title, "Digest 2024-01-02"; got != want {
+		t.Errorf("title got %q, want %q", got, want)
+	}
+	if got, want := len(included), 2; got != want {
+		t.Errorf("got %d included articles, want %d: %+v", got, want, included)
+	}
+	if got, want := strings.Join(failed, " "), srv.URL+"/js"; got != want {
+		t.Errorf("failed got %q, want %q", got, want)
+	}
+	if len(kept) != 0 {
+		t.Errorf("kept got %+v, want none", kept)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.writeTo(buf); err != nil {
+		t.Fatalf("writeTo got error: %v", err)
+	}
+	if errs := url2epub.ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+		t.Errorf("ValidateEpub got %v", errs)
+	}
+
+	t.Run("all-failed", func(t *testing.T) {
+		p, included, failed, kept := buildDigest(
+			context.Background(),
+			[]PendingURL{{URL: srv.URL + "/js"}},
+			&EntityChatToken{},
+			now,
+		)
+		if p != nil || len(included) != 0 || len(failed) != 1 || len(kept) != 0 {
+			t.Errorf("buildDigest got (%v, %+v, %q, %+v), want (nil, [], [%s/js], [])", p, included, failed, kept, srv.URL)
+		}
+	})
+
+	t.Run("timed-out", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		pending := []PendingURL{
+			{URL: srv.URL + "/article"},
+			{URL: srv.URL + "/js"},
+		}
+		p, included, failed, kept := buildDigest(ctx, pending, &EntityChatToken{}, now)
+		if p != nil || len(included) != 0 || len(failed) != 0 {
+			t.Errorf("buildDigest got (%v, %+v, %q), want (nil, [], [])", p, included, failed)
+		}
+		if got := removePending(pending, kept); len(got) != 0 {
+			t.Errorf("kept got %+v, want all of %+v", kept, pending)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envOr returns the value of env name parsed by parse, or def when the env is
+// empty or invalid.
+func envOr[T any](ctx context.Context, name string, def T, parse func(string) (T, error)) T {
+	return parseEnvValue(ctx, name, os.Getenv(name), def, parse)
+}
+
+// parseEnvValue is envOr with the value s of env name already read.
+//
+// Invalid values are logged as warnings.
+func parseEnvValue[T any](ctx context.Context, name, s string, def T, parse func(string) (T, error)) T {
+	if s == "" {
+		return def
+	}
+	v, err := parse(s)
+	if err != nil {
+		slog.WarnContext(
+			ctx,
+			"Invalid "+name+", using default",
+			"err", err,
+			"value", s,
+			"default", def,
+		)
+		return def
+	}
+	return v
+}
+
+// positiveDuration parses s in time.ParseDuration format, and rejects <=0
+// values.
+func positiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("duration %v is not positive", d)
+	}
+	return d, err
+}
+
+// nonNegativeDuration parses s in time.ParseDuration format, and rejects <0
+// values.
+func nonNegativeDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("duration %v is negative", d)
+	}
+	return d, err
+}
+
+// positiveInt parses s as an int, and rejects <=0 values.
+func positiveInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("%d is not positive", n)
+	}
+	return n, err
+}
+
+// nonNegativeInt parses s as an int, and rejects <0 values.
+func nonNegativeInt(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("%d is negative", n)
+	}
+	return n, err
+}
+
+// nonNegativeFloat parses s as a float64, and rejects <0 values.
+func nonNegativeFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err == nil && f < 0 {
+		err = fmt.Errorf("%v is negative", f)
+	}
+	return f, err
+}
@@ -70,8 +70,7 @@ var fonts = [][]fontInfo{
 	},
 }
 
-func fontHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message) {
-	chat := GetChat(ctx, message.Chat.ID)
+func fontHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
 	if chat == nil {
 		replyMessage(ctx, w, message, notStartedMsg, true, nil)
 		return
@@ -99,7 +98,7 @@ func fontHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Mess
 	)
 }
 
-func fontCallbackHandler(ctx context.Context, w http.ResponseWriter, data string, callback *tgbot.CallbackQuery) {
+func fontCallbackHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, data string, callback *tgbot.CallbackQuery) {
 	if callback.Message == nil {
 		slog.ErrorContext(
 			ctx,
@@ -111,7 +110,6 @@ func fontCallbackHandler(ctx context.Context, w http.ResponseWriter, data string
 		reply200(w)
 		return
 	}
-	chat := GetChat(ctx, callback.Message.Chat.ID)
 	if chat == nil {
 		slog.ErrorContext(
 			ctx,
@@ -141,12 +139,10 @@ func fontCallbackHandler(ctx context.Context, w http.ResponseWriter, data string
 			"err", err,
 		)
 	}
-	getBot().SendMessage(
-		ctx,
-		callback.Message.Chat.ID,
-		fmt.Sprintf(fontSuccessMsg, chat.GetFont()),
-		&callback.Message.ID,
-		nil,
-	)
+	getBot().SendMessage(ctx, tgbot.SendMessageArgs{
+		ChatID:  callback.Message.Chat.ID,
+		Text:    fmt.Sprintf(fontSuccessMsg, chat.GetFont()),
+		ReplyTo: quotedMessageID(ctx, callback.Message.ID),
+	})
 	reply200(w)
 }
@@ -4,9 +4,11 @@ go 1.23
 
 require (
 	cloud.google.com/go/datastore v1.20.0
+	github.com/google/uuid v1.6.0
 	go.yhsif.com/ctxslog v1.1.0
 	go.yhsif.com/url2epub v0.4.0
 	golang.org/x/image v0.23.0
+	golang.org/x/net v0.34.0
 )
 
 require (
@@ -19,7 +21,8 @@ require (
 	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/golang/groupcache v0.0.0-20241129210726-2c02b8208cf8 // indirect
 	github.com/google/s2a-go v0.1.9 // indirect
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c // indirect
+	github.com/srwiley/rasterx v0.0.0-20210519020934-456a8d69b780 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.3.4 // indirect
 	github.com/googleapis/gax-go/v2 v2.14.1 // indirect
 	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
@@ -30,7 +33,6 @@ require (
 	go.opentelemetry.io/otel/trace v1.33.0 // indirect
 	go.yhsif.com/immutable v1.0.0-rc1 // indirect
 	golang.org/x/crypto v0.32.0 // indirect
-	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/oauth2 v0.25.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
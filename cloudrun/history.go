@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"go.yhsif.com/url2epub/tgbot"
+)
+
+const (
+	historyKind = "upload-history"
+
+	// The max number of uploads to keep in the history of a chat.
+	maxUploadHistory = 10
+
+	historyTimeFormat = "2006-01-02 15:04 MST"
+)
+
+// UploadRecord is a successful upload in the history of a chat.
+type UploadRecord struct {
+	Title  string      `datastore:"title,noindex" json:"title"`
+	URL    string      `datastore:"url,noindex" json:"url"`
+	Time   time.Time   `datastore:"time,noindex" json:"time"`
+	Target AccountType `datastore:"target,noindex" json:"target"`
+}
+
+// EntityUploadHistory is the recent uploads of a chat stored in datastore.
+//
+// It's stored separately from EntityChatToken, so that recording an upload
+// never overwrites the chat settings changed in the meantime.
+type EntityUploadHistory struct {
+	Chat int64 `datastore:"chat" json:"chat"`
+	// The most recent upload comes first.
+	Uploads []UploadRecord `datastore:"uploads,noindex" json:"uploads"`
+}
+
+func historyDatastoreKey(chat int64) *datastore.Key {
+	return datastore.NameKey(historyKind, fmt.Sprintf(chatKey, chat), nil)
+}
+
+// getUploadHistory returns the recent uploads of the chat, most recent first.
+func getUploadHistory(ctx context.Context, chat int64) ([]UploadRecord, error) {
+	e := &EntityUploadHistory{
+		Chat: chat,
+	}
+	if err := dsClient.Get(ctx, historyDatastoreKey(chat), e); err != nil {
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return e.Uploads, nil
+}
+
+// recordUpload adds record to the history of the chat.
+//
+// The history is updated in a transaction, as uploads from the background
+// retries and feeds can be recorded concurrently for the same chat.
+//
+// Failures are only logged, as they should not fail the upload itself.
+func recordUpload(ctx context.Context, chat int64, record UploadRecord) {
+	key := historyDatastoreKey(chat)
+	if _, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		e := &EntityUploadHistory{
+			Chat: chat,
+		}
+		if err := tx.Get(key, e); err != nil && !errors.Is(err, datastore.ErrNoSuchEntity) {
+			return fmt.Errorf("failed to get upload history: %w", err)
+		}
+		e.Uploads = addUpload(e.Uploads, record)
+		_, err := tx.Put(key, e)
+		return err
+	}); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"recordUpload: Failed to save upload history",
+			"err", err,
+		)
+	}
+}
+
+// deleteUploadHistory deletes the history of the chat.
+func deleteUploadHistory(ctx context.Context, chat int64) {
+	key := historyDatastoreKey(chat)
+	if err := dsClient.Delete(ctx, key); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to delete datastore key",
+			"err", err,
+			"key", key,
+		)
+	}
+}
+
+// addUpload returns the history with record added as the most recent upload,
+// bounded by maxUploadHistory.
+func addUpload(uploads []UploadRecord, record UploadRecord) []UploadRecord {
+	uploads = append([]UploadRecord{record}, uploads...)
+	if len(uploads) > maxUploadHistory {
+		uploads = uploads[:maxUploadHistory]
+	}
+	return uploads
+}
+
+// findRecentUpload returns the most recent upload of url in uploads within
+// window before now, including the ones retried with archive.is.
+func findRecentUpload(uploads []UploadRecord, url string, now time.Time, window time.Duration) (UploadRecord, bool) {
+	for _, upload := range uploads {
+		if now.Sub(upload.Time) > window {
+			// uploads are sorted, the rest are all older.
+			break
+		}
+		if upload.URL == url || upload.URL == archiveNewest+url {
+			return upload, true
+		}
+	}
+	return UploadRecord{}, false
+}
+
+// findUploadByToken returns the url of the upload matching the callback token
+// in uploads.
+func findUploadByToken(uploads []UploadRecord, token string) (string, bool) {
+	for _, upload := range uploads {
+		url := strings.TrimPrefix(upload.URL, archiveNewest)
+		if callbackToken(url) == token {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+// historyMessage formats the html reply of the list command.
+func historyMessage(uploads []UploadRecord) string {
+	var sb strings.Builder
+	sb.WriteString(listHeader)
+	for i, upload := range uploads {
+		fmt.Fprintf(
+			&sb,
+			"\n%d. <a href=\"%s\">%s</a> → %s, %s",
+			i+1,
+			tgbot.EscapeHTML(upload.URL),
+			tgbot.EscapeHTML(upload.Title),
+			targetNames[upload.Target],
+			upload.Time.UTC().Format(historyTimeFormat),
+		)
+	}
+	return sb.String()
+}
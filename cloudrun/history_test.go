@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddUpload(t *testing.T) {
+	var uploads []UploadRecord
+	for i := range maxUploadHistory + 5 {
+		uploads = addUpload(uploads, UploadRecord{
+			Title: fmt.Sprintf("title %d", i),
+		})
+	}
+	if got, want := len(uploads), maxUploadHistory; got != want {
+		t.Fatalf("len got %d, want %d", got, want)
+	}
+	if got, want := uploads[0].Title, fmt.Sprintf("title %d", maxUploadHistory+4); got != want {
+		t.Errorf("most recent got %q, want %q", got, want)
+	}
+	if got, want := uploads[maxUploadHistory-1].Title, "title 5"; got != want {
+		t.Errorf("least recent got %q, want %q", got, want)
+	}
+}
+
+func TestHistoryMessage(t *testing.T) {
+	msg := historyMessage([]UploadRecord{
+		{
+			Title:  "<b>Foo</b> & Bar",
+			URL:    "https://example.com/?a=1&b=2",
+			Time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Target: AccountTypeKindle,
+		},
+		{
+			Title:  "Baz",
+			URL:    "https://example.com/baz",
+			Time:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Target: AccountTypeRM,
+		},
+	})
+	want := listHeader + `
+1. <a href="https://example.com/?a=1&amp;b=2">&lt;b&gt;Foo&lt;/b&gt; &amp; Bar</a> → Kindle, 2024-01-02 03:04 UTC
+2. <a href="https://example.com/baz">Baz</a> → reMarkable, 2024-01-01 00:00 UTC`
+	if msg != want {
+		t.Errorf("got:\n%s\nwant:\n%s", msg, want)
+	}
+}
+
+func TestFindRecentUpload(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	uploads := []UploadRecord{
+		{
+			URL:  "https://example.com/a",
+			Time: now.Add(-time.Minute),
+		},
+		{
+			URL:  archiveNewest + "https://example.com/b",
+			Time: now.Add(-5 * time.Minute),
+		},
+		{
+			URL:  "https://example.com/c",
+			Time: now.Add(-time.Hour),
+		},
+	}
+	for _, c := range []struct {
+		label  string
+		url    string
+		window time.Duration
+		want   bool
+	}{
+		{
+			label:  "recent",
+			url:    "https://example.com/a",
+			window: 10 * time.Minute,
+			want:   true,
+		},
+		{
+			label:  "archive",
+			url:    "https://example.com/b",
+			window: 10 * time.Minute,
+			want:   true,
+		},
+		{
+			label:  "outside-window",
+			url:    "https://example.com/c",
+			window: 10 * time.Minute,
+			want:   false,
+		},
+		{
+			label:  "short-window",
+			url:    "https://example.com/b",
+			window: 2 * time.Minute,
+			want:   false,
+		},
+		{
+			label:  "not-found",
+			url:    "https://example.com/d",
+			window: 10 * time.Minute,
+			want:   false,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if _, got := findRecentUpload(uploads, c.url, now, c.window); got != c.want {
+				t.Errorf("findRecentUpload(%q, %v) got %v, want %v", c.url, c.window, got, c.want)
+			}
+		})
+	}
+
+	t.Run("token", func(t *testing.T) {
+		for _, want := range []string{
+			"https://example.com/a",
+			"https://example.com/b",
+		} {
+			if got, ok := findUploadByToken(uploads, callbackToken(want)); !ok || got != want {
+				t.Errorf("findUploadByToken(%q) got %q, %v, want %q, true", want, got, ok, want)
+			}
+		}
+		if got, ok := findUploadByToken(uploads, callbackToken("https://example.com/d")); ok {
+			t.Errorf("findUploadByToken got %q, want not found", got)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	headerIdempotencyKey     = "idempotency-key"
+	headerIdempotentReplayed = "idempotent-replayed"
+
+	// The max number of results kept by idempotencyCache, as each of them holds
+	// the whole epub in memory.
+	maxIdempotencyEntries = 16
+)
+
+var (
+	errIdempotencyInProgress = errors.New("a request with the same idempotency key is still in progress")
+	errIdempotencyMismatch   = errors.New("idempotency key was already used with different args")
+)
+
+// idempotentResult is the result of a request with an idempotency key.
+type idempotentResult struct {
+	// The encoded form of the request, to detect the reuse of the same key with
+	// different args.
+	fingerprint string
+	// false while the request is still in progress.
+	done    bool
+	expires time.Time
+
+	id    string
+	title string
+	data  []byte
+}
+
+// idempotencyCache keeps the results of the REST requests with idempotency
+// keys in memory for ttl, so the retries of the same request return the cached
+// result instead of generating the epub again.
+//
+// A nil *idempotencyCache is valid and does not cache anything.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResult
+}
+
+// newIdempotencyCache creates an idempotencyCache keeping the results for ttl.
+//
+// It returns nil (disabled) when ttl <= 0.
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &idempotencyCache{
+		ttl:     ttl,
+		entries: make(map[string]*idempotentResult),
+	}
+}
+
+// begin starts a request with key.
+//
+// When there's a finished result for key, it's returned. Otherwise when track
+// is true, the request is tracked as in progress and the caller must call
+// either finish or abort with key when it's done. track is false when the
+// cache is disabled or full, in which case the request should just be handled
+// as if it has no idempotency key.
+//
+// It returns errIdempotencyInProgress if the previous request with key is still
+// in progress, or errIdempotencyMismatch if key was used with a different
+// fingerprint.
+func (c *idempotencyCache) begin(key, fingerprint string, now time.Time) (cached *idempotentResult, track bool, err error) {
+	if c == nil {
+		return nil, false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if entry.done && now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if entry := c.entries[key]; entry != nil {
+		if entry.fingerprint != fingerprint {
+			return nil, false, errIdempotencyMismatch
+		}
+		if !entry.done {
+			return nil, false, errIdempotencyInProgress
+		}
+		return entry, false, nil
+	}
+	if len(c.entries) >= maxIdempotencyEntries {
+		return nil, false, nil
+	}
+	c.entries[key] = &idempotentResult{
+		fingerprint: fingerprint,
+	}
+	return nil, true, nil
+}
+
+// finish stores the result of the request with key, tracked by begin.
+func (c *idempotencyCache) finish(key, id, title string, data []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry := c.entries[key]; entry != nil {
+		entry.done = true
+		entry.expires = now.Add(c.ttl)
+		entry.id = id
+		entry.title = title
+		entry.data = data
+	}
+}
+
+// abort stops tracking the request with key, tracked by begin, so that it can
+// be retried.
+func (c *idempotencyCache) abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
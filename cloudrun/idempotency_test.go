@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	const ttl = time.Minute
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("nil", func(t *testing.T) {
+		var c *idempotencyCache
+		if cached, track, err := c.begin("key", "a", now); cached != nil || track || err != nil {
+			t.Errorf("begin got (%v, %v, %v), want (nil, false, nil)", cached, track, err)
+		}
+	})
+
+	t.Run("finish", func(t *testing.T) {
+		c := newIdempotencyCache(ttl)
+		if _, track, err := c.begin("key", "a", now); !track || err != nil {
+			t.Fatalf("begin got (%v, %v), want (true, nil)", track, err)
+		}
+		if _, _, err := c.begin("key", "a", now); !errors.Is(err, errIdempotencyInProgress) {
+			t.Errorf("begin in progress got error %v, want %v", err, errIdempotencyInProgress)
+		}
+		c.finish("key", "id", "title", []byte("data"), now)
+		cached, track, err := c.begin("key", "a", now.Add(ttl))
+		if err != nil || track {
+			t.Fatalf("begin finished got (%v, %v), want (false, nil)", track, err)
+		}
+		if cached == nil || cached.title != "title" || string(cached.data) != "data" {
+			t.Errorf("begin finished got cached %+v", cached)
+		}
+		if _, _, err := c.begin("key", "b", now); !errors.Is(err, errIdempotencyMismatch) {
+			t.Errorf("begin with different fingerprint got error %v, want %v", err, errIdempotencyMismatch)
+		}
+		if cached, track, err := c.begin("key", "b", now.Add(ttl+time.Second)); cached != nil || !track || err != nil {
+			t.Errorf("begin expired got (%v, %v, %v), want (nil, true, nil)", cached, track, err)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		c := newIdempotencyCache(ttl)
+		c.begin("key", "a", now)
+		c.abort("key")
+		if cached, track, err := c.begin("key", "a", now); cached != nil || !track || err != nil {
+			t.Errorf("begin after abort got (%v, %v, %v), want (nil, true, nil)", cached, track, err)
+		}
+	})
+
+	t.Run("full", func(t *testing.T) {
+		c := newIdempotencyCache(ttl)
+		for i := range maxIdempotencyEntries {
+			c.begin(fmt.Sprintf("key-%d", i), "a", now)
+		}
+		if cached, track, err := c.begin("key", "a", now); cached != nil || track || err != nil {
+			t.Errorf("begin when full got (%v, %v, %v), want (nil, false, nil)", cached, track, err)
+		}
+	})
+}
+
+func TestGetIdempotencyTTL(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{
+			value: "",
+			want:  defaultIdempotencyTTL,
+		},
+		{
+			value: "0",
+			want:  0,
+		},
+		{
+			value: "1m",
+			want:  time.Minute,
+		},
+		{
+			value: "foo",
+			want:  defaultIdempotencyTTL,
+		},
+		{
+			value: "-1s",
+			want:  defaultIdempotencyTTL,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("IDEMPOTENCY_TTL", c.value)
+			if got := getIdempotencyTTL(context.Background()); got != c.want {
+				t.Errorf("getIdempotencyTTL() with IDEMPOTENCY_TTL=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errOverloaded is the error returned by generationLimiter when there are too
+// many concurrent epub generations.
+var errOverloaded = errors.New("too many concurrent epub generations, please try again later")
+
+// generationLimiter limits the concurrent epub generations of the whole
+// instance, as each of them could download a lot of images.
+//
+// A nil *generationLimiter is valid and does not limit anything.
+type generationLimiter struct {
+	sem chan struct{}
+
+	// When true, the generations beyond the limit fail immediately with
+	// errOverloaded, instead of waiting in the queue for up to maxWait.
+	shed    bool
+	maxWait time.Duration
+}
+
+// newGenerationLimiter creates a generationLimiter allowing up to limit
+// concurrent generations.
+//
+// It returns nil (no limit) when limit <= 0.
+func newGenerationLimiter(limit int, shed bool, maxWait time.Duration) *generationLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &generationLimiter{
+		sem:     make(chan struct{}, limit),
+		shed:    shed,
+		maxWait: maxWait,
+	}
+}
+
+// acquire takes a slot for a generation, the returned release must be called
+// when the generation is done.
+//
+// It returns an error wrapping errOverloaded when no slot is available
+// (immediately in shed mode, or after waiting for maxWait otherwise), or ctx
+// error when ctx is done while waiting.
+func (l *generationLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.sem }
+	select {
+	case l.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.shed {
+		return nil, errOverloaded
+	}
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errOverloaded
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGenerationLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("nil", func(t *testing.T) {
+		l := newGenerationLimiter(0, false, time.Second)
+		if l != nil {
+			t.Fatalf("newGenerationLimiter(0) got %v, want nil", l)
+		}
+		for range 10 {
+			if _, err := l.acquire(ctx); err != nil {
+				t.Fatalf("acquire got error %v", err)
+			}
+		}
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		l := newGenerationLimiter(1, true, time.Minute)
+		release, err := l.acquire(ctx)
+		if err != nil {
+			t.Fatalf("acquire got error %v", err)
+		}
+		if _, err := l.acquire(ctx); !errors.Is(err, errOverloaded) {
+			t.Errorf("acquire beyond limit got error %v, want %v", err, errOverloaded)
+		}
+		release()
+		release, err = l.acquire(ctx)
+		if err != nil {
+			t.Fatalf("acquire after release got error %v", err)
+		}
+		release()
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		l := newGenerationLimiter(1, false, 10*time.Millisecond)
+		release, err := l.acquire(ctx)
+		if err != nil {
+			t.Fatalf("acquire got error %v", err)
+		}
+		if _, err := l.acquire(ctx); !errors.Is(err, errOverloaded) {
+			t.Errorf("acquire after waiting got error %v, want %v", err, errOverloaded)
+		}
+
+		l.maxWait = time.Minute
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			release()
+		}()
+		release, err = l.acquire(ctx)
+		if err != nil {
+			t.Fatalf("acquire in queue got error %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if _, err := l.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("acquire with ctx timeout got error %v, want %v", err, context.DeadlineExceeded)
+		}
+		release()
+	})
+}
@@ -5,45 +5,133 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"cloud.google.com/go/datastore"
 
+	"go.yhsif.com/url2epub"
 	"go.yhsif.com/url2epub/tgbot"
 )
 
 const (
 	epubTimeout   = time.Second * 15
 	uploadTimeout = time.Second * 15
+
+	// The timeout of downloading a single image, so that one stuck image
+	// doesn't take the whole epubTimeout.
+	imageTimeout = time.Second * 5
+
+	// The timeout of a single telegram api call.
+	telegramTimeout = time.Second * 10
+
+	// The default deadline of the whole archive.is retry,
+	// including generating the epub and uploading it.
+	defaultArchiveRetryTimeout = time.Minute
+
+	// The default window to ask for confirmation before sending the same url
+	// again.
+	defaultDedupWindow = 10 * time.Minute
+
+	// The default outgoing requests per second allowed to a single host, and the
+	// burst of them.
+	defaultRateLimitPerHost = 2
+	defaultRateLimitBurst   = 5
+
+	// The default number of the latest entries to archive from a feed, and the
+	// max allowed.
+	defaultFeedEntries = 5
+	maxFeedEntries     = 20
+
+	// The default max number of concurrent epub generations of the whole
+	// instance.
+	defaultMaxConcurrentEpubs = 4
+
+	// The Retry-After of the REST responses when overloaded.
+	overloadRetryAfter = 30 * time.Second
+
+	// The deadline of archiving all the entries of a feed,
+	// including generating the epubs and uploading them.
+	feedTimeout = 5 * time.Minute
+
+	// The default grace period to drain the in-flight requests and background
+	// tasks on shutdown. Cloud Run sends SIGKILL 10 seconds after SIGTERM.
+	defaultShutdownGracePeriod = 9 * time.Second
+
+	// The default time to keep the results of the REST requests with
+	// idempotency keys.
+	defaultIdempotencyTTL = 5 * time.Minute
 )
 
+// Default max epub sizes in bytes, by upload targets.
+var defaultMaxEpubSizes = map[AccountType]int{
+	// reMarkable cloud only reports its limit when uploading,
+	// use a conservative default here.
+	AccountTypeRM: 100 << 20,
+	// The attachment limit of Send to Kindle emails.
+	AccountTypeKindle: 50 << 20,
+	// The limit of Dropbox files/upload api (without upload sessions).
+	AccountTypeDropbox: 150 << 20,
+}
+
+// The update types the bot actually handles.
+var allowedUpdates = []string{
+	tgbot.UpdateTypeMessage,
+	tgbot.UpdateTypeCallbackQuery,
+}
+
 const (
 	webhookMaxConn = 5
 
+	// The max number of dirs to show in a single page of the /dir reply.
+	dirPageSize = 20
+
+	// The number of bytes of the sha256 hash to use in callback tokens,
+	// which is 22 bytes after base64 encoding.
+	callbackTokenBytes = 16
+
 	globalURLPrefix = `https://url2epub.fishy.me`
 	webhookPrefix   = `/w/`
 	epubEndpoint    = `/epub`
-
-	rmDescription = `desktop-windows`
-
-	startCommand = `/start`
-	stopCommand  = `/stop`
-	dirCommand   = `/dir`
-	fontCommand  = `/font`
-	epubCommand  = `/epub`
-	fitCommand   = `/fit`
+	saveEndpoint    = `/save`
+
+	defaultRMDescription = `desktop-windows`
+	// The max length of RM_DESCRIPTION env.
+	maxRMDescriptionLength = 64
+
+	startCommand    = `/start`
+	stopCommand     = `/stop`
+	listCommand     = `/list`
+	addCommand      = `/add`
+	digestCommand   = `/digest`
+	dirCommand      = `/dir`
+	fontCommand     = `/font`
+	epubCommand     = `/epub`
+	fitCommand      = `/fit`
+	formatCommand   = `/format`
+	noImagesCommand = `/noimages`
+	quoteCommand    = `/quote`
 
 	unknownCallback = `🚫 Unknown callback`
 
-	dirIDPrefix = `dir:`
-	fontPrefix  = `font:`
+	dirIDPrefix   = `dir:`
+	dirPagePrefix = `dirpage:`
+	fontPrefix    = `font:`
+	resendPrefix  = `resend:`
 
 	dropboxDirPrefix = `dbdir:`
+	// Dropbox paths always start with "/", so this never collides with dirs.
+	dropboxDirPagePrefix = dropboxDirPrefix + `page:`
 
 	restDocURL = `https://github.com/fishy/url2epub/blob/main/REST.md`
 
@@ -54,6 +142,25 @@ var defaultUserAgent string
 
 var dsClient *datastore.Client
 
+// generations limits the concurrent epub generations of the whole instance.
+var generations *generationLimiter
+
+// maxConcurrentImages is the ReadableArgs.MaxConcurrentImages of every epub
+// generation, so the total image downloads of the instance is bounded by it
+// times the limit of generations.
+var maxConcurrentImages int
+
+// idempotency caches the results of the REST requests with idempotency keys.
+var idempotency *idempotencyCache
+
+// hostRateLimiter throttles the outgoing requests to generate epubs, shared by
+// all the chats and the REST endpoint.
+var hostRateLimiter *url2epub.HostRateLimiter
+
+// verifyRMUploads is the rmapi.UploadArgs.VerifyVisible of the reMarkable
+// uploads, off by default as it costs an extra root index round trip.
+var verifyRMUploads bool
+
 func main() {
 	initLogger()
 
@@ -68,6 +175,10 @@ func main() {
 	}
 
 	ctx := context.Background()
+	// Canceled on SIGTERM (sent by Cloud Run on deploy or scale down) to shut
+	// down gracefully.
+	serveCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
 	if err := initDatastoreClient(ctx); err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -76,7 +187,19 @@ func main() {
 		)
 		os.Exit(1)
 	}
-	initBot(ctx)
+	hostRateLimiter = getHostRateLimiter(ctx)
+	generations = getGenerationLimiter(ctx)
+	idempotency = newIdempotencyCache(getIdempotencyTTL(ctx))
+	corsOrigins = getCORSPolicy()
+	pdfRender = getPDFRenderer()
+	maxConcurrentImages = getMaxConcurrentImages(ctx)
+	verifyRMUploads = getVerifyRMUploads(ctx)
+	polling := getTelegramPolling(ctx)
+	initBot(ctx, polling)
+	if polling {
+		slog.WarnContext(ctx, "TELEGRAM_POLLING is set, long polling updates instead of using webhook")
+		go pollUpdates(serveCtx)
+	}
 
 	defaultUserAgent = fmt.Sprintf(userAgentTemplate, os.Getenv("K_REVISION"))
 	slog.InfoContext(
@@ -87,7 +210,9 @@ func main() {
 
 	http.HandleFunc("/", rootHandler)
 	http.HandleFunc(webhookPrefix, webhookHandler)
-	http.HandleFunc(epubEndpoint, restEpubHandler)
+	http.HandleFunc(epubEndpoint, withCORS(restEpubHandler))
+	http.HandleFunc(saveEndpoint, restSaveHandler)
+	http.HandleFunc(selfTestEndpoint, selfTestHandler)
 	http.HandleFunc("/_ah/health", healthCheckHandler)
 
 	port := os.Getenv("PORT")
@@ -99,17 +224,33 @@ func main() {
 			"port", port,
 		)
 	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to listen",
+			"err", err,
+			"port", port,
+		)
+		os.Exit(1)
+	}
 	slog.InfoContext(
 		ctx,
 		"Started listening",
 		"port", port,
 	)
 
-	slog.ErrorContext(
-		ctx,
-		"HTTP server returned",
-		"err", http.ListenAndServe(fmt.Sprintf(":%s", port), nil),
-	)
+	srv := &http.Server{
+		Handler: http.DefaultServeMux,
+	}
+	if err := inflight.serve(serveCtx, srv, ln, getShutdownGracePeriod(ctx)); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"HTTP server returned",
+			"err", err,
+		)
+		os.Exit(1)
+	}
 }
 
 func initDatastoreClient(ctx context.Context) error {
@@ -146,9 +287,17 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	handleUpdate(ctx, w, &update)
+}
 
+// handleUpdate handles a single telegram update, from either the webhook or
+// long polling.
+func handleUpdate(ctx context.Context, w http.ResponseWriter, update *tgbot.Update) {
 	if callback := update.Callback; callback != nil {
 		ctx := chatContext(ctx, callback.Message.Chat.ID)
+		// Load the chat once for both the quote preference and the handlers.
+		chat := GetChat(ctx, callback.Message.Chat.ID)
+		ctx = quoteRepliesContext(ctx, chat.GetQuoteReplies())
 		data := callback.Data
 		switch {
 		default:
@@ -162,12 +311,19 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 			reply200(w)
 
 		case strings.HasPrefix(data, dirIDPrefix):
-			dirRMCallbackHandler(ctx, w, data, callback)
+			dirRMCallbackHandler(ctx, w, chat, data, callback)
+		case strings.HasPrefix(data, dirPagePrefix):
+			dirRMPageCallbackHandler(ctx, w, chat, data, callback)
 		case strings.HasPrefix(data, fontPrefix):
-			fontCallbackHandler(ctx, w, data, callback)
+			fontCallbackHandler(ctx, w, chat, data, callback)
+		case strings.HasPrefix(data, resendPrefix):
+			resendCallbackHandler(ctx, w, chat, data, callback)
 
+		case strings.HasPrefix(data, dropboxDirPagePrefix):
+			// Must be checked before dropboxDirPrefix.
+			dirDropboxPageCallbackHandler(ctx, w, chat, data, callback)
 		case strings.HasPrefix(data, dropboxDirPrefix):
-			dirDropboxCallbackHandler(ctx, w, data, callback)
+			dirDropboxCallbackHandler(ctx, w, chat, data, callback)
 		}
 		return
 	}
@@ -178,22 +334,36 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	ctx = chatContext(ctx, update.Message.Chat.ID)
+	chat := GetChat(ctx, update.Message.Chat.ID)
+	ctx = quoteRepliesContext(ctx, chat.GetQuoteReplies())
 	text := update.Message.Text
 	switch {
 	default:
-		urlHandler(ctx, w, update.Message)
+		urlHandler(ctx, w, chat, update.Message)
 	case strings.HasPrefix(text, startCommand):
-		startHandler(ctx, w, update.Message, text)
+		startHandler(ctx, w, chat, update.Message, text)
 	case strings.HasPrefix(text, fitCommand):
-		fitHandler(ctx, w, update.Message, text)
+		fitHandler(ctx, w, chat, update.Message, text)
+	case strings.HasPrefix(text, formatCommand):
+		formatHandler(ctx, w, chat, update.Message, text)
 	case strings.HasPrefix(text, epubCommand):
 		epubHandler(ctx, w, update.Message)
-	case text == stopCommand:
-		stopHandler(ctx, w, update.Message)
-	case text == dirCommand:
-		dirHandler(ctx, w, update.Message)
+	case text == stopCommand || strings.HasPrefix(text, stopCommand+" "):
+		stopHandler(ctx, w, chat, update.Message, text)
+	case text == listCommand:
+		listHandler(ctx, w, chat, update.Message)
+	case text == addCommand || strings.HasPrefix(text, addCommand+" "):
+		addHandler(ctx, w, chat, update.Message)
+	case text == digestCommand:
+		digestHandler(ctx, w, chat, update.Message)
+	case text == dirCommand || strings.HasPrefix(text, dirCommand+" "):
+		dirHandler(ctx, w, chat, update.Message, text)
 	case text == fontCommand:
-		fontHandler(ctx, w, update.Message)
+		fontHandler(ctx, w, chat, update.Message)
+	case text == noImagesCommand:
+		noImagesHandler(ctx, w, chat, update.Message)
+	case text == quoteCommand || strings.HasPrefix(text, quoteCommand+" "):
+		quoteHandler(ctx, w, chat, update.Message, text)
 	}
 }
 
@@ -208,14 +378,45 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 var tokenValue atomic.Pointer[tgbot.Bot]
 
 // initBot initializes botToken.
-func initBot(ctx context.Context) {
+//
+// When polling is true, it deletes the webhook instead of setting it, so that
+// updates can be long polled.
+//
+// The webhook path is derived from SECRET_TELEGRAM_TOKEN env, mixed with
+// SECRET_WEBHOOK_PATH env when it's set. To rotate the webhook path (e.g. when
+// it's leaked) without changing the telegram token, set SECRET_WEBHOOK_PATH to
+// a new random value and deploy. The new revision sets the webhook to the new
+// path on startup, after which requests to the old path are rejected. The
+// updates sent to the new path while the old revision is still serving are
+// rejected too, but telegram retries them.
+func initBot(ctx context.Context, polling bool) {
 	secret := os.Getenv("SECRET_TELEGRAM_TOKEN")
 	tokenValue.Store(&tgbot.Bot{
 		Token:           secret,
 		GlobalURLPrefix: globalURLPrefix,
 		WebhookPrefix:   webhookPrefix,
+		WebhookSecret:   os.Getenv("SECRET_WEBHOOK_PATH"),
+		HTTPClient: &http.Client{
+			Transport: url2epub.NewTransport(url2epub.DefaultTransportTimeouts),
+			Timeout:   telegramTimeout,
+		},
 	})
-	if _, err := getBot().SetWebhook(ctx, webhookMaxConn); err != nil {
+	if polling {
+		if err := getBot().DeleteWebhook(ctx); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"Failed to delete webhook",
+				"err", err,
+			)
+			os.Exit(1)
+		}
+		return
+	}
+	if _, err := getBot().SetWebhook(ctx, tgbot.SetWebhookArgs{
+		MaxConn:            webhookMaxConn,
+		AllowedUpdates:     allowedUpdates,
+		DropPendingUpdates: getDropPendingUpdates(ctx),
+	}); err != nil {
 		slog.ErrorContext(
 			ctx,
 			"Failed to set webhook",
@@ -232,3 +433,174 @@ func getBot() *tgbot.Bot {
 func getProjectID() string {
 	return os.Getenv("CLOUD_PROJECT_ID")
 }
+
+// getArchiveRetryTimeout returns the deadline for the archive.is retry,
+// configured by ARCHIVE_RETRY_TIMEOUT env in time.ParseDuration format.
+func getArchiveRetryTimeout(ctx context.Context) time.Duration {
+	return envOr(ctx, "ARCHIVE_RETRY_TIMEOUT", defaultArchiveRetryTimeout, positiveDuration)
+}
+
+// getDedupWindow returns the window to ask for confirmation before sending the
+// same url again, configured by DEDUP_WINDOW env in time.ParseDuration format.
+//
+// It returns 0 when dedup is disabled.
+func getDedupWindow(ctx context.Context) time.Duration {
+	return envOr(ctx, "DEDUP_WINDOW", defaultDedupWindow, nonNegativeDuration)
+}
+
+// getIdempotencyTTL returns the time to keep the results of the REST requests
+// with idempotency keys, configured by IDEMPOTENCY_TTL env in
+// time.ParseDuration format.
+//
+// It returns 0 when idempotency keys are ignored.
+func getIdempotencyTTL(ctx context.Context) time.Duration {
+	return envOr(ctx, "IDEMPOTENCY_TTL", defaultIdempotencyTTL, nonNegativeDuration)
+}
+
+// getShutdownGracePeriod returns the grace period to drain the in-flight
+// requests and background tasks on shutdown, configured by
+// SHUTDOWN_GRACE_PERIOD env in time.ParseDuration format.
+func getShutdownGracePeriod(ctx context.Context) time.Duration {
+	return envOr(ctx, "SHUTDOWN_GRACE_PERIOD", defaultShutdownGracePeriod, nonNegativeDuration)
+}
+
+// getFeedEntries returns the number of the latest entries to archive when a
+// feed url is sent, configured by FEED_ENTRIES env, capped at maxFeedEntries.
+func getFeedEntries(ctx context.Context) int {
+	return min(envOr(ctx, "FEED_ENTRIES", defaultFeedEntries, positiveInt), maxFeedEntries)
+}
+
+// getGenerationLimiter returns the limiter of the concurrent epub generations
+// of the whole instance, configured by MAX_CONCURRENT_EPUBS env (0 to disable)
+// and SHED_OVERLOAD env.
+//
+// When SHED_OVERLOAD is true, the generations beyond the limit fail
+// immediately, otherwise they wait in the queue for up to epubTimeout.
+func getGenerationLimiter(ctx context.Context) *generationLimiter {
+	limit, shed := parseGenerationLimit(
+		ctx,
+		os.Getenv("MAX_CONCURRENT_EPUBS"),
+		os.Getenv("SHED_OVERLOAD"),
+	)
+	return newGenerationLimiter(limit, shed, epubTimeout)
+}
+
+func parseGenerationLimit(ctx context.Context, maxStr, shedStr string) (limit int, shed bool) {
+	limit = parseEnvValue(ctx, "MAX_CONCURRENT_EPUBS", maxStr, defaultMaxConcurrentEpubs, nonNegativeInt)
+	shed = parseEnvValue(ctx, "SHED_OVERLOAD", shedStr, false, strconv.ParseBool)
+	return limit, shed
+}
+
+// getMaxConcurrentImages returns the max number of concurrent image downloads
+// of a single epub generation, configured by MAX_CONCURRENT_IMAGES env.
+//
+// It returns 0 (the default of url2epub) when it's not set.
+func getMaxConcurrentImages(ctx context.Context) int {
+	return envOr(ctx, "MAX_CONCURRENT_IMAGES", 0, positiveInt)
+}
+
+// getHostRateLimiter returns the rate limiter of the outgoing requests to each
+// host, configured by RATE_LIMIT_PER_HOST env (requests per second, 0 to
+// disable) and RATE_LIMIT_BURST env.
+func getHostRateLimiter(ctx context.Context) *url2epub.HostRateLimiter {
+	perSecond, burst := parseHostRateLimit(
+		ctx,
+		os.Getenv("RATE_LIMIT_PER_HOST"),
+		os.Getenv("RATE_LIMIT_BURST"),
+	)
+	return url2epub.NewHostRateLimiter(perSecond, burst)
+}
+
+func parseHostRateLimit(ctx context.Context, perSecondStr, burstStr string) (perSecond float64, burst int) {
+	perSecond = parseEnvValue(ctx, "RATE_LIMIT_PER_HOST", perSecondStr, defaultRateLimitPerHost, nonNegativeFloat)
+	burst = parseEnvValue(ctx, "RATE_LIMIT_BURST", burstStr, defaultRateLimitBurst, positiveInt)
+	return perSecond, burst
+}
+
+// getVerifyRMUploads returns whether to verify the reMarkable uploads are
+// visible in the root index after uploading, configured by VERIFY_RM_UPLOADS
+// env.
+func getVerifyRMUploads(ctx context.Context) bool {
+	return envOr(ctx, "VERIFY_RM_UPLOADS", false, strconv.ParseBool)
+}
+
+// getDropPendingUpdates returns whether to drop the pending telegram updates
+// when setting the webhook on startup, configured by DROP_PENDING_UPDATES env.
+func getDropPendingUpdates(ctx context.Context) bool {
+	return envOr(ctx, "DROP_PENDING_UPDATES", false, strconv.ParseBool)
+}
+
+// getHostPolicy returns the policy of the hosts allowed to generate epubs from,
+// configured by BLOCK_PRIVATE_HOSTS env (default to true) and BLOCKED_HOSTS env
+// (comma separated, default to url2epub.DefaultHostPolicy.DenyHosts).
+//
+// Self-hosters can relax it by setting BLOCK_PRIVATE_HOSTS to false, and
+// BLOCKED_HOSTS to "-" to block no hosts.
+func getHostPolicy(ctx context.Context) *url2epub.HostPolicy {
+	return parseHostPolicy(ctx, os.Getenv("BLOCK_PRIVATE_HOSTS"), os.Getenv("BLOCKED_HOSTS"))
+}
+
+func parseHostPolicy(ctx context.Context, blockPrivate, blockedHosts string) *url2epub.HostPolicy {
+	policy := &url2epub.HostPolicy{
+		BlockPrivate: parseEnvValue(
+			ctx,
+			"BLOCK_PRIVATE_HOSTS",
+			blockPrivate,
+			url2epub.DefaultHostPolicy.BlockPrivate,
+			strconv.ParseBool,
+		),
+		DenyHosts: url2epub.DefaultHostPolicy.DenyHosts,
+	}
+	switch blockedHosts = strings.TrimSpace(blockedHosts); blockedHosts {
+	case "":
+	case "-":
+		policy.DenyHosts = nil
+	default:
+		policy.DenyHosts = nil
+		for _, host := range strings.Split(blockedHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				policy.DenyHosts = append(policy.DenyHosts, host)
+			}
+		}
+	}
+	return policy
+}
+
+// getRMDescription returns the device description used to register with
+// reMarkable, configured by RM_DESCRIPTION env.
+//
+// It's shown in the user's reMarkable account to identify the bot's device.
+func getRMDescription(ctx context.Context) string {
+	return parseRMDescription(ctx, os.Getenv("RM_DESCRIPTION"))
+}
+
+func parseRMDescription(ctx context.Context, s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultRMDescription
+	}
+	if utf8.RuneCountInString(s) > maxRMDescriptionLength || strings.ContainsFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r)
+	}) {
+		slog.WarnContext(
+			ctx,
+			"Invalid RM_DESCRIPTION, using default",
+			"value", s,
+			"default", defaultRMDescription,
+		)
+		return defaultRMDescription
+	}
+	return s
+}
+
+// getMaxEpubSize returns the max epub size in bytes for the upload target,
+// configured by MAX_EPUB_SIZE_<TARGET> env (e.g. MAX_EPUB_SIZE_KINDLE).
+//
+// It returns 0 when there's no limit.
+func getMaxEpubSize(ctx context.Context, target AccountType) int {
+	return envOr(ctx, maxEpubSizeEnv(target), defaultMaxEpubSizes[target], nonNegativeInt)
+}
+
+func maxEpubSizeEnv(target AccountType) string {
+	return "MAX_EPUB_SIZE_" + strings.ToUpper(target.String())
+}
@@ -9,6 +9,8 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+
+	"go.yhsif.com/url2epub"
 )
 
 const (
@@ -16,9 +18,13 @@ const (
 	mgURL  = "https://api.mailgun.net/v3/%s/messages"
 )
 
-var httpClient http.Client
+// The http client used to send requests to mailgun and dropbox.
+var httpClient = &http.Client{
+	Transport: url2epub.NewTransport(url2epub.DefaultTransportTimeouts),
+}
 
-func sendEmail(ctx context.Context, email string, title string, epub io.Reader, chatID int64) error {
+// sendEmail sends the file in r as the attachment named title+ext to email.
+func sendEmail(ctx context.Context, email string, title, ext string, r io.Reader, chatID int64) error {
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
 
@@ -43,11 +49,11 @@ func sendEmail(ctx context.Context, email string, title string, epub io.Reader,
 		}
 	}
 
-	w, err := writer.CreateFormFile("attachment", title+".epub")
+	w, err := writer.CreateFormFile("attachment", title+ext)
 	if err != nil {
 		return fmt.Errorf("sendEmail: failed to create form file: %w", err)
 	}
-	if _, err := io.Copy(w, epub); err != nil {
+	if _, err := io.Copy(w, r); err != nil {
 		return fmt.Errorf("sendEmail: failed to copy form file: %w", err)
 	}
 
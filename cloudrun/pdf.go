@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const pdfMimeType = "application/pdf"
+
+// The proxy wkhtmltopdf uses for all the network requests, which refuses
+// connections so that the page can't fetch anything outside of the temp dir,
+// bypassing HostPolicy.
+const wkhtmltopdfBlackholeProxy = "http://127.0.0.1:9"
+
+// errPDFNotConfigured is the error returned when pdf output is requested but
+// there's no pdfRenderer configured.
+var errPDFNotConfigured = errors.New("pdf output is not configured on this server")
+
+// pdfPage is the readable html to be rendered into pdf.
+type pdfPage struct {
+	title string
+	// The readable html, with the images referenced by their relative paths in
+	// images.
+	node   *html.Node
+	images map[string]io.Reader
+}
+
+// pdfRenderer renders the readable html into pdf.
+type pdfRenderer interface {
+	renderPDF(ctx context.Context, page pdfPage, w io.Writer) error
+}
+
+// pdfRender is the pdfRenderer used by the REST endpoint, nil means pdf output
+// is not supported.
+var pdfRender pdfRenderer
+
+// getPDFRenderer returns the pdfRenderer configured by WKHTMLTOPDF env, which
+// is the path to the wkhtmltopdf binary.
+//
+// It returns nil when the env is empty. Note that the default distroless base
+// image doesn't have wkhtmltopdf.
+func getPDFRenderer() pdfRenderer {
+	if path := os.Getenv("WKHTMLTOPDF"); path != "" {
+		return wkhtmltopdf(path)
+	}
+	return nil
+}
+
+// wkhtmltopdf is a pdfRenderer using the wkhtmltopdf binary at the path.
+type wkhtmltopdf string
+
+func (bin wkhtmltopdf) renderPDF(ctx context.Context, page pdfPage, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "url2epub-pdf-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, r := range page.images {
+		// The paths of the images are generated by us, but just in case.
+		local, err := filepath.Localize(name)
+		if err != nil {
+			return fmt.Errorf("invalid image path %q: %w", name, err)
+		}
+		local = filepath.Join(dir, local)
+		if err := os.MkdirAll(filepath.Dir(local), 0o700); err != nil {
+			return fmt.Errorf("failed to create dir for image %q: %w", name, err)
+		}
+		if err := writeFile(local, r); err != nil {
+			return fmt.Errorf("failed to write image %q: %w", name, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := html.Render(&buf, page.node); err != nil {
+		return fmt.Errorf("failed to render html: %w", err)
+	}
+	const index = "index.html"
+	if err := writeFile(filepath.Join(dir, index), &buf); err != nil {
+		return fmt.Errorf("failed to write html: %w", err)
+	}
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, string(bin), wkhtmltopdfArgs(dir, page.title, index)...)
+	cmd.Dir = dir
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("wkhtmltopdf failed: %w: %q", err, stderr.String())
+	}
+	return nil
+}
+
+// wkhtmltopdfArgs returns the args to render index in dir to stdout.
+//
+// The html is from untrusted pages, so javascript is disabled, local file
+// access is limited to dir, and network requests are sent to a proxy
+// refusing all connections.
+func wkhtmltopdfArgs(dir, title, index string) []string {
+	return []string{
+		"--quiet",
+		"--encoding", "utf-8",
+		"--disable-javascript",
+		"--disable-local-file-access",
+		"--allow", dir,
+		"--proxy", wkhtmltopdfBlackholeProxy,
+		// Do not fail the whole rendering on the blocked requests.
+		"--load-error-handling", "ignore",
+		"--load-media-error-handling", "ignore",
+		"--title", title,
+		index,
+		"-", // stdout
+	}
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWkhtmltopdfArgs(t *testing.T) {
+	args := wkhtmltopdfArgs("/tmp/url2epub-pdf-1", "Title", "index.html")
+	for _, want := range [][]string{
+		{"--disable-javascript"},
+		{"--disable-local-file-access"},
+		{"--allow", "/tmp/url2epub-pdf-1"},
+		{"--proxy", wkhtmltopdfBlackholeProxy},
+		{"--title", "Title"},
+		{"index.html", "-"},
+	} {
+		i := slices.Index(args, want[0])
+		if i < 0 || i+len(want) > len(args) || !slices.Equal(args[i:i+len(want)], want) {
+			t.Errorf("wkhtmltopdfArgs got %q, want it to contain %q", args, want)
+		}
+	}
+	if slices.Contains(args, "--enable-local-file-access") {
+		t.Errorf("wkhtmltopdfArgs got %q, want no --enable-local-file-access", args)
+	}
+}
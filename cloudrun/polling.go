@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"go.yhsif.com/url2epub/tgbot"
+)
+
+// The delay before retrying GetUpdates after an error.
+const pollRetryDelay = time.Second
+
+// getTelegramPolling returns whether to long poll telegram updates instead of
+// using webhook, configured by TELEGRAM_POLLING env.
+//
+// It's meant for local development without a public https endpoint,
+// webhook is always used by default.
+func getTelegramPolling(ctx context.Context) bool {
+	return envOr(ctx, "TELEGRAM_POLLING", false, strconv.ParseBool)
+}
+
+// pollUpdates long polls telegram updates and handles them, until ctx is
+// canceled.
+func pollUpdates(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		updates, err := getBot().GetUpdates(ctx, offset)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get updates", "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.ID + 1
+			handlePolledUpdate(ctx, &update)
+		}
+	}
+}
+
+// handlePolledUpdate handles an update got from long polling.
+//
+// The handlers are written for webhook, which can reply by writing an api
+// call into the webhook response. handlePolledUpdate records the response and
+// makes the api call instead.
+func handlePolledUpdate(ctx context.Context, update *tgbot.Update) {
+	w := httptest.NewRecorder()
+	handleUpdate(ctx, w, update)
+	forwardWebhookReply(ctx, w)
+}
+
+// forwardWebhookReply makes the api call a handler wrote into the webhook
+// response w, if any.
+func forwardWebhookReply(ctx context.Context, w *httptest.ResponseRecorder) {
+	if w.Header().Get("Content-Type") != "application/json" {
+		return
+	}
+	body := bytes.TrimSpace(w.Body.Bytes())
+	var reply struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil || reply.Method == "" {
+		slog.ErrorContext(
+			ctx,
+			"Unable to get method from webhook reply",
+			"err", err,
+			"body", string(body),
+		)
+		return
+	}
+	if code, err := getBot().PostRequestJSON(ctx, reply.Method, json.RawMessage(body)); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"Failed to forward webhook reply",
+			"err", err,
+			"code", code,
+			"method", reply.Method,
+		)
+	}
+}
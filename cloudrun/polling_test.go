@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.yhsif.com/url2epub/tgbot"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGetTelegramPolling(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  bool
+	}{
+		{
+			value: "",
+			want:  false,
+		},
+		{
+			value: "true",
+			want:  true,
+		},
+		{
+			value: "0",
+			want:  false,
+		},
+		{
+			value: "foo",
+			want:  false,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("TELEGRAM_POLLING", c.value)
+			if got := getTelegramPolling(context.Background()); got != c.want {
+				t.Errorf("getTelegramPolling() with TELEGRAM_POLLING=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestForwardWebhookReply(t *testing.T) {
+	type request struct {
+		path string
+		body map[string]any
+	}
+	var requests []request
+	orig := tokenValue.Load()
+	t.Cleanup(func() {
+		tokenValue.Store(orig)
+	})
+	tokenValue.Store(&tgbot.Bot{
+		Token: "token",
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				var body map[string]any
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					return nil, err
+				}
+				requests = append(requests, request{
+					path: req.URL.Path,
+					body: body,
+				})
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(`{"ok":true}`)),
+				}, nil
+			}),
+		},
+	})
+
+	ctx := context.Background()
+	msg := &tgbot.Message{
+		ID: 1,
+		Chat: tgbot.Chat{
+			ID: 123,
+		},
+	}
+
+	t.Run("reply", func(t *testing.T) {
+		requests = nil
+		w := httptest.NewRecorder()
+		replyMessage(ctx, w, msg, "hello", true, nil)
+		forwardWebhookReply(ctx, w)
+		if len(requests) != 1 {
+			t.Fatalf("got %d requests, want 1: %v", len(requests), requests)
+		}
+		if got, want := requests[0].path, "/bottoken/sendMessage"; got != want {
+			t.Errorf("path got %q, want %q", got, want)
+		}
+		if got, want := requests[0].body["text"], "hello"; got != want {
+			t.Errorf("text got %v, want %q", got, want)
+		}
+		if got, want := requests[0].body["chat_id"], float64(123); got != want {
+			t.Errorf("chat_id got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("200", func(t *testing.T) {
+		requests = nil
+		w := httptest.NewRecorder()
+		reply200(w)
+		forwardWebhookReply(ctx, w)
+		if len(requests) != 0 {
+			t.Errorf("got %d requests, want 0: %v", len(requests), requests)
+		}
+	})
+}
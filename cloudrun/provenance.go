@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"go.yhsif.com/url2epub"
+)
+
+// provenanceMetaName is the name of the meta tag in the generated epub
+// holding the json encoded provenance.
+const provenanceMetaName = "url2epub:provenance"
+
+// provenance records where and how the content of a generated epub was
+// extracted, for auditing.
+type provenance struct {
+	// The url requested by the user.
+	URL string `json:"url"`
+	// The url after following redirects.
+	FinalURL string `json:"finalUrl"`
+	// The time the html was fetched, in RFC 3339.
+	FetchedAt string `json:"fetchedAt"`
+	// The http status code of the html response.
+	Status int `json:"status"`
+	// Whether the fetched html is an AMP document.
+	AMP bool `json:"amp"`
+	// Where the content is from, see sourceOf.
+	Source string `json:"source"`
+	// The hex encoded sha256 of the fetched html, as parsed and re-rendered.
+	ContentSHA256 string `json:"contentSha256"`
+	// The version of this tool.
+	Version string `json:"version"`
+}
+
+// newProvenance creates the provenance of root, fetched from url and
+// redirected to finalURL at fetchedAt.
+func newProvenance(url, finalURL string, fetchedAt time.Time, root *url2epub.Node) *provenance {
+	return &provenance{
+		URL:       url,
+		FinalURL:  finalURL,
+		FetchedAt: fetchedAt.UTC().Format(time.RFC3339),
+		// url2epub.GetHTML fails on all other status codes.
+		Status:        http.StatusOK,
+		AMP:           root.IsAMP(),
+		Source:        sourceOf(finalURL),
+		ContentSHA256: contentSHA256(root),
+		Version:       toolVersion(),
+	}
+}
+
+// contentSHA256 returns the hex encoded sha256 of the rendered root.
+func contentSHA256(root *url2epub.Node) string {
+	h := sha256.New()
+	if root != nil {
+		node := root.AsNode()
+		html.Render(h, &node)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// toolVersion returns the version of this binary from its build info,
+// preferring the vcs revision.
+var toolVersion = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && setting.Value != "" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+})
+
+// embed adds p as a meta tag into the head of node, the html node returned by
+// url2epub.Node.Readable.
+func (p *provenance) embed(node *html.Node) error {
+	var head *html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Head {
+			head = c
+			break
+		}
+	}
+	if head == nil {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	head.AppendChild(&html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Meta,
+		Data:     atom.Meta.String(),
+		Attr: []html.Attribute{
+			{
+				Key: "name",
+				Val: provenanceMetaName,
+			},
+			{
+				Key: "content",
+				Val: string(data),
+			},
+		},
+	})
+	return nil
+}
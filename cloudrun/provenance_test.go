@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"go.yhsif.com/url2epub"
+)
+
+func TestProvenance(t *testing.T) {
+	const src = `<html amp><head><title>Hello</title></head><body><p>Hello</p></body></html>`
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	root := url2epub.FromNode(doc).FindFirstAtomNode(atom.Html)
+	fetchedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	prov := newProvenance(
+		"https://example.com/foo",
+		"https://archive.ph/abc",
+		fetchedAt,
+		root,
+	)
+	if got, want := prov.FetchedAt, "2024-01-02T02:04:05Z"; got != want {
+		t.Errorf("FetchedAt got %q, want %q", got, want)
+	}
+	if got, want := prov.Status, http.StatusOK; got != want {
+		t.Errorf("Status got %d, want %d", got, want)
+	}
+	if !prov.AMP {
+		t.Error("AMP got false, want true")
+	}
+	if got, want := prov.Source, sourceArchive; got != want {
+		t.Errorf("Source got %q, want %q", got, want)
+	}
+	if got := prov.ContentSHA256; len(got) != 64 || got != contentSHA256(root) {
+		t.Errorf("ContentSHA256 got %q, want stable 64 hex digits", got)
+	}
+	if prov.Version == "" {
+		t.Error("Version is empty")
+	}
+
+	node, err := html.Parse(strings.NewReader(`<html><head></head><body><p>Hello</p></body></html>`))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	node = node.FirstChild
+	if err := prov.embed(node); err != nil {
+		t.Fatalf("embed failed: %v", err)
+	}
+	var sb strings.Builder
+	if err := html.Render(&sb, node); err != nil {
+		t.Fatalf("html.Render failed: %v", err)
+	}
+	rendered, err := html.Parse(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	var content string
+	for meta := range url2epub.FromNode(rendered).FindAllAtomNodes(atom.Meta) {
+		m := meta.AsNode()
+		var name, value string
+		for _, attr := range m.Attr {
+			switch attr.Key {
+			case "name":
+				name = attr.Val
+			case "content":
+				value = attr.Val
+			}
+		}
+		if name == provenanceMetaName {
+			content = value
+		}
+	}
+	var got provenance
+	if err := json.Unmarshal([]byte(content), &got); err != nil {
+		t.Fatalf("Failed to decode embedded provenance %q: %v", content, err)
+	}
+	if got != *prov {
+		t.Errorf("Embedded provenance got %#v, want %#v", got, *prov)
+	}
+}
@@ -3,15 +3,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	neturl "net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"go.yhsif.com/ctxslog"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 
 	"go.yhsif.com/url2epub"
 )
@@ -22,14 +31,65 @@ const (
 	queryFit                  = "fit"
 	queryLang                 = "lang"
 	queryPassthroughUserAgent = "passthrough-user-agent"
+	queryOGImageFallback      = "og-image-fallback"
+	queryImages               = "images"
+	queryCover                = "cover"
+	queryEncoding             = "encoding"
+	queryFormat               = "format"
+	queryBaseURL              = "base-url"
 )
 
+const encodingBase64 = "base64"
+
+// formatJSON is the value of queryFormat to only get the metadata of the epub
+// as epubMetadataJSON, without generating the epub.
+const formatJSON = "json"
+
+// maxBase64EpubSize is the max size of the epub to be returned in base64
+// encoded json, so the response (4/3 of the epub size) stays under the 32MiB
+// response size limit of Cloud Run.
+const maxBase64EpubSize = 20 << 20
+
+// maxHTMLBodySize is the max size of the html posted to the REST endpoint.
+const maxHTMLBodySize = 10 << 20
+
 const minArticleNodes = 20
 
+const defaultImagesDir = "images"
+
+// coverMinSize is the min width and height of an image to be automatically
+// used as the epub cover, to avoid using icons and logos as covers.
+const coverMinSize = 200
+
 func restEpubHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := logContext(r)
 
 	url := r.FormValue(queryURL)
+	// When the html is posted, it's used instead of fetching the url, and
+	// base-url is used as the url.
+	var body []byte
+	if isHTMLPost(r) {
+		url = r.FormValue(queryBaseURL)
+		if u, err := neturl.Parse(url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(
+				w,
+				fmt.Sprintf("%s must be an absolute http(s) url when posting html, got %q", queryBaseURL, url),
+				http.StatusBadRequest,
+			)
+			return
+		}
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTMLBodySize))
+		if err != nil {
+			code := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				code = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("unable to read html: %v", err), code)
+			return
+		}
+	}
 	ctx = ctxslog.Attach(ctx, "origUrl", url)
 	gray, _ := strconv.ParseBool(r.FormValue(queryGray))
 	fit64, _ := strconv.ParseInt(r.FormValue(queryFit), 10, 64)
@@ -40,23 +100,390 @@ func restEpubHandler(w http.ResponseWriter, r *http.Request) {
 		userAgent = r.Header.Get("user-agent")
 		ctx = ctxslog.Attach(ctx, "userAgent", userAgent)
 	}
-	_, title, data, err := getEpub(ctx, url, userAgent, r.FormValue(queryLang), gray, fit)
+	ogImageFallback, _ := strconv.ParseBool(r.FormValue(queryOGImageFallback))
+	images := true
+	if v := r.FormValue(queryImages); v != "" {
+		images, _ = strconv.ParseBool(v)
+	}
+	cover := true
+	if v := r.FormValue(queryCover); v != "" {
+		cover, _ = strconv.ParseBool(v)
+	}
+	var asJSON bool
+	switch v := r.FormValue(queryEncoding); v {
+	default:
+		http.Error(w, fmt.Sprintf("unsupported encoding %q", v), http.StatusBadRequest)
+		return
+	case "":
+		asJSON = acceptsJSON(r)
+	case encodingBase64:
+		asJSON = true
+	}
+	format := OutputFormatEpub
+	var metadataOnly bool
+	switch v := r.FormValue(queryFormat); v {
+	case "":
+	case formatJSON:
+		metadataOnly = true
+	default:
+		f, err := ParseOutputFormat(v)
+		if err != nil || (f != OutputFormatEpub && f != OutputFormatPDF) {
+			http.Error(w, fmt.Sprintf("unsupported format %q", v), http.StatusBadRequest)
+			return
+		}
+		format = f
+	}
+	if format == OutputFormatPDF && pdfRender == nil {
+		http.Error(w, errPDFNotConfigured.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	key := r.Header.Get(headerIdempotencyKey)
+	var track bool
+	// The metadata is cheap and has no side effects, so it's never cached.
+	if key != "" && !metadataOnly {
+		ctx = ctxslog.Attach(ctx, "idempotencyKey", key)
+		fingerprint := r.Form.Encode()
+		if body != nil {
+			sum := sha256.Sum256(body)
+			fingerprint += "&html-sha256=" + hex.EncodeToString(sum[:])
+		}
+		cached, t, err := idempotency.begin(key, fingerprint, time.Now())
+		switch {
+		case errors.Is(err, errIdempotencyInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errIdempotencyMismatch):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case cached != nil:
+			w.Header().Set(headerIdempotentReplayed, "true")
+			writeFileResponse(w, asJSON, format, cached.id, cached.title, cached.data)
+			return
+		}
+		track = t
+	}
+	var finished bool
+	defer func() {
+		if track && !finished {
+			idempotency.abort(key)
+		}
+	}()
+
+	p, err := prepareEpub(ctx, getEpubArgs{
+		url:             url,
+		userAgent:       userAgent,
+		lang:            r.FormValue(queryLang),
+		gray:            gray,
+		fit:             fit,
+		ogImageFallback: ogImageFallback,
+		skipImages:      !images,
+		autoCover:       cover,
+		html:            body,
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		code := http.StatusBadRequest
+		switch {
+		case errors.Is(err, url2epub.ErrBlockedHost):
+			code = http.StatusForbidden
+		case errors.Is(err, errOverloaded):
+			code = http.StatusServiceUnavailable
+			w.Header().Set("retry-after", strconv.Itoa(int(overloadRetryAfter.Seconds())))
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if metadataOnly {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(p.metadata())
+		return
+	}
+	if track || asJSON {
+		// The result needs to be cached or encoded, so it can't be streamed.
+		buf := new(bytes.Buffer)
+		if err := p.write(ctx, format, buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if track {
+			idempotency.finish(key, p.id, p.title, buf.Bytes(), time.Now())
+			finished = true
+		}
+		writeFileResponse(w, asJSON, format, p.id, p.title, buf.Bytes())
 		return
 	}
+	setFileHeaders(w, format, p.title)
+	// Stream the file without content-length (so it's chunked), instead of
+	// buffering the whole file in memory first.
+	if err := p.write(ctx, format, w); err != nil {
+		// It's too late to change the status code at this point.
+		slog.ErrorContext(
+			ctx,
+			"Failed to stream file",
+			"err", err,
+			"id", p.id,
+			"format", format,
+		)
+	}
+}
+
+// fileTypeOf returns the file extension and mime type of the REST response in
+// format, which is either OutputFormatEpub or OutputFormatPDF.
+func fileTypeOf(format OutputFormat) (ext, mimeType string) {
+	if format == OutputFormatPDF {
+		return ".pdf", pdfMimeType
+	}
+	return ".epub", url2epub.EpubMimeType
+}
+
+// setFileHeaders sets the headers of the file response in format.
+func setFileHeaders(w http.ResponseWriter, format OutputFormat, title string) {
+	ext, mimeType := fileTypeOf(format)
 	w.Header().Set(
 		"content-disposition",
-		fmt.Sprintf(`attachment; filename*=UTF-8''%s.epub`, neturl.QueryEscape(title)),
+		fmt.Sprintf(`attachment; filename*=UTF-8''%s%s`, neturl.QueryEscape(title), ext),
 	)
-	w.Header().Set("content-type", url2epub.EpubMimeType)
-	w.Header().Set("content-length", strconv.FormatInt(int64(data.Len()), 10))
-	data.WriteTo(w)
+	w.Header().Set("content-type", mimeType)
+}
+
+// epubJSON is the json response of the epub (or pdf) when requested with
+// encoding=base64.
+type epubJSON struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	Filename      string `json:"filename"`
+	Size          int    `json:"size"`
+	ContentBase64 []byte `json:"content_base64"`
+}
+
+// acceptsJSON returns true if r explicitly accepts application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("accept") {
+		for _, v := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(v)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFileResponse writes the file in format in data to w, either as the file
+// itself or base64 encoded in json.
+func writeFileResponse(w http.ResponseWriter, asJSON bool, format OutputFormat, id, title string, data []byte) {
+	if !asJSON {
+		setFileHeaders(w, format, title)
+		w.Write(data)
+		return
+	}
+	ext, _ := fileTypeOf(format)
+	if len(data) > maxBase64EpubSize {
+		http.Error(
+			w,
+			fmt.Sprintf("file size %d exceeds the max %d for base64 encoding", len(data), maxBase64EpubSize),
+			http.StatusRequestEntityTooLarge,
+		)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(epubJSON{
+		ID:       id,
+		Title:    title,
+		Filename: title + ext,
+		Size:     len(data),
+		// encoding/json encodes []byte as base64.
+		ContentBase64: data,
+	})
+}
+
+// epubMetadataJSON is the json response of format=json.
+type epubMetadataJSON struct {
+	Title       string `json:"title"`
+	Author      string `json:"author,omitempty"`
+	Description string `json:"description,omitempty"`
+	Lang        string `json:"lang"`
+	ImageCount  int    `json:"image_count"`
+	// The uncompressed size of the html and the images, as an estimation of
+	// the size of the epub.
+	SizeBytes int `json:"size_bytes"`
+	// The url of the article after following redirects.
+	SourceURL string `json:"source_url"`
+}
+
+// saveDefaults are the args used by restSaveHandler when not set in the
+// request, tuned for reading on e-ink devices.
+var saveDefaults = map[string]string{
+	queryGray: "true",
+	// The width of reMarkable 2 screen.
+	queryFit: "1404",
+	// The request comes directly from the user's browser via the bookmarklet,
+	// so the site sees the same user agent as the page the user was reading.
+	queryPassthroughUserAgent: "true",
+}
+
+// restSaveHandler is restEpubHandler with saveDefaults, so a bookmarklet can
+// just open it with the url of the current page.
+func restSaveHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for k, v := range saveDefaults {
+		if !r.Form.Has(k) {
+			r.Form.Set(k, v)
+		}
+	}
+	// Every request generates a new epub from the current content of the page.
+	w.Header().Set("cache-control", "private, no-store")
+	restEpubHandler(w, r)
 }
 
 var errUnsupportedURL = errors.New("unsupported URL")
 
-func getEpub(ctx context.Context, url string, ua string, lang string, gray bool, fit int) (id, title string, data *bytes.Buffer, err error) {
+// ErrJavaScriptRequired is the error returned by getEpub when the extracted
+// article is (almost) empty, which usually means the page needs JavaScript to
+// render its content.
+var ErrJavaScriptRequired = errors.New("page requires JavaScript")
+
+// minArticleTextLength is the min length of the text in the readable html for
+// getEpub to not return ErrJavaScriptRequired.
+//
+// It's intentionally low, as we only want to catch the empty shells of
+// JavaScript rendered pages, not short articles.
+const minArticleTextLength = 50
+
+// getEpubArgs defines the args used by getEpub function.
+type getEpubArgs struct {
+	// The format of the generated file, default to epub.
+	format OutputFormat
+
+	url       string
+	userAgent string
+	lang      string
+	gray      bool
+	fit       int
+
+	ogImageFallback bool
+	skipImages      bool
+
+	// When true, the first substantial image (or og:image when there's no image
+	// in the article) is used as the epub cover.
+	autoCover bool
+
+	// The title to use when the title of the page is poor (empty or just the
+	// domain), for example the text of the link in the telegram message.
+	titleHint string
+
+	// The dir of the images in the epub, default to "images".
+	imagesDir string
+
+	// When non-nil, the html is parsed from it instead of fetched from url, and
+	// url is only used as the base url (of the images, etc.).
+	html []byte
+}
+
+// getEpub generates the epub (or pdf when args.format is OutputFormatPDF) from
+// args.url into a buffer.
+//
+// The returned provenance is also embedded in the epub.
+func getEpub(ctx context.Context, args getEpubArgs) (id, title string, data *bytes.Buffer, prov *provenance, err error) {
+	p, err := prepareEpub(ctx, args)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	data = new(bytes.Buffer)
+	if err := p.write(ctx, args.format, data); err != nil {
+		return "", "", nil, nil, err
+	}
+	return p.id, p.title, data, p.prov, nil
+}
+
+// preparedEpub is an epub with all its content fetched, ready to be written.
+type preparedEpub struct {
+	id    string
+	title string
+	prov  *provenance
+
+	// Dest is not set.
+	args url2epub.EpubArgs
+}
+
+// writeTo writes the epub to w.
+//
+// As the images are read while writing, it can only be called once.
+func (p *preparedEpub) writeTo(w io.Writer) error {
+	args := p.args
+	args.Dest = w
+	if _, err := url2epub.Epub(args); err != nil {
+		return fmt.Errorf("unable to create epub: %w", err)
+	}
+	return nil
+}
+
+// metadata returns the metadata of the epub without writing it.
+func (p *preparedEpub) metadata() epubMetadataJSON {
+	lang := p.args.OverrideLang
+	if lang == "" {
+		lang = url2epub.FromNode(p.args.Node).GetLang()
+	}
+	if lang == "" {
+		// Same as the default in url2epub.Epub.
+		lang = "en"
+	}
+	var buf bytes.Buffer
+	html.Render(&buf, p.args.Node)
+	size := buf.Len()
+	for _, r := range p.args.Images {
+		// The images are already downloaded into memory by Readable.
+		if l, ok := r.(interface{ Len() int }); ok {
+			size += l.Len()
+		}
+	}
+	var source string
+	if p.prov != nil {
+		source = p.prov.FinalURL
+	}
+	return epubMetadataJSON{
+		Title:       p.title,
+		Author:      p.args.Author,
+		Description: p.args.Description,
+		Lang:        lang,
+		ImageCount:  len(p.args.Images),
+		SizeBytes:   size,
+		SourceURL:   source,
+	}
+}
+
+// write writes the file in format to w.
+//
+// Like writeTo, it can only be called once.
+func (p *preparedEpub) write(ctx context.Context, format OutputFormat, w io.Writer) error {
+	if format != OutputFormatPDF {
+		return p.writeTo(w)
+	}
+	if pdfRender == nil {
+		return errPDFNotConfigured
+	}
+	if p.args.Node == nil {
+		return errors.New("unable to create pdf: only single article is supported")
+	}
+	if err := pdfRender.renderPDF(ctx, pdfPage{
+		title:  p.title,
+		node:   p.args.Node,
+		images: p.args.Images,
+	}, w); err != nil {
+		return fmt.Errorf("unable to create pdf: %w", err)
+	}
+	return nil
+}
+
+// prepareEpub fetches everything needed to generate the epub from args.url.
+//
+// The returned provenance is also embedded in the epub.
+func prepareEpub(ctx context.Context, args getEpubArgs) (p *preparedEpub, err error) {
+	url := args.url
+	ua := args.userAgent
 	if ua == "" {
 		ua = defaultUserAgent
 	}
@@ -65,6 +492,7 @@ func getEpub(ctx context.Context, url string, ua string, lang string, gray bool,
 		args := []any{
 			slog.Duration("took", time.Since(start)),
 			slog.String("url", url),
+			slog.String("source", sourceOf(url)),
 			slog.String("ua", ua),
 		}
 		level := slog.LevelDebug
@@ -77,62 +505,166 @@ func getEpub(ctx context.Context, url string, ua string, lang string, gray bool,
 		} else {
 			args = append(
 				args,
-				slog.String("id", id),
-				slog.String("title", title),
-				slog.Int("size", data.Len()),
+				slog.String("id", p.id),
+				slog.String("title", p.title),
+				slog.Any("provenance", p.prov),
 			)
 		}
-		slog.Log(ctx, level, "getEpub finished", args...)
+		slog.Log(ctx, level, "prepareEpub finished", args...)
 	}(time.Now())
 
+	imagesDir := args.imagesDir
+	if imagesDir == "" {
+		imagesDir = defaultImagesDir
+	}
+
+	release, err := generations.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start generating epub for %q: %w", url, err)
+	}
+	defer release()
+
 	ctx, cancel := context.WithTimeout(ctx, epubTimeout)
 	defer cancel()
-	root, baseURL, err := url2epub.GetHTML(ctx, url2epub.GetHTMLArgs{
-		URL:       url,
-		UserAgent: ua,
-	})
+	fetchedAt := time.Now()
+	hostPolicy := getHostPolicy(ctx)
+	var root *url2epub.Node
+	var baseURL *neturl.URL
+	if args.html != nil {
+		root, baseURL, err = parseHTML(args.html, url)
+	} else {
+		root, baseURL, err = url2epub.GetHTML(ctx, url2epub.GetHTMLArgs{
+			URL:         url,
+			UserAgent:   ua,
+			HostPolicy:  hostPolicy,
+			RateLimiter: hostRateLimiter,
+		})
+	}
 	if err != nil {
-		return "", "", nil, fmt.Errorf(
-			"unable to get html for %q: %v",
+		return nil, fmt.Errorf(
+			"unable to get html for %q: %w",
 			url,
 			err,
 		)
 	}
 	node, images, err := root.Readable(ctx, url2epub.ReadableArgs{
 		BaseURL:         baseURL,
-		ImagesDir:       "images",
-		Grayscale:       gray,
-		FitImage:        fit,
+		ImagesDir:       imagesDir,
+		Grayscale:       args.gray,
+		FitImage:        args.fit,
 		MinArticleNodes: minArticleNodes,
+		OGImageFallback: args.ogImageFallback || args.autoCover,
+		SkipImages:      args.skipImages,
+		PerImageTimeout: imageTimeout,
+		HostPolicy:      hostPolicy,
+		RateLimiter:     hostRateLimiter,
+
+		MaxConcurrentImages: maxConcurrentImages,
 	})
+	if errors.Is(err, url2epub.ErrNoBody) {
+		return nil, fmt.Errorf(
+			"%w: %q: %w",
+			ErrJavaScriptRequired,
+			url,
+			err,
+		)
+	}
 	if err != nil {
-		return "", "", nil, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"unable to generate readable html: %w",
 			err,
 		)
 	}
 	if node == nil {
 		// Should not happen
-		return "", "", nil, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"%w: %q",
 			errUnsupportedURL,
 			url,
 		)
 	}
+	if length := url2epub.FromNode(node).TextLength(); length < minArticleTextLength {
+		return nil, fmt.Errorf(
+			"%w: %q only has %d characters of text",
+			ErrJavaScriptRequired,
+			url,
+			length,
+		)
+	}
 
-	buf := new(bytes.Buffer)
-	data = buf
-	title = root.GetTitle()
-	id, err = url2epub.Epub(url2epub.EpubArgs{
-		Dest:         buf,
-		Title:        title,
-		Author:       root.GetAuthor(),
-		Node:         node,
-		OverrideLang: lang,
-		Images:       images,
-	})
+	prov := newProvenance(url, baseURL.String(), fetchedAt, root)
+	if err := prov.embed(node); err != nil {
+		slog.WarnContext(ctx, "Unable to embed provenance", "err", err)
+	}
+
+	var cover string
+	if args.autoCover {
+		cover = url2epub.FindCoverImage(node, images, coverMinSize)
+	}
+
+	title := pickTitle(root.GetTitle(), args.titleHint, baseURL)
+	// Decide the id upfront, so it's known before writing the epub.
+	id := uuid.NewString()
+	return &preparedEpub{
+		id:    id,
+		title: title,
+		prov:  prov,
+		args: url2epub.EpubArgs{
+			Title:           title,
+			Author:          root.GetAuthor(),
+			Description:     root.GetDescription(),
+			Node:            node,
+			OverrideLang:    args.lang,
+			Images:          images,
+			CoverImage:      cover,
+			DeterministicID: id,
+			ModTime:         fetchedAt,
+		},
+	}, nil
+}
+
+// isHTMLPost returns whether r is a POST request with html body.
+func isHTMLPost(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	return mediaType == "text/html"
+}
+
+// parseHTML parses data as the html fetched from baseURL, like
+// url2epub.GetHTML.
+func parseHTML(data []byte, baseURL string) (*url2epub.Node, *neturl.URL, error) {
+	u, err := neturl.Parse(baseURL)
 	if err != nil {
-		err = fmt.Errorf("unable to create epub: %w", err)
+		return nil, nil, fmt.Errorf("unable to parse url %q: %w", baseURL, err)
+	}
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse html: %w", err)
+	}
+	return url2epub.FromNode(root).FindFirstAtomNode(atom.Html), u, nil
+}
+
+// pickTitle returns hint instead of title when title is poor, which is either
+// empty or just the domain of u.
+func pickTitle(title, hint string, u *neturl.URL) string {
+	if hint == "" {
+		return title
+	}
+	trimmed := strings.TrimSpace(title)
+	if trimmed == "" {
+		return hint
+	}
+	if u != nil {
+		host := strings.ToLower(u.Hostname())
+		switch strings.TrimSuffix(strings.ToLower(trimmed), "/") {
+		case host,
+			strings.TrimPrefix(host, "www."),
+			strings.ToLower(u.Host),
+			strings.TrimSuffix(strings.ToLower(u.String()), "/"):
+			return hint
+		}
 	}
-	return
+	return title
 }
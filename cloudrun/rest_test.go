@@ -0,0 +1,770 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"go.yhsif.com/url2epub"
+)
+
+const (
+	testJSShellHTML = `<!doctype html>
+<html lang="en">
+<head><title>My App</title><script src="/static/js/main.js"></script></head>
+<body>
+<noscript>You need to enable JavaScript to run this app.</noscript>
+<div id="root"></div>
+<script>window.__INITIAL_STATE__ = {};</script>
+</body>
+</html>`
+
+	testLoadingShellHTML = `<!doctype html>
+<html lang="en">
+<head><title>My App</title><script src="/static/js/main.js"></script></head>
+<body>
+<div id="root"><div class="spinner"><p>Loading…</p></div></div>
+</body>
+</html>`
+
+	testArticleHTML = `<!doctype html>
+<html lang="en">
+<head><title>Hello</title></head>
+<body>
+<article>
+<h1>Hello, world</h1>
+<p>This is a short but real article, with enough text to not be mistaken as the empty shell of a page rendered by JavaScript.</p>
+</article>
+</body>
+</html>`
+)
+
+func TestGetEpubJavaScriptRequired(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	for _, c := range []struct {
+		label string
+		html  string
+		want  error
+	}{
+		{
+			label: "js-shell",
+			html:  testJSShellHTML,
+			want:  ErrJavaScriptRequired,
+		},
+		{
+			label: "loading-shell",
+			html:  testLoadingShellHTML,
+			want:  ErrJavaScriptRequired,
+		},
+		{
+			label: "article",
+			html:  testArticleHTML,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("content-type", "text/html; charset=utf-8")
+				io.WriteString(w, c.html)
+			}))
+			t.Cleanup(srv.Close)
+
+			_, _, _, _, err := getEpub(context.Background(), getEpubArgs{
+				url: srv.URL,
+			})
+			if !errors.Is(err, c.want) {
+				t.Errorf("getEpub got error %v, want %v", err, c.want)
+			}
+			if c.want == nil {
+				return
+			}
+			if errors.Is(err, errUnsupportedURL) {
+				t.Errorf("getEpub got error %v, should not be errUnsupportedURL", err)
+			}
+			if !strings.Contains(err.Error(), srv.URL) {
+				t.Errorf("getEpub got error %v, want it to contain the url %q", err, srv.URL)
+			}
+		})
+	}
+}
+
+func TestGetEpubTitleHint(t *testing.T) {
+	// The test server is on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		html := testArticleHTML
+		if r.URL.Path == "/poor" {
+			html = strings.Replace(html, "<title>Hello</title>", "<title>"+r.Host+"</title>", 1)
+		}
+		io.WriteString(w, html)
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, c := range []struct {
+		label string
+		path  string
+		want  string
+	}{
+		{
+			label: "poor",
+			path:  "/poor",
+			want:  "Great article on X",
+		},
+		{
+			label: "good",
+			path:  "/good",
+			want:  "Hello",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			_, title, _, _, err := getEpub(context.Background(), getEpubArgs{
+				url:       srv.URL + c.path,
+				titleHint: "Great article on X",
+			})
+			if err != nil {
+				t.Fatalf("getEpub failed: %v", err)
+			}
+			if title != c.want {
+				t.Errorf("title got %q, want %q", title, c.want)
+			}
+		})
+	}
+}
+
+func TestPickTitle(t *testing.T) {
+	u, err := neturl.Parse("https://www.example.com/post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const hint = "Great article on X"
+	for _, c := range []struct {
+		label string
+		title string
+		hint  string
+		want  string
+	}{
+		{
+			label: "good",
+			title: "Some title",
+			hint:  hint,
+			want:  "Some title",
+		},
+		{
+			label: "empty",
+			title: " ",
+			hint:  hint,
+			want:  hint,
+		},
+		{
+			label: "host",
+			title: "www.example.com",
+			hint:  hint,
+			want:  hint,
+		},
+		{
+			label: "domain",
+			title: "Example.com",
+			hint:  hint,
+			want:  hint,
+		},
+		{
+			label: "url",
+			title: "https://www.example.com/post/1",
+			hint:  hint,
+			want:  hint,
+		},
+		{
+			label: "no-hint",
+			title: "example.com",
+			want:  "example.com",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := pickTitle(c.title, c.hint, u); got != c.want {
+				t.Errorf("pickTitle(%q, %q) got %q, want %q", c.title, c.hint, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetEpubBlockedHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, _, _, _, err := getEpub(context.Background(), getEpubArgs{
+		url: srv.URL,
+	})
+	if !errors.Is(err, url2epub.ErrBlockedHost) {
+		t.Errorf("getEpub got error %v, want %v", err, url2epub.ErrBlockedHost)
+	}
+}
+
+func TestRestEpubHandlerStreaming(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(src.Close)
+
+	t.Run("handler", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, epubEndpoint+"?url="+neturl.QueryEscape(src.URL), nil)
+		rec := httptest.NewRecorder()
+		restEpubHandler(rec, req)
+		resp := rec.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", resp.StatusCode, http.StatusOK, rec.Body.String())
+		}
+		if got := resp.Header.Get("content-length"); got != "" {
+			t.Errorf("got content-length %q, want none", got)
+		}
+		data := rec.Body.Bytes()
+		if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Errorf("streamed epub is not a valid zip: %v", err)
+		}
+	})
+
+	t.Run("same-as-buffered", func(t *testing.T) {
+		// Epub modifies the node, so each write needs its own prepared epub.
+		modTime := time.Now()
+		newPrepared := func() *preparedEpub {
+			t.Helper()
+			root, err := html.Parse(strings.NewReader(testArticleHTML))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &preparedEpub{
+				id:    "id",
+				title: "Hello",
+				args: url2epub.EpubArgs{
+					Title:           "Hello",
+					Node:            root,
+					DeterministicID: "id",
+					ModTime:         modTime,
+				},
+			}
+		}
+		buf := new(bytes.Buffer)
+		if err := newPrepared().writeTo(buf); err != nil {
+			t.Fatalf("writeTo buffer got error: %v", err)
+		}
+
+		p := newPrepared()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := p.writeTo(w); err != nil {
+				t.Errorf("writeTo ResponseWriter got error: %v", err)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if got, want := resp.TransferEncoding, []string{"chunked"}; !slices.Equal(got, want) {
+			t.Errorf("got transfer encoding %q, want %q", got, want)
+		}
+		streamed, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(streamed, buf.Bytes()) {
+			t.Errorf("streamed epub (%d bytes) differs from buffered epub (%d bytes)", len(streamed), buf.Len())
+		}
+		if _, err := zip.NewReader(bytes.NewReader(streamed), int64(len(streamed))); err != nil {
+			t.Errorf("streamed epub is not a valid zip: %v", err)
+		}
+	})
+}
+
+func TestRestEpubHandlerOverloaded(t *testing.T) {
+	t.Cleanup(func() {
+		generations = nil
+	})
+	generations = newGenerationLimiter(1, true, 0)
+	release, err := generations.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire got error %v", err)
+	}
+	defer release()
+
+	req := httptest.NewRequest(http.MethodGet, epubEndpoint+"?url="+neturl.QueryEscape("https://example.com/"), nil)
+	rec := httptest.NewRecorder()
+	restEpubHandler(rec, req)
+	resp := rec.Result()
+	if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got := resp.Header.Get("retry-after"); got == "" {
+		t.Error("got no retry-after header")
+	}
+}
+
+func TestRestEpubHandlerIdempotency(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	t.Cleanup(func() {
+		idempotency = nil
+	})
+	idempotency = newIdempotencyCache(time.Minute)
+	var fetches atomic.Int64
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(src.Close)
+
+	request := func(url string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, epubEndpoint+"?url="+neturl.QueryEscape(url), nil)
+		req.Header.Set(headerIdempotencyKey, "key")
+		rec := httptest.NewRecorder()
+		restEpubHandler(rec, req)
+		return rec
+	}
+
+	first := request(src.URL)
+	if first.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", first.Code, http.StatusOK, first.Body.String())
+	}
+	second := request(src.URL)
+	if second.Code != http.StatusOK {
+		t.Fatalf("retry got status %d, want %d: %s", second.Code, http.StatusOK, second.Body.String())
+	}
+	if got := second.Header().Get(headerIdempotentReplayed); got != "true" {
+		t.Errorf("retry got %s header %q, want \"true\"", headerIdempotentReplayed, got)
+	}
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Error("retry got a different epub")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("source fetched %d times, want 1", got)
+	}
+
+	if got, want := request(src.URL+"/other").Code, http.StatusUnprocessableEntity; got != want {
+		t.Errorf("different url got status %d, want %d", got, want)
+	}
+}
+
+func TestRestEpubHandlerBase64(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(src.Close)
+
+	for _, c := range []struct {
+		label    string
+		encoding string
+		accept   string
+		wantJSON bool
+		wantCode int
+	}{
+		{
+			label:    "default",
+			accept:   "*/*",
+			wantCode: http.StatusOK,
+		},
+		{
+			label:    "query",
+			encoding: encodingBase64,
+			wantJSON: true,
+			wantCode: http.StatusOK,
+		},
+		{
+			label:    "accept",
+			accept:   "text/plain, application/json;q=0.9",
+			wantJSON: true,
+			wantCode: http.StatusOK,
+		},
+		{
+			label:    "unsupported",
+			encoding: "hex",
+			wantCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			query := neturl.Values{
+				queryURL: {src.URL},
+			}
+			if c.encoding != "" {
+				query.Set(queryEncoding, c.encoding)
+			}
+			req := httptest.NewRequest(http.MethodGet, epubEndpoint+"?"+query.Encode(), nil)
+			if c.accept != "" {
+				req.Header.Set("accept", c.accept)
+			}
+			rec := httptest.NewRecorder()
+			restEpubHandler(rec, req)
+			if rec.Code != c.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, c.wantCode, rec.Body.String())
+			}
+			if c.wantCode != http.StatusOK {
+				return
+			}
+			data := rec.Body.Bytes()
+			if c.wantJSON {
+				if got, want := rec.Header().Get("content-type"), "application/json"; got != want {
+					t.Errorf("got content-type %q, want %q", got, want)
+				}
+				var resp epubJSON
+				if err := json.Unmarshal(data, &resp); err != nil {
+					t.Fatalf("Failed to decode json response: %v", err)
+				}
+				if resp.ID == "" {
+					t.Error("got empty id")
+				}
+				if got, want := resp.Filename, resp.Title+".epub"; got != want {
+					t.Errorf("got filename %q, want %q", got, want)
+				}
+				if got, want := resp.Size, len(resp.ContentBase64); got != want {
+					t.Errorf("got size %d, want %d", got, want)
+				}
+				data = resp.ContentBase64
+			} else if got, want := rec.Header().Get("content-type"), url2epub.EpubMimeType; got != want {
+				t.Errorf("got content-type %q, want %q", got, want)
+			}
+			if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Errorf("epub is not a valid zip: %v", err)
+			}
+		})
+	}
+}
+
+func TestRestSaveHandler(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	const browserUA = "Mozilla/5.0 (bookmarklet)"
+	origUA := defaultUserAgent
+	t.Cleanup(func() {
+		defaultUserAgent = origUA
+	})
+	defaultUserAgent = "url2epub-test"
+	uaCh := make(chan string, 1)
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uaCh <- r.Header.Get("user-agent")
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(src.Close)
+
+	for _, c := range []struct {
+		label  string
+		query  neturl.Values
+		wantUA string
+	}{
+		{
+			label: "defaults",
+			query: neturl.Values{
+				queryURL: {src.URL},
+			},
+			wantUA: browserUA,
+		},
+		{
+			label: "overridden",
+			query: neturl.Values{
+				queryURL:                  {src.URL},
+				queryPassthroughUserAgent: {"false"},
+			},
+			wantUA: defaultUserAgent,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, saveEndpoint+"?"+c.query.Encode(), nil)
+			req.Header.Set("user-agent", browserUA)
+			rec := httptest.NewRecorder()
+			restSaveHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+			if got := <-uaCh; got != c.wantUA {
+				t.Errorf("source got user-agent %q, want %q", got, c.wantUA)
+			}
+			if got, want := rec.Header().Get("cache-control"), "private, no-store"; got != want {
+				t.Errorf("got cache-control %q, want %q", got, want)
+			}
+			if got := rec.Header().Get("content-disposition"); !strings.HasPrefix(got, "attachment;") {
+				t.Errorf("got content-disposition %q, want attachment", got)
+			}
+		})
+	}
+}
+
+// stubPDFRenderer is a pdfRenderer writing the title of the page as the pdf.
+type stubPDFRenderer struct {
+	pages []pdfPage
+}
+
+func (s *stubPDFRenderer) renderPDF(_ context.Context, page pdfPage, w io.Writer) error {
+	s.pages = append(s.pages, page)
+	_, err := io.WriteString(w, "%PDF-stub "+page.title)
+	return err
+}
+
+func TestRestEpubHandlerPDF(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(src.Close)
+	t.Cleanup(func() {
+		pdfRender = nil
+	})
+
+	request := func(format string) *httptest.ResponseRecorder {
+		t.Helper()
+		query := neturl.Values{
+			queryURL:    {src.URL},
+			queryFormat: {format},
+		}
+		req := httptest.NewRequest(http.MethodGet, epubEndpoint+"?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		restEpubHandler(rec, req)
+		return rec
+	}
+
+	t.Run("not-configured", func(t *testing.T) {
+		pdfRender = nil
+		if got, want := request("pdf").Code, http.StatusNotImplemented; got != want {
+			t.Errorf("got status %d, want %d", got, want)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		if got, want := request("link").Code, http.StatusBadRequest; got != want {
+			t.Errorf("got status %d, want %d", got, want)
+		}
+	})
+
+	t.Run("pdf", func(t *testing.T) {
+		stub := new(stubPDFRenderer)
+		pdfRender = stub
+		rec := request("pdf")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+		}
+		if got, want := rec.Header().Get("content-type"), pdfMimeType; got != want {
+			t.Errorf("got content-type %q, want %q", got, want)
+		}
+		if got, want := rec.Header().Get("content-disposition"), `attachment; filename*=UTF-8''Hello.pdf`; got != want {
+			t.Errorf("got content-disposition %q, want %q", got, want)
+		}
+		if got, want := rec.Body.String(), "%PDF-stub Hello"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+		if len(stub.pages) != 1 || stub.pages[0].node == nil {
+			t.Errorf("renderer got pages %+v, want 1 page with node", stub.pages)
+		}
+	})
+}
+
+func TestRestEpubHandlerMetadata(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+	const page = `<!doctype html>
+<html lang="fr">
+<head>
+<title>Bonjour</title>
+<meta name="author" content="Jane Doe">
+<meta name="description" content="A short greeting.">
+</head>
+<body>
+<article>
+<h1>Bonjour, le monde</h1>
+<p>This is a short but real article, with enough text to not be mistaken as the empty shell of a page rendered by JavaScript.</p>
+<img src="/image.png">
+</article>
+</body>
+</html>`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "image/png")
+		w.Write(img.Bytes())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	})
+	src := httptest.NewServer(mux)
+	t.Cleanup(src.Close)
+
+	query := neturl.Values{
+		queryURL:    {src.URL},
+		queryFormat: {formatJSON},
+	}
+	req := httptest.NewRequest(http.MethodGet, epubEndpoint+"?"+query.Encode(), nil)
+	req.Header.Set(headerIdempotencyKey, "key")
+	rec := httptest.NewRecorder()
+	restEpubHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if got, want := rec.Header().Get("content-type"), "application/json"; got != want {
+		t.Errorf("got content-type %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("content-disposition"); got != "" {
+		t.Errorf("got content-disposition %q, want none", got)
+	}
+	var got epubMetadataJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to decode json %q: %v", rec.Body.String(), err)
+	}
+	if got.SizeBytes <= img.Len() {
+		t.Errorf("got size_bytes %d, want > %d", got.SizeBytes, img.Len())
+	}
+	got.SizeBytes = 0
+	want := epubMetadataJSON{
+		Title:       "Bonjour",
+		Author:      "Jane Doe",
+		Description: "A short greeting.",
+		Lang:        "fr",
+		ImageCount:  1,
+		SourceURL:   src.URL,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRestEpubHandlerPostHTML(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+	var pageFetched atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article/images/a.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "image/png")
+		w.Write(img.Bytes())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		pageFetched.Store(true)
+		http.Error(w, "login required", http.StatusUnauthorized)
+	})
+	src := httptest.NewServer(mux)
+	t.Cleanup(src.Close)
+
+	const page = `<!doctype html>
+<html lang="en">
+<head><title>Posted</title></head>
+<body>
+<article>
+<h1>Posted, world</h1>
+<p>This is a short but real article, with enough text to not be mistaken as the empty shell of a page rendered by JavaScript.</p>
+<img src="images/a.png">
+</article>
+</body>
+</html>`
+	post := func(baseURL string) *httptest.ResponseRecorder {
+		t.Helper()
+		query := neturl.Values{
+			queryBaseURL: {baseURL},
+		}
+		req := httptest.NewRequest(http.MethodPost, epubEndpoint+"?"+query.Encode(), strings.NewReader(page))
+		req.Header.Set("content-type", "text/html; charset=utf-8")
+		rec := httptest.NewRecorder()
+		restEpubHandler(rec, req)
+		return rec
+	}
+
+	t.Run("no-base-url", func(t *testing.T) {
+		if got, want := post("").Code, http.StatusBadRequest; got != want {
+			t.Errorf("got status %d, want %d", got, want)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		rec := post(src.URL + "/article/")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+		}
+		if pageFetched.Load() {
+			t.Error("page fetched, want the posted html used instead")
+		}
+		data := rec.Body.Bytes()
+		z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("epub is not a valid zip: %v", err)
+		}
+		var opf []byte
+		var images int
+		for _, f := range z.File {
+			switch {
+			case strings.HasSuffix(f.Name, ".opf"):
+				r, err := f.Open()
+				if err != nil {
+					t.Fatalf("Failed to open %q: %v", f.Name, err)
+				}
+				opf, err = io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("Failed to read %q: %v", f.Name, err)
+				}
+			case strings.Contains(f.Name, "/"+defaultImagesDir+"/"):
+				images++
+			}
+		}
+		if want := "<dc:title>Posted</dc:title>"; !bytes.Contains(opf, []byte(want)) {
+			t.Errorf("opf does not contain %q:\n%s", want, opf)
+		}
+		if images != 1 {
+			t.Errorf("got %d images in epub, want 1 resolved against base-url", images)
+		}
+	})
+}
+
+func TestGetEpubPDF(t *testing.T) {
+	// The test servers are on loopback.
+	t.Setenv("BLOCK_PRIVATE_HOSTS", "false")
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		io.WriteString(w, testArticleHTML)
+	}))
+	t.Cleanup(src.Close)
+	pdfRender = new(stubPDFRenderer)
+	t.Cleanup(func() {
+		pdfRender = nil
+	})
+
+	_, title, data, _, err := getEpub(context.Background(), getEpubArgs{
+		format: OutputFormatPDF,
+		url:    src.URL,
+	})
+	if err != nil {
+		t.Fatalf("getEpub failed: %v", err)
+	}
+	if got, want := data.String(), "%PDF-stub "+title; got != want {
+		t.Errorf("got data %q, want %q", got, want)
+	}
+}
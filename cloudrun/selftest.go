@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"go.yhsif.com/url2epub"
+)
+
+const selfTestEndpoint = `/selftest`
+
+// The embedded static test page used by the self test.
+//
+//go:embed selftest
+var selfTestFS embed.FS
+
+const selfTestPage = "/selftest/index.html"
+
+// The stages of the self test.
+const (
+	selfTestStageGetHTML  = "get-html"
+	selfTestStageReadable = "readable"
+	selfTestStageEpub     = "epub"
+	selfTestStageValidate = "validate"
+)
+
+// selfTestStage is the result of a single stage of the self test.
+type selfTestStage struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Took  string `json:"took"`
+	Error string `json:"error,omitempty"`
+}
+
+// selfTestResult is the json response of the self test endpoint.
+type selfTestResult struct {
+	OK     bool            `json:"ok"`
+	Took   string          `json:"took"`
+	Size   int             `json:"size,omitempty"`
+	Stages []selfTestStage `json:"stages"`
+}
+
+// stage runs f as the named stage and records its result.
+//
+// It returns false if f failed, in which case the following stages should be
+// skipped.
+func (r *selfTestResult) stage(name string, f func() error) bool {
+	start := time.Now()
+	err := f()
+	stage := selfTestStage{
+		Name: name,
+		OK:   err == nil,
+		Took: time.Since(start).String(),
+	}
+	if err != nil {
+		stage.Error = err.Error()
+	}
+	r.Stages = append(r.Stages, stage)
+	return err == nil
+}
+
+// checkSelfTestSecret checks the bearer token in r against
+// SECRET_SELFTEST_TOKEN env.
+//
+// When the env is not set, the self test endpoint is disabled.
+func checkSelfTestSecret(r *http.Request, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := logContext(r)
+
+	if !checkSelfTestSecret(r, os.Getenv("SECRET_SELFTEST_TOKEN")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	result := runSelfTest(ctx)
+	level := slog.LevelInfo
+	if !result.OK {
+		level = slog.LevelError
+	}
+	slog.Log(ctx, level, "Self test finished", "result", result)
+
+	w.Header().Set("content-type", "application/json")
+	if !result.OK {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// runSelfTest generates an epub from the embedded test page, then validates
+// it.
+func runSelfTest(ctx context.Context) (result selfTestResult) {
+	defer func(start time.Time) {
+		result.Took = time.Since(start).String()
+	}(time.Now())
+
+	srv := httptest.NewServer(http.FileServerFS(selfTestFS))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, epubTimeout)
+	defer cancel()
+
+	var root *url2epub.Node
+	var baseURL *neturl.URL
+	var node *html.Node
+	var images map[string]io.Reader
+	var data bytes.Buffer
+	result.OK = result.stage(selfTestStageGetHTML, func() error {
+		var err error
+		root, baseURL, err = url2epub.GetHTML(ctx, url2epub.GetHTMLArgs{
+			URL:       srv.URL + selfTestPage,
+			UserAgent: defaultUserAgent,
+		})
+		return err
+	}) && result.stage(selfTestStageReadable, func() error {
+		var err error
+		node, images, err = root.Readable(ctx, url2epub.ReadableArgs{
+			BaseURL:         baseURL,
+			ImagesDir:       "images",
+			Grayscale:       true,
+			MinArticleNodes: minArticleNodes,
+		})
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return errors.New("no readable content")
+		}
+		if len(images) == 0 {
+			return errors.New("no images extracted")
+		}
+		return nil
+	}) && result.stage(selfTestStageEpub, func() error {
+		_, err := url2epub.Epub(url2epub.EpubArgs{
+			Dest:       &data,
+			Title:      root.GetTitle(),
+			Author:     root.GetAuthor(),
+			Node:       node,
+			Images:     images,
+			CoverImage: url2epub.FindCoverImage(node, images, coverMinSize),
+		})
+		return err
+	}) && result.stage(selfTestStageValidate, func() error {
+		result.Size = data.Len()
+		return errors.Join(url2epub.ValidateEpub(bytes.NewReader(data.Bytes()), int64(data.Len()))...)
+	})
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	result := runSelfTest(context.Background())
+	if !result.OK {
+		t.Errorf("runSelfTest failed: %+v", result)
+	}
+	want := []string{
+		selfTestStageGetHTML,
+		selfTestStageReadable,
+		selfTestStageEpub,
+		selfTestStageValidate,
+	}
+	if len(result.Stages) != len(want) {
+		t.Fatalf("runSelfTest got stages %+v, want %q", result.Stages, want)
+	}
+	for i, stage := range result.Stages {
+		if stage.Name != want[i] {
+			t.Errorf("stages[%d] got %q, want %q", i, stage.Name, want[i])
+		}
+		if !stage.OK || stage.Error != "" {
+			t.Errorf("stages[%d] failed: %+v", i, stage)
+		}
+	}
+	if result.Size <= 0 {
+		t.Errorf("runSelfTest got size %d", result.Size)
+	}
+}
+
+func TestCheckSelfTestSecret(t *testing.T) {
+	const secret = "secret"
+	for _, c := range []struct {
+		label  string
+		secret string
+		header string
+		want   bool
+	}{
+		{
+			label:  "ok",
+			secret: secret,
+			header: "Bearer " + secret,
+			want:   true,
+		},
+		{
+			label:  "wrong-token",
+			secret: secret,
+			header: "Bearer foo",
+		},
+		{
+			label:  "no-bearer",
+			secret: secret,
+			header: secret,
+		},
+		{
+			label:  "no-header",
+			secret: secret,
+		},
+		{
+			label:  "disabled",
+			header: "Bearer ",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			r := httptest.NewRequest("GET", selfTestEndpoint, nil)
+			if c.header != "" {
+				r.Header.Set("authorization", c.header)
+			}
+			if got := checkSelfTestSecret(r, c.secret); got != c.want {
+				t.Errorf("checkSelfTestSecret got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflight tracks the in-flight requests and background tasks of the server,
+// to drain them on shutdown.
+var inflight = new(inflightTracker)
+
+// inflightCounter counts the active and finished requests or tasks.
+type inflightCounter struct {
+	active   atomic.Int64
+	finished atomic.Int64
+}
+
+func (c *inflightCounter) start() {
+	c.active.Add(1)
+}
+
+func (c *inflightCounter) done() {
+	c.active.Add(-1)
+	c.finished.Add(1)
+}
+
+type inflightTracker struct {
+	requests inflightCounter
+	tasks    inflightCounter
+	wg       sync.WaitGroup
+}
+
+// wrap returns h with its requests tracked.
+func (t *inflightTracker) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.requests.start()
+		defer t.requests.done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// goBackground runs f in a new goroutine, which is waited for on shutdown.
+//
+// It should be used for the work outliving the requests, like the uploads
+// after replying to the webhook.
+func (t *inflightTracker) goBackground(f func()) {
+	t.tasks.start()
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer t.tasks.done()
+		f()
+	}()
+}
+
+// serve serves srv on ln until ctx is done, then shuts it down gracefully,
+// draining the in-flight requests and background tasks for up to grace.
+//
+// The requests still in-flight after grace are forcibly closed, while the
+// background tasks are abandoned.
+func (t *inflightTracker) serve(ctx context.Context, srv *http.Server, ln net.Listener, grace time.Duration) error {
+	srv.Handler = t.wrap(srv.Handler)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	finishedRequests := t.requests.finished.Load()
+	finishedTasks := t.tasks.finished.Load()
+	slog.InfoContext(
+		ctx,
+		"Shutting down",
+		"grace", grace,
+		"requests", t.requests.active.Load(),
+		"tasks", t.tasks.active.Load(),
+	)
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), grace)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		// Shutdown does not close the active connections when timed out.
+		srv.Close()
+	}
+	tasksDone := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(tasksDone)
+	}()
+	select {
+	case <-tasksDone:
+	case <-shutdownCtx.Done():
+	}
+
+	slog.InfoContext(
+		ctx,
+		"Shut down",
+		"err", err,
+		"drainedRequests", t.requests.finished.Load()-finishedRequests,
+		"closedRequests", t.requests.active.Load(),
+		"drainedTasks", t.tasks.finished.Load()-finishedTasks,
+		"abandonedTasks", t.tasks.active.Load(),
+	)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Already logged and closed.
+		return nil
+	}
+	return err
+}
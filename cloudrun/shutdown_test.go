@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetShutdownGracePeriod(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{
+			value: "",
+			want:  defaultShutdownGracePeriod,
+		},
+		{
+			value: "0",
+			want:  0,
+		},
+		{
+			value: "5s",
+			want:  5 * time.Second,
+		},
+		{
+			value: "foo",
+			want:  defaultShutdownGracePeriod,
+		},
+		{
+			value: "-1s",
+			want:  defaultShutdownGracePeriod,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("SHUTDOWN_GRACE_PERIOD", c.value)
+			if got := getShutdownGracePeriod(context.Background()); got != c.want {
+				t.Errorf("getShutdownGracePeriod() with SHUTDOWN_GRACE_PERIOD=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+// startServe starts serving handler with a new inflightTracker in the
+// background, returning the url of the server, the tracker, the function to
+// trigger the shutdown, and the channel of serve's result.
+func startServe(t *testing.T, handler http.HandlerFunc, grace time.Duration) (string, *inflightTracker, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := new(inflightTracker)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	result := make(chan error, 1)
+	go func() {
+		result <- tracker.serve(ctx, &http.Server{Handler: handler}, ln, grace)
+	}()
+	return "http://" + ln.Addr().String(), tracker, cancel, result
+}
+
+func TestServeDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var tracker *inflightTracker
+	taskDone := make(chan struct{})
+	url, tracker, shutdown, result := startServe(t, func(w http.ResponseWriter, r *http.Request) {
+		tracker.goBackground(func() {
+			<-release
+			close(taskDone)
+		})
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}, 5*time.Second)
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+	<-started
+	shutdown()
+	// Give serve a chance to start shutting down before releasing.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if resp := <-responses; resp.err != nil || resp.body != "done" {
+		t.Errorf("Got response (%q, %v), want (\"done\", nil)", resp.body, resp.err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("serve returned %v", err)
+	}
+	select {
+	case <-taskDone:
+	default:
+		t.Error("serve returned before the background task finished")
+	}
+	if got := tracker.requests.finished.Load(); got != 1 {
+		t.Errorf("Got %d finished requests, want 1", got)
+	}
+	if got := tracker.tasks.active.Load(); got != 0 {
+		t.Errorf("Got %d active tasks, want 0", got)
+	}
+}
+
+func TestServeForceClose(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	url, tracker, shutdown, result := startServe(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}, 50*time.Millisecond)
+
+	responseErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		responseErr <- err
+	}()
+	<-started
+	shutdown()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("serve returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the grace period")
+	}
+	if err := <-responseErr; err == nil {
+		t.Error("Expected the request to be forcibly closed")
+	}
+	if got := tracker.requests.active.Load(); got != 1 {
+		t.Errorf("Got %d active requests, want 1", got)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,6 +22,7 @@ import (
 
 	"go.yhsif.com/ctxslog"
 
+	"go.yhsif.com/url2epub"
 	"go.yhsif.com/url2epub/rmapi"
 	"go.yhsif.com/url2epub/tgbot"
 
@@ -40,7 +43,9 @@ const (
 
 	startExplain = `ℹ️
 
-Please add one of "rm" (for reMarkable account), "kindle" (for kindle and other emails), or "dropbox" (for Dropbox account) after "` + startCommand + ` " and follow instructions there.`
+Please add one of "rm" (for reMarkable account), "kindle" (for kindle and other emails), or "dropbox" (for Dropbox account) after "` + startCommand + ` " and follow instructions there.
+
+You can link multiple accounts of different types, and the URLs you send will be sent to all of them. Use "` + stopCommand + ` <type>" to unlink one of them.`
 
 	startExplainRM = `ℹ️
 
@@ -69,8 +74,31 @@ By default all epubs are sent to your root directory. To set a different one, us
 
 	notStartedMsg = `🚫 You had not run ` + startCommand + ` command successfully yet.`
 
-	stopMsg = `✅ Successfully deleted your reMarkable token or Kindle email.
+	stopMsg = `✅ Successfully deleted all your linked accounts.
 You can now go to https://my.remarkable.com/device/desktop to revoke access if it was reMarkable token.`
+	stopTargetMsg    = `✅ Successfully unlinked your %s account, the other linked accounts are kept.`
+	stopNotLinkedMsg = `🚫 Your %s account is not linked.`
+	stopUnknownMsg   = `🚫 Unknown account %q. Please use one of "rm", "kindle", or "dropbox" after "` + stopCommand + ` ", or "` + stopCommand + `" alone to unlink all accounts.`
+	stopSaveErr      = `🚫 Failed to unlink this account. Please try again later.`
+
+	listHeader   = `📚 Your recent uploads:`
+	listEmptyMsg = `ℹ️ You don't have any uploads yet.`
+	listErrMsg   = `🚫 Failed to get your recent uploads. Please try again later.`
+
+	addUsageMsg     = `ℹ️ Use "` + addCommand + ` <url>" to add an URL to your pending list, and "` + digestCommand + `" to send all of them as a single epub.`
+	addedMsg        = `✅ Added to your pending list (%d of %d), use "` + digestCommand + `" to send all of them as a single epub.`
+	addDuplicateMsg = `ℹ️ This URL is already in your pending list.`
+	addFullMsg      = `🚫 Your pending list is full (%d URLs), use "` + digestCommand + `" to send them first.`
+	addErrMsg       = `🚫 Failed to save your pending list. Please try again later.`
+
+	digestEmptyMsg     = `ℹ️ Your pending list is empty, use "` + addCommand + ` <url>" to add URLs first.`
+	digestErrMsg       = `🚫 Failed to get your pending list. Please try again later.`
+	digestStartMsg     = `ℹ️ Building the digest from the %d URLs in your pending list...`
+	digestFailedMsg    = `🚫 Failed to generate epub from any of the URLs in your pending list.`
+	digestHeader       = `📰 Your digest <b>%s</b> includes %d articles:`
+	digestFailedHeader = `⚠️ Failed to include these URLs, they are removed from your pending list:`
+	digestKeptHeader   = `⏳ These URLs are kept in your pending list for the next digest:`
+	digestRetryMsg     = `🚫 Failed to generate epub from the URLs in your pending list in time, they are kept in your pending list. Please try again later.`
 
 	dirMsg          = `You are currently saving to "%s", please choose a new directory to save to:`
 	dirErrMsg       = `🚫 Failed to list directories. Please try again later.`
@@ -79,18 +107,42 @@ You can now go to https://my.remarkable.com/device/desktop to revoke access if i
 	dirSuccess      = `✅ Saved!`
 	dirSuccessMsg   = `✅ Your new directory "%s" is saved.`
 	dirWrongAccount = dirCommand + ` is not supported by your account.`
+	dirNoMatch      = `🚫 No folders match "%s".`
+	dirPrevPage     = `« Prev`
+	dirNextPage     = `Next »`
+
+	dedupMsg          = `ℹ️ This URL was already sent to your %s account %s ago: "%s". Send it again?`
+	dedupResendButton = `🔁 Send again`
+	dedupResending    = `🔁 Sending again...`
+	dedupOldErr       = `🚫 This URL is no longer in your recent uploads, please send it again.`
 
 	noURLmsg             = `🚫 No URL found in message.`
 	unsupportedURLmsg    = `⚠️ Unsupported URL: "%s"`
 	failedEpubMsg        = `🚫 Failed to generate epub from URL: "%s"`
 	failedEpubRetry      = `, will retry with archive.is.`
+	javaScriptMsg        = `⚠️ This page needs JavaScript: "%s"`
+	javaScriptRetry      = `, trying archive.is.`
+	overloadedMsg        = `⚠️ Too many URLs are being processed right now, please send "%s" again later.`
+	feedMsg              = `ℹ️ This is a feed, archiving its latest %d entries: "%s"`
+	failedFeedMsg        = `🚫 Failed to get the entries of feed: "%s"`
+	feedEmptyMsg         = `⚠️ No entries found in feed: "%s"`
+	feedTimeoutMsg       = `⚠️ Timed out archiving feed "%s", only archived %d of its latest %d entries.`
 	failedUploadRM       = `🚫 Failed to upload epub to your reMarkable account for URL: "%s"`
+	failedUploadRMSchema = ` Your reMarkable account uses a newer sync protocol that is not supported yet, you might want to use Dropbox integration instead.`
+	failedUploadRMHidden = ` The upload seemed to succeed but the document is not visible in your reMarkable account, you might want to use Dropbox integration instead.`
+	failedUploadRMLarge  = ` The epub (%s) is larger than the %s limit of your reMarkable account. You can try "` + fitCommand + ` <number>" to downscale the images, or "` + noImagesCommand + `" to skip the images.`
+	rmTokenExpired       = ` Your reMarkable account link seems to be expired or revoked, please use "` + startCommand + ` rm" to link it again.`
+	rmTemporary          = ` reMarkable cloud seems to be busy right now, please try again later.`
 	failedUploadDropbox  = `🚫 Failed to upload epub to your Dropbox account for URL: "%s"`
 	failedEmail          = `🚫 Failed to email epub to your kindle device for URL: "%s"`
-	successUploadRM      = `✅ Uploaded "%s.epub" (%s) to your reMarkable account from URL: "%s"`
-	successUploadDropbox = `✅ Uploaded "%s" (%s) to your Dropbox account from URL: "%s"`
-	successEmail         = `✅ Sent "%s.epub" (%s) to your kindle device from URL: "%s"`
+	// The success messages are in html, see successMessage.
+	successUploadRM      = `✅ Uploaded <b>%s</b> (%s) to your reMarkable account from URL: <a href="%s">%s</a>`
+	successUploadDropbox = `✅ Uploaded <b>%s</b> (%s) to your Dropbox account from URL: <a href="%s">%s</a>`
+	successEmail         = `✅ Sent <b>%s</b> (%s) to your kindle device from URL: <a href="%s">%s</a>`
 	epubMsg              = "ℹ️ Download your epub file here: %s"
+	epubDownloadButton   = "⬇️ Download epub"
+	epubTooLargeMsg      = `🚫 The epub generated from URL "%s" is %s, larger than the %s limit of %s. You can try "` + fitCommand + ` <number>" to downscale the images, or "` + noImagesCommand + `" to skip the images.`
+	sourceArchiveNote    = ` Note that the content is from an archive snapshot (%s) instead of the original site, it might be incomplete.`
 
 	fitExplain = `ℹ️
 
@@ -103,6 +155,32 @@ Use "` + fitCommand + ` clear" to remove fit preference and leave big images int
 Your current fit preference is: %d (0 means no downscaling).`
 	fitSaveErr = `🚫 Failed to save fit preference. Please try again later.`
 	fitSaved   = `✅ Your new fit preference is saved: %d (0 means no downscaling).`
+
+	formatExplain = `ℹ️
+
+Use "` + formatCommand + ` <format>" to choose the output format for the URLs you send. Supported formats are:
+- epub: generate the epub file and send it to your account.
+- pdf: generate a pdf file of the article and send it to your account instead (only when supported by this server).
+- link: reply with a link to download the epub file instead.
+
+Use "` + formatCommand + ` reset" to go back to the default format (epub).
+
+Your current format is: %s.`
+	formatUnsupported = `🚫 Format "%s" is not supported on this server.`
+	formatSaveErr     = `🚫 Failed to save format preference. Please try again later.`
+	formatSaved       = `✅ Your new format preference is saved: %s.`
+
+	noImagesSaveErr = `🚫 Failed to save images preference. Please try again later.`
+	noImagesOn      = `✅ Images will be skipped from now on, use ` + noImagesCommand + ` again to include images.`
+	noImagesOff     = `✅ Images will be included from now on, use ` + noImagesCommand + ` again to skip images.`
+
+	quoteExplain = `ℹ️
+
+Use "` + quoteCommand + ` on" or "` + quoteCommand + ` off" to choose whether my replies quote your original messages.
+
+Your current preference is: %s.`
+	quoteSaveErr = `🚫 Failed to save quote preference. Please try again later.`
+	quoteSaved   = `✅ Your new quote preference is saved: %s.`
 )
 
 const (
@@ -110,26 +188,124 @@ const (
 	archiveNewest = archivePrefix + "newest/"
 )
 
+// The effective sources of the content.
+const (
+	sourceOrigin  = "origin"
+	sourceArchive = "archive.is"
+	sourceWayback = "wayback"
+)
+
+// The hosts of archive.is and its mirrors.
+var archiveHosts = map[string]bool{
+	"archive.is":    true,
+	"archive.ph":    true,
+	"archive.today": true,
+	"archive.li":    true,
+	"archive.vn":    true,
+	"archive.md":    true,
+	"archive.fo":    true,
+}
+
+const waybackHost = "web.archive.org"
+
+// sourceOf returns the effective source of the content from url.
+func sourceOf(url string) string {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return sourceOrigin
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	switch {
+	default:
+		return sourceOrigin
+	case archiveHosts[host]:
+		return sourceArchive
+	case host == waybackHost:
+		return sourceWayback
+	}
+}
+
+// successMessage formats the html success message of the upload from url,
+// with the user controlled parts escaped.
+func successMessage(format string, name string, size int, url string) string {
+	escaped := tgbot.EscapeHTML(url)
+	return fmt.Sprintf(format, tgbot.EscapeHTML(name), prettySize(size), escaped, escaped) +
+		tgbot.EscapeHTML(sourceNote(url))
+}
+
+// sourceNote returns the note to be appended to the success message for url,
+// or empty string if the content is from the origin.
+func sourceNote(url string) string {
+	source := sourceOf(url)
+	if source == sourceOrigin {
+		return ""
+	}
+	return fmt.Sprintf(sourceArchiveNote, source)
+}
+
+// firstURLInMessage returns the first url in the text or the caption of the
+// message, including the forwarded ones.
+//
+// When there's no url in them, the url of the link preview is used instead.
 func firstURLInMessage(ctx context.Context, message *tgbot.Message) string {
-	for _, entity := range message.Entities {
+	url, _ := firstLinkInMessage(ctx, message)
+	return url
+}
+
+// firstLinkInMessage is firstURLInMessage but also returns the display text of
+// the url when it's a text_link.
+func firstLinkInMessage(ctx context.Context, message *tgbot.Message) (url, text string) {
+	if url, text := firstLinkInEntities(ctx, message.Text, message.Entities); url != "" {
+		return url, text
+	}
+	if url, text := firstLinkInEntities(ctx, message.Caption, message.CaptionEntities); url != "" {
+		return url, text
+	}
+	if message.LinkPreviewOptions != nil {
+		return message.LinkPreviewOptions.URL, ""
+	}
+	return "", ""
+}
+
+func firstLinkInEntities(ctx context.Context, text string, entities []tgbot.MessageEntity) (url, linkText string) {
+	var u16 []uint16
+	entityText := func(entity tgbot.MessageEntity) (string, bool) {
+		if u16 == nil {
+			u16 = utf16.Encode([]rune(text))
+		}
+		if int64(len(u16)) < entity.Offset+entity.Length {
+			slog.ErrorContext(
+				ctx,
+				"Unable to process url entity",
+				"entity", entity,
+				"text", text,
+			)
+			return "", false
+		}
+		return string(utf16.Decode(u16[entity.Offset : entity.Offset+entity.Length])), true
+	}
+	for _, entity := range entities {
 		switch entity.Type {
 		case "url":
-			u16 := utf16.Encode([]rune(message.Text))
-			if int64(len(u16)) < entity.Offset+entity.Length {
-				slog.ErrorContext(
-					ctx,
-					"Unable to process url entity",
-					"entity", entity,
-					"text", message.Text,
-				)
-				continue
+			if url, ok := entityText(entity); ok {
+				return url, ""
 			}
-			return string(utf16.Decode(u16[entity.Offset : entity.Offset+entity.Length]))
 		case "text_link":
-			return entity.URL
+			linkText, _ := entityText(entity)
+			return entity.URL, strings.TrimSpace(linkText)
 		}
 	}
-	return ""
+	return "", ""
+}
+
+// titleHintForURL returns the display text of the text_link of url in the
+// message, to be used as the epub title when the page's own title is poor.
+func titleHintForURL(ctx context.Context, message *tgbot.Message, url string) string {
+	link, text := firstLinkInMessage(ctx, message)
+	if link == "" || (link != url && archiveNewest+link != url) {
+		return ""
+	}
+	return text
 }
 
 var langRE = regexp.MustCompile(`\blang: ?([a-zA-Z_-]*)\b`)
@@ -168,6 +344,15 @@ func firstLangInMessage(message *tgbot.Message) string {
 	return ""
 }
 
+// shouldRetryWithArchive returns true if we should retry url with archive.is
+// after failing to generate epub from it.
+//
+// We only retry once: never retry a retry (first == false),
+// or an url that's already from archive.is.
+func shouldRetryWithArchive(url string, first bool) bool {
+	return first && !strings.HasPrefix(url, archivePrefix)
+}
+
 func handleURL(
 	ctx context.Context,
 	w http.ResponseWriter,
@@ -181,56 +366,189 @@ func handleURL(
 	if !first {
 		reply = sendReplyMessage
 	}
+	if chat.GetFormat() == OutputFormatLink {
+		restURL := epubRESTURL(url, lang, chat.SkipImages)
+		reply(ctx, w, message, fmt.Sprintf(epubMsg, restURL), true, epubURLMarkup(restURL), withoutLinkPreview)
+		slog.InfoContext(
+			ctx,
+			"handleURL: Replied with rest url",
+			"restUrl", restURL,
+		)
+		return
+	}
+	format := chat.GetFormat()
+	if format == OutputFormatPDF && pdfRender == nil {
+		// The server was reconfigured after the chat chose pdf.
+		slog.WarnContext(ctx, "handleURL: pdf is not configured, falling back to epub")
+		format = OutputFormatEpub
+	}
 	start := time.Now()
-	id, title, data, err := getEpub(ctx, url, defaultUserAgent, lang, true, chat.FitImage)
-	if !first {
+	id, title, data, _, err := getEpub(ctx, getEpubArgs{
+		format:    format,
+		url:       url,
+		userAgent: defaultUserAgent,
+		lang:      lang,
+		gray:      true,
+		fit:       chat.FitImage,
+		titleHint: titleHintForURL(ctx, message, url),
+
+		skipImages: chat.SkipImages,
+		autoCover:  true,
+	})
+	if !first && strings.HasPrefix(url, archivePrefix) {
 		slog.DebugContext(ctx, "Retried with archive.is", "err", err, "url", url, "took", time.Since(start))
 	}
 	if err != nil {
-		if errors.Is(err, errUnsupportedURL) {
+		if errors.Is(err, url2epub.ErrFeed) && first {
+			handleFeed(ctx, w, message, chat, url)
+			return
+		}
+		if errors.Is(err, errOverloaded) {
+			// Retrying with archive.is would only make it worse.
+			reply(ctx, w, message, fmt.Sprintf(overloadedMsg, url), true, nil)
+			return
+		}
+		if errors.Is(err, errUnsupportedURL) ||
+			errors.Is(err, url2epub.ErrUnsupportedScheme) ||
+			errors.Is(err, url2epub.ErrBlockedHost) {
 			reply(ctx, w, message, fmt.Sprintf(unsupportedURLmsg, url), true, nil)
 		} else {
 			msg := fmt.Sprintf(failedEpubMsg, url)
-			if first && !strings.HasPrefix(url, archivePrefix) {
-				msg += failedEpubRetry
-				go func() {
-					ctx := context.WithoutCancel(ctx)
+			retryMsg := failedEpubRetry
+			if errors.Is(err, ErrJavaScriptRequired) {
+				msg = fmt.Sprintf(javaScriptMsg, url)
+				retryMsg = javaScriptRetry
+			}
+			if shouldRetryWithArchive(url, first) {
+				msg += retryMsg
+				inflight.goBackground(func() {
+					// Detach from the request so it won't be canceled when we reply to
+					// the webhook, but still bound it with its own deadline.
+					timeout := getArchiveRetryTimeout(ctx)
+					ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+					defer cancel()
 					newURL := archiveNewest + url
-					slog.DebugContext(ctx, "Failed with original url, retrying with archive.is", "err", err, "orig", url, "new", newURL)
+					slog.DebugContext(ctx, "Failed with original url, retrying with archive.is", "err", err, "orig", url, "new", newURL, "timeout", timeout)
 					handleURL(ctx, nil /* ResponseWriter */, message, chat, newURL, lang, false /* first */)
-				}()
+					if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+						slog.WarnContext(ctx, "Retry with archive.is timed out", "orig", url, "new", newURL, "timeout", timeout)
+					}
+				})
 			}
 			reply(ctx, w, message, msg, true, nil)
 		}
 		return
 	}
-	switch chat.Type {
+	for i, target := range chat.GetTargets() {
+		targetReply := reply
+		if i > 0 {
+			// The webhook response can only carry a single reply.
+			targetReply = sendReplyMessage
+		}
+		// Every target reads the epub from its own buffer.
+		deliverEpub(ctx, w, message, chat, target, format, url, id, title, bytes.NewBuffer(data.Bytes()), targetReply)
+	}
+}
+
+// handleFeed archives the latest entries of the feed url, each as its own
+// epub, in the background after replying.
+func handleFeed(
+	ctx context.Context,
+	w http.ResponseWriter,
+	message *tgbot.Message,
+	chat *EntityChatToken,
+	url string,
+) {
+	n := getFeedEntries(ctx)
+	replyMessage(ctx, w, message, fmt.Sprintf(feedMsg, n, url), true, nil)
+	inflight.goBackground(func() {
+		// Detach from the request so it won't be canceled when we reply to the
+		// webhook, but still bound it with its own deadline.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), feedTimeout)
+		defer cancel()
+		feed, _, err := url2epub.GetFeed(ctx, url2epub.GetHTMLArgs{
+			URL:         url,
+			UserAgent:   defaultUserAgent,
+			HostPolicy:  getHostPolicy(ctx),
+			RateLimiter: hostRateLimiter,
+			Timeout:     epubTimeout,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "handleFeed: Failed to get feed", "err", err, "url", url)
+			sendReplyMessage(ctx, nil, message, fmt.Sprintf(failedFeedMsg, url), true, nil)
+			return
+		}
+		entries := feed.Latest(n)
+		if len(entries) == 0 {
+			sendReplyMessage(ctx, nil, message, fmt.Sprintf(feedEmptyMsg, url), true, nil)
+			return
+		}
+		slog.InfoContext(ctx, "handleFeed: Archiving feed entries", "url", url, "title", feed.Title, "entries", len(entries))
+		for i, entry := range entries {
+			if ctx.Err() != nil {
+				slog.WarnContext(ctx, "handleFeed: Timed out", "url", url, "archived", i, "entries", len(entries), "timeout", feedTimeout)
+				sendReplyMessage(ctx, nil, message, fmt.Sprintf(feedTimeoutMsg, url, i, len(entries)), true, nil)
+				return
+			}
+			ctx := ctxslog.Attach(ctx, "feedEntryUrl", entry.URL)
+			// Not first, so a feed entry is never handled as a feed again, nor
+			// retried with archive.is.
+			handleURL(ctx, nil /* ResponseWriter */, message, chat, entry.URL, langForURL(ctx, message, entry.URL), false /* first */)
+		}
+	})
+}
+
+// deliverEpub sends the generated epub (or pdf, depending on format) to a
+// single linked target of the chat, and replies the result.
+func deliverEpub(
+	ctx context.Context,
+	w http.ResponseWriter,
+	message *tgbot.Message,
+	chat *EntityChatToken,
+	target AccountType,
+	format OutputFormat,
+	url, id, title string,
+	data *bytes.Buffer,
+	reply replyFunc,
+) {
+	if limit := getMaxEpubSize(ctx, target); limit > 0 && data.Len() > limit {
+		slog.WarnContext(
+			ctx,
+			"deliverEpub: epub too large",
+			"url", url,
+			"target", target,
+			"epubSize", data.Len(),
+			"limit", limit,
+		)
+		reply(ctx, w, message, fmt.Sprintf(epubTooLargeMsg, url, prettySize(data.Len()), targetNames[target], prettySize(limit)), true, nil)
+		return
+	}
+	switch target {
 	default:
 		// Should not happen, but just in case
 		slog.WarnContext(
 			ctx,
-			"handleURL: unknown chat type",
-			"type", chat.Type,
+			"deliverEpub: unknown chat type",
+			"type", target,
 		)
 		reply(ctx, w, message, notStartedMsg, true, nil)
 
 	case 0:
 		// Should not happen, but just in case
-		slog.WarnContext(ctx, "handleURL: chat type = 0")
+		slog.WarnContext(ctx, "deliverEpub: chat type = 0")
 		fallthrough
 	case AccountTypeRM:
-		uploadRM(ctx, w, message, chat, url, id, title, data, reply)
+		uploadRM(ctx, w, message, chat, format, url, id, title, data, reply)
 
 	case AccountTypeDropbox:
-		uploadDropbox(ctx, w, message, chat, url, id, title, data, reply)
+		uploadDropbox(ctx, w, message, chat, format, url, id, title, data, reply)
 
 	case AccountTypeKindle:
-		sendKindleEmail(ctx, w, message, chat, url, title, data, reply)
+		sendKindleEmail(ctx, w, message, chat, format, url, title, data, reply)
 	}
 }
 
-func urlHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message) {
-	chat := GetChat(ctx, message.Chat.ID)
+func urlHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
 	if chat == nil {
 		replyMessage(ctx, w, message, notStartedMsg, true, nil)
 		return
@@ -241,7 +559,97 @@ func urlHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Messa
 		return
 	}
 	ctx = ctxslog.Attach(ctx, "origUrl", url)
+	if origin := message.ForwardOrigin; origin != nil {
+		ctx = ctxslog.Attach(ctx, "forwardOrigin", origin.Type)
+	}
+
+	if window := getDedupWindow(ctx); window > 0 && chat.GetFormat() != OutputFormatLink {
+		uploads, err := getUploadHistory(ctx, chat.Chat)
+		if err != nil {
+			// Not fatal, just skip dedup.
+			slog.ErrorContext(ctx, "urlHandler: Unable to get upload history", "err", err)
+		}
+		if upload, ok := findRecentUpload(uploads, url, time.Now(), window); ok {
+			slog.InfoContext(ctx, "urlHandler: Found recent duplicate upload", "uploadedAt", upload.Time)
+			replyMessage(ctx, w, message, fmt.Sprintf(
+				dedupMsg,
+				targetNames[upload.Target],
+				prettyAge(time.Since(upload.Time)),
+				upload.Title,
+			), true, resendMarkup(url))
+			return
+		}
+	}
+
+	handleURL(ctx, w, message, chat, url, langForURL(ctx, message, url), true /* first */)
+}
+
+// resendMarkup returns the inline keyboard to confirm sending url again.
+func resendMarkup(url string) *tgbot.InlineKeyboardMarkup {
+	return &tgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbot.InlineKeyboardButton{
+			{
+				{
+					Text: dedupResendButton,
+					Data: resendPrefix + callbackToken(url),
+				},
+			},
+		},
+	}
+}
+
+// resendCallbackHandler handles the confirmation to send a duplicate url
+// again, bypassing dedup.
+func resendCallbackHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, data string, callback *tgbot.CallbackQuery) {
+	if callback.Message == nil {
+		slog.ErrorContext(
+			ctx,
+			"resendCallbackHandler: Bad callback",
+			"data", data,
+			"callback", callback,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, dedupOldErr)
+		reply200(w)
+		return
+	}
+	if chat == nil {
+		getBot().ReplyCallback(ctx, callback.ID, notStartedMsg)
+		reply200(w)
+		return
+	}
+	uploads, err := getUploadHistory(ctx, chat.Chat)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"resendCallbackHandler: Unable to get upload history",
+			"err", err,
+		)
+	}
+	url, ok := findUploadByToken(uploads, strings.TrimPrefix(data, resendPrefix))
+	if !ok {
+		getBot().ReplyCallback(ctx, callback.ID, dedupOldErr)
+		reply200(w)
+		return
+	}
+	if _, err := getBot().ReplyCallback(ctx, callback.ID, dedupResending); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"resendCallbackHandler: Unable to reply to callback",
+			"err", err,
+		)
+	}
+	// Reply to the original message with the url when possible.
+	message := callback.Message
+	if message.ReplyTo != nil {
+		message = message.ReplyTo
+	}
+	ctx = ctxslog.Attach(ctx, "origUrl", url)
+	handleURL(ctx, w, message, chat, url, langForURL(ctx, message, url), true /* first */)
+}
 
+// langForURL returns the lang override for url, either from the message or
+// from the domain default.
+func langForURL(ctx context.Context, message *tgbot.Message, url string) string {
 	lang := firstLangInMessage(message)
 	if lang != "" {
 		slog.DebugContext(ctx, "Found overriding lang in message", "lang", lang)
@@ -250,7 +658,7 @@ func urlHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Messa
 			slog.DebugContext(ctx, "Overriding lang from domain", "lang", lang, "domain", u.Host)
 		}
 	}
-	handleURL(ctx, w, message, chat, url, lang, true /* first */)
+	return lang
 }
 
 func sendKindleEmail(
@@ -258,6 +666,7 @@ func sendKindleEmail(
 	w http.ResponseWriter,
 	message *tgbot.Message,
 	chat *EntityChatToken,
+	format OutputFormat,
 	url, title string,
 	data *bytes.Buffer,
 	reply replyFunc,
@@ -269,13 +678,15 @@ func sendKindleEmail(
 			ctx,
 			"sendKindleEmail: Finished",
 			"took", time.Since(start),
+			"source", sourceOf(url),
 			"epubSize", size,
 			"title", title,
 			"err", err,
 		)
 	}(time.Now())
 
-	err = sendEmail(ctx, chat.KindleEmail, title, data, chat.Chat)
+	ext, _ := fileTypeOf(format)
+	err = sendEmail(ctx, chat.KindleEmail, title, ext, data, chat.Chat)
 	if err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -286,7 +697,13 @@ func sendKindleEmail(
 		reply(ctx, w, message, fmt.Sprintf(failedEmail, url), true, nil)
 		return
 	}
-	reply(ctx, w, message, fmt.Sprintf(successEmail, title, prettySize(size), url), true, nil)
+	reply(ctx, w, message, successMessage(successEmail, title+ext, size, url), true, nil, withHTML, withoutLinkPreview)
+	recordUpload(ctx, chat.Chat, UploadRecord{
+		Title:  title,
+		URL:    url,
+		Time:   time.Now(),
+		Target: AccountTypeKindle,
+	})
 }
 
 func uploadRM(
@@ -294,6 +711,7 @@ func uploadRM(
 	w http.ResponseWriter,
 	message *tgbot.Message,
 	chat *EntityChatToken,
+	format OutputFormat,
 	url, id, title string,
 	data *bytes.Buffer,
 	reply replyFunc,
@@ -308,6 +726,7 @@ func uploadRM(
 			ctx,
 			"uploadRM: Finished",
 			"took", time.Since(start),
+			"source", sourceOf(url),
 			"epubSize", size,
 			"id", id,
 			"title", title,
@@ -320,11 +739,12 @@ func uploadRM(
 		ID:       id,
 		Title:    title,
 		Data:     data,
-		Type:     rmapi.FileTypeEpub,
+		Type:     rmFileTypeOf(format),
 		ParentID: chat.GetParentID(),
 		ContentArgs: rmapi.ContentArgs{
 			Font: chat.GetFont(),
 		},
+		VerifyVisible: verifyRMUploads,
 	})
 	if err != nil {
 		slog.ErrorContext(
@@ -332,10 +752,33 @@ func uploadRM(
 			"uploadRM: Upload failed",
 			"err", err,
 		)
-		reply(ctx, w, message, fmt.Sprintf(failedUploadRM, url), true, nil)
+		msg := fmt.Sprintf(failedUploadRM, url)
+		var ge rmapi.GCSError
+		var tooLarge rmapi.UploadTooLargeError
+		if errors.Is(err, rmapi.ErrTokenExpired) {
+			msg += rmTokenExpired
+		} else if errors.Is(err, rmapi.ErrTemporary) {
+			msg += rmTemporary
+		} else if errors.As(err, &tooLarge) {
+			msg += fmt.Sprintf(failedUploadRMLarge, prettySize(int(tooLarge.Size)), prettySize(int(tooLarge.MaxUploadSize)))
+		} else if errors.Is(err, rmapi.ErrUnsupportedSchema) {
+			msg += failedUploadRMSchema
+		} else if errors.Is(err, rmapi.ErrUploadNotVisible) {
+			msg += failedUploadRMHidden
+		} else if errors.As(err, &ge) && ge.Code != "" {
+			msg += fmt.Sprintf(" This error detail might be helpful: %q.", ge.Code)
+		}
+		reply(ctx, w, message, msg, true, nil)
 		return
 	}
-	reply(ctx, w, message, fmt.Sprintf(successUploadRM, title, prettySize(size), url), true, nil)
+	ext, _ := fileTypeOf(format)
+	reply(ctx, w, message, successMessage(successUploadRM, title+ext, size, url), true, nil, withHTML, withoutLinkPreview)
+	recordUpload(ctx, chat.Chat, UploadRecord{
+		Title:  title,
+		URL:    url,
+		Time:   time.Now(),
+		Target: AccountTypeRM,
+	})
 }
 
 func handleDropboxAuthError(
@@ -384,6 +827,7 @@ func uploadDropbox(
 	w http.ResponseWriter,
 	message *tgbot.Message,
 	chat *EntityChatToken,
+	format OutputFormat,
 	url, id, title string,
 	data *bytes.Buffer,
 	reply replyFunc,
@@ -400,6 +844,7 @@ func uploadDropbox(
 			ctx,
 			"uploadDropbox: Finished",
 			"took", time.Since(start),
+			"source", sourceOf(url),
 			"epubSize", size,
 			"id", id,
 			"title", title,
@@ -408,7 +853,8 @@ func uploadDropbox(
 	}(time.Now())
 	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
 	defer cancel()
-	filename := dropboxFilenameCleaner.Replace(title) + ".epub"
+	ext, _ := fileTypeOf(format)
+	filename := dropboxFilenameCleaner.Replace(title) + ext
 	if chat.DropboxFolder != "" {
 		filename = path.Join(chat.DropboxFolder, filename)
 	}
@@ -422,19 +868,26 @@ func uploadDropbox(
 		reply(ctx, w, message, fmt.Sprintf(failedUploadDropbox, url), true, nil)
 		return
 	}
-	reply(ctx, w, message, fmt.Sprintf(successUploadDropbox, filename, prettySize(size), url), true, nil)
+	reply(ctx, w, message, successMessage(successUploadDropbox, filename, size, url), true, nil, withHTML, withoutLinkPreview)
+	recordUpload(ctx, chat.Chat, UploadRecord{
+		Title:  title,
+		URL:    url,
+		Time:   time.Now(),
+		Target: AccountTypeDropbox,
+	})
 }
 
-func epubHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message) {
-	url := firstURLInMessage(ctx, message)
-	if url == "" && message.ReplyTo != nil {
-		url = firstURLInMessage(ctx, message.ReplyTo)
-	}
-	if url == "" {
-		replyMessage(ctx, w, message, noURLmsg, true, nil)
-		return
+// rmFileTypeOf returns the reMarkable file type of the file in format.
+func rmFileTypeOf(format OutputFormat) rmapi.FileType {
+	if format == OutputFormatPDF {
+		return rmapi.FileTypePdf
 	}
+	return rmapi.FileTypeEpub
+}
 
+// epubRESTURL returns the REST url to download the epub file generated from
+// url.
+func epubRESTURL(url string, lang string, skipImages bool) string {
 	var sb strings.Builder
 	sb.WriteString(globalURLPrefix)
 	sb.WriteString(epubEndpoint)
@@ -442,17 +895,29 @@ func epubHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Mess
 	params := make(neturl.Values)
 	params.Set(queryURL, url)
 	params.Set(queryGray, "1")
-	if lang := firstLangInMessage(message); lang != "" {
+	if lang != "" {
 		params.Set(queryLang, lang)
-	} else if u, err := neturl.Parse(url); err == nil {
-		if lang = defaultLangByDomain[u.Host]; lang != "" {
-			slog.DebugContext(ctx, "Overriding lang from domain", "lang", lang, "domain", u.Host)
-		}
+	}
+	if skipImages {
+		params.Set(queryImages, "0")
 	}
 	params.Set(queryPassthroughUserAgent, "1")
 	sb.WriteString(params.Encode())
-	restURL := sb.String()
-	replyMessage(ctx, w, message, fmt.Sprintf(epubMsg, restURL), true, nil)
+	return sb.String()
+}
+
+func epubHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message) {
+	url := firstURLInMessage(ctx, message)
+	if url == "" && message.ReplyTo != nil {
+		url = firstURLInMessage(ctx, message.ReplyTo)
+	}
+	if url == "" {
+		replyMessage(ctx, w, message, noURLmsg, true, nil)
+		return
+	}
+
+	restURL := epubRESTURL(url, langForURL(ctx, message, url), false /* skipImages */)
+	replyMessage(ctx, w, message, fmt.Sprintf(epubMsg, restURL), true, epubURLMarkup(restURL), withoutLinkPreview)
 	slog.InfoContext(
 		ctx,
 		"epubHandler: Generated rest url",
@@ -461,7 +926,22 @@ func epubHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Mess
 	)
 }
 
-func startHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message, text string) {
+// epubURLMarkup returns the markup with a single url button to download the
+// epub from restURL.
+func epubURLMarkup(restURL string) *tgbot.InlineKeyboardMarkup {
+	return &tgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbot.InlineKeyboardButton{
+			{
+				{
+					Text: epubDownloadButton,
+					URL:  restURL,
+				},
+			},
+		},
+	}
+}
+
+func startHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, text string) {
 	payload := strings.TrimSpace(strings.TrimPrefix(text, startCommand))
 	if payload == "" {
 		replyMessage(ctx, w, message, startExplain, true, nil)
@@ -478,7 +958,7 @@ func startHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Mes
 		return "", false
 	}
 	if payload, ok := checkPrefix("rm"); ok {
-		startRM(ctx, w, message, payload)
+		startRM(ctx, w, chat, message, payload)
 		return
 	}
 	if payload, ok := checkPrefix("kindle"); ok {
@@ -493,14 +973,25 @@ func startHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Mes
 	replyMessage(ctx, w, message, startExplain, true, nil)
 }
 
-func startRM(ctx context.Context, w http.ResponseWriter, message *tgbot.Message, token string) {
+func startRM(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, token string) {
 	if token == "" {
-		replyMessage(ctx, w, message, startExplainRM, true, nil)
+		msg := startExplainRM
+		if chat != nil && chat.RMToken != "" {
+			// Let the user know if the link needs to be fixed.
+			client := &rmapi.Client{
+				RefreshToken: chat.RMToken,
+			}
+			if err := client.Verify(ctx); errors.Is(err, rmapi.ErrTokenExpired) {
+				msg = "⚠️" + rmTokenExpired + "\n\n" + msg
+			}
+		}
+		replyMessage(ctx, w, message, msg, true, nil)
 		return
 	}
+	description := getRMDescription(ctx)
 	client, err := rmapi.Register(ctx, rmapi.RegisterArgs{
 		Token:       token,
-		Description: rmDescription,
+		Description: description,
 	})
 	if err != nil {
 		slog.ErrorContext(
@@ -514,14 +1005,17 @@ func startRM(ctx context.Context, w http.ResponseWriter, message *tgbot.Message,
 		), true, nil)
 		return
 	}
-	chat := GetChat(ctx, message.Chat.ID)
-	if chat == nil {
-		chat = &EntityChatToken{
-			Chat: message.Chat.ID,
-		}
+	chat, err = getChatForStart(ctx, message.Chat.ID)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"startRM: Unable to get chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, startSaveErr, true, nil)
+		return
 	}
-	chat.Type = AccountTypeRM
-	chat.RMToken = client.RefreshToken
+	chat.linkAccount(AccountTypeRM, client.RefreshToken)
 	if err := chat.Save(ctx); err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -532,7 +1026,7 @@ func startRM(ctx context.Context, w http.ResponseWriter, message *tgbot.Message,
 		return
 	}
 	replyMessage(ctx, w, message, fmt.Sprintf(
-		startSuccessRM, rmDescription, time.Now().Format("2006-01-02"),
+		startSuccessRM, description, time.Now().Format("2006-01-02"),
 	), true, nil)
 }
 
@@ -544,14 +1038,17 @@ func startKindle(ctx context.Context, w http.ResponseWriter, message *tgbot.Mess
 		), true, nil)
 		return
 	}
-	chat := GetChat(ctx, message.Chat.ID)
-	if chat == nil {
-		chat = &EntityChatToken{
-			Chat: message.Chat.ID,
-		}
+	chat, err := getChatForStart(ctx, message.Chat.ID)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"startKindle: Unable to get chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, startSaveErr, true, nil)
+		return
 	}
-	chat.Type = AccountTypeKindle
-	chat.KindleEmail = email
+	chat.linkAccount(AccountTypeKindle, email)
 	if err := chat.Save(ctx); err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -583,14 +1080,17 @@ func startDropbox(ctx context.Context, w http.ResponseWriter, message *tgbot.Mes
 		// error already handled
 		return
 	}
-	chat := GetChat(ctx, message.Chat.ID)
-	if chat == nil {
-		chat = &EntityChatToken{
-			Chat: message.Chat.ID,
-		}
+	chat, err := getChatForStart(ctx, message.Chat.ID)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"startDropbox: Unable to get chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, startSaveErr, true, nil)
+		return
 	}
-	chat.Type = AccountTypeDropbox
-	chat.DropboxToken = client.RefreshToken
+	chat.linkAccount(AccountTypeDropbox, client.RefreshToken)
 	if err := chat.Save(ctx); err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -603,64 +1103,271 @@ func startDropbox(ctx context.Context, w http.ResponseWriter, message *tgbot.Mes
 	replyMessage(ctx, w, message, startSuccessDropbox, true, nil)
 }
 
-func stopHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message) {
-	chat := GetChat(ctx, message.Chat.ID)
+func stopHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, text string) {
 	if chat == nil {
 		replyMessage(ctx, w, message, notStartedMsg, true, nil)
 		return
 	}
-	chat.Delete(ctx)
-	replyMessage(ctx, w, message, stopMsg, true, nil)
+	payload := strings.TrimSpace(strings.TrimPrefix(text, stopCommand))
+	if payload == "" {
+		chat.Delete(ctx)
+		deleteUploadHistory(ctx, chat.Chat)
+		deletePendingURLs(ctx, chat.Chat)
+		replyMessage(ctx, w, message, stopMsg, true, nil)
+		return
+	}
+
+	var target AccountType
+	if err := target.UnmarshalText([]byte(payload)); err != nil {
+		replyMessage(ctx, w, message, fmt.Sprintf(stopUnknownMsg, payload), true, nil)
+		return
+	}
+	if !chat.unlinkAccount(target) {
+		replyMessage(ctx, w, message, fmt.Sprintf(stopNotLinkedMsg, targetNames[target]), true, nil)
+		return
+	}
+	if len(chat.Targets) == 0 {
+		chat.Delete(ctx)
+		deleteUploadHistory(ctx, chat.Chat)
+		deletePendingURLs(ctx, chat.Chat)
+	} else if err := chat.Save(ctx); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"stopHandler: Unable to save chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, stopSaveErr, true, nil)
+		return
+	}
+	replyMessage(ctx, w, message, fmt.Sprintf(stopTargetMsg, targetNames[target]), true, nil)
 }
 
-func dirHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message) {
-	chat := GetChat(ctx, message.Chat.ID)
+func listHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
 	if chat == nil {
 		replyMessage(ctx, w, message, notStartedMsg, true, nil)
 		return
 	}
-	switch chat.Type {
-	default:
-		replyMessage(ctx, w, message, dirWrongAccount, true, nil)
-
-	case 0:
-		// Should not happen, but just in case
-		slog.WarnContext(ctx, "dirHandler: chat type = 0")
-		fallthrough
-	case AccountTypeRM:
-		dirRM(ctx, w, chat, message)
-
-	case AccountTypeDropbox:
-		dirDropbox(ctx, w, chat, message)
+	uploads, err := getUploadHistory(ctx, chat.Chat)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"listHandler: Unable to get upload history",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, listErrMsg, true, nil)
+		return
+	}
+	if len(uploads) == 0 {
+		replyMessage(ctx, w, message, listEmptyMsg, true, nil)
+		return
 	}
+	replyMessage(ctx, w, message, historyMessage(uploads), true, nil, withHTML, withoutLinkPreview)
 }
 
-func dirRM(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
-	client := &rmapi.Client{
-		RefreshToken: chat.RMToken,
+func addHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
+	if chat == nil {
+		replyMessage(ctx, w, message, notStartedMsg, true, nil)
+		return
 	}
-	dirs, err := client.ListDirs(ctx)
+	url := firstURLInMessage(ctx, message)
+	if url == "" {
+		replyMessage(ctx, w, message, addUsageMsg, true, nil)
+		return
+	}
+	pending, err := getPendingURLs(ctx, chat.Chat)
 	if err != nil {
 		slog.ErrorContext(
 			ctx,
-			"dirRM: ListDirs failed",
+			"addHandler: Unable to get pending urls",
 			"err", err,
 		)
-		replyMessage(ctx, w, message, dirErrMsg, true, nil)
+		replyMessage(ctx, w, message, addErrMsg, true, nil)
 		return
 	}
-	choices := make([][]tgbot.InlineKeyboardButton, 0, len(dirs))
-	for id, name := range dirs {
-		choices = append(choices, []tgbot.InlineKeyboardButton{
-			{
-				Text: name,
-				Data: dirIDPrefix + id,
-			},
-		})
+	pending, err = addPending(pending, PendingURL{
+		URL:       url,
+		Time:      time.Now(),
+		TitleHint: titleHintForURL(ctx, message, url),
+	})
+	switch {
+	case errors.Is(err, errPendingDuplicate):
+		replyMessage(ctx, w, message, addDuplicateMsg, true, nil)
+		return
+	case errors.Is(err, errPendingFull):
+		replyMessage(ctx, w, message, fmt.Sprintf(addFullMsg, maxPendingURLs), true, nil)
+		return
 	}
-	sort.Slice(choices, func(i, j int) bool {
-		return choices[i][0].Text < choices[j][0].Text
+	if err := savePendingURLs(ctx, chat.Chat, pending); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"addHandler: Unable to save pending urls",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, addErrMsg, true, nil)
+		return
+	}
+	replyMessage(ctx, w, message, fmt.Sprintf(addedMsg, len(pending), maxPendingURLs), true, nil)
+}
+
+func digestHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
+	if chat == nil {
+		replyMessage(ctx, w, message, notStartedMsg, true, nil)
+		return
+	}
+	pending, err := getPendingURLs(ctx, chat.Chat)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"digestHandler: Unable to get pending urls",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, digestErrMsg, true, nil)
+		return
+	}
+	if len(pending) == 0 {
+		replyMessage(ctx, w, message, digestEmptyMsg, true, nil)
+		return
+	}
+	replyMessage(ctx, w, message, fmt.Sprintf(digestStartMsg, len(pending)), true, nil)
+	inflight.goBackground(func() {
+		// Detach from the request so it won't be canceled when we reply to the
+		// webhook, but still bound it with its own deadline.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), digestTimeout)
+		defer cancel()
+		p, included, failed, kept := buildDigest(ctx, pending, chat, time.Now())
+		slog.InfoContext(ctx, "digestHandler: Built digest", "included", len(included), "failed", len(failed), "kept", len(kept))
+
+		// Remove the processed urls from the latest pending list, as more urls
+		// could be added in the meantime. The kept urls stay for the next digest.
+		saveCtx, saveCancel := context.WithTimeout(context.WithoutCancel(ctx), pendingUpdateTimeout)
+		defer saveCancel()
+		done := removePending(pending, kept)
+		if current, err := getPendingURLs(saveCtx, chat.Chat); err != nil {
+			slog.ErrorContext(ctx, "digestHandler: Unable to get pending urls", "err", err)
+		} else if err := savePendingURLs(saveCtx, chat.Chat, removePending(current, done)); err != nil {
+			slog.ErrorContext(ctx, "digestHandler: Unable to save pending urls", "err", err)
+		}
+
+		if p == nil {
+			msg := digestFailedMsg
+			if len(kept) > 0 {
+				msg = digestRetryMsg
+			}
+			sendReplyMessage(ctx, nil, message, msg, true, nil)
+			return
+		}
+		data := new(bytes.Buffer)
+		if err := p.writeTo(data); err != nil {
+			slog.ErrorContext(ctx, "digestHandler: Unable to write epub", "err", err)
+			sendReplyMessage(ctx, nil, message, digestFailedMsg, true, nil)
+			return
+		}
+		for _, target := range chat.GetTargets() {
+			// Every target reads the epub from its own buffer.
+			// Digests have multiple sections, which are only supported by epub.
+			deliverEpub(ctx, nil, message, chat, target, OutputFormatEpub, included[0].url, p.id, p.title, bytes.NewBuffer(data.Bytes()), sendReplyMessage)
+		}
+		sendReplyMessage(ctx, nil, message, digestMessage(p.title, included, failed, kept), true, nil, withHTML, withoutLinkPreview)
 	})
+}
+
+func dirHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, text string) {
+	if chat == nil {
+		replyMessage(ctx, w, message, notStartedMsg, true, nil)
+		return
+	}
+	switch chat.dirTarget() {
+	default:
+		replyMessage(ctx, w, message, dirWrongAccount, true, nil)
+
+	case 0:
+		// Should not happen, but just in case
+		slog.WarnContext(ctx, "dirHandler: chat type = 0")
+		fallthrough
+	case AccountTypeRM:
+		dirRM(ctx, w, chat, message, dirQuery(text))
+
+	case AccountTypeDropbox:
+		dirDropbox(ctx, w, chat, message, dirQuery(text))
+	}
+}
+
+// dirQuery returns the filter query from the "/dir <query>" command text.
+func dirQuery(text string) string {
+	return strings.TrimSpace(strings.TrimPrefix(text, dirCommand))
+}
+
+// dirQueryFromCallback returns the filter query from the original "/dir
+// <query>" command message the callback message replied to, if any.
+func dirQueryFromCallback(callback *tgbot.CallbackQuery) string {
+	if callback.Message == nil || callback.Message.ReplyTo == nil {
+		return ""
+	}
+	text := callback.Message.ReplyTo.Text
+	if !strings.HasPrefix(text, dirCommand) {
+		return ""
+	}
+	return dirQuery(text)
+}
+
+// filterChoices returns the choices with text containing query, case
+// insensitive.
+func filterChoices(choices [][]tgbot.InlineKeyboardButton, query string) [][]tgbot.InlineKeyboardButton {
+	if query == "" {
+		return choices
+	}
+	query = strings.ToLower(query)
+	filtered := make([][]tgbot.InlineKeyboardButton, 0, len(choices))
+	for _, row := range choices {
+		if strings.Contains(strings.ToLower(row[0].Text), query) {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered
+}
+
+func dirRM(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, query string) {
+	client := &rmapi.Client{
+		RefreshToken: chat.RMToken,
+	}
+	dirs, err := client.ListDirs(ctx)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirRM: ListDirs failed",
+			"err", err,
+		)
+		msg := dirErrMsg
+		switch {
+		case errors.Is(err, rmapi.ErrTokenExpired):
+			msg += rmTokenExpired
+		case errors.Is(err, rmapi.ErrTemporary):
+			msg += rmTemporary
+		}
+		replyMessage(ctx, w, message, msg, true, nil)
+		return
+	}
+	choices := filterChoices(rmDirChoices(dirs), query)
+	switch {
+	case query != "" && len(choices) == 0:
+		replyMessage(ctx, w, message, fmt.Sprintf(dirNoMatch, query), true, nil)
+		return
+
+	case query != "" && len(choices) == 1:
+		// Only one match, just select it.
+		chat.RMParentID = choices[0][0].Data
+		if err := chat.Save(ctx); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"dirRM: Unable to save chat",
+				"err", err,
+			)
+			replyMessage(ctx, w, message, dirSaveErr, true, nil)
+			return
+		}
+		replyMessage(ctx, w, message, fmt.Sprintf(dirSuccessMsg, choices[0][0].Text), true, nil)
+		return
+	}
 	replyMessage(
 		ctx,
 		w,
@@ -668,12 +1375,65 @@ func dirRM(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, me
 		fmt.Sprintf(dirMsg, dirs[chat.GetParentID()]),
 		true,
 		&tgbot.InlineKeyboardMarkup{
-			InlineKeyboard: choices,
+			InlineKeyboard: pageChoices(choices, 0, dirPagePrefix),
 		},
 	)
 }
 
-func dirDropbox(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
+// rmDirChoices returns the sorted choices for the reMarkable dirs returned by
+// rmapi.Client.ListDirs.
+func rmDirChoices(dirs map[string]string) [][]tgbot.InlineKeyboardButton {
+	choices := make([][]tgbot.InlineKeyboardButton, 0, len(dirs))
+	for id, name := range dirs {
+		choices = append(choices, []tgbot.InlineKeyboardButton{
+			{
+				Text: name,
+				Data: dirIDPrefix + id,
+			},
+		})
+	}
+	sort.Slice(choices, func(i, j int) bool {
+		if choices[i][0].Text == choices[j][0].Text {
+			// Different dirs could have the same name, break the tie with the id
+			// to keep the order consistent across pages.
+			return choices[i][0].Data < choices[j][0].Data
+		}
+		return choices[i][0].Text < choices[j][0].Text
+	})
+	return choices
+}
+
+// pageChoices returns the choices on the given page (0-indexed), with an
+// additional row of prev/next buttons if there are more than one pages.
+//
+// The data of the prev/next buttons are pagePrefix followed by the page number.
+func pageChoices(choices [][]tgbot.InlineKeyboardButton, page int, pagePrefix string) [][]tgbot.InlineKeyboardButton {
+	if len(choices) <= dirPageSize {
+		return choices
+	}
+	pages := (len(choices) + dirPageSize - 1) / dirPageSize
+	page = max(0, min(page, pages-1))
+	start := page * dirPageSize
+	end := min(start+dirPageSize, len(choices))
+	result := make([][]tgbot.InlineKeyboardButton, 0, end-start+1)
+	result = append(result, choices[start:end]...)
+	var nav []tgbot.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, tgbot.InlineKeyboardButton{
+			Text: dirPrevPage,
+			Data: pagePrefix + strconv.Itoa(page-1),
+		})
+	}
+	if page < pages-1 {
+		nav = append(nav, tgbot.InlineKeyboardButton{
+			Text: dirNextPage,
+			Data: pagePrefix + strconv.Itoa(page+1),
+		})
+	}
+	return append(result, nav)
+}
+
+func dirDropbox(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, query string) {
 	client := dropboxClientFromChat(ctx, w, message, chat, replyMessage)
 	if client == nil {
 		// error message already replied
@@ -689,18 +1449,27 @@ func dirDropbox(ctx context.Context, w http.ResponseWriter, chat *EntityChatToke
 		replyMessage(ctx, w, message, dirErrMsg, true, nil)
 		return
 	}
-	choices := make([][]tgbot.InlineKeyboardButton, 0, len(dirs))
-	for _, dir := range dirs {
-		choices = append(choices, []tgbot.InlineKeyboardButton{
-			{
-				Text: dir.Display,
-				Data: dropboxDirPrefix + dir.Display,
-			},
-		})
+	choices := filterChoices(dropboxDirChoices(dirs), query)
+	switch {
+	case query != "" && len(choices) == 0:
+		replyMessage(ctx, w, message, fmt.Sprintf(dirNoMatch, query), true, nil)
+		return
+
+	case query != "" && len(choices) == 1:
+		// Only one match, just select it.
+		chat.DropboxFolder = choices[0][0].Text
+		if err := chat.Save(ctx); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"dirDropbox: Unable to save chat",
+				"err", err,
+			)
+			replyMessage(ctx, w, message, dirSaveErr, true, nil)
+			return
+		}
+		replyMessage(ctx, w, message, fmt.Sprintf(dirSuccessMsg, chat.DropboxFolder), true, nil)
+		return
 	}
-	sort.Slice(choices, func(i, j int) bool {
-		return choices[i][0].Text < choices[j][0].Text
-	})
 	replyMessage(
 		ctx,
 		w,
@@ -708,12 +1477,55 @@ func dirDropbox(ctx context.Context, w http.ResponseWriter, chat *EntityChatToke
 		fmt.Sprintf(dirMsg, chat.DropboxFolder),
 		true,
 		&tgbot.InlineKeyboardMarkup{
-			InlineKeyboard: choices,
+			InlineKeyboard: pageChoices(choices, 0, dropboxDirPagePrefix),
 		},
 	)
 }
 
-func dirRMCallbackHandler(ctx context.Context, w http.ResponseWriter, data string, callback *tgbot.CallbackQuery) {
+// callbackToken returns a short token for s to be used in callback data
+// instead of s itself, as telegram limits callback data to 64 bytes.
+//
+// The token is not reversible, the callback handler should map it back by
+// comparing it with the tokens of the candidates.
+// It never contains ":", so it can be safely used after a prefix.
+func callbackToken(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(hash[:callbackTokenBytes])
+}
+
+// findDropboxDir finds the display path of the dir matching the callback token
+// in dirs.
+func findDropboxDir(dirs []DropboxEntry, token string) (string, bool) {
+	for _, dir := range dirs {
+		if callbackToken(dir.Display) == token {
+			return dir.Display, true
+		}
+	}
+	return "", false
+}
+
+// dropboxDirChoices returns the sorted choices for the Dropbox dirs returned by
+// DropboxClient.ListDirs.
+func dropboxDirChoices(dirs []DropboxEntry) [][]tgbot.InlineKeyboardButton {
+	choices := make([][]tgbot.InlineKeyboardButton, 0, len(dirs))
+	for _, dir := range dirs {
+		choices = append(choices, []tgbot.InlineKeyboardButton{
+			{
+				Text: dir.Display,
+				// Full paths could easily exceed the 64 bytes limit of callback data.
+				Data: dropboxDirPrefix + callbackToken(dir.Display),
+			},
+		})
+	}
+	// Use stable sort so that the pages stay consistent even if there are dirs
+	// with the same display name.
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i][0].Text < choices[j][0].Text
+	})
+	return choices
+}
+
+func dirRMCallbackHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, data string, callback *tgbot.CallbackQuery) {
 	if callback.Message == nil {
 		slog.ErrorContext(
 			ctx,
@@ -725,7 +1537,6 @@ func dirRMCallbackHandler(ctx context.Context, w http.ResponseWriter, data strin
 		reply200(w)
 		return
 	}
-	chat := GetChat(ctx, callback.Message.Chat.ID)
 	if chat == nil {
 		slog.ErrorContext(
 			ctx,
@@ -769,16 +1580,78 @@ func dirRMCallbackHandler(ctx context.Context, w http.ResponseWriter, data strin
 		)
 		return
 	}
-	getBot().SendMessage(
+	getBot().SendMessage(ctx, tgbot.SendMessageArgs{
+		ChatID:  callback.Message.Chat.ID,
+		Text:    fmt.Sprintf(dirSuccessMsg, dirs[chat.GetParentID()]),
+		ReplyTo: quotedMessageID(ctx, callback.Message.ID),
+	})
+}
+
+func dirRMPageCallbackHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, data string, callback *tgbot.CallbackQuery) {
+	page, err := strconv.Atoi(strings.TrimPrefix(data, dirPagePrefix))
+	if callback.Message == nil || err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirRMPageCallbackHandler: Bad callback",
+			"data", data,
+			"callback", callback,
+			"err", err,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, dirOldErr)
+		reply200(w)
+		return
+	}
+	if chat == nil {
+		slog.ErrorContext(
+			ctx,
+			"dirRMPageCallbackHandler: Bad callback",
+			"data", data,
+			"chat", callback.Message.Chat.ID,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, notStartedMsg)
+		reply200(w)
+		return
+	}
+	client := &rmapi.Client{
+		RefreshToken: chat.RMToken,
+	}
+	dirs, err := client.ListDirs(ctx)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirRMPageCallbackHandler: ListDirs failed",
+			"err", err,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, dirErrMsg)
+		reply200(w)
+		return
+	}
+	if _, err := getBot().ReplyCallback(ctx, callback.ID, ""); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirRMPageCallbackHandler: Unable to reply to callback",
+			"err", err,
+		)
+	}
+	reply200(w)
+
+	if _, err := getBot().EditMessageReplyMarkup(
 		ctx,
 		callback.Message.Chat.ID,
-		fmt.Sprintf(dirSuccessMsg, dirs[chat.GetParentID()]),
-		&callback.Message.ID,
-		nil,
-	)
+		callback.Message.ID,
+		&tgbot.InlineKeyboardMarkup{
+			InlineKeyboard: pageChoices(filterChoices(rmDirChoices(dirs), dirQueryFromCallback(callback)), page, dirPagePrefix),
+		},
+	); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirRMPageCallbackHandler: Unable to edit message",
+			"err", err,
+		)
+	}
 }
 
-func dirDropboxCallbackHandler(ctx context.Context, w http.ResponseWriter, data string, callback *tgbot.CallbackQuery) {
+func dirDropboxCallbackHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, data string, callback *tgbot.CallbackQuery) {
 	if callback.Message == nil {
 		slog.ErrorContext(
 			ctx,
@@ -790,7 +1663,6 @@ func dirDropboxCallbackHandler(ctx context.Context, w http.ResponseWriter, data
 		reply200(w)
 		return
 	}
-	chat := GetChat(ctx, callback.Message.Chat.ID)
 	if chat == nil {
 		slog.ErrorContext(
 			ctx,
@@ -803,6 +1675,40 @@ func dirDropboxCallbackHandler(ctx context.Context, w http.ResponseWriter, data
 		return
 	}
 	dir := strings.TrimPrefix(data, dropboxDirPrefix)
+	if !strings.HasPrefix(dir, "/") {
+		// It's a callback token instead of the raw path (used by older messages),
+		// list the dirs again to map it back to the path.
+		client := dropboxClientFromChat(ctx, nil /* ResponseWriter */, callback.Message, chat, sendReplyMessage)
+		if client == nil {
+			// error message already sent
+			getBot().ReplyCallback(ctx, callback.ID, dirSaveErr)
+			reply200(w)
+			return
+		}
+		dirs, err := client.ListDirs(ctx)
+		if err != nil {
+			slog.ErrorContext(
+				ctx,
+				"dirDropboxCallbackHandler: ListDirs failed",
+				"err", err,
+			)
+			getBot().ReplyCallback(ctx, callback.ID, dirSaveErr)
+			reply200(w)
+			return
+		}
+		var ok bool
+		dir, ok = findDropboxDir(dirs, dir)
+		if !ok {
+			slog.ErrorContext(
+				ctx,
+				"dirDropboxCallbackHandler: Dir not found",
+				"data", data,
+			)
+			getBot().ReplyCallback(ctx, callback.ID, dirOldErr)
+			reply200(w)
+			return
+		}
+	}
 	chat.DropboxFolder = dir
 	if err := chat.Save(ctx); err != nil {
 		slog.ErrorContext(
@@ -823,17 +1729,82 @@ func dirDropboxCallbackHandler(ctx context.Context, w http.ResponseWriter, data
 	}
 	reply200(w)
 
-	getBot().SendMessage(
+	getBot().SendMessage(ctx, tgbot.SendMessageArgs{
+		ChatID:  callback.Message.Chat.ID,
+		Text:    fmt.Sprintf(dirSuccessMsg, dir),
+		ReplyTo: quotedMessageID(ctx, callback.Message.ID),
+	})
+}
+
+func dirDropboxPageCallbackHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, data string, callback *tgbot.CallbackQuery) {
+	page, err := strconv.Atoi(strings.TrimPrefix(data, dropboxDirPagePrefix))
+	if callback.Message == nil || err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirDropboxPageCallbackHandler: Bad callback",
+			"data", data,
+			"callback", callback,
+			"err", err,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, dirOldErr)
+		reply200(w)
+		return
+	}
+	if chat == nil {
+		slog.ErrorContext(
+			ctx,
+			"dirDropboxPageCallbackHandler: Bad callback",
+			"data", data,
+			"chat", callback.Message.Chat.ID,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, notStartedMsg)
+		reply200(w)
+		return
+	}
+	client := dropboxClientFromChat(ctx, nil /* ResponseWriter */, callback.Message, chat, sendReplyMessage)
+	if client == nil {
+		// error message already sent
+		getBot().ReplyCallback(ctx, callback.ID, dirErrMsg)
+		reply200(w)
+		return
+	}
+	dirs, err := client.ListDirs(ctx)
+	if err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirDropboxPageCallbackHandler: ListDirs failed",
+			"err", err,
+		)
+		getBot().ReplyCallback(ctx, callback.ID, dirErrMsg)
+		reply200(w)
+		return
+	}
+	if _, err := getBot().ReplyCallback(ctx, callback.ID, ""); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirDropboxPageCallbackHandler: Unable to reply to callback",
+			"err", err,
+		)
+	}
+	reply200(w)
+
+	if _, err := getBot().EditMessageReplyMarkup(
 		ctx,
 		callback.Message.Chat.ID,
-		fmt.Sprintf(dirSuccessMsg, dir),
-		&callback.Message.ID,
-		nil,
-	)
+		callback.Message.ID,
+		&tgbot.InlineKeyboardMarkup{
+			InlineKeyboard: pageChoices(filterChoices(dropboxDirChoices(dirs), dirQueryFromCallback(callback)), page, dropboxDirPagePrefix),
+		},
+	); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"dirDropboxPageCallbackHandler: Unable to edit message",
+			"err", err,
+		)
+	}
 }
 
-func fitHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Message, text string) {
-	chat := GetChat(ctx, message.Chat.ID)
+func fitHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, text string) {
 	if chat == nil {
 		replyMessage(ctx, w, message, notStartedMsg, true, nil)
 		return
@@ -877,23 +1848,173 @@ func fitHandler(ctx context.Context, w http.ResponseWriter, message *tgbot.Messa
 	), true, nil)
 }
 
+func formatHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, text string) {
+	if chat == nil {
+		replyMessage(ctx, w, message, notStartedMsg, true, nil)
+		return
+	}
+	payload := strings.TrimSpace(strings.TrimPrefix(text, formatCommand))
+	if payload == "" {
+		replyMessage(ctx, w, message, fmt.Sprintf(formatExplain, chat.Format), true, nil)
+		return
+	}
+	if strings.EqualFold(payload, "reset") {
+		chat.Format = OutputFormatDefault
+	} else {
+		format, err := ParseOutputFormat(payload)
+		if err != nil {
+			slog.ErrorContext(
+				ctx,
+				"formatHandler: Invalid payload",
+				"err", err,
+				"payload", text,
+			)
+			replyMessage(ctx, w, message, fmt.Sprintf(formatExplain, chat.Format), true, nil)
+			return
+		}
+		if format == OutputFormatPDF && pdfRender == nil {
+			replyMessage(ctx, w, message, fmt.Sprintf(formatUnsupported, format), true, nil)
+			return
+		}
+		chat.Format = format
+	}
+	if err := chat.Save(ctx); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"formatHandler: Unable to save chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, formatSaveErr, true, nil)
+		return
+	}
+	replyMessage(ctx, w, message, fmt.Sprintf(formatSaved, chat.Format), true, nil)
+}
+
+func noImagesHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message) {
+	if chat == nil {
+		replyMessage(ctx, w, message, notStartedMsg, true, nil)
+		return
+	}
+	chat.SkipImages = !chat.SkipImages
+	if err := chat.Save(ctx); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"noImagesHandler: Unable to save chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, noImagesSaveErr, true, nil)
+		return
+	}
+	msg := noImagesOff
+	if chat.SkipImages {
+		msg = noImagesOn
+	}
+	replyMessage(ctx, w, message, msg, true, nil)
+}
+
+func quoteHandler(ctx context.Context, w http.ResponseWriter, chat *EntityChatToken, message *tgbot.Message, text string) {
+	if chat == nil {
+		replyMessage(ctx, w, message, notStartedMsg, true, nil)
+		return
+	}
+	switch payload := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(text, quoteCommand))); payload {
+	default:
+		replyMessage(ctx, w, message, fmt.Sprintf(quoteExplain, onOff(chat.GetQuoteReplies())), true, nil)
+		return
+	case "on":
+		chat.NoQuote = false
+	case "off":
+		chat.NoQuote = true
+	}
+	if err := chat.Save(ctx); err != nil {
+		slog.ErrorContext(
+			ctx,
+			"quoteHandler: Unable to save chat",
+			"err", err,
+		)
+		replyMessage(ctx, w, message, quoteSaveErr, true, nil)
+		return
+	}
+	ctx = quoteRepliesContext(ctx, chat.GetQuoteReplies())
+	replyMessage(ctx, w, message, fmt.Sprintf(quoteSaved, onOff(chat.GetQuoteReplies())), true, nil)
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+type quoteRepliesKeyType struct{}
+
+var quoteRepliesKey quoteRepliesKeyType
+
+// quoteRepliesContext attaches the quote preference of the chat to ctx,
+// which will be honored by the reply functions.
+func quoteRepliesContext(ctx context.Context, quote bool) context.Context {
+	return context.WithValue(ctx, quoteRepliesKey, quote)
+}
+
+// quoteReplies returns the quote preference attached to ctx, default to true.
+func quoteReplies(ctx context.Context) bool {
+	quote, ok := ctx.Value(quoteRepliesKey).(bool)
+	return !ok || quote
+}
+
+// quotedMessageID returns the pointer to id if replies should quote the
+// original message, or nil otherwise.
+func quotedMessageID(ctx context.Context, id int64) *int64 {
+	if !quoteReplies(ctx) {
+		return nil
+	}
+	return &id
+}
+
 func reply200(w http.ResponseWriter) {
 	code := http.StatusOK
 	http.Error(w, http.StatusText(code), code)
 }
 
+// replyOption customizes the reply message.
+type replyOption func(*tgbot.ReplyMessage)
+
+// withHTML sets the parse mode of the reply to html, the msg must be escaped
+// with tgbot.EscapeHTML accordingly.
+func withHTML(reply *tgbot.ReplyMessage) {
+	reply.ParseMode = tgbot.ParseModeHTML
+}
+
+// withoutLinkPreview disables the link preview of the reply, for replies
+// containing urls that are not meant to be previewed.
+func withoutLinkPreview(reply *tgbot.ReplyMessage) {
+	reply.LinkPreviewOptions = &tgbot.LinkPreviewOptions{
+		IsDisabled: true,
+	}
+}
+
 func generateReplyMessage(
+	ctx context.Context,
 	orig *tgbot.Message,
 	msg string,
 	quote bool,
 	markup *tgbot.InlineKeyboardMarkup,
+	opts ...replyOption,
 ) *tgbot.ReplyMessage {
+	if err := markup.Validate(); err != nil {
+		// Still send the text without the invalid markup.
+		slog.ErrorContext(ctx, "Invalid reply markup", "err", err, "markup", markup)
+		markup = nil
+	}
 	reply := &tgbot.ReplyMessage{
 		ChatID:      orig.Chat.ID,
 		Text:        msg,
 		ReplyMarkup: markup,
 	}
-	if quote {
+	for _, opt := range opts {
+		opt(reply)
+	}
+	if quote && quoteReplies(ctx) {
 		reply.ReplyParameters = &tgbot.ReplyParameters{
 			MessageID:                orig.ID,
 			AllowSendingWithoutReply: true,
@@ -909,6 +2030,7 @@ type replyFunc func(
 	msg string,
 	quote bool,
 	markup *tgbot.InlineKeyboardMarkup,
+	opts ...replyOption,
 )
 
 func replyMessage(
@@ -918,8 +2040,9 @@ func replyMessage(
 	msg string,
 	quote bool,
 	markup *tgbot.InlineKeyboardMarkup,
+	opts ...replyOption,
 ) {
-	reply := generateReplyMessage(orig, msg, quote, markup)
+	reply := generateReplyMessage(ctx, orig, msg, quote, markup, opts...)
 	reply.Method = "sendMessage"
 	w.Header().Add("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(reply)
@@ -932,8 +2055,9 @@ func sendReplyMessage(
 	msg string,
 	quote bool,
 	markup *tgbot.InlineKeyboardMarkup,
+	opts ...replyOption,
 ) {
-	reply := generateReplyMessage(orig, msg, quote, markup)
+	reply := generateReplyMessage(ctx, orig, msg, quote, markup, opts...)
 	if code, err := getBot().PostRequestJSON(ctx, "sendMessage", reply); err != nil {
 		slog.ErrorContext(ctx, "sendReplyMessage failed", "err", err, "code", code)
 	}
@@ -944,6 +2068,13 @@ var (
 	_ replyFunc = sendReplyMessage
 )
 
+// User facing names of the upload targets.
+var targetNames = map[AccountType]string{
+	AccountTypeRM:      "reMarkable",
+	AccountTypeKindle:  "Kindle",
+	AccountTypeDropbox: "Dropbox",
+}
+
 var sizeUnits = []string{"KiB", "MiB"}
 
 func prettySize(size int) string {
@@ -958,3 +2089,27 @@ func prettySize(size int) string {
 	}
 	return s
 }
+
+// prettyAge formats d in the largest whole unit of days, hours, or minutes
+// for the dedup message.
+func prettyAge(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d < time.Minute:
+		return "less than a minute"
+	case d < time.Hour:
+		return pluralUnit(int(d/time.Minute), "minute")
+	case d < day:
+		return pluralUnit(int(d/time.Hour), "hour")
+	default:
+		return pluralUnit(int(d/day), "day")
+	}
+}
+
+// pluralUnit formats n of unit, e.g. "1 minute" or "2 minutes".
+func pluralUnit(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
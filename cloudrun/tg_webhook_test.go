@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"go.yhsif.com/url2epub"
+	"go.yhsif.com/url2epub/tgbot"
 )
 
 func TestPrettySize(t *testing.T) {
@@ -47,3 +56,1275 @@ func TestPrettySize(t *testing.T) {
 		})
 	}
 }
+
+func TestShouldRetryWithArchive(t *testing.T) {
+	for _, c := range []struct {
+		url   string
+		first bool
+		want  bool
+	}{
+		{
+			url:   "https://example.com/foo",
+			first: true,
+			want:  true,
+		},
+		{
+			url:   "https://example.com/foo",
+			first: false,
+			want:  false,
+		},
+		{
+			url:   archiveNewest + "https://example.com/foo",
+			first: true,
+			want:  false,
+		},
+		{
+			url:   archiveNewest + "https://example.com/foo",
+			first: false,
+			want:  false,
+		},
+	} {
+		if got := shouldRetryWithArchive(c.url, c.first); got != c.want {
+			t.Errorf("shouldRetryWithArchive(%q, %v) got %v, want %v", c.url, c.first, got, c.want)
+		}
+	}
+}
+
+func TestGetArchiveRetryTimeout(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{
+			value: "",
+			want:  defaultArchiveRetryTimeout,
+		},
+		{
+			value: "30s",
+			want:  30 * time.Second,
+		},
+		{
+			value: "2m",
+			want:  2 * time.Minute,
+		},
+		{
+			value: "foo",
+			want:  defaultArchiveRetryTimeout,
+		},
+		{
+			value: "-1s",
+			want:  defaultArchiveRetryTimeout,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("ARCHIVE_RETRY_TIMEOUT", c.value)
+			if got := getArchiveRetryTimeout(context.Background()); got != c.want {
+				t.Errorf("getArchiveRetryTimeout() with ARCHIVE_RETRY_TIMEOUT=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetDedupWindow(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{
+			value: "",
+			want:  defaultDedupWindow,
+		},
+		{
+			value: "0",
+			want:  0,
+		},
+		{
+			value: "1h",
+			want:  time.Hour,
+		},
+		{
+			value: "foo",
+			want:  defaultDedupWindow,
+		},
+		{
+			value: "-1s",
+			want:  defaultDedupWindow,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("DEDUP_WINDOW", c.value)
+			if got := getDedupWindow(context.Background()); got != c.want {
+				t.Errorf("getDedupWindow() with DEDUP_WINDOW=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetFeedEntries(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  int
+	}{
+		{
+			value: "",
+			want:  defaultFeedEntries,
+		},
+		{
+			value: "3",
+			want:  3,
+		},
+		{
+			value: "1000",
+			want:  maxFeedEntries,
+		},
+		{
+			value: "0",
+			want:  defaultFeedEntries,
+		},
+		{
+			value: "foo",
+			want:  defaultFeedEntries,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("FEED_ENTRIES", c.value)
+			if got := getFeedEntries(context.Background()); got != c.want {
+				t.Errorf("getFeedEntries() with FEED_ENTRIES=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseHostPolicy(t *testing.T) {
+	for _, c := range []struct {
+		label        string
+		blockPrivate string
+		blockedHosts string
+		want         url2epub.HostPolicy
+	}{
+		{
+			label: "default",
+			want:  url2epub.DefaultHostPolicy,
+		},
+		{
+			label:        "relaxed",
+			blockPrivate: "false",
+			blockedHosts: "-",
+			want:         url2epub.HostPolicy{},
+		},
+		{
+			label:        "custom",
+			blockPrivate: "true",
+			blockedHosts: " example.com, ,foo.test ",
+			want: url2epub.HostPolicy{
+				BlockPrivate: true,
+				DenyHosts:    []string{"example.com", "foo.test"},
+			},
+		},
+		{
+			label:        "invalid",
+			blockPrivate: "foo",
+			want:         url2epub.DefaultHostPolicy,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			got := parseHostPolicy(context.Background(), c.blockPrivate, c.blockedHosts)
+			if got.BlockPrivate != c.want.BlockPrivate || !slices.Equal(got.DenyHosts, c.want.DenyHosts) {
+				t.Errorf("parseHostPolicy(%q, %q) got %+v, want %+v", c.blockPrivate, c.blockedHosts, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseHostRateLimit(t *testing.T) {
+	for _, c := range []struct {
+		label         string
+		perSecond     string
+		burst         string
+		wantPerSecond float64
+		wantBurst     int
+	}{
+		{
+			label:         "default",
+			wantPerSecond: defaultRateLimitPerHost,
+			wantBurst:     defaultRateLimitBurst,
+		},
+		{
+			label:         "custom",
+			perSecond:     "0.5",
+			burst:         "2",
+			wantPerSecond: 0.5,
+			wantBurst:     2,
+		},
+		{
+			label:         "disabled",
+			perSecond:     "0",
+			wantPerSecond: 0,
+			wantBurst:     defaultRateLimitBurst,
+		},
+		{
+			label:         "invalid",
+			perSecond:     "-1",
+			burst:         "foo",
+			wantPerSecond: defaultRateLimitPerHost,
+			wantBurst:     defaultRateLimitBurst,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			perSecond, burst := parseHostRateLimit(context.Background(), c.perSecond, c.burst)
+			if perSecond != c.wantPerSecond || burst != c.wantBurst {
+				t.Errorf(
+					"parseHostRateLimit(%q, %q) got (%v, %v), want (%v, %v)",
+					c.perSecond,
+					c.burst,
+					perSecond,
+					burst,
+					c.wantPerSecond,
+					c.wantBurst,
+				)
+			}
+		})
+	}
+}
+
+func TestParseGenerationLimit(t *testing.T) {
+	for _, c := range []struct {
+		label     string
+		limit     string
+		shed      string
+		wantLimit int
+		wantShed  bool
+	}{
+		{
+			label:     "default",
+			wantLimit: defaultMaxConcurrentEpubs,
+		},
+		{
+			label:     "custom",
+			limit:     "10",
+			shed:      "true",
+			wantLimit: 10,
+			wantShed:  true,
+		},
+		{
+			label:     "disabled",
+			limit:     "0",
+			wantLimit: 0,
+		},
+		{
+			label:     "invalid",
+			limit:     "-1",
+			shed:      "foo",
+			wantLimit: defaultMaxConcurrentEpubs,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			limit, shed := parseGenerationLimit(context.Background(), c.limit, c.shed)
+			if limit != c.wantLimit || shed != c.wantShed {
+				t.Errorf(
+					"parseGenerationLimit(%q, %q) got (%v, %v), want (%v, %v)",
+					c.limit,
+					c.shed,
+					limit,
+					shed,
+					c.wantLimit,
+					c.wantShed,
+				)
+			}
+		})
+	}
+}
+
+func TestGetMaxConcurrentImages(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  int
+	}{
+		{
+			value: "",
+			want:  0,
+		},
+		{
+			value: "2",
+			want:  2,
+		},
+		{
+			value: "0",
+			want:  0,
+		},
+		{
+			value: "foo",
+			want:  0,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("MAX_CONCURRENT_IMAGES", c.value)
+			if got := getMaxConcurrentImages(context.Background()); got != c.want {
+				t.Errorf("getMaxConcurrentImages() with MAX_CONCURRENT_IMAGES=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetDropPendingUpdates(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  bool
+	}{
+		{
+			value: "",
+			want:  false,
+		},
+		{
+			value: "true",
+			want:  true,
+		},
+		{
+			value: "1",
+			want:  true,
+		},
+		{
+			value: "false",
+			want:  false,
+		},
+		{
+			value: "foo",
+			want:  false,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("DROP_PENDING_UPDATES", c.value)
+			if got := getDropPendingUpdates(context.Background()); got != c.want {
+				t.Errorf("getDropPendingUpdates() with DROP_PENDING_UPDATES=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetVerifyRMUploads(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  bool
+	}{
+		{
+			value: "",
+			want:  false,
+		},
+		{
+			value: "true",
+			want:  true,
+		},
+		{
+			value: "1",
+			want:  true,
+		},
+		{
+			value: "false",
+			want:  false,
+		},
+		{
+			value: "foo",
+			want:  false,
+		},
+	} {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv("VERIFY_RM_UPLOADS", c.value)
+			if got := getVerifyRMUploads(context.Background()); got != c.want {
+				t.Errorf("getVerifyRMUploads() with VERIFY_RM_UPLOADS=%q got %v, want %v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseRMDescription(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		value string
+		want  string
+	}{
+		{
+			label: "empty",
+			value: "",
+			want:  defaultRMDescription,
+		},
+		{
+			label: "spaces",
+			value: "  ",
+			want:  defaultRMDescription,
+		},
+		{
+			label: "valid",
+			value: " url2epub-bot ",
+			want:  "url2epub-bot",
+		},
+		{
+			label: "too-long",
+			value: strings.Repeat("a", maxRMDescriptionLength+1),
+			want:  defaultRMDescription,
+		},
+		{
+			label: "control",
+			value: "url2epub\nbot",
+			want:  defaultRMDescription,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := parseRMDescription(context.Background(), c.value); got != c.want {
+				t.Errorf("parseRMDescription(%q) got %q, want %q", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetMaxEpubSize(t *testing.T) {
+	for _, c := range []struct {
+		label  string
+		target AccountType
+		value  string
+		want   int
+	}{
+		{
+			label:  "kindle-default",
+			target: AccountTypeKindle,
+			want:   50 << 20,
+		},
+		{
+			label:  "rm-default",
+			target: AccountTypeRM,
+			want:   100 << 20,
+		},
+		{
+			label:  "dropbox-override",
+			target: AccountTypeDropbox,
+			value:  "1048576",
+			want:   1 << 20,
+		},
+		{
+			label:  "no-limit",
+			target: AccountTypeKindle,
+			value:  "0",
+			want:   0,
+		},
+		{
+			label:  "invalid",
+			target: AccountTypeKindle,
+			value:  "50MB",
+			want:   50 << 20,
+		},
+		{
+			label:  "negative",
+			target: AccountTypeRM,
+			value:  "-1",
+			want:   100 << 20,
+		},
+		{
+			label:  "unknown-target",
+			target: 0,
+			want:   0,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			t.Setenv(maxEpubSizeEnv(c.target), c.value)
+			if got := getMaxEpubSize(context.Background(), c.target); got != c.want {
+				t.Errorf("getMaxEpubSize(%v) with %q got %d, want %d", c.target, c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSourceOf(t *testing.T) {
+	for _, c := range []struct {
+		url  string
+		want string
+	}{
+		{
+			url:  "https://example.com/foo",
+			want: sourceOrigin,
+		},
+		{
+			url:  archiveNewest + "https://example.com/foo",
+			want: sourceArchive,
+		},
+		{
+			url:  "https://archive.ph/AbCdE",
+			want: sourceArchive,
+		},
+		{
+			url:  "https://web.archive.org/web/2024/https://example.com/foo",
+			want: sourceWayback,
+		},
+		{
+			url:  "https://archive.org/details/foo",
+			want: sourceOrigin,
+		},
+		{
+			url:  "://bad",
+			want: sourceOrigin,
+		},
+	} {
+		t.Run(c.url, func(t *testing.T) {
+			if got := sourceOf(c.url); got != c.want {
+				t.Errorf("sourceOf(%q) got %q, want %q", c.url, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	for _, c := range []struct {
+		input   string
+		want    OutputFormat
+		wantErr bool
+	}{
+		{
+			input: "epub",
+			want:  OutputFormatEpub,
+		},
+		{
+			input: " PDF ",
+			want:  OutputFormatPDF,
+		},
+		{
+			input: "Link",
+			want:  OutputFormatLink,
+		},
+		{
+			input:   "mobi",
+			wantErr: true,
+		},
+	} {
+		t.Run(c.input, func(t *testing.T) {
+			got, err := ParseOutputFormat(c.input)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("ParseOutputFormat(%q) got err %v, want err %v", c.input, err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("ParseOutputFormat(%q) got %v, want %v", c.input, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEpubRESTURL(t *testing.T) {
+	for _, c := range []struct {
+		url        string
+		lang       string
+		skipImages bool
+		want       string
+	}{
+		{
+			url:  "https://example.com/foo?a=b",
+			want: globalURLPrefix + epubEndpoint + "?gray=1&passthrough-user-agent=1&url=https%3A%2F%2Fexample.com%2Ffoo%3Fa%3Db",
+		},
+		{
+			url:  "https://example.com/foo",
+			lang: "zh_CN",
+			want: globalURLPrefix + epubEndpoint + "?gray=1&lang=zh_CN&passthrough-user-agent=1&url=https%3A%2F%2Fexample.com%2Ffoo",
+		},
+		{
+			url:        "https://example.com/foo",
+			skipImages: true,
+			want:       globalURLPrefix + epubEndpoint + "?gray=1&images=0&passthrough-user-agent=1&url=https%3A%2F%2Fexample.com%2Ffoo",
+		},
+	} {
+		t.Run(c.url, func(t *testing.T) {
+			if got := epubRESTURL(c.url, c.lang, c.skipImages); got != c.want {
+				t.Errorf("epubRESTURL(%q, %q, %v) got %q, want %q", c.url, c.lang, c.skipImages, got, c.want)
+			}
+		})
+	}
+}
+
+func TestPageChoices(t *testing.T) {
+	const prefix = "page:"
+	choices := func(n int) [][]tgbot.InlineKeyboardButton {
+		dirs := make(map[string]string, n)
+		for i := range n {
+			dirs[fmt.Sprintf("id-%03d", i)] = fmt.Sprintf("dir %03d", i)
+		}
+		return rmDirChoices(dirs)
+	}
+
+	for _, c := range []struct {
+		label string
+		n     int
+		page  int
+		// the first and last dir on the page, and the nav buttons data
+		first, last string
+		nav         []string
+	}{
+		{
+			label: "single-page",
+			n:     dirPageSize,
+			first: "dir 000",
+			last:  fmt.Sprintf("dir %03d", dirPageSize-1),
+		},
+		{
+			label: "first-page",
+			n:     dirPageSize*2 + 1,
+			first: "dir 000",
+			last:  fmt.Sprintf("dir %03d", dirPageSize-1),
+			nav:   []string{prefix + "1"},
+		},
+		{
+			label: "middle-page",
+			n:     dirPageSize*2 + 1,
+			page:  1,
+			first: fmt.Sprintf("dir %03d", dirPageSize),
+			last:  fmt.Sprintf("dir %03d", dirPageSize*2-1),
+			nav:   []string{prefix + "0", prefix + "2"},
+		},
+		{
+			label: "last-page",
+			n:     dirPageSize*2 + 1,
+			page:  2,
+			first: fmt.Sprintf("dir %03d", dirPageSize*2),
+			last:  fmt.Sprintf("dir %03d", dirPageSize*2),
+			nav:   []string{prefix + "1"},
+		},
+		{
+			label: "out-of-range",
+			n:     dirPageSize*2 + 1,
+			page:  10,
+			first: fmt.Sprintf("dir %03d", dirPageSize*2),
+			last:  fmt.Sprintf("dir %03d", dirPageSize*2),
+			nav:   []string{prefix + "1"},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			got := pageChoices(choices(c.n), c.page, prefix)
+			if c.nav != nil {
+				var nav []string
+				for _, button := range got[len(got)-1] {
+					nav = append(nav, button.Data)
+				}
+				if !slices.Equal(nav, c.nav) {
+					t.Errorf("nav got %q, want %q", nav, c.nav)
+				}
+				got = got[:len(got)-1]
+			}
+			if len(got) > dirPageSize {
+				t.Errorf("got %d choices, want <= %d", len(got), dirPageSize)
+			}
+			if first := got[0][0].Text; first != c.first {
+				t.Errorf("first got %q, want %q", first, c.first)
+			}
+			if last := got[len(got)-1][0].Text; last != c.last {
+				t.Errorf("last got %q, want %q", last, c.last)
+			}
+		})
+	}
+}
+
+func TestDropboxDirChoicesPages(t *testing.T) {
+	const n = dirPageSize*2 + 5
+	dirs := make([]DropboxEntry, 0, n)
+	// Add them in reverse order to make sure they are sorted.
+	for i := n - 1; i >= 0; i-- {
+		dirs = append(dirs, DropboxEntry{Display: fmt.Sprintf("/Books/%03d", i)})
+	}
+	choices := dropboxDirChoices(dirs)
+
+	var seen []string
+	for page := 0; ; page++ {
+		got := pageChoices(choices, page, dropboxDirPagePrefix)
+		nav := got[len(got)-1]
+		for _, row := range got[:len(got)-1] {
+			data := row[0].Data
+			if strings.HasPrefix(data, dropboxDirPagePrefix) {
+				t.Errorf("dir data %q collides with page prefix %q", data, dropboxDirPagePrefix)
+			}
+			seen = append(seen, row[0].Text)
+		}
+		var next string
+		for _, button := range nav {
+			if !strings.HasPrefix(button.Data, dropboxDirPagePrefix) {
+				t.Errorf("nav data %q does not have page prefix %q", button.Data, dropboxDirPagePrefix)
+			}
+			if button.Text == dirNextPage {
+				next = button.Data
+			}
+		}
+		if next == "" {
+			break
+		}
+		if want := dropboxDirPagePrefix + strconv.Itoa(page+1); next != want {
+			t.Fatalf("next page data got %q, want %q", next, want)
+		}
+	}
+	if len(seen) != n {
+		t.Fatalf("got %d dirs across all pages, want %d", len(seen), n)
+	}
+	if !slices.IsSorted(seen) {
+		t.Errorf("dirs across pages not sorted: %q", seen)
+	}
+}
+
+func TestFilterChoices(t *testing.T) {
+	choices := dropboxDirChoices([]DropboxEntry{
+		{Display: "/Books"},
+		{Display: "/Books/Fiction"},
+		{Display: "/Articles"},
+		{Display: "/Papers/Books Review"},
+	})
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{
+			query: "",
+			want:  []string{"/Articles", "/Books", "/Books/Fiction", "/Papers/Books Review"},
+		},
+		{
+			query: "book",
+			want:  []string{"/Books", "/Books/Fiction", "/Papers/Books Review"},
+		},
+		{
+			query: "FICTION",
+			want:  []string{"/Books/Fiction"},
+		},
+		{
+			query: "foo",
+		},
+	} {
+		t.Run(c.query, func(t *testing.T) {
+			var got []string
+			for _, row := range filterChoices(choices, c.query) {
+				got = append(got, row[0].Text)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("filterChoices(%q) got %q, want %q", c.query, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDirQueryFromCallback(t *testing.T) {
+	for _, c := range []struct {
+		label    string
+		callback *tgbot.CallbackQuery
+		want     string
+	}{
+		{
+			label:    "no-message",
+			callback: &tgbot.CallbackQuery{},
+		},
+		{
+			label: "no-reply-to",
+			callback: &tgbot.CallbackQuery{
+				Message: &tgbot.Message{},
+			},
+		},
+		{
+			label: "no-query",
+			callback: &tgbot.CallbackQuery{
+				Message: &tgbot.Message{
+					ReplyTo: &tgbot.Message{Text: dirCommand},
+				},
+			},
+		},
+		{
+			label: "query",
+			callback: &tgbot.CallbackQuery{
+				Message: &tgbot.Message{
+					ReplyTo: &tgbot.Message{Text: dirCommand + "  books "},
+				},
+			},
+			want: "books",
+		},
+		{
+			label: "other-command",
+			callback: &tgbot.CallbackQuery{
+				Message: &tgbot.Message{
+					ReplyTo: &tgbot.Message{Text: fontCommand + " books"},
+				},
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := dirQueryFromCallback(c.callback); got != c.want {
+				t.Errorf("dirQueryFromCallback got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDropboxDirCallbackToken(t *testing.T) {
+	dirs := []DropboxEntry{
+		{Display: "/Books"},
+		{Display: "/" + strings.Repeat("A very long folder name/", 10) + "Books"},
+		{Display: "/中文/書籍"},
+	}
+	for _, row := range dropboxDirChoices(dirs) {
+		data := row[0].Data
+		if len(data) > 64 {
+			t.Errorf("callback data %q for %q is %d bytes, want <= 64", data, row[0].Text, len(data))
+		}
+		token := strings.TrimPrefix(data, dropboxDirPrefix)
+		if strings.Contains(token, ":") || strings.HasPrefix(token, "/") {
+			t.Errorf("token %q for %q is ambiguous", token, row[0].Text)
+		}
+		got, ok := findDropboxDir(dirs, token)
+		if !ok || got != row[0].Text {
+			t.Errorf("findDropboxDir(%q) got %q, %v, want %q", token, got, ok, row[0].Text)
+		}
+	}
+	if got, ok := findDropboxDir(dirs, callbackToken("/Other")); ok {
+		t.Errorf("findDropboxDir for unknown dir got %q", got)
+	}
+}
+
+func TestGenerateReplyMessageMarkup(t *testing.T) {
+	orig := &tgbot.Message{
+		ID: 1,
+		Chat: tgbot.Chat{
+			ID: 123,
+		},
+	}
+	ctx := context.Background()
+
+	markup := epubURLMarkup("https://example.com/epub?url=foo")
+	if err := markup.Validate(); err != nil {
+		t.Errorf("epubURLMarkup is invalid: %v", err)
+	}
+	if reply := generateReplyMessage(ctx, orig, "foo", true, markup); reply.ReplyMarkup != markup {
+		t.Errorf("Valid markup got %#v, want %#v", reply.ReplyMarkup, markup)
+	}
+
+	invalid := &tgbot.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbot.InlineKeyboardButton{
+			{{Text: "foo", Data: "foo", URL: "https://example.com/"}},
+		},
+	}
+	reply := generateReplyMessage(ctx, orig, "foo", true, invalid)
+	if reply.ReplyMarkup != nil {
+		t.Errorf("Invalid markup should be dropped, got %#v", reply.ReplyMarkup)
+	}
+	if reply.Text != "foo" {
+		t.Errorf("Text got %q, want %q", reply.Text, "foo")
+	}
+}
+
+func TestQuoteReplies(t *testing.T) {
+	orig := &tgbot.Message{
+		ID: 1,
+		Chat: tgbot.Chat{
+			ID: 123,
+		},
+	}
+	for _, c := range []struct {
+		label string
+		chat  *EntityChatToken
+		quote bool
+		want  bool
+	}{
+		{
+			label: "not-started",
+			quote: true,
+			want:  true,
+		},
+		{
+			label: "default",
+			chat:  &EntityChatToken{},
+			quote: true,
+			want:  true,
+		},
+		{
+			label: "no-quote",
+			chat:  &EntityChatToken{NoQuote: true},
+			quote: true,
+			want:  false,
+		},
+		{
+			label: "not-quoted-reply",
+			chat:  &EntityChatToken{},
+			quote: false,
+			want:  false,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			ctx := quoteRepliesContext(context.Background(), c.chat.GetQuoteReplies())
+			reply := generateReplyMessage(ctx, orig, "foo", c.quote, nil)
+			if got := reply.ReplyParameters != nil; got != c.want {
+				t.Errorf("quoted got %v, want %v", got, c.want)
+			}
+			if c.want && reply.ReplyParameters.MessageID != orig.ID {
+				t.Errorf("quoted message id got %d, want %d", reply.ReplyParameters.MessageID, orig.ID)
+			}
+			if got, want := quotedMessageID(ctx, orig.ID) != nil, c.chat.GetQuoteReplies(); got != want {
+				t.Errorf("quotedMessageID got %v, want %v", got, want)
+			}
+		})
+	}
+
+	if !quoteReplies(context.Background()) {
+		t.Error("quoteReplies without preference should default to true")
+	}
+}
+
+func TestSuccessMessage(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		name  string
+		url   string
+		want  string
+	}{
+		{
+			label: "plain",
+			name:  "foo.epub",
+			url:   "https://example.com/foo",
+			want:  `✅ Uploaded <b>foo.epub</b> (1.0 KiB) to your reMarkable account from URL: <a href="https://example.com/foo">https://example.com/foo</a>`,
+		},
+		{
+			label: "escaped",
+			name:  `<Tom & "Jerry">.epub`,
+			url:   "https://example.com/?a=1&b=2",
+			want:  `✅ Uploaded <b>&lt;Tom &amp; &quot;Jerry&quot;&gt;.epub</b> (1.0 KiB) to your reMarkable account from URL: <a href="https://example.com/?a=1&amp;b=2">https://example.com/?a=1&amp;b=2</a>`,
+		},
+		{
+			label: "pdf",
+			name:  "foo.pdf",
+			url:   "https://example.com/foo",
+			want:  `✅ Uploaded <b>foo.pdf</b> (1.0 KiB) to your reMarkable account from URL: <a href="https://example.com/foo">https://example.com/foo</a>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := successMessage(successUploadRM, c.name, 1024, c.url); got != c.want {
+				t.Errorf("successMessage got %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	orig := &tgbot.Message{
+		ID: 1,
+		Chat: tgbot.Chat{
+			ID: 123,
+		},
+	}
+	ctx := context.Background()
+	if got := generateReplyMessage(ctx, orig, "foo", false, nil).ParseMode; got != "" {
+		t.Errorf("ParseMode without option got %q, want empty", got)
+	}
+	if got := generateReplyMessage(ctx, orig, "foo", false, nil, withHTML).ParseMode; got != tgbot.ParseModeHTML {
+		t.Errorf("ParseMode withHTML got %q, want %q", got, tgbot.ParseModeHTML)
+	}
+	if got := generateReplyMessage(ctx, orig, "foo", false, nil).LinkPreviewOptions; got != nil {
+		t.Errorf("LinkPreviewOptions without option got %#v, want nil", got)
+	}
+	if got := generateReplyMessage(ctx, orig, "foo", false, nil, withHTML, withoutLinkPreview).LinkPreviewOptions; got == nil || !got.IsDisabled {
+		t.Errorf("LinkPreviewOptions withoutLinkPreview got %#v, want disabled", got)
+	}
+}
+
+func TestLinkAccount(t *testing.T) {
+	for _, c := range []struct {
+		label      string
+		typ        AccountType
+		credential string
+		check      func(*EntityChatToken) string
+	}{
+		{
+			label:      "rm",
+			typ:        AccountTypeRM,
+			credential: "new-token",
+			check: func(e *EntityChatToken) string {
+				return e.RMToken
+			},
+		},
+		{
+			label:      "kindle",
+			typ:        AccountTypeKindle,
+			credential: "new@kindle.com",
+			check: func(e *EntityChatToken) string {
+				return e.KindleEmail
+			},
+		},
+		{
+			label:      "dropbox",
+			typ:        AccountTypeDropbox,
+			credential: "new-token",
+			check: func(e *EntityChatToken) string {
+				return e.DropboxToken
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			chat := &EntityChatToken{
+				Chat:          123,
+				Type:          AccountTypeRM,
+				FitImage:      200,
+				Format:        OutputFormatPDF,
+				SkipImages:    true,
+				NoQuote:       true,
+				RMToken:       "old-token",
+				RMParentID:    dirIDPrefix + "parent",
+				RMFont:        fontPrefix + "Noto Serif",
+				DropboxFolder: "/books",
+			}
+			chat.linkAccount(c.typ, c.credential)
+			if chat.Type != c.typ {
+				t.Errorf("Type got %v, want %v", chat.Type, c.typ)
+			}
+			want := []AccountType{AccountTypeRM}
+			if c.typ != AccountTypeRM {
+				want = append(want, c.typ)
+			}
+			if got := chat.GetTargets(); !slices.Equal(got, want) {
+				t.Errorf("GetTargets got %v, want %v", got, want)
+			}
+			if got := c.check(chat); got != c.credential {
+				t.Errorf("credential got %q, want %q", got, c.credential)
+			}
+			if got, want := chat.GetParentID(), "parent"; got != want {
+				t.Errorf("GetParentID got %q, want %q", got, want)
+			}
+			if got, want := chat.GetFont(), "Noto Serif"; got != want {
+				t.Errorf("GetFont got %q, want %q", got, want)
+			}
+			if got, want := chat.FitImage, 200; got != want {
+				t.Errorf("FitImage got %d, want %d", got, want)
+			}
+			if got, want := chat.GetFormat(), OutputFormatPDF; got != want {
+				t.Errorf("GetFormat got %v, want %v", got, want)
+			}
+			if !chat.SkipImages || !chat.NoQuote {
+				t.Errorf("SkipImages/NoQuote got %v/%v, want true/true", chat.SkipImages, chat.NoQuote)
+			}
+			if got, want := chat.DropboxFolder, "/books"; got != want {
+				t.Errorf("DropboxFolder got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestUnlinkAccount(t *testing.T) {
+	chat := &EntityChatToken{
+		Chat:    123,
+		Type:    AccountTypeRM,
+		RMToken: "rm-token",
+	}
+	if got, want := chat.GetTargets(), []AccountType{AccountTypeRM}; !slices.Equal(got, want) {
+		t.Errorf("GetTargets before migration got %v, want %v", got, want)
+	}
+	chat.linkAccount(AccountTypeKindle, "foo@kindle.com")
+	chat.linkAccount(AccountTypeDropbox, "dropbox-token")
+	if got, want := chat.GetTargets(), []AccountType{AccountTypeRM, AccountTypeKindle, AccountTypeDropbox}; !slices.Equal(got, want) {
+		t.Errorf("GetTargets got %v, want %v", got, want)
+	}
+	// Re-linking doesn't duplicate the target.
+	chat.linkAccount(AccountTypeKindle, "bar@kindle.com")
+	if got, want := chat.GetTargets(), []AccountType{AccountTypeRM, AccountTypeKindle, AccountTypeDropbox}; !slices.Equal(got, want) {
+		t.Errorf("GetTargets after re-linking got %v, want %v", got, want)
+	}
+	if got, want := chat.dirTarget(), AccountTypeDropbox; got != want {
+		t.Errorf("dirTarget after re-linking got %v, want %v", got, want)
+	}
+
+	if !chat.unlinkAccount(AccountTypeDropbox) {
+		t.Error("unlinkAccount(dropbox) got false, want true")
+	}
+	if chat.unlinkAccount(AccountTypeDropbox) {
+		t.Error("unlinkAccount(dropbox) again got true, want false")
+	}
+	if got, want := chat.GetTargets(), []AccountType{AccountTypeRM, AccountTypeKindle}; !slices.Equal(got, want) {
+		t.Errorf("GetTargets after unlinking got %v, want %v", got, want)
+	}
+	if chat.DropboxToken != "" {
+		t.Errorf("DropboxToken got %q, want empty", chat.DropboxToken)
+	}
+	if got, want := chat.Type, AccountTypeKindle; got != want {
+		t.Errorf("Type got %v, want %v", got, want)
+	}
+	if got, want := chat.dirTarget(), AccountTypeRM; got != want {
+		t.Errorf("dirTarget got %v, want %v", got, want)
+	}
+
+	chat.unlinkAccount(AccountTypeRM)
+	chat.unlinkAccount(AccountTypeKindle)
+	if len(chat.Targets) != 0 {
+		t.Errorf("Targets got %v, want empty", chat.Targets)
+	}
+}
+
+func TestFirstURLInMessage(t *testing.T) {
+	for _, c := range []struct {
+		label   string
+		payload string
+		want    string
+	}{
+		{
+			label: "text",
+			payload: `{
+  "message_id": 1,
+  "chat": {"id": 123},
+  "text": "see https://example.com/a",
+  "entities": [{"type": "url", "offset": 4, "length": 21}]
+}`,
+			want: "https://example.com/a",
+		},
+		{
+			label: "forwarded-text-link",
+			payload: `{
+  "message_id": 1,
+  "chat": {"id": 123},
+  "forward_origin": {
+    "type": "channel",
+    "date": 1700000000,
+    "chat": {"id": -100, "type": "channel", "username": "news"},
+    "message_id": 42
+  },
+  "text": "Some article",
+  "entities": [{"type": "text_link", "offset": 5, "length": 7, "url": "https://example.com/b"}]
+}`,
+			want: "https://example.com/b",
+		},
+		{
+			label: "forwarded-caption",
+			payload: `{
+  "message_id": 1,
+  "chat": {"id": 123},
+  "forward_origin": {
+    "type": "user",
+    "date": 1700000000,
+    "sender_user": {"id": 456, "first_name": "Foo"}
+  },
+  "caption": "📰 https://example.com/c",
+  "caption_entities": [{"type": "url", "offset": 3, "length": 21}]
+}`,
+			want: "https://example.com/c",
+		},
+		{
+			label: "forwarded-link-preview",
+			payload: `{
+  "message_id": 1,
+  "chat": {"id": 123},
+  "forward_origin": {
+    "type": "hidden_user",
+    "date": 1700000000,
+    "sender_user_name": "Bar"
+  },
+  "text": "Read this",
+  "link_preview_options": {"url": "https://example.com/d"}
+}`,
+			want: "https://example.com/d",
+		},
+		{
+			label: "none",
+			payload: `{
+  "message_id": 1,
+  "chat": {"id": 123},
+  "text": "hello"
+}`,
+			want: "",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			var message tgbot.Message
+			if err := json.Unmarshal([]byte(c.payload), &message); err != nil {
+				t.Fatalf("json.Unmarshal failed: %v", err)
+			}
+			if got := firstURLInMessage(context.Background(), &message); got != c.want {
+				t.Errorf("firstURLInMessage got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTitleHintForURL(t *testing.T) {
+	message := &tgbot.Message{
+		Text: "📰 Great article on X, lang:en",
+		Entities: []tgbot.MessageEntity{
+			{
+				Type:   "text_link",
+				Offset: 3,
+				Length: 18,
+				URL:    "https://example.com/x",
+			},
+		},
+	}
+	for _, c := range []struct {
+		label string
+		url   string
+		want  string
+	}{
+		{
+			label: "url",
+			url:   "https://example.com/x",
+			want:  "Great article on X",
+		},
+		{
+			label: "archive",
+			url:   archiveNewest + "https://example.com/x",
+			want:  "Great article on X",
+		},
+		{
+			label: "other-url",
+			url:   "https://example.com/y",
+			want:  "",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := titleHintForURL(context.Background(), message, c.url); got != c.want {
+				t.Errorf("titleHintForURL(%q) got %q, want %q", c.url, got, c.want)
+			}
+		})
+	}
+
+	t.Run("bare-url", func(t *testing.T) {
+		message := &tgbot.Message{
+			Text: "https://example.com/x",
+			Entities: []tgbot.MessageEntity{
+				{
+					Type:   "url",
+					Offset: 0,
+					Length: 21,
+				},
+			},
+		}
+		if got := titleHintForURL(context.Background(), message, "https://example.com/x"); got != "" {
+			t.Errorf("titleHintForURL got %q, want empty", got)
+		}
+	})
+}
+
+func TestPrettyAge(t *testing.T) {
+	for _, c := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{
+			d:    30 * time.Second,
+			want: "less than a minute",
+		},
+		{
+			d:    time.Minute,
+			want: "1 minute",
+		},
+		{
+			d:    59 * time.Minute,
+			want: "59 minutes",
+		},
+		{
+			d:    time.Hour,
+			want: "1 hour",
+		},
+		{
+			d:    23*time.Hour + 59*time.Minute,
+			want: "23 hours",
+		},
+		{
+			d:    24 * time.Hour,
+			want: "1 day",
+		},
+		{
+			d:    72 * time.Hour,
+			want: "3 days",
+		},
+	} {
+		t.Run(c.d.String(), func(t *testing.T) {
+			if got := prettyAge(c.d); got != c.want {
+				t.Errorf("prettyAge(%v) got %q, want %q", c.d, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package url2epub
+
+import (
+	"strings"
+
+	"go.yhsif.com/immutable"
+	"golang.org/x/net/html"
+)
+
+// DefaultConsentSelectors are the selectors of the containers injected by
+// common Consent Management Platforms (the "accept cookies" banners and
+// overlays), used by Readable when ReadableArgs.ConsentSelectors is nil.
+//
+// Each selector is either "#id" to match the id of the element, or ".class" to
+// match one of the classes of the element.
+var DefaultConsentSelectors = []string{
+	// OneTrust
+	"#onetrust-consent-sdk",
+	"#onetrust-banner-sdk",
+	"#onetrust-pc-sdk",
+	// Quantcast Choice
+	"#qc-cmp2-container",
+	".qc-cmp2-container",
+	// Cookiebot
+	"#CybotCookiebotDialog",
+	// TrustArc
+	"#truste-consent-track",
+	"#consent_blackbar",
+	// Didomi
+	"#didomi-host",
+	// Usercentrics
+	"#usercentrics-root",
+	// Osano
+	".osano-cm-window",
+	// CookieYes
+	".cky-consent-container",
+	// Complianz
+	"#cmplz-cookiebanner-container",
+	// iubenda
+	"#iubenda-cs-banner",
+	// Cookie Notice
+	"#cookie-notice",
+	// Termly
+	"#termly-code-snippet-support",
+}
+
+// consentMatcher matches the elements by the parsed consent selectors.
+type consentMatcher struct {
+	ids     immutable.Set[string]
+	classes immutable.Set[string]
+}
+
+// newConsentMatcher parses selectors into a consentMatcher.
+//
+// Selectors not starting with "#" or "." are ignored.
+func newConsentMatcher(selectors []string) consentMatcher {
+	var ids, classes []string
+	for _, s := range selectors {
+		switch {
+		case strings.HasPrefix(s, "#") && len(s) > 1:
+			ids = append(ids, s[1:])
+		case strings.HasPrefix(s, ".") && len(s) > 1:
+			classes = append(classes, s[1:])
+		}
+	}
+	return consentMatcher{
+		ids:     immutable.SetLiteral(ids...),
+		classes: immutable.SetLiteral(classes...),
+	}
+}
+
+// matches returns whether node matches any of the selectors.
+func (m consentMatcher) matches(node *html.Node) bool {
+	for _, attr := range node.Attr {
+		switch attr.Key {
+		case "id":
+			if m.ids.Contains(strings.TrimSpace(attr.Val)) {
+				return true
+			}
+		case "class":
+			for _, class := range strings.Fields(attr.Val) {
+				if m.classes.Contains(class) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
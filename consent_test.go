@@ -0,0 +1,51 @@
+package url2epub
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReadableConsentSelectors(t *testing.T) {
+	const src = `<html><body>
+<div id="onetrust-consent-sdk"><div class="onetrust-pc-dark-filter"></div><div id="onetrust-banner-sdk" class="otFlat"><p id="onetrust-policy-text">We and our partners use cookies to store and access information on your device.</p><button id="onetrust-accept-btn-handler">Accept All Cookies</button></div></div>
+<p>This is the article.</p>
+<div class="my-consent banner"><p>Custom consent.</p></div>
+</body></html>`
+	for _, c := range []struct {
+		label string
+		args  ReadableArgs
+		want  string
+	}{
+		{
+			label: "default",
+			want:  `<body><p>This is the article.</p><div><p>Custom consent.</p></div></body>`,
+		},
+		{
+			label: "disabled",
+			args: ReadableArgs{
+				ConsentSelectors: []string{},
+			},
+			want: `<body><div><div><p>We and our partners use cookies to store and access information on your device.</p></div></div><p>This is the article.</p><div><p>Custom consent.</p></div></body>`,
+		},
+		{
+			label: "extended",
+			args: ReadableArgs{
+				ConsentSelectors: append(slices.Clone(DefaultConsentSelectors), ".my-consent"),
+			},
+			want: `<body><p>This is the article.</p></body>`,
+		},
+		{
+			label: "invalid-ignored",
+			args: ReadableArgs{
+				ConsentSelectors: []string{"onetrust-consent-sdk", "#", ".my-consent"},
+			},
+			want: `<body><div><div><p>We and our partners use cookies to store and access information on your device.</p></div></div><p>This is the article.</p></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := readableBody(t, src, c.args); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
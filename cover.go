@@ -0,0 +1,76 @@
+package url2epub
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// FindCoverImage returns the local filename of the first image in node that's
+// at least minSize x minSize, to be used as EpubArgs.CoverImage.
+//
+// node and images should be the ones returned by Readable. It returns empty
+// string if no such image found.
+//
+// In order to read the dimensions of the images without consuming them, the
+// images not backed by *bytes.Buffer will be replaced in the map by
+// *bytes.Reader of the same content.
+//
+// Note that you need to blank import image type packages in order to be able to
+// decode the dimensions of the images, see grayscale.FromReader for example.
+func FindCoverImage(node *html.Node, images map[string]io.Reader, minSize int) string {
+	var found string
+	checked := make(map[string]bool)
+	var walk func(n *html.Node) bool
+	walk = func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Img {
+			for _, attr := range n.Attr {
+				if attr.Key != imgSrc || checked[attr.Val] {
+					continue
+				}
+				checked[attr.Val] = true
+				if imageFits(images, attr.Val, minSize) {
+					found = attr.Val
+					return false
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if !walk(c) {
+				return false
+			}
+		}
+		return true
+	}
+	if node != nil {
+		walk(node)
+	}
+	return found
+}
+
+// imageFits returns true if the image is at least minSize x minSize.
+func imageFits(images map[string]io.Reader, filename string, minSize int) bool {
+	reader, ok := images[filename]
+	if !ok || reader == nil {
+		return false
+	}
+	var data []byte
+	if buf, ok := reader.(*bytes.Buffer); ok {
+		data = buf.Bytes()
+	} else {
+		var err error
+		data, err = io.ReadAll(reader)
+		if err != nil {
+			return false
+		}
+		images[filename] = bytes.NewReader(data)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return config.Width >= minSize && config.Height >= minSize
+}
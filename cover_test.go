@@ -0,0 +1,181 @@
+package url2epub
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func testPNGImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFindCoverImage(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(`<html><body>
+<p><img src="images/001.png"><img src="images/002.png"></p>
+<p><img src="images/001.png"><img src="images/003.png"><img src="images/004.png"></p>
+</body></html>`))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	big := testPNGImage(t, 400, 300)
+	images := map[string]io.Reader{
+		// icon
+		"images/001.png": bytes.NewBuffer(testPNGImage(t, 16, 16)),
+		// banner
+		"images/002.png": bytes.NewBuffer(testPNGImage(t, 1000, 20)),
+		// not an image
+		"images/003.png": strings.NewReader("not an image"),
+		"images/004.png": bytes.NewReader(big),
+	}
+	const want = "images/004.png"
+	if got := FindCoverImage(node, images, 100); got != want {
+		t.Errorf("FindCoverImage got %q, want %q", got, want)
+	}
+	if got := FindCoverImage(node, images, 500); got != "" {
+		t.Errorf("FindCoverImage with larger min size got %q, want none", got)
+	}
+
+	// Make sure the images are still intact.
+	data, err := io.ReadAll(images[want])
+	if err != nil {
+		t.Fatalf("Failed to read %q: %v", want, err)
+	}
+	if !bytes.Equal(data, big) {
+		t.Errorf("Image %q changed after FindCoverImage", want)
+	}
+}
+
+func TestEpubCoverImage(t *testing.T) {
+	const cover = "images/001.png"
+	buf := testEpub(t, EpubArgs{
+		Title: "Hello",
+		Images: map[string]io.Reader{
+			cover: bytes.NewBuffer(testPNGImage(t, 400, 300)),
+		},
+		CoverImage: cover,
+	})
+	if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+		t.Errorf("ValidateEpub got %v", errs)
+	}
+	opf := testEpubOpf(t, buf)
+	for _, want := range []string{
+		`<item id="images_001_png" href="images/001.png" media-type="image/png" properties="cover-image"/>`,
+		`<meta name="cover" content="images_001_png"/>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("opf does not contain %q:\n%s", want, opf)
+		}
+	}
+}
+
+func TestEpubCover(t *testing.T) {
+	for _, c := range []struct {
+		label       string
+		contentType string
+		want        []string
+	}{
+		{
+			label: "detected",
+			want: []string{
+				`<item id="cover_png" href="cover.png" media-type="image/png" properties="cover-image"/>`,
+				`<meta name="cover" content="cover_png"/>`,
+			},
+		},
+		{
+			label:       "content-type",
+			contentType: "image/jpeg",
+			want: []string{
+				`<item id="cover_jpg" href="cover.jpg" media-type="image/jpeg" properties="cover-image"/>`,
+				`<meta name="cover" content="cover_jpg"/>`,
+			},
+		},
+		{
+			label:       "unsupported-content-type",
+			contentType: "application/octet-stream",
+			want: []string{
+				`<item id="cover_png" href="cover.png" media-type="image/png" properties="cover-image"/>`,
+				`<meta name="cover" content="cover_png"/>`,
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			buf := testEpub(t, EpubArgs{
+				Title: "Hello",
+				Images: map[string]io.Reader{
+					"images/001.png": bytes.NewBuffer(testPNGImage(t, 10, 10)),
+				},
+				Cover:            bytes.NewReader(testPNGImage(t, 400, 300)),
+				CoverContentType: c.contentType,
+			})
+			if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+				t.Errorf("ValidateEpub got %v", errs)
+			}
+			opf := testEpubOpf(t, buf)
+			for _, want := range c.want {
+				if !strings.Contains(opf, want) {
+					t.Errorf("opf does not contain %q:\n%s", want, opf)
+				}
+			}
+			if want := `<item id="images_001_png" href="images/001.png" media-type="image/png"/>`; !strings.Contains(opf, want) {
+				t.Errorf("opf does not contain %q:\n%s", want, opf)
+			}
+		})
+	}
+}
+
+func TestEpubCoverUnsupported(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(testArticleHTML))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	if _, err := Epub(EpubArgs{
+		Dest:  io.Discard,
+		Node:  node,
+		Cover: strings.NewReader("not an image"),
+	}); err == nil {
+		t.Error("Epub with unsupported cover expected error, got nil")
+	}
+}
+
+func TestEpubCoverWithCoverImage(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(testArticleHTML))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	if _, err := Epub(EpubArgs{
+		Dest: io.Discard,
+		Node: node,
+		Images: map[string]io.Reader{
+			"images/001.png": bytes.NewBuffer(testPNGImage(t, 400, 300)),
+		},
+		CoverImage: "images/001.png",
+		Cover:      bytes.NewReader(testPNGImage(t, 400, 300)),
+	}); err == nil {
+		t.Error("Epub with both Cover and CoverImage expected error, got nil")
+	}
+}
+
+func TestEpubCoverImageNotFound(t *testing.T) {
+	node, err := html.Parse(strings.NewReader(testArticleHTML))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	if _, err := Epub(EpubArgs{
+		Dest:       io.Discard,
+		Node:       node,
+		CoverImage: "images/001.png",
+	}); err == nil {
+		t.Error("Epub with missing cover image expected error, got nil")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+// loadCookieJar loads a Netscape format cookies.txt file into a cookie jar.
+//
+// The format is one cookie per line, with 7 tab separated fields:
+//
+//	domain  include-subdomains  path  secure  expiry  name  value
+//
+// Expired cookies are skipped. The returned jar takes care of matching the
+// domain and path of the cookies for each request.
+func loadCookieJar(filename string, now time.Time) (http.CookieJar, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	jar, err := cookiejar.New(&cookiejar.Options{
+		PublicSuffixList: publicsuffix.List,
+	})
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		var httpOnly bool
+		if strings.HasPrefix(line, httpOnlyPrefix) {
+			httpOnly = true
+			line = strings.TrimPrefix(line, httpOnlyPrefix)
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: expected 7 tab separated fields, got %d", filename, lineNum, len(fields))
+		}
+		domain := fields[0]
+		includeSubdomains := strings.EqualFold(fields[1], "TRUE")
+		secure := strings.EqualFold(fields[3], "TRUE")
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid expiry %q: %w", filename, lineNum, fields[4], err)
+		}
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		if expiry > 0 {
+			// 0 means session cookie.
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(now) {
+				continue
+			}
+		}
+		if includeSubdomains {
+			cookie.Domain = domain
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&neturl.URL{
+			Scheme: scheme,
+			Host:   strings.TrimPrefix(domain, "."),
+			Path:   cookie.Path,
+		}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"go.yhsif.com/url2epub"
+)
+
+// applyOverrides applies comma separated "flag=value" overrides to args.
+//
+// Supported flags are the ones affecting ReadableArgs: gray, fit,
+// min-article-nodes, min-article-text, og-image-fallback, and skip-images.
+func applyOverrides(args url2epub.ReadableArgs, overrides string) (url2epub.ReadableArgs, error) {
+	for _, item := range strings.Split(overrides, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return args, fmt.Errorf("invalid override %q, expected flag=value", item)
+		}
+		var err error
+		switch strings.TrimLeft(key, "-") {
+		default:
+			return args, fmt.Errorf("unsupported override flag %q", key)
+		case "gray":
+			args.Grayscale, err = strconv.ParseBool(value)
+		case "fit":
+			args.FitImage, err = strconv.Atoi(value)
+		case "min-article-nodes":
+			args.MinArticleNodes, err = strconv.Atoi(value)
+		case "min-article-text":
+			args.MinArticleText, err = strconv.Atoi(value)
+		case "og-image-fallback":
+			args.OGImageFallback, err = strconv.ParseBool(value)
+		case "skip-images":
+			args.SkipImages, err = strconv.ParseBool(value)
+		}
+		if err != nil {
+			return args, fmt.Errorf("invalid value for override %q: %w", item, err)
+		}
+	}
+	return args, nil
+}
+
+// serialize serializes the readable tree into comparable lines, using the same
+// format as recursivePrint.
+func serialize(node *html.Node) []string {
+	var buf bytes.Buffer
+	recursivePrint(&buf, url2epub.FromNode(node), "")
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// printDiff prints a structural diff between readable trees a and b to w.
+//
+// Lines are compared as multisets, so moved nodes are not reported, but
+// added/removed ones are.
+func printDiff(w io.Writer, a, b *html.Node, full bool) {
+	linesA := serialize(a)
+	linesB := serialize(b)
+	counts := make(map[string]int)
+	for _, line := range linesA {
+		counts[line]++
+	}
+	for _, line := range linesB {
+		counts[line]--
+	}
+	var removed, added []string
+	for line, n := range counts {
+		for ; n > 0; n-- {
+			removed = append(removed, line)
+		}
+		for ; n < 0; n++ {
+			added = append(added, line)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+
+	var tallyA, tallyB nodeTally
+	tallyA.walk(url2epub.FromNode(a))
+	tallyB.walk(url2epub.FromNode(b))
+	fmt.Fprintf(w, "elements: %d -> %d\n", tallyA.elements, tallyB.elements)
+	fmt.Fprintf(w, "texts:    %d -> %d\n", tallyA.texts, tallyB.texts)
+	fmt.Fprintf(w, "text len: %d -> %d (%+d)\n", tallyA.textLen, tallyB.textLen, tallyB.textLen-tallyA.textLen)
+	fmt.Fprintf(w, "lines:    +%d -%d\n", len(added), len(removed))
+	if !full {
+		return
+	}
+	for _, line := range removed {
+		fmt.Fprintf(w, "- %s\n", line)
+	}
+	for _, line := range added {
+		fmt.Fprintf(w, "+ %s\n", line)
+	}
+}
@@ -12,7 +12,10 @@ require (
 
 require (
 	github.com/google/uuid v1.6.0 // indirect
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c // indirect
+	github.com/srwiley/rasterx v0.0.0-20210519020934-456a8d69b780 // indirect
 	go.yhsif.com/immutable v1.0.0-rc1 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
 
 replace go.yhsif.com/url2epub => ../
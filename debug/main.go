@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -52,6 +57,46 @@ var (
 		0,
 		"Minimal nodes to use article node",
 	)
+	minArticleText = flag.Int(
+		"min-article-text",
+		0,
+		"Minimal non-whitespace characters of text to use article node",
+	)
+	ogImageFallback = flag.Bool(
+		"og-image-fallback",
+		false,
+		"Use og:image when no images were extracted from the article",
+	)
+	skipImages = flag.Bool(
+		"skip-images",
+		false,
+		"Skip all images",
+	)
+	cookies = flag.String(
+		"cookies",
+		"",
+		"Path to a Netscape format cookies.txt file, the matching cookies will be sent with the page and image requests. Only use it for content you are authorized to access.",
+	)
+	out = flag.String(
+		"out",
+		"",
+		"Write the output to this file instead of stdout.",
+	)
+	diff = flag.String(
+		"diff",
+		"",
+		`If non-empty, run the extraction again with comma separated overrides (e.g. "min-article-nodes=50,gray=true"), and print a diff of the two readable trees.`,
+	)
+	diffFull = flag.Bool(
+		"diff-full",
+		false,
+		"Print the full diff instead of only the summary, only used with -diff.",
+	)
+	saveImages = flag.String(
+		"save-images",
+		"",
+		"If non-empty, save all the images from the readable html into this directory. Can be used with any output mode.",
+	)
 )
 
 func main() {
@@ -59,9 +104,10 @@ func main() {
 		readableOutput flagutils.OneOf
 		htmlOutput     flagutils.OneOf
 		epubOutput     flagutils.OneOf
+		countOutput    flagutils.OneOf
 	)
 
-	flagutils.GroupOneOf(&readableOutput, &htmlOutput, &epubOutput)
+	flagutils.GroupOneOf(&readableOutput, &htmlOutput, &epubOutput, &countOutput)
 	flag.Var(
 		&readableOutput,
 		"readable",
@@ -77,6 +123,11 @@ func main() {
 		"epub",
 		"Output epub.",
 	)
+	flag.Var(
+		&countOutput,
+		"count-only",
+		"Only print a summary of the extraction (metadata, node/image counts, text length).",
+	)
 	flag.Parse()
 
 	slog.SetDefault(slog.New(ctxslog.ContextHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -84,11 +135,37 @@ func main() {
 		Level:     slog.LevelDebug,
 	}))))
 
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			slog.Error("Failed to create output file", "err", err, "file", *out)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				slog.Error("Failed to close output file", "err", err, "file", *out)
+			}
+		}()
+		w = f
+	}
+
+	var jar http.CookieJar
+	if *cookies != "" {
+		var err error
+		jar, err = loadCookieJar(*cookies, time.Now())
+		if err != nil {
+			slog.Error("Failed to load cookies", "err", err, "file", *cookies)
+			os.Exit(1)
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 	root, baseURL, err := url2epub.GetHTML(ctx, url2epub.GetHTMLArgs{
 		URL:       *url,
 		UserAgent: *ua,
+		CookieJar: jar,
 	})
 	if err != nil {
 		slog.Error("url2epub.GetHTML failed", "err", err)
@@ -100,13 +177,14 @@ func main() {
 		"amp", root.IsAMP(),
 		"ampURL", root.GetAMPurl(),
 	)
-	if readableOutput.Bool || htmlOutput.Bool || epubOutput.Bool {
+	if readableOutput.Bool || htmlOutput.Bool || epubOutput.Bool || countOutput.Bool || *saveImages != "" || *diff != "" {
 		if !root.IsAMP() {
 			ampURL := root.GetAMPurl()
 			if ampURL != "" {
 				root, baseURL, err = url2epub.GetHTML(ctx, url2epub.GetHTMLArgs{
 					URL:       ampURL,
 					UserAgent: *ua,
+					CookieJar: jar,
 				})
 				if err != nil {
 					slog.Error("url2epub.GetHTML failed", "err", err)
@@ -119,23 +197,48 @@ func main() {
 		}
 		slog.Debug("Page metadata", "title", root.GetTitle(), "author", root.GetAuthor())
 
-		node, images, err := root.Readable(ctx, url2epub.ReadableArgs{
+		readableArgs := url2epub.ReadableArgs{
 			BaseURL:         baseURL,
 			ImagesDir:       "images",
 			UserAgent:       *ua,
 			Grayscale:       *grayscale,
 			FitImage:        *fit,
 			MinArticleNodes: *minArticleNodes,
-		})
+			MinArticleText:  *minArticleText,
+			OGImageFallback: *ogImageFallback,
+			SkipImages:      *skipImages,
+			CookieJar:       jar,
+		}
+		node, images, err := root.Readable(ctx, readableArgs)
 		if err != nil {
 			slog.Error("url2epub.Readable failed", "err", err)
 			os.Exit(1)
 		}
+		if *diff != "" {
+			diffArgs, err := applyOverrides(readableArgs, *diff)
+			if err != nil {
+				slog.Error("Invalid -diff", "err", err)
+				os.Exit(1)
+			}
+			diffNode, _, err := root.Readable(ctx, diffArgs)
+			if err != nil {
+				slog.Error("url2epub.Readable failed with -diff", "err", err)
+				os.Exit(1)
+			}
+			printDiff(w, node, diffNode, *diffFull)
+			return
+		}
+		if *saveImages != "" {
+			if err := saveImagesTo(*saveImages, images); err != nil {
+				slog.Error("Save images failed", "err", err)
+				os.Exit(1)
+			}
+		}
 
 		switch {
 		case epubOutput.Bool:
 			id, err := url2epub.Epub(url2epub.EpubArgs{
-				Dest:   os.Stdout,
+				Dest:   w,
 				Title:  root.GetTitle(),
 				Author: root.GetAuthor(),
 				Node:   node,
@@ -148,21 +251,112 @@ func main() {
 			slog.Info("epub generated", "id", id)
 
 		case htmlOutput.Bool:
-			err = html.Render(os.Stdout, node)
+			err = html.Render(w, node)
 			if err != nil {
 				slog.Error("html.Render failed", "err", err)
 				os.Exit(1)
 			}
 
 		case readableOutput.Bool:
-			recursivePrint(url2epub.FromNode(node), "")
+			recursivePrint(w, url2epub.FromNode(node), "")
+
+		case countOutput.Bool:
+			printSummary(w, root, node, images)
+
+		case !htmlOutput.Bool && !epubOutput.Bool && !readableOutput.Bool && !countOutput.Bool:
+			// Only -save-images is used, print the original tree as usual.
+			recursivePrint(w, root, "")
 		}
 	} else {
-		recursivePrint(root, "")
+		recursivePrint(w, root, "")
+	}
+}
+
+// saveImagesTo writes all images into dir.
+//
+// As the readers inside images can only be read once, they are replaced with
+// in-memory readers of the same content so they can still be used later.
+func saveImagesTo(dir string, images map[string]io.Reader) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var saved int
+	var empty []string
+	for name, reader := range images {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read image %q: %w", name, err)
+		}
+		images[name] = bytes.NewReader(data)
+		if len(data) == 0 {
+			empty = append(empty, name)
+		}
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			return fmt.Errorf("failed to write image %q: %w", filename, err)
+		}
+		saved++
+	}
+	sort.Strings(empty)
+	slog.Info(
+		"Saved images",
+		"dir", dir,
+		"total", saved,
+		"empty", len(empty),
+		"emptyImages", empty,
+	)
+	return nil
+}
+
+type nodeTally struct {
+	elements int
+	texts    int
+	textLen  int
+}
+
+func (t *nodeTally) walk(n *url2epub.Node) {
+	if n == nil {
+		return
+	}
+	node := n.AsNode()
+	switch node.Type {
+	case html.TextNode:
+		t.texts++
+		t.textLen += len([]rune(strings.TrimSpace(node.Data)))
+	case html.ElementNode:
+		t.elements++
+	}
+	for c := range n.Children() {
+		t.walk(c)
+	}
+}
+
+// printSummary prints a summary of the extraction to w.
+//
+// It consumes the readers in images.
+func printSummary(w io.Writer, root *url2epub.Node, node *html.Node, images map[string]io.Reader) {
+	var tally nodeTally
+	tally.walk(url2epub.FromNode(node))
+	var empty int
+	for _, reader := range images {
+		if n, _ := io.Copy(io.Discard, reader); n == 0 {
+			empty++
+		}
 	}
+	fmt.Fprintf(w, "title:    %q\n", root.GetTitle())
+	fmt.Fprintf(w, "author:   %q\n", root.GetAuthor())
+	fmt.Fprintf(w, "lang:     %q\n", root.GetLang())
+	fmt.Fprintf(w, "amp:      %v\n", root.IsAMP())
+	fmt.Fprintf(w, "elements: %d\n", tally.elements)
+	fmt.Fprintf(w, "texts:    %d\n", tally.texts)
+	fmt.Fprintf(w, "text len: %d\n", tally.textLen)
+	fmt.Fprintf(w, "images:   %d (%d empty)\n", len(images), empty)
 }
 
-func recursivePrint(n *url2epub.Node, prefix string) {
+func recursivePrint(w io.Writer, n *url2epub.Node, prefix string) {
 	if n == nil {
 		return
 	}
@@ -173,7 +367,7 @@ func recursivePrint(n *url2epub.Node, prefix string) {
 		if len(text) > 10 {
 			text = append(text[:10], []rune("...")...)
 		}
-		fmt.Printf("%s[text: %q]\n", prefix, string(text))
+		fmt.Fprintf(w, "%s[text: %q]\n", prefix, string(text))
 	case html.ElementNode:
 		var sb strings.Builder
 		sb.WriteString(prefix)
@@ -187,9 +381,9 @@ func recursivePrint(n *url2epub.Node, prefix string) {
 			sb.WriteString(fmt.Sprintf("%q:%q", attr.Key, attr.Val))
 		}
 		sb.WriteString("]")
-		fmt.Println(sb.String())
+		fmt.Fprintln(w, sb.String())
 	}
 	for c := range n.Children() {
-		recursivePrint(c, prefix+"| ")
+		recursivePrint(w, c, prefix+"| ")
 	}
 }
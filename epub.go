@@ -7,8 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"maps"
 	"path"
+	"slices"
 	"strings"
 	"text/template"
 	"time"
@@ -40,9 +41,88 @@ const (
 	epubContentDir      = "content"
 	epubArticleFilename = "article.xhtml"
 	epubNavFilename     = "nav.xhtml"
+	epubCoverBasename   = "cover"
+	epubStyleFilename   = "style.css"
 	epubOpfFullpath     = epubContentDir + "/content.opf"
 )
 
+// Supported EpubArgs.PageDirection values.
+const (
+	PageDirectionLTR     = "ltr"
+	PageDirectionRTL     = "rtl"
+	PageDirectionDefault = "default"
+)
+
+// RTLLanguages are the primary language subtags of the right-to-left languages,
+// used to detect the page progression direction of the epub.
+var RTLLanguages = map[string]bool{
+	"ar": true,
+	"fa": true,
+	"he": true,
+	"ur": true,
+}
+
+// pageDirection returns the page progression direction of the epub.
+func pageDirection(override string, node *html.Node, lang string) (string, error) {
+	switch override {
+	default:
+		return "", fmt.Errorf("epub: unsupported page direction %q", override)
+	case PageDirectionLTR, PageDirectionRTL, PageDirectionDefault:
+		return override, nil
+	case "":
+	}
+	switch FromNode(node).GetDir() {
+	case PageDirectionRTL:
+		return PageDirectionRTL, nil
+	case PageDirectionLTR:
+		return "", nil
+	}
+	primary, _, _ := strings.Cut(lang, "-")
+	if RTLLanguages[strings.ToLower(primary)] {
+		return PageDirectionRTL, nil
+	}
+	return "", nil
+}
+
+// defaultEpubCSS is the stylesheet used when EpubArgs.CSS is empty.
+const defaultEpubCSS = `body {
+  margin: 0 1em;
+  line-height: 1.5;
+}
+
+blockquote {
+  margin: 1em 0;
+  padding: 0 1em;
+  border-left: 0.2em solid #888;
+}
+
+pre, code {
+  font-family: monospace;
+}
+
+pre {
+  white-space: pre-wrap;
+  padding: 0.5em;
+  border: 1px solid #888;
+}
+
+figure {
+  margin: 1em 0;
+  text-align: center;
+}
+
+figcaption {
+  font-size: 0.9em;
+}
+
+img {
+  display: block;
+  margin: 0 auto;
+  max-width: 100%;
+  height: auto;
+}
+`
+
 var (
 	epubOpfTmpl = template.Must(template.New("opf").Funcs(template.FuncMap{
 		"CleanPath": func(orig string) string {
@@ -59,33 +139,47 @@ var (
 	<dc:language>{{.Lang}}</dc:language>{{if .Author}}
 	<dc:creator id="creator">{{.Author}}</dc:creator>
 	<meta refines="#creator" property="role" scheme="marc:relators" id="role">aut</meta>
-	<meta property="dcterms:creator" id="auth">{{.Author}}</meta>{{end}}
+	<meta property="dcterms:creator" id="auth">{{.Author}}</meta>{{end}}{{if .Description}}
+	<dc:description>{{.Description}}</dc:description>{{end}}{{if .CoverImage}}
+	<meta name="cover" content="{{.CoverImage | CleanPath}}"/>{{end}}
   <meta property="dcterms:modified">{{.Time}}</meta>
  </metadata>
  <manifest>
   <item id="nav" href="{{.NavPath}}" media-type="application/xhtml+xml" properties="nav"/>
-  <item id="{{.ArticlePath}}" href="{{.ArticlePath}}" media-type="application/xhtml+xml"/>
+  <item id="css" href="{{.StylePath}}" media-type="text/css"/>
+  {{- range .Chapters}}
+  <item id="{{.Path}}" href="{{.Path}}" media-type="application/xhtml+xml"{{if .Properties}} properties="{{.Properties}}"{{end}}/>
+  {{- end}}
   {{range $path, $type := .Images}}
-  <item id="{{$path | CleanPath}}" href="{{$path}}" media-type="{{$type}}"/>
+  <item id="{{$path | CleanPath}}" href="{{$path}}" media-type="{{$type}}"{{if eq $path $.CoverImage}} properties="cover-image"{{end}}/>
 	{{- end}}
  </manifest>
- <spine>
-  <itemref idref="{{.ArticlePath}}"/>
+ <spine{{if .PageDirection}} page-progression-direction="{{.PageDirection}}"{{end}}>
+  {{- range .Chapters}}
+  <itemref idref="{{.Path}}"/>
+  {{- end}}
  </spine>
 </package>
 `))
 
-	epubNavTmpl = template.Must(template.New("nav").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+	epubNavTmpl = template.Must(template.New("nav").Parse(`{{define "toc"}}
+{{- range .}}
+    <li><a href="{{.Href}}">{{.Title}}</a>{{if .Children}}<ol>{{template "toc" .Children}}</ol>{{end}}</li>
+{{- end}}
+{{- end}}<?xml version="1.0" encoding="UTF-8"?>
 <html xmlns="http://www.w3.org/1999/xhtml">
  <head>
   <title>{{.Title}}</title>
   <meta http-equiv="default-style" content="text/html; charset=utf-8"></meta>
+  <link rel="stylesheet" type="text/css" href="{{.StylePath}}"/>
  </head>
  <body>
   <nav xmlns:epub="http://www.idpf.org/2007/ops" epub:type="toc">
    <h2>Contents</h2>
    <ol epub:type="list">
-    <li><a href="{{.ArticlePath}}">Content</a></li>
+   {{- if .TOC}}{{template "toc" .TOC}}{{else}}{{range .Chapters}}
+    <li><a href="{{.Path}}">{{.Title}}</a></li>
+   {{- end}}{{end}}
    </ol>
   </nav>
  </body>
@@ -97,11 +191,22 @@ type epubOpfData struct {
 	ID          string
 	Title       string
 	Author      string
+	Description string
 	Lang        string
 	Time        string
-	ArticlePath string
+	Chapters    []*epubChapter
 	NavPath     string
+	StylePath   string
 	Images      map[string]string
+
+	// The table of contents, if any headings found in the article.
+	TOC []*epubTOCItem
+
+	// The page progression direction of the spine, if any.
+	PageDirection string
+
+	// The path of the cover image, if any.
+	CoverImage string
 }
 
 // EpubArgs defines the args used by Epub function.
@@ -115,16 +220,83 @@ type EpubArgs struct {
 	// The author of the epub, if any.
 	Author string
 
+	// The description of the epub, if any.
+	Description string
+
 	// The node pointing to the html tag.
+	//
+	// It can't be used together with Sections.
 	Node *html.Node
 
-	// If non-empty, override the language detected from Node.
+	// If non-empty, the epub contains multiple articles, one for each section,
+	// instead of Node.
+	//
+	// The table of contents has an item for each section, with the headings of
+	// the article as its children. The images of all the sections are in
+	// Images, so the sections should use different ImagesDir in ReadableArgs to
+	// avoid conflicts.
+	Sections []EpubSection
+
+	// If non-empty, override the language detected from Node (or the first
+	// section).
 	OverrideLang string
 
+	// If non-empty, override the page progression direction detected from
+	// Node (or the first section), must be one of PageDirectionLTR, PageDirectionRTL, or
+	// PageDirectionDefault.
+	//
+	// When empty, it's PageDirectionRTL when either the html or body node has
+	// dir="rtl", or the language is in RTLLanguages. Otherwise it's left unset.
+	PageDirection string
+
 	// Images map:
 	// key: image local filename
 	// value: image content
 	Images map[string]io.Reader
+
+	// If non-empty, use the image with this local filename (must be a key in
+	// Images) as the cover image.
+	CoverImage string
+
+	// If non-nil, use its content as the cover image, stored separately from
+	// Images. It can't be used together with CoverImage.
+	Cover io.Reader
+
+	// The content type of Cover, detected from its content if empty or not
+	// supported. Epub fails if the detected one is not supported either.
+	CoverContentType string
+
+	// If non-empty, use it as the identifier of the epub instead of a random
+	// uuid.
+	DeterministicID string
+
+	// If non-zero, use it as the modified time of the epub and the files inside
+	// it, instead of the current time.
+	//
+	// When both DeterministicID and ModTime are set, Epub produces identical
+	// bytes from the same args.
+	ModTime time.Time
+
+	// If MaxNodesPerChapter > 0 and the body of Node has more nodes than it,
+	// the article will be split into multiple xhtml files (chapters) between
+	// its top level blocks, preferably before headings and sections, each with
+	// roughly at most MaxNodesPerChapter nodes.
+	//
+	// Some e-readers are sluggish opening a single large xhtml file.
+	MaxNodesPerChapter int
+
+	// The stylesheet of the epub, default to a bundled one with sensible
+	// margins, monospace pre, and centered figures and images when empty.
+	CSS string
+}
+
+// EpubSection is an article in a multi-article epub, see EpubArgs.Sections.
+type EpubSection struct {
+	// The title of the section in the table of contents.
+	Title string
+
+	// The node pointing to the html tag of the article.
+	Node *html.Node
 }
 
 func firstHTMLNode(root *html.Node) *html.Node {
@@ -156,13 +328,113 @@ func wrapEpubXMLnsNode(root *html.Node) *html.Node {
 	return root
 }
 
+// linkEpubStylesheet adds the link to the epub stylesheet into the head of
+// root, creating the head if it doesn't exist.
+func linkEpubStylesheet(root *html.Node) *html.Node {
+	node := firstHTMLNode(root)
+	if node == nil {
+		return root
+	}
+	var head *html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Head {
+			head = c
+			break
+		}
+	}
+	if head == nil {
+		head = &html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.Head,
+			Data:     atom.Head.String(),
+		}
+		node.InsertBefore(head, node.FirstChild)
+	}
+	head.AppendChild(&html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Link,
+		Data:     atom.Link.String(),
+		Attr: []html.Attribute{
+			{Key: "rel", Val: "stylesheet"},
+			{Key: "type", Val: "text/css"},
+			{Key: "href", Val: epubStyleFilename},
+		},
+	})
+	return root
+}
+
+// writeEpubImage writes the image f into the content dir of z, and returns its
+// content type.
+func writeEpubImage(z *zip.Writer, f string, modTime time.Time, reader io.Reader) (contentType string, err error) {
+	filename := path.Join(epubContentDir, f)
+	if readCloser, ok := reader.(io.ReadCloser); ok {
+		defer DrainAndClose(readCloser)
+	}
+	var buf []byte
+	if buffer, ok := reader.(*bytes.Buffer); ok {
+		buf = buffer.Bytes()
+	} else {
+		r := bufio.NewReader(reader)
+		var peekErr error
+		buf, peekErr = r.Peek(contentTypePeekSize)
+		if peekErr != nil && peekErr != io.EOF {
+			return "", fmt.Errorf("epub: unable to detect content type for %q: %w", filename, peekErr)
+		}
+		reader = r
+	}
+	contentType = detectImageContentType(buf)
+	if path.Ext(f) == svgExt {
+		// http.DetectContentType reports svg as text/xml.
+		contentType = svgMediaType
+	}
+
+	return contentType, ziputil.WriteFileAt(
+		z,
+		filename,
+		modTime,
+		ziputil.WriterToWrapper(func(w io.Writer) (int64, error) {
+			return io.Copy(w, reader)
+		}),
+	)
+}
+
 // Epub creates an Epub 3.0 file from given content.
 func Epub(args EpubArgs) (id string, err error) {
-	randomID, err := uuid.NewRandom()
+	if args.Cover != nil && args.CoverImage != "" {
+		return "", errors.New("epub: Cover and CoverImage are mutually exclusive")
+	}
+	if args.CoverImage != "" {
+		if _, ok := args.Images[args.CoverImage]; !ok {
+			return "", fmt.Errorf("epub: cover image %q not found in images", args.CoverImage)
+		}
+	}
+	if args.Node != nil && len(args.Sections) > 0 {
+		return "", errors.New("epub: Node and Sections are mutually exclusive")
+	}
+	node := args.Node
+	if len(args.Sections) > 0 {
+		node = args.Sections[0].Node
+	}
+	lang := args.OverrideLang
+	if lang == "" {
+		lang = FromNode(node).GetLang()
+	}
+	direction, err := pageDirection(args.PageDirection, node, lang)
 	if err != nil {
-		return "", fmt.Errorf("epub: unable to generate uuid: %w", err)
+		return "", err
 	}
 
+	id = args.DeterministicID
+	if id == "" {
+		randomID, err := uuid.NewRandom()
+		if err != nil {
+			return "", fmt.Errorf("epub: unable to generate uuid: %w", err)
+		}
+		id = randomID.String()
+	}
+	// Zero modTime means no modification time for the files inside the zip.
+	modTime := args.ModTime
+
 	z := zip.NewWriter(args.Dest)
 	defer func() {
 		if closeErr := z.Close(); closeErr != nil {
@@ -172,81 +444,122 @@ func Epub(args EpubArgs) (id string, err error) {
 
 	// mimetype must be the first file in the zip,
 	// and must use Store instead of Deflate.
-	if err := ziputil.StoreFile(z, epubMimetypeFilename, ziputil.StringWriterTo(EpubMimeType)); err != nil {
+	if err := ziputil.StoreFileAt(z, epubMimetypeFilename, modTime, ziputil.StringWriterTo(EpubMimeType)); err != nil {
 		return "", err
 	}
 
-	if err := ziputil.WriteFile(z, epubContainerFilename, ziputil.StringWriterTo(epubContainerContent)); err != nil {
+	if err := ziputil.WriteFileAt(z, epubContainerFilename, modTime, ziputil.StringWriterTo(epubContainerContent)); err != nil {
 		return "", err
 	}
 
-	if err := ziputil.WriteFile(
+	var toc []*epubTOCItem
+	var chapters []*epubChapter
+	if len(args.Sections) > 0 {
+		toc, chapters = epubSections(args.Sections, args.MaxNodesPerChapter)
+	} else {
+		// This needs to be done before splitting the chapters, as it assigns ids
+		// to the headings.
+		toc = buildEpubTOC(args.Node)
+		chapters = epubChapters(
+			linkEpubStylesheet(wrapEpubXMLnsNode(args.Node)),
+			args.MaxNodesPerChapter,
+		)
+		setEpubTOCHrefs(toc, chapterPaths(chapters))
+	}
+	for _, chapter := range chapters {
+		if err := ziputil.WriteFileAt(
+			z,
+			path.Join(epubContentDir, chapter.Path),
+			modTime,
+			ziputil.WriterToWrapper(func(w io.Writer) (int64, error) {
+				// NOTE: this does not return the correct n, but it's good enough for
+				// our use case.
+				return 0, html.Render(w, chapter.node)
+			}),
+		); err != nil {
+			return "", err
+		}
+	}
+
+	css := args.CSS
+	if css == "" {
+		css = defaultEpubCSS
+	}
+	if err := ziputil.WriteFileAt(
 		z,
-		path.Join(epubContentDir, epubArticleFilename),
-		ziputil.WriterToWrapper(func(w io.Writer) (int64, error) {
-			// NOTE: this does not return the correct n, but it's good enough for our
-			// use case.
-			return 0, html.Render(w, wrapEpubXMLnsNode(args.Node))
-		}),
+		path.Join(epubContentDir, epubStyleFilename),
+		modTime,
+		ziputil.StringWriterTo(css),
 	); err != nil {
 		return "", err
 	}
 
-	imageContentTypes := make(map[string]string, len(args.Images))
-	for f, reader := range args.Images {
-		if err := func() (err error) {
-			filename := path.Join(epubContentDir, f)
-			if readCloser, ok := reader.(io.ReadCloser); ok {
-				defer DrainAndClose(readCloser)
+	imageContentTypes := make(map[string]string, len(args.Images)+1)
+	// Sort the images to make the output deterministic.
+	for _, f := range slices.Sorted(maps.Keys(args.Images)) {
+		contentType, err := writeEpubImage(z, f, modTime, args.Images[f])
+		if err != nil {
+			return "", err
+		}
+		imageContentTypes[f] = contentType
+	}
+	coverImage := args.CoverImage
+	if args.Cover != nil {
+		if readCloser, ok := args.Cover.(io.ReadCloser); ok {
+			defer DrainAndClose(readCloser)
+		}
+		reader := bufio.NewReader(args.Cover)
+		contentType := args.CoverContentType
+		ext, ok := coverExt(contentType)
+		if !ok {
+			// Either not set or not supported, detect it from the content instead.
+			peek, peekErr := reader.Peek(contentTypePeekSize)
+			if peekErr != nil && peekErr != io.EOF {
+				return "", fmt.Errorf("epub: unable to detect content type for cover: %w", peekErr)
 			}
-			var buf []byte
-			if buffer, ok := reader.(*bytes.Buffer); ok {
-				buf = buffer.Bytes()
-			} else {
-				r := bufio.NewReader(reader)
-				var peekErr error
-				buf, peekErr = r.Peek(contentTypePeekSize)
-				if peekErr != nil && peekErr != io.EOF {
-					err = fmt.Errorf("epub: unable to detect content type for %q: %w", filename, peekErr)
-					return
-				}
-				reader = r
+			contentType = detectImageContentType(peek)
+			ext, ok = coverExt(contentType)
+			if !ok {
+				return "", fmt.Errorf("epub: unsupported content type %q for cover", contentType)
 			}
-			imageContentTypes[f] = http.DetectContentType(buf)
-
-			return ziputil.WriteFile(
-				z,
-				filename,
-				ziputil.WriterToWrapper(func(w io.Writer) (int64, error) {
-					return io.Copy(w, reader)
-				}),
-			)
-		}(); err != nil {
+		}
+		coverImage = epubCoverBasename + ext
+		if _, ok := args.Images[coverImage]; ok {
+			return "", fmt.Errorf("epub: cover %q conflicts with images", coverImage)
+		}
+		if _, err := writeEpubImage(z, coverImage, modTime, reader); err != nil {
 			return "", err
 		}
+		imageContentTypes[coverImage] = contentType
 	}
 
-	id = randomID.String()
-	lang := args.OverrideLang
-	if lang == "" {
-		lang = FromNode(args.Node).GetLang()
+	opfTime := modTime
+	if opfTime.IsZero() {
+		opfTime = time.Now()
 	}
 	data := epubOpfData{
 		ID:          html.EscapeString(id),
 		Title:       html.EscapeString(args.Title),
 		Author:      html.EscapeString(args.Author),
+		Description: html.EscapeString(args.Description),
 		Lang:        html.EscapeString(lang),
-		Time:        time.Now().UTC().Format(time.RFC3339),
-		ArticlePath: epubArticleFilename,
+		Time:        opfTime.UTC().Format(time.RFC3339),
+		Chapters:    chapters,
 		NavPath:     epubNavFilename,
+		StylePath:   epubStyleFilename,
+		TOC:         toc,
 		Images:      imageContentTypes,
+		CoverImage:  coverImage,
+
+		PageDirection: direction,
 	}
 	if data.Lang == "" {
 		data.Lang = "en"
 	}
-	if err := ziputil.WriteFile(
+	if err := ziputil.WriteFileAt(
 		z,
 		path.Join(epubContentDir, epubNavFilename),
+		modTime,
 		ziputil.WriterToWrapper(func(w io.Writer) (int64, error) {
 			// NOTE: this does not return the correct n, but it's good enough for our
 			// use case.
@@ -256,9 +569,10 @@ func Epub(args EpubArgs) (id string, err error) {
 		return "", err
 	}
 
-	if err := ziputil.WriteFile(
+	if err := ziputil.WriteFileAt(
 		z,
 		epubOpfFullpath,
+		modTime,
 		ziputil.WriterToWrapper(func(w io.Writer) (int64, error) {
 			// NOTE: this does not return the correct n, but it's good enough for our
 			// use case.
@@ -270,3 +584,13 @@ func Epub(args EpubArgs) (id string, err error) {
 
 	return id, nil
 }
+
+// coverExt returns the file extension of the cover image in contentType, and
+// whether it's supported.
+func coverExt(contentType string) (string, bool) {
+	if contentType == svgMediaType {
+		return svgExt, true
+	}
+	ext, ok := imageExts[contentType]
+	return ext, ok
+}
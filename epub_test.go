@@ -0,0 +1,459 @@
+package url2epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// testEpubFile returns the content of the file name in the content dir of the
+// epub.
+func testEpubFile(t *testing.T, buf *bytes.Buffer, name string) string {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader failed: %v", err)
+	}
+	f, err := z.Open(path.Join(epubContentDir, name))
+	if err != nil {
+		t.Fatalf("Failed to open %q: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Failed to read %q: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestEpubDescription(t *testing.T) {
+	type opfMetadata struct {
+		Descriptions []string `xml:"metadata>description"`
+	}
+
+	for _, c := range []struct {
+		label       string
+		description string
+		want        []string
+	}{
+		{
+			label:       "escaped",
+			description: `Tom & "Jerry" <3`,
+			want:        []string{`Tom & "Jerry" <3`},
+		},
+		{
+			label: "empty",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			opf := testEpubOpf(t, testEpub(t, EpubArgs{
+				Title:       "Hello",
+				Description: c.description,
+			}))
+			var got opfMetadata
+			if err := xml.Unmarshal([]byte(opf), &got); err != nil {
+				t.Fatalf("Failed to parse opf: %v\n%s", err, opf)
+			}
+			if !slices.Equal(got.Descriptions, c.want) {
+				t.Errorf("description got %q, want %q", got.Descriptions, c.want)
+			}
+		})
+	}
+}
+
+func TestEpubCSS(t *testing.T) {
+	const link = `<link rel="stylesheet" type="text/css" href="style.css"/>`
+	for _, c := range []struct {
+		label string
+		css   string
+		want  string
+	}{
+		{
+			label: "default",
+			want:  defaultEpubCSS,
+		},
+		{
+			label: "override",
+			css:   "body { color: red; }",
+			want:  "body { color: red; }",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			buf := testEpub(t, EpubArgs{
+				Title: "Hello",
+				CSS:   c.css,
+			})
+			if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+				t.Errorf("ValidateEpub got %v", errs)
+			}
+			if got := testEpubFile(t, buf, epubStyleFilename); got != c.want {
+				t.Errorf("css got %q, want %q", got, c.want)
+			}
+			for _, name := range []string{epubArticleFilename, epubNavFilename} {
+				if got := testEpubFile(t, buf, name); !strings.Contains(got, link) {
+					t.Errorf("%s does not contain %q:\n%s", name, link, got)
+				}
+			}
+			opf := testEpubOpf(t, buf)
+			if want := `<item id="css" href="style.css" media-type="text/css"/>`; !strings.Contains(opf, want) {
+				t.Errorf("opf does not contain %q:\n%s", want, opf)
+			}
+		})
+	}
+}
+
+func TestEpubTOC(t *testing.T) {
+	for _, c := range []struct {
+		label   string
+		src     string
+		nav     []string
+		article []string
+	}{
+		{
+			label: "headings",
+			src:   `<html><head><title>Hello</title></head><body><h1>Title &amp; <em>more</em></h1><p>Intro.</p><h2 id="first">First</h2><p>One.</p><h3>Sub</h3><p>Sub.</p><h2>  Second  </h2><p>Two.</p><h4>Ignored</h4><h2></h2><p id="toc-2">Conflict.</p></body></html>`,
+			nav: []string{
+				`<li><a href="article.xhtml#toc-1">Title &amp; more</a><ol>`,
+				`<li><a href="article.xhtml#first">First</a><ol>`,
+				`<li><a href="article.xhtml#toc-3">Sub</a></li></ol></li>`,
+				`<li><a href="article.xhtml#toc-4">Second</a></li></ol></li>`,
+			},
+			article: []string{
+				`<h1 id="toc-1">`,
+				`<h2 id="first">`,
+				`<h3 id="toc-3">`,
+				`<h2 id="toc-4">`,
+			},
+		},
+		{
+			label: "no-headings",
+			src:   `<html><head><title>Hello</title></head><body><p>Text.</p><h4>Small</h4></body></html>`,
+			nav: []string{
+				`<li><a href="article.xhtml">Content</a></li>`,
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			node, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			buf := testEpub(t, EpubArgs{
+				Title: "Hello",
+				Node:  node,
+			})
+			if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+				t.Errorf("ValidateEpub got %v", errs)
+			}
+			nav := testEpubFile(t, buf, epubNavFilename)
+			if !strings.HasPrefix(nav, "<?xml") {
+				t.Errorf("nav does not start with xml declaration:\n%s", nav)
+			}
+			for _, want := range c.nav {
+				if !strings.Contains(nav, want) {
+					t.Errorf("nav does not contain %q:\n%s", want, nav)
+				}
+			}
+			article := testEpubFile(t, buf, epubArticleFilename)
+			for _, want := range c.article {
+				if !strings.Contains(article, want) {
+					t.Errorf("article does not contain %q:\n%s", want, article)
+				}
+			}
+		})
+	}
+}
+
+func TestEpubDeterministic(t *testing.T) {
+	args := func() EpubArgs {
+		node, err := html.Parse(strings.NewReader(testArticleHTML))
+		if err != nil {
+			t.Fatalf("html.Parse failed: %v", err)
+		}
+		return EpubArgs{
+			Title: "Hello",
+			Node:  node,
+			Images: map[string]io.Reader{
+				"images/001.png": bytes.NewBuffer(testPNGImage(t, 10, 10)),
+				"images/002.png": bytes.NewBuffer(testPNGImage(t, 20, 20)),
+				"images/003.png": bytes.NewBuffer(testPNGImage(t, 30, 30)),
+			},
+			DeterministicID: "test-id",
+			ModTime:         time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		}
+	}
+	first := testEpub(t, args())
+	second := testEpub(t, args())
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Epub with the same args produced different bytes")
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(first.Bytes()), int64(first.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader failed: %v", err)
+	}
+	want := args().ModTime
+	for _, f := range z.File {
+		if !f.Modified.Equal(want) {
+			t.Errorf("%s modified got %v, want %v", f.Name, f.Modified, want)
+		}
+	}
+
+	opf := testEpubOpf(t, first)
+	for _, want := range []string{
+		`<dc:identifier id="BookID">test-id</dc:identifier>`,
+		`<meta property="dcterms:modified">2024-01-02T03:04:05Z</meta>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("opf does not contain %q:\n%s", want, opf)
+		}
+	}
+}
+
+func TestEpubPageDirection(t *testing.T) {
+	const rtl = `<spine page-progression-direction="rtl">`
+	for _, c := range []struct {
+		label    string
+		src      string
+		lang     string
+		override string
+		want     string
+	}{
+		{
+			label: "rtl-lang",
+			src:   `<html lang="ar-EG"><head><title>Hello</title></head><body><p>مرحبا</p></body></html>`,
+			want:  rtl,
+		},
+		{
+			label: "rtl-override-lang",
+			src:   testArticleHTML,
+			lang:  "he",
+			want:  rtl,
+		},
+		{
+			label: "rtl-dir",
+			src:   `<html><head><title>Hello</title></head><body dir="RTL"><p>Hello</p></body></html>`,
+			want:  rtl,
+		},
+		{
+			label: "ltr-dir",
+			src:   `<html lang="fa" dir="ltr"><head><title>Hello</title></head><body><p>Hello</p></body></html>`,
+			want:  `<spine>`,
+		},
+		{
+			label: "ltr-lang",
+			src:   testArticleHTML,
+			want:  `<spine>`,
+		},
+		{
+			label:    "override",
+			src:      testArticleHTML,
+			override: PageDirectionRTL,
+			want:     rtl,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			node, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			opf := testEpubOpf(t, testEpub(t, EpubArgs{
+				Title:         "Hello",
+				Node:          node,
+				OverrideLang:  c.lang,
+				PageDirection: c.override,
+			}))
+			if !strings.Contains(opf, c.want) {
+				t.Errorf("opf does not contain %q:\n%s", c.want, opf)
+			}
+		})
+	}
+
+	node, err := html.Parse(strings.NewReader(testArticleHTML))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	if _, err := Epub(EpubArgs{
+		Dest:          io.Discard,
+		Node:          node,
+		PageDirection: "up",
+	}); err == nil {
+		t.Error("Epub with invalid PageDirection expected error, got nil")
+	}
+}
+
+func TestEpubChapters(t *testing.T) {
+	var sb strings.Builder
+	var want []string
+	sb.WriteString(`<html><head><title>Hello</title></head><body><article>`)
+	for i := range 20 {
+		fmt.Fprintf(&sb, `<h2>Section %d</h2>`, i)
+		want = append(want, fmt.Sprintf("Section %d", i))
+		for j := range 5 {
+			fmt.Fprintf(&sb, `<p>Paragraph %d.%d</p>`, i, j)
+			want = append(want, fmt.Sprintf("Paragraph %d.%d", i, j))
+		}
+	}
+	sb.WriteString(`</article></body></html>`)
+	src := sb.String()
+
+	textOf := func(t *testing.T, s string) []string {
+		t.Helper()
+		node, err := html.Parse(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("html.Parse failed: %v", err)
+		}
+		var texts []string
+		body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+		for n := range body.Descendants() {
+			if n.Type == html.TextNode && strings.TrimSpace(n.Data) != "" {
+				texts = append(texts, strings.TrimSpace(n.Data))
+			}
+		}
+		return texts
+	}
+
+	for _, c := range []struct {
+		label    string
+		maxNodes int
+		chapters int
+	}{
+		{
+			label:    "disabled",
+			maxNodes: 0,
+			chapters: 1,
+		},
+		{
+			label:    "not-exceeded",
+			maxNodes: 1000,
+			chapters: 1,
+		},
+		{
+			label:    "split",
+			maxNodes: 50,
+			chapters: 5,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			node, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			buf := testEpub(t, EpubArgs{
+				Title:              "Hello",
+				Node:               node,
+				MaxNodesPerChapter: c.maxNodes,
+			})
+			if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+				t.Errorf("ValidateEpub got %v", errs)
+			}
+
+			paths := []string{epubArticleFilename}
+			if c.chapters > 1 {
+				paths = nil
+				for i := range c.chapters {
+					paths = append(paths, fmt.Sprintf(epubChapterFilenameTemplate, i+1))
+				}
+			}
+			opf := testEpubOpf(t, buf)
+			if got := strings.Count(opf, "<itemref "); got != len(paths) {
+				t.Errorf("got %d spine items, want %d:\n%s", got, len(paths), opf)
+			}
+			nav := testEpubFile(t, buf, epubNavFilename)
+			var got []string
+			for _, p := range paths {
+				if want := fmt.Sprintf(`<itemref idref="%s"/>`, p); !strings.Contains(opf, want) {
+					t.Errorf("opf does not contain %q:\n%s", want, opf)
+				}
+				if want := fmt.Sprintf(`<a href="%s#`, p); !strings.Contains(nav, want) {
+					t.Errorf("nav does not contain %q:\n%s", want, nav)
+				}
+				got = append(got, textOf(t, testEpubFile(t, buf, p))...)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("content got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestEpubSections(t *testing.T) {
+	parse := func(t *testing.T, s string) *html.Node {
+		t.Helper()
+		node, err := html.Parse(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("html.Parse failed: %v", err)
+		}
+		return node
+	}
+	sections := []EpubSection{
+		{
+			Title: "First & foremost",
+			Node:  parse(t, `<html lang="fr"><body><h2>Intro</h2><p>One</p><img src="images/1/001.png"/></body></html>`),
+		},
+		{
+			Title: "Second",
+			// Same heading text (and generated id) as the first section.
+			Node: parse(t, `<html><body><h2>Intro</h2><p>Two</p></body></html>`),
+		},
+	}
+
+	t.Run("conflict", func(t *testing.T) {
+		_, err := Epub(EpubArgs{
+			Dest:     io.Discard,
+			Node:     parse(t, `<html><body><p>Hello</p></body></html>`),
+			Sections: sections,
+		})
+		if err == nil {
+			t.Error("Epub with both Node and Sections got no error")
+		}
+	})
+
+	buf := testEpub(t, EpubArgs{
+		Title:    "Digest",
+		Sections: sections,
+		Images: map[string]io.Reader{
+			"images/1/001.png": bytes.NewReader(testPNGImage(t, 10, 10)),
+		},
+	})
+	if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+		t.Errorf("ValidateEpub got %v", errs)
+	}
+
+	opf := testEpubOpf(t, buf)
+	for _, want := range []string{
+		`<dc:language>fr</dc:language>`,
+		`<itemref idref="section-01-` + epubArticleFilename + `"/>`,
+		`<itemref idref="section-02-` + epubArticleFilename + `"/>`,
+		`href="images/1/001.png"`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("opf does not contain %q:\n%s", want, opf)
+		}
+	}
+
+	nav := testEpubFile(t, buf, epubNavFilename)
+	for _, want := range []string{
+		`<a href="section-01-` + epubArticleFilename + `">First &amp; foremost</a>`,
+		`<a href="section-01-` + epubArticleFilename + `#`,
+		`<a href="section-02-` + epubArticleFilename + `">Second</a>`,
+		`<a href="section-02-` + epubArticleFilename + `#`,
+	} {
+		if !strings.Contains(nav, want) {
+			t.Errorf("nav does not contain %q:\n%s", want, nav)
+		}
+	}
+	if got := testEpubFile(t, buf, "section-02-"+epubArticleFilename); !strings.Contains(got, "Two") {
+		t.Errorf("second section got %q, want it to contain %q", got, "Two")
+	}
+}
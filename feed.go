@@ -0,0 +1,286 @@
+package url2epub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// ErrFeed is the error returned by GetHTML when the url is an RSS or Atom feed
+// instead of an html page. Use GetFeed for it instead.
+var ErrFeed = errors.New("url2epub: url is a feed")
+
+// ErrNotFeed is the error returned by ParseFeed and GetFeed when the content
+// is not an RSS or Atom feed.
+var ErrNotFeed = errors.New("url2epub: not an RSS or Atom feed")
+
+// feedSniffLen is the max number of bytes to look at to decide whether the
+// content is a feed.
+//
+// It needs to be large enough to skip the xml declaration, stylesheets and
+// comments before the root element.
+const feedSniffLen = 1024
+
+// Feed is a parsed RSS or Atom feed.
+type Feed struct {
+	Title   string
+	Entries []FeedEntry
+}
+
+// FeedEntry is a single entry (RSS item) of a Feed.
+type FeedEntry struct {
+	Title string
+
+	// The absolute url of the entry when it's from GetFeed, otherwise it's as in
+	// the feed.
+	URL string
+
+	// Zero when it's missing or cannot be parsed.
+	Published time.Time
+}
+
+// Latest returns up to n entries of the feed, newest first.
+//
+// When any of the entries doesn't have a published time, the order in the feed
+// is kept, as most feeds already put the newest entries first.
+func (f *Feed) Latest(n int) []FeedEntry {
+	entries := slices.Clone(f.Entries)
+	if !slices.ContainsFunc(entries, func(e FeedEntry) bool {
+		return e.Published.IsZero()
+	}) {
+		slices.SortStableFunc(entries, func(a, b FeedEntry) int {
+			return b.Published.Compare(a.Published)
+		})
+	}
+	if len(entries) > n {
+		entries = entries[:max(n, 0)]
+	}
+	return entries
+}
+
+type rssFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Items []struct {
+			Title   string `xml:"title"`
+			Link    string `xml:"link"`
+			GUID    string `xml:"guid"`
+			PubDate string `xml:"pubDate"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomFeed struct {
+	Title   string `xml:"title"`
+	Entries []struct {
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+// The time layouts seen in the pubDate of RSS feeds.
+var rssTimeLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+}
+
+func parseFeedTime(s string, layouts ...string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func newFeedDecoder(r io.Reader) *xml.Decoder {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charset.NewReaderLabel
+	// Many feeds in the wild use html entities like &nbsp;.
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	return d
+}
+
+// feedRoot returns the root element of the xml document from d, or nil if it's
+// not an xml document.
+func feedRoot(d *xml.Decoder) *xml.StartElement {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			return &t
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func isFeedRoot(root *xml.StartElement) bool {
+	if root == nil {
+		return false
+	}
+	switch root.Name.Local {
+	default:
+		return false
+	case "rss", "feed":
+		return true
+	}
+}
+
+// isFeed returns true if the content from r looks like an RSS or Atom feed,
+// by its root element.
+//
+// It only peeks r without consuming it.
+func isFeed(r *bufio.Reader) bool {
+	// Peek returns the available data with an error when it's shorter.
+	prefix, _ := r.Peek(feedSniffLen)
+	return isFeedRoot(feedRoot(newFeedDecoder(bytes.NewReader(prefix))))
+}
+
+// ParseFeed parses an RSS 2.0 or Atom feed from r.
+//
+// If the content is not an RSS or Atom feed, the returned error wraps
+// ErrNotFeed.
+func ParseFeed(r io.Reader) (*Feed, error) {
+	d := newFeedDecoder(r)
+	root := feedRoot(d)
+	if !isFeedRoot(root) {
+		return nil, ErrNotFeed
+	}
+	switch root.Name.Local {
+	default:
+		// Should not happen
+		return nil, ErrNotFeed
+
+	case "rss":
+		var rss rssFeed
+		if err := d.DecodeElement(&rss, root); err != nil {
+			return nil, fmt.Errorf("unable to parse rss feed: %w", err)
+		}
+		feed := &Feed{
+			Title:   strings.TrimSpace(rss.Channel.Title),
+			Entries: make([]FeedEntry, 0, len(rss.Channel.Items)),
+		}
+		for _, item := range rss.Channel.Items {
+			link := strings.TrimSpace(item.Link)
+			if link == "" {
+				link = strings.TrimSpace(item.GUID)
+			}
+			if link == "" {
+				continue
+			}
+			feed.Entries = append(feed.Entries, FeedEntry{
+				Title:     strings.TrimSpace(item.Title),
+				URL:       link,
+				Published: parseFeedTime(item.PubDate, rssTimeLayouts...),
+			})
+		}
+		return feed, nil
+
+	case "feed":
+		var atom atomFeed
+		if err := d.DecodeElement(&atom, root); err != nil {
+			return nil, fmt.Errorf("unable to parse atom feed: %w", err)
+		}
+		feed := &Feed{
+			Title:   strings.TrimSpace(atom.Title),
+			Entries: make([]FeedEntry, 0, len(atom.Entries)),
+		}
+		for _, entry := range atom.Entries {
+			var link string
+			for _, l := range entry.Links {
+				// The link without rel is the same as rel="alternate".
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = strings.TrimSpace(l.Href)
+					break
+				}
+			}
+			if link == "" {
+				continue
+			}
+			published := entry.Published
+			if published == "" {
+				published = entry.Updated
+			}
+			feed.Entries = append(feed.Entries, FeedEntry{
+				Title:     strings.TrimSpace(entry.Title),
+				URL:       link,
+				Published: parseFeedTime(published, time.RFC3339),
+			})
+		}
+		return feed, nil
+	}
+}
+
+// GetFeed does HTTP get request on an RSS or Atom feed, and parses it.
+//
+// The urls of the entries are resolved into absolute urls, and the entries
+// that are not http or https are dropped.
+//
+// Like GetHTML, the returned URL is the URL of the last (final) request after
+// redirects.
+func GetFeed(ctx context.Context, args GetHTMLArgs) (*Feed, *url.URL, error) {
+	src, err := url.Parse(args.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse url %q: %w", args.URL, err)
+	}
+
+	if args.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.Timeout)
+		defer cancel()
+	}
+	body, lastURL, err := get(ctx, src, getArgs{
+		userAgent:   args.UserAgent,
+		cookieJar:   args.CookieJar,
+		hostPolicy:  args.HostPolicy,
+		rateLimiter: args.RateLimiter,
+		client:      args.Client,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get %q: %w", args.URL, err)
+	}
+	defer DrainAndClose(body)
+	src = lastURL
+	feed, err := ParseFeed(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse %q: %w", src, err)
+	}
+	entries := feed.Entries[:0]
+	for _, entry := range feed.Entries {
+		u, err := src.Parse(entry.URL)
+		if err != nil || checkScheme(u) != nil {
+			continue
+		}
+		entry.URL = u.String()
+		entries = append(entries, entry)
+	}
+	feed.Entries = entries
+	return feed, src, nil
+}
@@ -0,0 +1,199 @@
+package url2epub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRSSFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<?xml-stylesheet type="text/xsl" href="/feed.xsl"?>
+<rss version="2.0">
+<channel>
+<title>My Blog</title>
+<link>https://example.com/</link>
+<item>
+<title>Older&nbsp;post</title>
+<link>https://example.com/older</link>
+<pubDate>Mon, 02 Jan 2006 15:04:05 -0700</pubDate>
+</item>
+<item>
+<title>Newer post</title>
+<link>/newer</link>
+<pubDate>Tue, 3 Jan 2006 15:04:05 -0700</pubDate>
+</item>
+<item>
+<title>No link</title>
+<guid isPermaLink="true">https://example.com/guid</guid>
+<pubDate>Sun, 01 Jan 2006 15:04:05 -0700</pubDate>
+</item>
+<item>
+<title>Not http</title>
+<link>mailto:foo@example.com</link>
+<pubDate>Sun, 01 Jan 2006 15:04:05 -0700</pubDate>
+</item>
+</channel>
+</rss>`
+
+	testAtomFeed = `<?xml version="1.0" encoding="utf-8"?>
+<!-- generated -->
+<feed xmlns="http://www.w3.org/2005/Atom">
+<title>My Atom Blog</title>
+<entry>
+<title>First</title>
+<link rel="edit" href="https://example.com/edit/1"/>
+<link href="https://example.com/1"/>
+<published>2006-01-02T15:04:05Z</published>
+</entry>
+<entry>
+<title>Second</title>
+<link rel="alternate" href="https://example.com/2"/>
+</entry>
+<entry>
+<title>No link</title>
+<link rel="self" href="https://example.com/self/3"/>
+</entry>
+</feed>`
+)
+
+func TestParseFeed(t *testing.T) {
+	t.Run("rss", func(t *testing.T) {
+		feed, err := ParseFeed(strings.NewReader(testRSSFeed))
+		if err != nil {
+			t.Fatalf("ParseFeed failed: %v", err)
+		}
+		if got, want := feed.Title, "My Blog"; got != want {
+			t.Errorf("Title got %q, want %q", got, want)
+		}
+		var urls []string
+		for _, entry := range feed.Latest(10) {
+			urls = append(urls, entry.URL)
+		}
+		if got, want := strings.Join(urls, " "), "/newer https://example.com/older https://example.com/guid mailto:foo@example.com"; got != want {
+			t.Errorf("Latest urls got %q, want %q", got, want)
+		}
+		if got, want := feed.Entries[0].Title, "Older post"; got != want {
+			t.Errorf("Title of the first entry got %q, want %q", got, want)
+		}
+		if got, want := feed.Entries[0].Published, time.Date(2006, 1, 2, 22, 4, 5, 0, time.UTC); !got.Equal(want) {
+			t.Errorf("Published of the first entry got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("atom", func(t *testing.T) {
+		feed, err := ParseFeed(strings.NewReader(testAtomFeed))
+		if err != nil {
+			t.Fatalf("ParseFeed failed: %v", err)
+		}
+		if got, want := feed.Title, "My Atom Blog"; got != want {
+			t.Errorf("Title got %q, want %q", got, want)
+		}
+		// Not all entries have published time, so the feed order is kept.
+		var urls []string
+		for _, entry := range feed.Latest(1) {
+			urls = append(urls, entry.URL)
+		}
+		if got, want := strings.Join(urls, " "), "https://example.com/1"; got != want {
+			t.Errorf("Latest urls got %q, want %q", got, want)
+		}
+		if got, want := len(feed.Entries), 2; got != want {
+			t.Errorf("Got %d entries, want %d", got, want)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		_, err := ParseFeed(strings.NewReader(`<!doctype html><html><body><p>Hello</p></body></html>`))
+		if !errors.Is(err, ErrNotFeed) {
+			t.Errorf("ParseFeed got error %v, want %v", err, ErrNotFeed)
+		}
+	})
+}
+
+func TestIsFeed(t *testing.T) {
+	for _, c := range []struct {
+		label   string
+		content string
+		want    bool
+	}{
+		{
+			label:   "rss",
+			content: testRSSFeed,
+			want:    true,
+		},
+		{
+			label:   "atom",
+			content: testAtomFeed,
+			want:    true,
+		},
+		{
+			label:   "html",
+			content: `<!doctype html><html><head><title>rss</title></head><body><feed></feed></body></html>`,
+		},
+		{
+			label:   "xhtml",
+			content: `<?xml version="1.0" encoding="UTF-8"?><html xmlns="http://www.w3.org/1999/xhtml"><body></body></html>`,
+		},
+		{
+			label:   "text",
+			content: `rss feed`,
+		},
+		{
+			label: "empty",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(c.content), feedSniffLen)
+			if got := isFeed(r); got != c.want {
+				t.Errorf("isFeed got %v, want %v", got, c.want)
+			}
+			// Make sure nothing is consumed.
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != c.content {
+				t.Errorf("Content after isFeed got %q, want %q", data, c.content)
+			}
+		})
+	}
+}
+
+func TestGetFeed(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/rss+xml")
+		io.WriteString(w, testRSSFeed)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<html><body><p>Hello</p></body></html>`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+
+	if _, _, err := GetHTML(ctx, GetHTMLArgs{URL: srv.URL + "/feed"}); !errors.Is(err, ErrFeed) {
+		t.Errorf("GetHTML on feed got error %v, want %v", err, ErrFeed)
+	}
+	if _, _, err := GetFeed(ctx, GetHTMLArgs{URL: srv.URL + "/page"}); !errors.Is(err, ErrNotFeed) {
+		t.Errorf("GetFeed on html got error %v, want %v", err, ErrNotFeed)
+	}
+
+	feed, _, err := GetFeed(ctx, GetHTMLArgs{URL: srv.URL + "/feed"})
+	if err != nil {
+		t.Fatalf("GetFeed failed: %v", err)
+	}
+	var urls []string
+	for _, entry := range feed.Latest(10) {
+		urls = append(urls, entry.URL)
+	}
+	if got, want := strings.Join(urls, " "), srv.URL+"/newer https://example.com/older https://example.com/guid"; got != want {
+		t.Errorf("Latest urls got %q, want %q", got, want)
+	}
+}
@@ -4,6 +4,11 @@ go 1.23
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20210519020934-456a8d69b780
 	go.yhsif.com/immutable v1.0.0-rc1
 	golang.org/x/net v0.34.0
+	golang.org/x/text v0.21.0
 )
+
+require golang.org/x/image v0.21.0 // indirect
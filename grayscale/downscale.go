@@ -12,76 +12,133 @@ import (
 // If fit <= 0 or if the original image is already smaller than fit x fit,
 // the original image will be returned as-is.
 func Downscale(img *image.Gray16, fit int) image.Image {
-	if fit <= 0 {
+	newMax, ratio, ok := downscaleSize(img.Bounds(), fit)
+	if !ok {
 		return img
 	}
-	var scaled bool
-	ratio := 1.0
-	origMin := img.Bounds().Min
-	// origMax := img.Bounds().Max
-	origSizeX := float64(img.Bounds().Max.X - origMin.X)
-	origSizeY := float64(img.Bounds().Max.Y - origMin.Y)
-	if ratioX := float64(fit) / float64(img.Bounds().Max.X-origMin.X); ratioX < ratio {
-		scaled = true
-		ratio = ratioX
-	}
-	if ratioY := float64(fit) / float64(img.Bounds().Max.Y-origMin.Y); ratioY < ratio {
-		scaled = true
-		ratio = ratioY
-	}
-	if !scaled {
+	newImg := image.NewGray16(image.Rectangle{
+		Min: image.Point{
+			X: 0,
+			Y: 0,
+		},
+		Max: newMax,
+	})
+	downscale(
+		img.Bounds(),
+		newMax,
+		ratio,
+		func(x, y int) float64 {
+			return float64(img.Gray16At(x, y).Y)
+		},
+		func(x, y int, c float64) {
+			newImg.SetGray16(x, y, color.Gray16{
+				Y: uint16(math.Round(c)),
+			})
+		},
+	)
+	return newImg
+}
+
+// Downscale8 is Downscale for 8-bit grayscale images.
+func Downscale8(img *image.Gray, fit int) image.Image {
+	newMax, ratio, ok := downscaleSize(img.Bounds(), fit)
+	if !ok {
 		return img
 	}
-	newMax := image.Point{
-		X: int(math.Round(float64(img.Bounds().Max.X-origMin.X) * ratio)),
-		Y: int(math.Round(float64(img.Bounds().Max.Y-origMin.Y) * ratio)),
-	}
-	newImg := image.NewGray16(image.Rectangle{
+	newImg := image.NewGray(image.Rectangle{
 		Min: image.Point{
 			X: 0,
 			Y: 0,
 		},
 		Max: newMax,
 	})
+	downscale(
+		img.Bounds(),
+		newMax,
+		ratio,
+		func(x, y int) float64 {
+			return float64(img.GrayAt(x, y).Y)
+		},
+		func(x, y int, c float64) {
+			newImg.SetGray(x, y, color.Gray{
+				Y: uint8(math.Round(c)),
+			})
+		},
+	)
+	return newImg
+}
+
+// downscaleSize returns the size of the downscaled image and the ratio,
+// or false if the image of bounds doesn't need to be downscaled to fit.
+func downscaleSize(bounds image.Rectangle, fit int) (newMax image.Point, ratio float64, ok bool) {
+	if fit <= 0 {
+		return image.Point{}, 0, false
+	}
+	ratio = 1.0
+	origMin := bounds.Min
+	if ratioX := float64(fit) / float64(bounds.Max.X-origMin.X); ratioX < ratio {
+		ok = true
+		ratio = ratioX
+	}
+	if ratioY := float64(fit) / float64(bounds.Max.Y-origMin.Y); ratioY < ratio {
+		ok = true
+		ratio = ratioY
+	}
+	if !ok {
+		return image.Point{}, 0, false
+	}
+	newMax = image.Point{
+		// Keep at least 1px for very long or tall images.
+		X: max(int(math.Round(float64(bounds.Max.X-origMin.X)*ratio)), 1),
+		Y: max(int(math.Round(float64(bounds.Max.Y-origMin.Y)*ratio)), 1),
+	}
+	return newMax, ratio, true
+}
+
+// downscale calculates the weighted average of the pixels from the original
+// image of bounds (read via at) for each pixel in the downscaled image of
+// newMax, and writes them via set.
+func downscale(
+	bounds image.Rectangle,
+	newMax image.Point,
+	ratio float64,
+	at func(x, y int) float64,
+	set func(x, y int, c float64),
+) {
+	origMin := bounds.Min
+	origSizeX := float64(bounds.Max.X - origMin.X)
+	origSizeY := float64(bounds.Max.Y - origMin.Y)
+	yStarts := make([]int, newMax.Y)
 	yWeights := make([][]float64, newMax.Y)
+	for y := 0; y < newMax.Y; y++ {
+		yStarts[y], yWeights[y] = pixelWeights(float64(y)/ratio, min(float64(y+1)/ratio, origSizeY))
+	}
 	for x := 0; x < newMax.X; x++ {
-		minX := float64(x) / ratio
-		minXInt := int(minX)
-		maxX := min(float64(x+1)/ratio, origSizeX)
-		maxXInt := int(maxX)
-		xWeights := make([]float64, maxXInt-minXInt)
-		xWeights[0] = math.Floor(minX+1) - minX
-		xWeights[maxXInt-minXInt-1] = maxX - math.Floor(maxX)
-		for i := 1; i < maxXInt-minXInt-1; i++ {
-			xWeights[i] = 1
-		}
-
+		xStart, xWeights := pixelWeights(float64(x)/ratio, min(float64(x+1)/ratio, origSizeX))
 		for y := 0; y < newMax.Y; y++ {
-			minY := float64(y) / ratio
-			minYInt := int(minY)
-			maxY := min(float64(y+1)/ratio, origSizeY)
-			maxYInt := int(maxY)
-			if yWeights[y] == nil {
-				yWeights[y] = make([]float64, maxYInt-minYInt)
-				yWeights[y][0] = math.Floor(minY+1) - minY
-				yWeights[y][maxYInt-minYInt-1] = maxY - math.Floor(maxY)
-				for i := 1; i < maxYInt-minYInt-1; i++ {
-					yWeights[y][i] = 1
-				}
-			}
 			var c, n float64
-			for xx := minXInt; xx < maxXInt; xx++ {
-				for yy := minYInt; yy < maxYInt; yy++ {
-					weight := xWeights[xx-minXInt] * yWeights[y][yy-minYInt]
-					color := img.Gray16At(xx+origMin.X, yy+origMin.Y).Y
+			for i, xWeight := range xWeights {
+				for j, yWeight := range yWeights[y] {
+					weight := xWeight * yWeight
 					n += weight
-					c += float64(color) * weight
+					c += at(xStart+i+origMin.X, yStarts[y]+j+origMin.Y) * weight
 				}
 			}
-			newImg.SetGray16(x, y, color.Gray16{
-				Y: uint16(math.Round(c / n)),
-			})
+			set(x, y, c/n)
 		}
 	}
-	return newImg
+}
+
+// pixelWeights returns the index of the first pixel covered by [from, to),
+// and how much each covered pixel is covered, as their weights.
+func pixelWeights(from, to float64) (start int, weights []float64) {
+	start = int(from)
+	end := max(int(math.Ceil(to)), start+1)
+	weights = make([]float64, end-start)
+	for i := range weights {
+		lo := max(from, float64(start+i))
+		hi := min(to, float64(start+i+1))
+		weights[i] = max(hi-lo, 0)
+	}
+	return start, weights
 }
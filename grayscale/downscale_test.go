@@ -0,0 +1,194 @@
+package grayscale
+
+import (
+	"image"
+	"image/color"
+	"slices"
+	"testing"
+)
+
+func TestDownscaleNoop(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		size  image.Point
+		fit   int
+	}{
+		{
+			label: "smaller",
+			size:  image.Pt(100, 100),
+			fit:   200,
+		},
+		{
+			label: "same",
+			size:  image.Pt(100, 50),
+			fit:   100,
+		},
+		{
+			label: "no-fit",
+			size:  image.Pt(1, 1),
+			fit:   0,
+		},
+		{
+			label: "negative-fit",
+			size:  image.Pt(100, 100),
+			fit:   -1,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			img := image.NewGray16(image.Rectangle{Max: c.size})
+			if got, ok := Downscale(img, c.fit).(*image.Gray16); !ok || got != img {
+				t.Errorf("Downscale(%v, %d) got %p, want the original %p", c.size, c.fit, got, img)
+			}
+			img8 := image.NewGray(image.Rectangle{Max: c.size})
+			if got, ok := Downscale8(img8, c.fit).(*image.Gray); !ok || got != img8 {
+				t.Errorf("Downscale8(%v, %d) got %p, want the original %p", c.size, c.fit, got, img8)
+			}
+		})
+	}
+}
+
+func TestDownscaleThin(t *testing.T) {
+	const gray = 0x1234
+	for _, c := range []struct {
+		label string
+		min   image.Point
+		size  image.Point
+		fit   int
+		want  image.Point
+	}{
+		{
+			label: "1px-tall",
+			size:  image.Pt(1000, 1),
+			fit:   100,
+			want:  image.Pt(100, 1),
+		},
+		{
+			label: "1px-wide",
+			size:  image.Pt(1, 1000),
+			fit:   100,
+			want:  image.Pt(1, 100),
+		},
+		{
+			label: "1px-tall-half",
+			size:  image.Pt(300, 1),
+			fit:   200,
+			want:  image.Pt(200, 1),
+		},
+		{
+			label: "3px-tall",
+			size:  image.Pt(1000, 3),
+			fit:   100,
+			want:  image.Pt(100, 1),
+		},
+		{
+			label: "non-zero-min",
+			min:   image.Pt(5, 7),
+			size:  image.Pt(1000, 1),
+			fit:   10,
+			want:  image.Pt(10, 1),
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			rect := image.Rectangle{Max: c.size}.Add(c.min)
+			img := image.NewGray16(rect)
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				for y := rect.Min.Y; y < rect.Max.Y; y++ {
+					img.SetGray16(x, y, color.Gray16{Y: gray})
+				}
+			}
+			got := Downscale(img, c.fit)
+			if size := got.Bounds().Size(); size != c.want {
+				t.Fatalf("Downscale(%v, %d) got size %v, want %v", c.size, c.fit, size, c.want)
+			}
+			bounds := got.Bounds()
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					if v := color.Gray16Model.Convert(got.At(x, y)).(color.Gray16).Y; v != gray {
+						t.Fatalf("Pixel (%d, %d) got %#x, want %#x", x, y, v, gray)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPixelWeights(t *testing.T) {
+	for _, c := range []struct {
+		label     string
+		from, to  float64
+		wantStart int
+		want      []float64
+	}{
+		{
+			label:     "single-full",
+			from:      2,
+			to:        3,
+			wantStart: 2,
+			want:      []float64{1},
+		},
+		{
+			label:     "single-partial",
+			from:      2.25,
+			to:        2.75,
+			wantStart: 2,
+			want:      []float64{0.5},
+		},
+		{
+			label:     "two",
+			from:      0.5,
+			to:        2,
+			wantStart: 0,
+			want:      []float64{0.5, 1},
+		},
+		{
+			label:     "three",
+			from:      0.5,
+			to:        2.25,
+			wantStart: 0,
+			want:      []float64{0.5, 1, 0.25},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			start, weights := pixelWeights(c.from, c.to)
+			if start != c.wantStart {
+				t.Errorf("start got %d, want %d", start, c.wantStart)
+			}
+			if !slices.Equal(weights, c.want) {
+				t.Errorf("weights got %v, want %v", weights, c.want)
+			}
+		})
+	}
+}
+
+func TestDownscaleBanner(t *testing.T) {
+	// Try all the fits on thin banners, including the ones producing exactly
+	// one sample per output pixel in one of the dimensions.
+	for _, size := range []image.Point{
+		image.Pt(2000, 1),
+		image.Pt(1, 2000),
+		image.Pt(2000, 2),
+		image.Pt(3, 5),
+		image.Pt(101, 1),
+	} {
+		img := image.NewGray16(image.Rectangle{Max: size})
+		for x := range size.X {
+			for y := range size.Y {
+				img.SetGray16(x, y, color.Gray16{Y: uint16(0x1000 + (x+y)%2*0x1000)})
+			}
+		}
+		for fit := 1; fit <= max(size.X, size.Y); fit++ {
+			got := Downscale(img, fit)
+			bounds := got.Bounds()
+			if bounds.Dx() > fit || bounds.Dy() > fit || bounds.Empty() {
+				t.Fatalf("Downscale(%v, %d) got bounds %v", size, fit, bounds)
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					if v := color.Gray16Model.Convert(got.At(x, y)).(color.Gray16).Y; v < 0x1000 || v > 0x2000 {
+						t.Fatalf("Downscale(%v, %d) pixel (%d, %d) got %#x, want in [0x1000, 0x2000]", size, fit, x, y, v)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package grayscale
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// The magic numbers of gif87a and gif89a.
+var gifHeaders = [][]byte{
+	[]byte("GIF87a"),
+	[]byte("GIF89a"),
+}
+
+// IsGIF returns true if data starts with a gif header.
+func IsGIF(data []byte) bool {
+	for _, header := range gifHeaders {
+		if bytes.HasPrefix(data, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// FirstFrame decodes the first frame of a (possibly animated) gif from r.
+//
+// The frame is drawn onto the logical screen of the gif, as frames are allowed
+// to only cover part of it.
+func FirstFrame(r io.Reader) (image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("grayscale: gif has no frames")
+	}
+	frame := g.Image[0]
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if screen.Empty() || frame.Bounds() == screen {
+		return frame, nil
+	}
+	img := image.NewRGBA(screen)
+	draw.Draw(img, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+	return img, nil
+}
+
+// peekGIF returns true if r starts with a gif header.
+func peekGIF(r *bufio.Reader) bool {
+	data, _ := r.Peek(len(gifHeaders[0]))
+	return IsGIF(data)
+}
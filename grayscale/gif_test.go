@@ -0,0 +1,79 @@
+package grayscale
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestFirstFrame(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	frame := func(r image.Rectangle, c uint8) *image.Paletted {
+		img := image.NewPaletted(r, palette)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				img.SetColorIndex(x, y, c)
+			}
+		}
+		return img
+	}
+
+	for _, c := range []struct {
+		label string
+		first image.Rectangle
+	}{
+		{
+			label: "full",
+			first: image.Rect(0, 0, 4, 4),
+		},
+		{
+			label: "partial",
+			first: image.Rect(1, 1, 3, 3),
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := gif.EncodeAll(&buf, &gif.GIF{
+				Image: []*image.Paletted{
+					frame(c.first, 1),
+					frame(image.Rect(0, 0, 4, 4), 0),
+				},
+				Delay: []int{10, 10},
+				Config: image.Config{
+					ColorModel: palette,
+					Width:      4,
+					Height:     4,
+				},
+			}); err != nil {
+				t.Fatalf("gif.EncodeAll failed: %v", err)
+			}
+			if !IsGIF(buf.Bytes()) {
+				t.Fatal("IsGIF got false, want true")
+			}
+
+			img, orig, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !bytes.Equal(orig.Bytes(), buf.Bytes()) {
+				t.Errorf("Decode orig got %d bytes, want %d", orig.Len(), buf.Len())
+			}
+			if got, want := img.Bounds(), image.Rect(0, 0, 4, 4); got != want {
+				t.Errorf("bounds got %v, want %v", got, want)
+			}
+			for x := c.first.Min.X; x < c.first.Max.X; x++ {
+				for y := c.first.Min.Y; y < c.first.Max.Y; y++ {
+					if r, _, _, _ := img.At(x, y).RGBA(); r != 0xffff {
+						t.Errorf("(%d, %d) got red %#x, want white from the first frame", x, y, r)
+					}
+				}
+			}
+		})
+	}
+
+	if IsGIF([]byte("\x89PNG\r\n\x1a\n")) {
+		t.Error("IsGIF got true for png, want false")
+	}
+}
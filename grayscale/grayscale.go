@@ -1,6 +1,7 @@
 package grayscale
 
 import (
+	"bufio"
 	"bytes"
 	"image"
 	"image/jpeg"
@@ -21,18 +22,39 @@ import (
 // It returns the original data via orig, in case any decoding fails and you
 // want to fallback to the original image.
 func FromReader(r io.Reader) (_ *image.Gray16, orig *bytes.Buffer, _ error) {
+	img, orig, err := Decode(r)
+	if err != nil {
+		return nil, orig, err
+	}
+	return Grayscale(img), orig, nil
+}
+
+// Decode decodes an image from original raw data (r) without grayscaling it.
+//
+// Animated gifs are decoded into their first frame, see FirstFrame.
+//
+// See FromReader for the notes on image type packages and orig.
+func Decode(r io.Reader) (_ image.Image, orig *bytes.Buffer, _ error) {
 	orig = new(bytes.Buffer)
-	r = io.TeeReader(r, orig)
+	br := bufio.NewReader(io.TeeReader(r, orig))
 	defer func() {
-		io.Copy(io.Discard, r)
+		io.Copy(io.Discard, br)
 	}()
-	img, _, err := image.Decode(r)
+	if peekGIF(br) {
+		img, err := FirstFrame(br)
+		if err != nil {
+			return nil, orig, err
+		}
+		return img, orig, nil
+	}
+	img, _, err := image.Decode(br)
 	if err != nil {
 		return nil, orig, err
 	}
-	return Grayscale(img), orig, nil
+	return img, orig, nil
 }
 
+// Grayscale converts img into 16-bit grayscale.
 func Grayscale(img image.Image) *image.Gray16 {
 	gray := image.NewGray16(img.Bounds())
 	origMinX := img.Bounds().Min.X
@@ -49,10 +71,41 @@ func Grayscale(img image.Image) *image.Gray16 {
 	return gray
 }
 
+// Grayscale8 converts img into 8-bit grayscale.
+//
+// Compared to Grayscale, it halves the pixel data, and the encoded jpeg only
+// has a single component, with no visible difference on e-ink screens.
+func Grayscale8(img image.Image) *image.Gray {
+	gray := image.NewGray(img.Bounds())
+	origMinX := img.Bounds().Min.X
+	origMinY := img.Bounds().Min.Y
+	newMinX := gray.Bounds().Min.X
+	newMinY := gray.Bounds().Min.Y
+	for x := newMinX; x < gray.Bounds().Max.X; x++ {
+		for y := newMinY; y < gray.Bounds().Max.Y; y++ {
+			origX := x - newMinX + origMinX
+			origY := y - newMinY + origMinY
+			gray.Set(x, y, img.At(origX, origY))
+		}
+	}
+	return gray
+}
+
+// DefaultJPEGQuality is the JPEG quality used by ToJPEG.
+const DefaultJPEGQuality = jpeg.DefaultQuality
+
 // ToJPEG encodes the image to JPEG with default quality.
 func ToJPEG(img image.Image) (*bytes.Buffer, error) {
+	return ToJPEGWithQuality(img, DefaultJPEGQuality)
+}
+
+// ToJPEGWithQuality encodes the image to JPEG with quality,
+// which ranges from 1 to 100 inclusive, higher is better.
+//
+// Out of range qualities are clamped.
+func ToJPEGWithQuality(img image.Image, quality int) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
-	if err := jpeg.Encode(buf, img, nil); err != nil {
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
 		return nil, err
 	}
 	return buf, nil
@@ -0,0 +1,107 @@
+package grayscale
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestToJPEGWithQuality(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := range 64 {
+		for y := range 64 {
+			img.Set(x, y, color.RGBA{
+				R: uint8(x * 4),
+				G: uint8(y * 4),
+				B: uint8((x * y) % 256),
+				A: 255,
+			})
+		}
+	}
+	gray := Grayscale(img)
+
+	low, err := ToJPEGWithQuality(gray, 10)
+	if err != nil {
+		t.Fatalf("ToJPEGWithQuality(10) failed: %v", err)
+	}
+	high, err := ToJPEGWithQuality(gray, 95)
+	if err != nil {
+		t.Fatalf("ToJPEGWithQuality(95) failed: %v", err)
+	}
+	if low.Len() >= high.Len() {
+		t.Errorf("quality 10 size %d >= quality 95 size %d", low.Len(), high.Len())
+	}
+
+	def, err := ToJPEG(gray)
+	if err != nil {
+		t.Fatalf("ToJPEG failed: %v", err)
+	}
+	withDefault, err := ToJPEGWithQuality(gray, DefaultJPEGQuality)
+	if err != nil {
+		t.Fatalf("ToJPEGWithQuality(DefaultJPEGQuality) failed: %v", err)
+	}
+	if def.Len() != withDefault.Len() {
+		t.Errorf("ToJPEG size %d != ToJPEGWithQuality(DefaultJPEGQuality) size %d", def.Len(), withDefault.Len())
+	}
+}
+
+func TestGrayscale8Size(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 128))
+	for x := range 256 {
+		for y := range 128 {
+			img.Set(x, y, color.RGBA{
+				R: uint8(x),
+				G: uint8(y * 2),
+				B: uint8((x * y) % 256),
+				A: 255,
+			})
+		}
+	}
+
+	gray16, err := ToJPEG(Downscale(Grayscale(img), 100))
+	if err != nil {
+		t.Fatalf("ToJPEG(16-bit) failed: %v", err)
+	}
+	gray8, err := ToJPEG(Downscale8(Grayscale8(img), 100))
+	if err != nil {
+		t.Fatalf("ToJPEG(8-bit) failed: %v", err)
+	}
+	if gray8.Len() >= gray16.Len() {
+		t.Errorf("8-bit size %d >= 16-bit size %d", gray8.Len(), gray16.Len())
+	}
+}
+
+func TestDownscale8(t *testing.T) {
+	img := Grayscale8(image.NewRGBA(image.Rect(0, 0, 400, 200)))
+	for _, c := range []struct {
+		label string
+		fit   int
+		want  image.Point
+	}{
+		{
+			label: "no-fit",
+			fit:   0,
+			want:  image.Pt(400, 200),
+		},
+		{
+			label: "larger",
+			fit:   500,
+			want:  image.Pt(400, 200),
+		},
+		{
+			label: "downscale",
+			fit:   100,
+			want:  image.Pt(100, 50),
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			got := Downscale8(img, c.fit)
+			if size := got.Bounds().Size(); size != c.want {
+				t.Errorf("got size %v, want %v", size, c.want)
+			}
+			if _, ok := got.(*image.Gray); !ok {
+				t.Errorf("got %T, want *image.Gray", got)
+			}
+		})
+	}
+}
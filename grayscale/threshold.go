@@ -0,0 +1,73 @@
+package grayscale
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+)
+
+// DefaultThresholdLevel is the cutoff in the middle of black and white.
+const DefaultThresholdLevel = math.MaxUint16/2 + 1
+
+// Threshold converts img into pure black and white.
+//
+// Pixels darker than level become black, the rest become white.
+func Threshold(img *image.Gray16, level uint16) *image.Gray {
+	bw := image.NewGray(img.Bounds())
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			bw.SetGray(x, y, bilevel(float64(img.Gray16At(x, y).Y), level))
+		}
+	}
+	return bw
+}
+
+// Dither is Threshold with Floyd–Steinberg dithering, which keeps the shades of
+// photos better.
+func Dither(img *image.Gray16, level uint16) *image.Gray {
+	bw := image.NewGray(img.Bounds())
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	// The errors diffused to the current and the next rows.
+	curr := make([]float64, width+2)
+	next := make([]float64, width+2)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for i := 0; i < width; i++ {
+			x := bounds.Min.X + i
+			old := float64(img.Gray16At(x, y).Y) + curr[i+1]
+			c := bilevel(old, level)
+			bw.SetGray(x, y, c)
+			diff := old - float64(c.Y)*math.MaxUint16/math.MaxUint8
+			curr[i+2] += diff * 7 / 16
+			next[i] += diff * 3 / 16
+			next[i+1] += diff * 5 / 16
+			next[i+2] += diff * 1 / 16
+		}
+		curr, next = next, curr
+		clear(next)
+	}
+	return bw
+}
+
+func bilevel(y float64, level uint16) color.Gray {
+	if y < float64(level) {
+		return color.Gray{Y: 0}
+	}
+	return color.Gray{Y: math.MaxUint8}
+}
+
+// ToPNG encodes the image to PNG, which is much smaller than JPEG for images
+// from Threshold and Dither.
+func ToPNG(img image.Image) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	encoder := png.Encoder{
+		CompressionLevel: png.BestCompression,
+	}
+	if err := encoder.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,96 @@
+package grayscale
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestThreshold(t *testing.T) {
+	const level = 0x8000
+	for _, c := range []struct {
+		label string
+		y     uint16
+		want  uint8
+	}{
+		{
+			label: "black",
+			y:     0,
+			want:  0,
+		},
+		{
+			label: "below-level",
+			y:     level - 1,
+			want:  0,
+		},
+		{
+			label: "at-level",
+			y:     level,
+			want:  255,
+		},
+		{
+			label: "above-level",
+			y:     level + 1,
+			want:  255,
+		},
+		{
+			label: "white",
+			y:     0xffff,
+			want:  255,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			img := image.NewGray16(image.Rect(0, 0, 1, 1))
+			img.SetGray16(0, 0, color.Gray16{Y: c.y})
+			if got := Threshold(img, level).GrayAt(0, 0).Y; got != c.want {
+				t.Errorf("Threshold(%#x, %#x) got %d, want %d", c.y, level, got, c.want)
+			}
+		})
+	}
+}
+
+func TestThresholdMidGray(t *testing.T) {
+	const mid = 0x7fff
+	img := image.NewGray16(image.Rect(0, 0, 1, 1))
+	img.SetGray16(0, 0, color.Gray16{Y: mid})
+	for _, c := range []struct {
+		level uint16
+		want  uint8
+	}{
+		{level: mid - 1, want: 255},
+		{level: mid, want: 255},
+		{level: mid + 1, want: 0},
+	} {
+		if got := Threshold(img, c.level).GrayAt(0, 0).Y; got != c.want {
+			t.Errorf("Threshold(%#x, %#x) got %d, want %d", mid, c.level, got, c.want)
+		}
+	}
+}
+
+func TestDither(t *testing.T) {
+	// A mid-gray image should be dithered into roughly half black and half
+	// white pixels, while Threshold makes it all one color.
+	const size = 32
+	img := image.NewGray16(image.Rect(0, 0, size, size))
+	for x := range size {
+		for y := range size {
+			img.SetGray16(x, y, color.Gray16{Y: 0x8000})
+		}
+	}
+	bw := Dither(img, DefaultThresholdLevel)
+	var white int
+	for x := range size {
+		for y := range size {
+			switch bw.GrayAt(x, y).Y {
+			default:
+				t.Fatalf("Pixel (%d, %d) is %d, want 0 or 255", x, y, bw.GrayAt(x, y).Y)
+			case 0:
+			case 255:
+				white++
+			}
+		}
+	}
+	if total := size * size; white < total*2/5 || white > total*3/5 {
+		t.Errorf("got %d white pixels out of %d, want about half", white, total)
+	}
+}
@@ -0,0 +1,126 @@
+package url2epub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrBlockedHost is the error returned when the url (or any of its redirects)
+// is blocked by the HostPolicy.
+var ErrBlockedHost = errors.New("url2epub: blocked host")
+
+// HostPolicy defines the hosts GetHTML and Readable are allowed to fetch from,
+// to protect the services fetching user supplied urls from SSRF.
+//
+// The ip addresses are checked after dns resolution when connecting, so they
+// can't be bypassed by hostnames resolving to private addresses or redirects.
+type HostPolicy struct {
+	// If BlockPrivate is set to true, the addresses that are private, loopback,
+	// link-local (including cloud metadata endpoints), unspecified, or
+	// multicast are blocked.
+	BlockPrivate bool
+
+	// The hosts to be blocked, case insensitive.
+	//
+	// A host also blocks all its subdomains, for example "example.com" blocks
+	// "www.example.com" as well.
+	DenyHosts []string
+}
+
+// DefaultHostPolicy is a HostPolicy suitable for publicly exposed services.
+var DefaultHostPolicy = HostPolicy{
+	BlockPrivate: true,
+	DenyHosts: []string{
+		"metadata.google.internal",
+	},
+}
+
+// The shared address space for carrier-grade NAT (RFC 6598), which is not
+// covered by netip.Addr.IsPrivate.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+type hostPolicyKeyType struct{}
+
+var hostPolicyKey hostPolicyKeyType
+
+// checkURL checks the host of u before sending the request.
+//
+// It's nil safe, a nil policy allows everything.
+func (p *HostPolicy) checkURL(u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for _, deny := range p.DenyHosts {
+		deny = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(deny)), ".")
+		if deny == "" {
+			continue
+		}
+		if host == deny || strings.HasSuffix(host, "."+deny) {
+			return fmt.Errorf("%w: %q is denied", ErrBlockedHost, host)
+		}
+	}
+	if !p.BlockPrivate {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %q is loopback", ErrBlockedHost, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkIP checks the resolved ip address.
+//
+// It's nil safe, a nil policy allows everything.
+func (p *HostPolicy) checkIP(ip netip.Addr) error {
+	if p == nil || !p.BlockPrivate {
+		return nil
+	}
+	ip = ip.Unmap()
+	if ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %v is not a public address", ErrBlockedHost, ip)
+	}
+	return nil
+}
+
+// withHostPolicy attaches p to ctx for the dialer to check the addresses.
+func withHostPolicy(ctx context.Context, p *HostPolicy) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, hostPolicyKey, p)
+}
+
+// checkDialAddress is used as the ControlContext of the dialer of NewTransport,
+// to check the address (ip:port) against the HostPolicy attached to ctx.
+func checkDialAddress(ctx context.Context, _, address string, _ syscall.RawConn) error {
+	p, _ := ctx.Value(hostPolicyKey).(*HostPolicy)
+	if p == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: invalid address %q: %w", ErrBlockedHost, address, err)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: invalid address %q: %w", ErrBlockedHost, address, err)
+	}
+	return p.checkIP(ip)
+}
@@ -0,0 +1,160 @@
+package url2epub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHostPolicyCheckURL(t *testing.T) {
+	policy := &HostPolicy{
+		BlockPrivate: true,
+		DenyHosts:    []string{"Example.COM", " metadata.google.internal. "},
+	}
+	for _, c := range []struct {
+		url  string
+		want bool
+	}{
+		{url: "https://example.com/foo", want: true},
+		{url: "https://www.example.com/foo", want: true},
+		{url: "https://notexample.com/foo", want: false},
+		{url: "http://metadata.google.internal/computeMetadata/v1/", want: true},
+		{url: "http://localhost:8080/", want: true},
+		{url: "http://foo.localhost/", want: true},
+		{url: "http://127.0.0.1/", want: true},
+		{url: "http://10.1.2.3/", want: true},
+		{url: "http://172.16.0.1/", want: true},
+		{url: "http://192.168.1.1/", want: true},
+		{url: "http://169.254.169.254/latest/meta-data/", want: true},
+		{url: "http://100.64.0.1/", want: true},
+		{url: "http://0.0.0.0/", want: true},
+		{url: "http://[::1]/", want: true},
+		{url: "http://[fe80::1]/", want: true},
+		{url: "http://[fd00::1]/", want: true},
+		{url: "http://[::ffff:127.0.0.1]/", want: true},
+		{url: "http://8.8.8.8/", want: false},
+		{url: "http://[2001:4860:4860::8888]/", want: false},
+		{url: "https://go.dev/", want: false},
+	} {
+		t.Run(c.url, func(t *testing.T) {
+			u, err := url.Parse(c.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = policy.checkURL(u)
+			if got := errors.Is(err, ErrBlockedHost); got != c.want {
+				t.Errorf("checkURL got %v, want blocked %v", err, c.want)
+			}
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		var policy *HostPolicy
+		u, err := url.Parse("http://127.0.0.1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.checkURL(u); err != nil {
+			t.Errorf("nil policy got %v, want nil", err)
+		}
+	})
+
+	t.Run("allow-private", func(t *testing.T) {
+		policy := &HostPolicy{
+			DenyHosts: []string{"example.com"},
+		}
+		u, err := url.Parse("http://127.0.0.1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.checkURL(u); err != nil {
+			t.Errorf("checkURL got %v, want nil", err)
+		}
+	})
+}
+
+func TestCheckDialAddress(t *testing.T) {
+	ctx := withHostPolicy(context.Background(), &DefaultHostPolicy)
+	for _, c := range []struct {
+		address string
+		want    bool
+	}{
+		{address: "127.0.0.1:80", want: true},
+		{address: "[::1]:443", want: true},
+		{address: "169.254.169.254:80", want: true},
+		{address: "8.8.8.8:443", want: false},
+	} {
+		t.Run(c.address, func(t *testing.T) {
+			err := checkDialAddress(ctx, "tcp", c.address, nil)
+			if got := errors.Is(err, ErrBlockedHost); got != c.want {
+				t.Errorf("checkDialAddress got %v, want blocked %v", err, c.want)
+			}
+			// Without policy attached, everything is allowed.
+			if err := checkDialAddress(context.Background(), "tcp", c.address, nil); err != nil {
+				t.Errorf("checkDialAddress without policy got %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestGetHTMLHostPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://blocked.test/", http.StatusFound)
+			return
+		}
+		w.Header().Set("content-type", "text/html")
+		io.WriteString(w, "<html><body><p>hello</p></body></html>")
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, c := range []struct {
+		label  string
+		path   string
+		policy *HostPolicy
+		want   bool
+	}{
+		{
+			label: "no-policy",
+			path:  "/",
+		},
+		{
+			label: "allow-private",
+			path:  "/",
+			policy: &HostPolicy{
+				DenyHosts: []string{"blocked.test"},
+			},
+		},
+		{
+			label:  "private",
+			path:   "/",
+			policy: &DefaultHostPolicy,
+			want:   true,
+		},
+		{
+			label: "redirect",
+			path:  "/redirect",
+			policy: &HostPolicy{
+				DenyHosts: []string{"blocked.test"},
+			},
+			want: true,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			_, _, err := GetHTML(context.Background(), GetHTMLArgs{
+				URL:        srv.URL + c.path,
+				HostPolicy: c.policy,
+			})
+			if got := errors.Is(err, ErrBlockedHost); got != c.want {
+				t.Errorf("GetHTML got %v, want blocked %v", err, c.want)
+			}
+			if !c.want && err != nil {
+				t.Errorf("GetHTML failed: %v", err)
+			}
+		})
+	}
+}
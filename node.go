@@ -3,6 +3,7 @@ package url2epub
 import (
 	"iter"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
@@ -65,6 +66,31 @@ func (n *Node) FindFirstAtomNode(a atom.Atom) *Node {
 	return found
 }
 
+// FindAllAtomNodes returns an iterator for n itself and all its descendants,
+// with Type == html.ElementNode and DataAtom == a, using depth first search.
+func (n *Node) FindAllAtomNodes(a atom.Atom) iter.Seq[*Node] {
+	return func(yield func(*Node) bool) {
+		n.findAllAtomNodes(a, yield)
+	}
+}
+
+func (n *Node) findAllAtomNodes(a atom.Atom, yield func(*Node) bool) bool {
+	if n == nil {
+		return true
+	}
+	if node := n.AsNode(); node.Type == html.ElementNode && node.DataAtom == a {
+		if !yield(n) {
+			return false
+		}
+	}
+	for c := range n.Children() {
+		if !c.findAllAtomNodes(a, yield) {
+			return false
+		}
+	}
+	return true
+}
+
 // IsAMP returns true if root is an AMP html document.
 func (n *Node) IsAMP() bool {
 	n = n.FindFirstAtomNode(atom.Html)
@@ -93,6 +119,23 @@ func (n *Node) GetLang() string {
 	return ""
 }
 
+// GetDir returns the dir attribute of html node, or body node if html node
+// doesn't have one, in lower case.
+func (n *Node) GetDir() string {
+	for _, a := range []atom.Atom{atom.Html, atom.Body} {
+		node := n.FindFirstAtomNode(a)
+		if node == nil {
+			continue
+		}
+		for _, attr := range node.Attr {
+			if attr.Key == dirKey && attr.Val != "" {
+				return strings.ToLower(strings.TrimSpace(attr.Val))
+			}
+		}
+	}
+	return ""
+}
+
 // GetAMPurl returns the amp URL of the document, if any.
 func (n *Node) GetAMPurl() string {
 	head := n.FindFirstAtomNode(atom.Head)
@@ -114,6 +157,42 @@ func (n *Node) GetAMPurl() string {
 	return found
 }
 
+// GetNextPageURL returns the URL of the next page of a paginated document,
+// if any.
+//
+// It's from the first link or a element with rel="next", with link elements
+// inside head preferred.
+func (n *Node) GetNextPageURL() string {
+	if head := n.FindFirstAtomNode(atom.Head); head != nil {
+		for link := range head.FindAllAtomNodes(atom.Link) {
+			if href, ok := relNextHref(link); ok {
+				return href
+			}
+		}
+	}
+	if body := n.FindFirstAtomNode(atom.Body); body != nil {
+		for a := range body.FindAllAtomNodes(atom.A) {
+			if href, ok := relNextHref(a); ok {
+				return href
+			}
+		}
+	}
+	return ""
+}
+
+// relNextHref returns the href of n if it has "next" in its rel attribute.
+func relNextHref(n *Node) (string, bool) {
+	node := n.AsNode()
+	m := buildAttrMap(&node)
+	for _, rel := range strings.Fields(m["rel"]) {
+		if strings.EqualFold(rel, "next") {
+			href := strings.TrimSpace(m["href"])
+			return href, href != ""
+		}
+	}
+	return "", false
+}
+
 // GetTitle returns the title of the document, if any.
 //
 // Note that if og:title exists in the meta header, it's preferred over title.
@@ -183,6 +262,70 @@ func (n *Node) GetAuthor() (author string) {
 	return ""
 }
 
+// GetDescription returns the description of the document, if any.
+//
+// og:description is preferred over the description meta.
+func (n *Node) GetDescription() (description string) {
+	defer func() {
+		description = strings.TrimSpace(html.UnescapeString(description))
+	}()
+
+	head := n.FindFirstAtomNode(atom.Head)
+	if head == nil {
+		return ""
+	}
+
+	// Try to find og:description.
+	for cc := range head.Children() {
+		c := cc.AsNode()
+		if c.Type != html.ElementNode || c.DataAtom != atom.Meta {
+			continue
+		}
+		m := buildAttrMap(&c)
+		if m["property"] == "og:description" {
+			description = m["content"]
+			break
+		}
+	}
+	if description != "" {
+		return description
+	}
+
+	for cc := range head.Children() {
+		c := cc.AsNode()
+		if c.Type != html.ElementNode || c.DataAtom != atom.Meta {
+			continue
+		}
+		m := buildAttrMap(&c)
+		if m["name"] == "description" {
+			return m["content"]
+		}
+	}
+	return ""
+}
+
+// GetOGImageURL returns the og:image url of the document, if any.
+//
+// Note that the returned url could be relative.
+func (n *Node) GetOGImageURL() string {
+	head := n.FindFirstAtomNode(atom.Head)
+	if head == nil {
+		return ""
+	}
+
+	for cc := range head.Children() {
+		c := cc.AsNode()
+		if c.Type != html.ElementNode || c.DataAtom != atom.Meta {
+			continue
+		}
+		m := buildAttrMap(&c)
+		if m["property"] == "og:image" {
+			return strings.TrimSpace(m["content"])
+		}
+	}
+	return ""
+}
+
 func buildAttrMap(node *html.Node) map[string]string {
 	m := make(map[string]string, len(node.Attr))
 	for _, attr := range node.Attr {
@@ -190,3 +333,20 @@ func buildAttrMap(node *html.Node) map[string]string {
 	}
 	return m
 }
+
+// TextLength returns the total number of runes of the text in n and its
+// descendants, with leading and trailing whitespaces of each text node
+// trimmed.
+func (n *Node) TextLength() int {
+	if n == nil {
+		return 0
+	}
+	if node := n.AsNode(); node.Type == html.TextNode {
+		return utf8.RuneCountInString(strings.TrimSpace(node.Data))
+	}
+	var length int
+	for c := range n.Children() {
+		length += c.TextLength()
+	}
+	return length
+}
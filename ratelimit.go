@@ -0,0 +1,114 @@
+package url2epub
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often HostRateLimiter cleans up the hosts idle long enough to have their
+// buckets refilled.
+const rateLimitCleanupInterval = time.Minute
+
+// HostRateLimiter throttles the outgoing requests of GetHTML and Readable per
+// target host, with a token bucket for each host.
+//
+// A nil *HostRateLimiter is valid and does not throttle any requests.
+type HostRateLimiter struct {
+	perSecond float64
+	burst     float64
+
+	lock        sync.Mutex
+	buckets     map[string]*rateLimitBucket
+	lastCleanup time.Time
+}
+
+type rateLimitBucket struct {
+	// Can be negative, when there are requests waiting for the tokens.
+	tokens float64
+	last   time.Time
+}
+
+// NewHostRateLimiter creates a HostRateLimiter allowing perSecond requests per
+// second to each host, with bursts of up to burst requests.
+//
+// It returns nil (no throttling) when perSecond <= 0. burst < 1 is treated as
+// 1.
+func NewHostRateLimiter(perSecond float64, burst int) *HostRateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &HostRateLimiter{
+		perSecond: perSecond,
+		burst:     float64(max(burst, 1)),
+		buckets:   make(map[string]*rateLimitBucket),
+	}
+}
+
+// Wait blocks until a request to the host of u is allowed, or ctx is done.
+//
+// It's safe to be called concurrently.
+func (l *HostRateLimiter) Wait(ctx context.Context, u *url.URL) error {
+	if l == nil {
+		return nil
+	}
+	delay := l.reserve(strings.ToLower(u.Hostname()), time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// reserve takes a token from the bucket of host at now, and returns how long
+// to wait for the token to become available.
+func (l *HostRateLimiter) reserve(host string, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastCleanup) >= rateLimitCleanupInterval {
+		l.cleanup(now)
+	}
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &rateLimitBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[host] = b
+	}
+	l.refill(b, now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.perSecond * float64(time.Second))
+}
+
+// refill adds the tokens accumulated since the last refill into b.
+func (l *HostRateLimiter) refill(b *rateLimitBucket, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(l.burst, b.tokens+elapsed.Seconds()*l.perSecond)
+		b.last = now
+	}
+}
+
+// cleanup removes the buckets that are full at now, as they are the same as
+// new ones.
+func (l *HostRateLimiter) cleanup(now time.Time) {
+	l.lastCleanup = now
+	for host, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, host)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package url2epub
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHostRateLimiterReserve(t *testing.T) {
+	l := NewHostRateLimiter(2, 3)
+	start := time.Now()
+
+	for i, want := range []time.Duration{
+		0,
+		0,
+		0,
+		500 * time.Millisecond,
+		time.Second,
+	} {
+		if got := l.reserve("example.com", start); got != want {
+			t.Errorf("reserve #%d got %v, want %v", i, got, want)
+		}
+	}
+	if got := l.reserve("example.org", start); got != 0 {
+		t.Errorf("reserve of another host got %v, want 0", got)
+	}
+
+	// The 2 reserved tokens are paid back after 1s, then 1 more token after
+	// another 0.5s.
+	if got := l.reserve("example.com", start.Add(1500*time.Millisecond)); got != 0 {
+		t.Errorf("reserve after refill got %v, want 0", got)
+	}
+	if got, want := len(l.buckets), 2; got != want {
+		t.Errorf("got %d buckets, want %d", got, want)
+	}
+
+	// example.org is idle long enough to be full, example.com is not.
+	l.reserve("example.com", start.Add(rateLimitCleanupInterval))
+	if _, ok := l.buckets["example.org"]; ok {
+		t.Error("idle host example.org is not cleaned up")
+	}
+	if _, ok := l.buckets["example.com"]; !ok {
+		t.Error("active host example.com is cleaned up")
+	}
+}
+
+func TestHostRateLimiterWait(t *testing.T) {
+	u, err := url.Parse("https://example.com/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		var l *HostRateLimiter
+		if err := l.Wait(context.Background(), u); err != nil {
+			t.Errorf("Wait got error %v", err)
+		}
+		if l := NewHostRateLimiter(0, 1); l != nil {
+			t.Errorf("NewHostRateLimiter(0, 1) got %v, want nil", l)
+		}
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		l := NewHostRateLimiter(20, 1)
+		start := time.Now()
+		for range 3 {
+			if err := l.Wait(context.Background(), u); err != nil {
+				t.Fatalf("Wait got error %v", err)
+			}
+		}
+		if took, want := time.Since(start), 100*time.Millisecond; took < want {
+			t.Errorf("3 requests took %v, want at least %v", took, want)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		l := NewHostRateLimiter(0.1, 1)
+		if err := l.Wait(context.Background(), u); err != nil {
+			t.Fatalf("Wait got error %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := l.Wait(ctx, u); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Wait got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
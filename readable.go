@@ -1,19 +1,27 @@
 package url2epub
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log/slog"
+	"maps"
+	"math"
+	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"go.yhsif.com/immutable"
 	"golang.org/x/net/html"
@@ -26,14 +34,25 @@ const (
 	imgSrc    = "src"
 	imgSrcset = "srcset"
 	jpgExt    = ".jpg"
+	gifExt    = ".gif"
 
 	langKey = "lang"
+	dirKey  = "dir"
 )
 
 var emptyStringSet = immutable.EmptySet[string]()
 
+// ErrNoBody is the error returned by Readable when nothing is left in the body
+// of the document after removing the unreadable parts, which usually means the
+// content of the page is rendered by JavaScript.
+var ErrNoBody = errors.New("no body tag found")
+
 var imgAtoms = immutable.SetLiteral(atom.Img, atom.Source)
 
+// The attributes of images only kept when we don't transform images,
+// see (*readableState).keepImgDimensions.
+var imgDimensions = immutable.SetLiteral("width", "height")
+
 // A map of:
 // key: atoms we want to keep in the readable html.
 // value: the attributes we want to keep inside this atom.
@@ -54,7 +73,8 @@ var atoms = map[atom.Atom]immutable.Set[string]{
 		imgSrc,
 		imgSrcset,
 		"alt",
-		// Do not keep width and height here as we might downscale it
+		// Do not keep width and height here as we might downscale it,
+		// see imgDimensions.
 	),
 	atom.Source: immutable.SetLiteral(
 		imgSrc,
@@ -149,17 +169,67 @@ type ReadableArgs struct {
 	// User-Agent to be used to download images.
 	UserAgent string
 
+	// If non-empty, override UserAgent for image downloads only.
+	//
+	// Some CDNs block or serve different responses to image requests based on
+	// User-Agent.
+	ImageUserAgent string
+
+	// The Referer header of image downloads, default to BaseURL when empty.
+	//
+	// Many hotlink protections reject image requests without a Referer
+	// matching the article's origin.
+	ImageReferer string
+
+	// If NoImageReferer is set to true, no Referer header will be sent with
+	// image downloads, and ImageReferer is ignored.
+	NoImageReferer bool
+
 	// Directory prefix for downloaded images.
 	ImagesDir string
 
 	// If Grayscale is set to true,
 	// all images will be grayscaled and encoded as jpegs.
+	//
+	// It's the same as ImageModeGray, and only used when ImageMode is
+	// ImageModeDefault.
 	Grayscale bool
 
+	// How to process the images, default to ImageModeDefault.
+	ImageMode ImageMode
+
 	// Downscale images to fit in NxN,
-	// only used when Grayscale is set to true.
+	// only used when Grayscale is set to true (or with ImageModeGray or
+	// ImageModeBW).
 	FitImage int
 
+	// The quality (1-100) of the jpegs encoded from the grayscaled images,
+	// only used when Grayscale is set to true (or with ImageModeGray).
+	//
+	// <=0 means grayscale.DefaultJPEGQuality.
+	JPEGQuality int
+
+	// If Grayscale8 is set to true, images are grayscaled into 8-bit instead
+	// of 16-bit, which produces smaller jpegs,
+	// only used when Grayscale is set to true (or with ImageModeGray).
+	Grayscale8 bool
+
+	// The cutoff of ImageModeBW, pixels darker than it become black.
+	//
+	// 0 means grayscale.DefaultThresholdLevel.
+	ThresholdLevel uint16
+
+	// If Dither is set to true, ImageModeBW uses Floyd–Steinberg dithering,
+	// which keeps the shades of photos better.
+	Dither bool
+
+	// If FlattenAnimated is set to true, gif images are replaced by their first
+	// frame and encoded as pngs, as animated gifs bloat the epub and are usually
+	// not rendered properly on e-ink screens,
+	// only used with ImageModeColor (the other modes always only keep the first
+	// frame).
+	FlattenAnimated bool
+
 	// Set the minimal number of readable nodes under the first article node to
 	// use that instead of body.
 	//
@@ -167,29 +237,339 @@ type ReadableArgs struct {
 	// and use the body node instead.
 	//
 	// <=0 to disable this check (always use first article node if found).
+	//
+	// When ArticleStrategy considers other nodes (for example main),
+	// the same check applies to them as well.
 	MinArticleNodes int
+
+	// Set the minimal number of non-whitespace characters of the text under the
+	// first article node to use that instead of body.
+	//
+	// It complements MinArticleNodes, as a node could have a lot of nodes under
+	// it but very little text (for example lots of nested spans).
+	// When the article node fails either check, body node is used instead.
+	//
+	// <=0 to disable this check.
+	MinArticleText int
+
+	// The strategy to pick the article node, default to ArticleFirst.
+	ArticleStrategy ArticleStrategy
+
+	// The cookie jar to be used to download images, optional.
+	CookieJar http.CookieJar
+
+	// The http client to be used to download images and next pages, optional.
+	//
+	// See GetHTMLArgs.Client for more details.
+	Client *http.Client
+
+	// The policy of the hosts allowed to download images and next pages from,
+	// optional.
+	//
+	// The blocked images are treated as failed downloads, without retries.
+	HostPolicy *HostPolicy
+
+	// The rate limiter to throttle the image downloads and next pages,
+	// optional.
+	//
+	// The time waiting for the rate limiter counts towards PerImageTimeout.
+	RateLimiter *HostRateLimiter
+
+	// How to handle svg images, default to SVGDrop.
+	SVGMode SVGMode
+
+	// If SkipImages is set to true, all images are dropped without being
+	// downloaded.
+	SkipImages bool
+
+	// When SkipImages is true, replace images with their alt text (if any)
+	// instead of dropping them completely.
+	KeepImageAlt bool
+
+	// If OGImageFallback is set to true and no images were extracted from the
+	// article, the og:image of the document (if any) will be inserted at the top
+	// of the article.
+	OGImageFallback bool
+
+	// The max number of images to be downloaded concurrently,
+	// <=0 to use DefaultMaxConcurrentImages.
+	MaxConcurrentImages int
+
+	// The timeout of downloading a single image, <=0 means no timeout other
+	// than the one from ctx.
+	//
+	// When an image download times out, it's handled the same way as other
+	// download errors.
+	PerImageTimeout time.Duration
+
+	// The number of extra attempts to download an image after network errors or
+	// 5xx status codes, 0 to use DefaultImageDownloadRetries, <0 to disable
+	// retries.
+	ImageDownloadRetries int
+
+	// The max number of next pages to follow for paginated documents,
+	// <=0 to disable.
+	//
+	// When it's >0, the next pages (see Node.GetNextPageURL) are downloaded and
+	// their readable content appended to the body, until there's no next page,
+	// the next page was already visited, or the limit is reached.
+	//
+	// It requires BaseURL to be set.
+	FollowNextPages int
+
+	// The selectors of the cookie consent banners to be dropped with everything
+	// under them, see DefaultConsentSelectors for the format.
+	//
+	// nil means DefaultConsentSelectors. To extend it, append to a copy of
+	// DefaultConsentSelectors. To disable it, use an empty non-nil slice.
+	ConsentSelectors []string
+}
+
+// DefaultMaxConcurrentImages is the default value of
+// ReadableArgs.MaxConcurrentImages.
+const DefaultMaxConcurrentImages = 8
+
+// DefaultImageDownloadRetries is the default value of
+// ReadableArgs.ImageDownloadRetries.
+const DefaultImageDownloadRetries = 1
+
+// The backoff before the first retry of image downloads, doubled on every
+// following retry.
+const imageRetryBackoff = 200 * time.Millisecond
+
+// ArticleStrategy defines how Readable picks the node containing the main
+// content of the document.
+//
+// If none of the candidates of the strategy passes the MinArticleNodes and
+// MinArticleText checks, the body node is used instead.
+type ArticleStrategy int
+
+// ArticleStrategy values.
+const (
+	// Use the first article node.
+	ArticleFirst ArticleStrategy = iota
+
+	// Use the first main node, then the first article node.
+	ArticlePreferMain
+
+	// Use the article node with the most readable nodes under it.
+	//
+	// This is useful for pages with multiple article nodes, for example blog
+	// index pages with teaser cards, where the first one is not necessarily the
+	// full content.
+	ArticleLargest
+)
+
+// ImageMode defines how Readable processes the downloaded images.
+type ImageMode int
+
+// ImageMode values.
+const (
+	// Use ImageModeGray when Grayscale is set to true, ImageModeColor otherwise.
+	ImageModeDefault ImageMode = iota
+
+	// Keep the images as-is.
+	ImageModeColor
+
+	// Grayscale the images and encode them as jpegs.
+	ImageModeGray
+
+	// Convert the images into pure black and white and encode them as pngs,
+	// for scanned text.
+	ImageModeBW
+)
+
+// readableState holds the states shared by all the readableRecursive calls
+// inside a single Readable call.
+type readableState struct {
+	args *ReadableArgs
+	// The base URL of the page being processed, which is args.BaseURL for the
+	// first page.
+	baseURL *url.URL
+
+	wg sync.WaitGroup
+	// Semaphore to limit the number of concurrent image downloads.
+	sem chan struct{}
+
+	// key: image local filename
+	// value: pointer to the image content, filled by the download goroutines
+	images map[string]*io.Reader
+	// key: image src url
+	// value: image local filename
+	imgMapping map[string]string
+	imgCounter int
+
+	// Guards dropped and renamed.
+	droppedLock sync.Mutex
+	// The local filenames of the images to be dropped
+	dropped []string
+	// key: image local filename
+	// value: the new local filename with the extension matching its content
+	renamed map[string]string
+
+	// The cookie consent banners to be dropped.
+	consent consentMatcher
+}
+
+// addImage starts downloading the image from srcURL in the background,
+// and returns its local filename.
+//
+// If the same srcURL was already added before, the same local filename is
+// returned without downloading it again.
+func (state *readableState) addImage(ctx context.Context, srcURL *url.URL) string {
+	src := srcURL.String()
+	if filename, exists := state.imgMapping[src]; exists {
+		// This image url already appeared before, reuse the same local file.
+		return filename
+	}
+	state.imgCounter++
+	ext := path.Ext(srcURL.Path)
+	if state.args.imageMode() != ImageModeColor {
+		ext = state.args.imageExt()
+	} else if state.args.SVGMode == SVGRasterize && strings.EqualFold(ext, svgExt) {
+		ext = pngExt
+	} else if state.args.FlattenAnimated && strings.EqualFold(ext, gifExt) {
+		ext = pngExt
+	}
+	filename := fmt.Sprintf("%03d", state.imgCounter) + ext
+	filename = path.Join(state.args.ImagesDir, filename)
+	state.imgMapping[src] = filename
+	reader := new(io.Reader)
+	state.images[filename] = reader
+	state.wg.Add(1)
+	go func() {
+		defer state.wg.Done()
+		select {
+		case state.sem <- struct{}{}:
+			defer func() { <-state.sem }()
+		case <-ctx.Done():
+			// downloadImage will fail fast with the context error.
+		}
+		keep, contentExt := downloadImage(ctx, srcURL, state.args, reader)
+		if !keep {
+			state.dropImage(filename)
+			return
+		}
+		if ext := path.Ext(filename); contentExt != "" && !strings.EqualFold(contentExt, ext) {
+			state.renameImage(filename, strings.TrimSuffix(filename, ext)+contentExt)
+		}
+	}()
+	return filename
+}
+
+// keepImgDimensions returns true if the width and height attributes of images
+// should be kept.
+//
+// They are only kept when the images will not be downscaled.
+func (state *readableState) keepImgDimensions() bool {
+	return state.args.imageMode() == ImageModeColor && state.args.FitImage <= 0
+}
+
+// isImgDimension returns true if attr is a valid width or height attribute
+// of images.
+func isImgDimension(attr html.Attribute) bool {
+	if !imgDimensions.Contains(attr.Key) {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(attr.Val))
+	return err == nil && n > 0
+}
+
+// dropImage marks the image to be dropped from the final result.
+//
+// It's safe to be called concurrently.
+func (state *readableState) dropImage(filename string) {
+	state.droppedLock.Lock()
+	defer state.droppedLock.Unlock()
+	state.dropped = append(state.dropped, filename)
+}
+
+// renameImage marks the image to be renamed to newName in the final result.
+//
+// It's safe to be called concurrently.
+func (state *readableState) renameImage(filename, newName string) {
+	state.droppedLock.Lock()
+	defer state.droppedLock.Unlock()
+	if state.renamed == nil {
+		state.renamed = make(map[string]string)
+	}
+	state.renamed[filename] = newName
+}
+
+// addImageData adds an image with already known content, and returns its
+// local filename.
+func (state *readableState) addImageData(data []byte, ext string) string {
+	state.imgCounter++
+	filename := fmt.Sprintf("%03d", state.imgCounter) + ext
+	filename = path.Join(state.args.ImagesDir, filename)
+	reader := io.Reader(bytes.NewBuffer(data))
+	state.images[filename] = &reader
+	return filename
+}
+
+// addDataURI adds the image from a data uri src, and returns its local
+// filename.
+//
+// svg data uris are handled by addSVGDataURI. For other images the content type
+// is sniffed from the decoded data instead of trusting the declared media type,
+// and it returns empty string if it's not a supported raster image.
+func (state *readableState) addDataURI(ctx context.Context, src string) string {
+	mediaType, data, ok := parseDataURI(src)
+	if !ok {
+		return ""
+	}
+	if mediaType == svgMediaType {
+		return state.addSVGDataURI(ctx, src)
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return ""
+	}
+	ext, ok := imageExts[detectImageContentType(data)]
+	if !ok {
+		slog.DebugContext(ctx, "Unsupported data uri image", "mediaType", mediaType, "size", len(data))
+		return ""
+	}
+	if state.args.imageMode() == ImageModeColor {
+		if state.args.FlattenAnimated && ext == gifExt {
+			buf, err := flattenGIF(data)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error while trying to flatten data uri gif", "err", err)
+				return state.addImageData(data, ext)
+			}
+			return state.addImageData(buf.Bytes(), pngExt)
+		}
+		return state.addImageData(data, ext)
+	}
+	img, _, err := grayscale.Decode(bytes.NewReader(data))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while trying to grayscale data uri image", "err", err)
+		return state.addImageData(data, ext)
+	}
+	buf, err := state.args.encodeImage(img)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error while trying to encode grayscaled data uri image", "err", err)
+		return state.addImageData(data, ext)
+	}
+	return state.addImageData(buf.Bytes(), state.args.imageExt())
 }
 
 // Readable strips node n into a readable one, with all images downloaded and
 // replaced.
 func (n *Node) Readable(ctx context.Context, args ReadableArgs) (*html.Node, map[string]io.Reader, error) {
-	imgPointers := make(map[string]*io.Reader)
-	imgMapping := make(map[string]string)
-	var wg sync.WaitGroup
-	var counter int
-
-	head, err := n.FindFirstAtomNode(atom.Head).readableRecursive(
-		ctx,
-		&wg,
-		args.BaseURL,
-		args.UserAgent,
-		args.ImagesDir,
-		imgPointers,
-		imgMapping,
-		&counter,
-		args.Grayscale,
-		args.FitImage,
-	)
+	maxImages := args.MaxConcurrentImages
+	if maxImages <= 0 {
+		maxImages = DefaultMaxConcurrentImages
+	}
+	state := &readableState{
+		args:       &args,
+		baseURL:    args.BaseURL,
+		sem:        make(chan struct{}, maxImages),
+		images:     make(map[string]*io.Reader),
+		imgMapping: make(map[string]string),
+		consent:    newConsentMatcher(args.consentSelectors()),
+	}
+
+	head, err := n.FindFirstAtomNode(atom.Head).readableRecursive(ctx, state)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -236,56 +616,17 @@ func (n *Node) Readable(ctx context.Context, args ReadableArgs) (*html.Node, map
 		})
 	}
 
-	var body *html.Node
-	articleNode := n.FindFirstAtomNode(atom.Article)
-	if articleNode != nil && args.MinArticleNodes > 0 {
-		count, hasMin := articleNode.countRecursive(args.MinArticleNodes)
-		slog.DebugContext(ctx, "found article node", "nodes", count, "min", args.MinArticleNodes, "hasMin", hasMin)
-		if !hasMin {
-			articleNode = nil
-		}
-	}
-	article, err := articleNode.readableRecursive(
-		ctx,
-		&wg,
-		args.BaseURL,
-		args.UserAgent,
-		args.ImagesDir,
-		imgPointers,
-		imgMapping,
-		&counter,
-		args.Grayscale,
-		args.FitImage,
-	)
+	body, err := n.readableBody(ctx, state)
 	if err != nil {
 		return nil, nil, err
 	}
-	if article == nil {
-		body, err = n.FindFirstAtomNode(atom.Body).readableRecursive(
-			ctx,
-			&wg,
-			args.BaseURL,
-			args.UserAgent,
-			args.ImagesDir,
-			imgPointers,
-			imgMapping,
-			&counter,
-			args.Grayscale,
-			args.FitImage,
-		)
-		if err != nil {
-			return nil, nil, err
+	if args.OGImageFallback && !args.SkipImages && state.imgCounter == 0 {
+		if img := n.ogImageNode(ctx, state); img != nil {
+			body.InsertBefore(img, body.FirstChild)
 		}
-		if body == nil {
-			return nil, nil, errors.New("no body tag found")
-		}
-	} else {
-		body = &html.Node{
-			Type:     html.ElementNode,
-			DataAtom: atom.Body,
-			Data:     atom.Body.String(),
-		}
-		body.AppendChild(article)
+	}
+	if args.FollowNextPages > 0 && args.BaseURL != nil {
+		n.appendNextPages(ctx, state, body)
 	}
 
 	root := &html.Node{
@@ -294,21 +635,39 @@ func (n *Node) Readable(ctx context.Context, args ReadableArgs) (*html.Node, map
 		Data:     atom.Html.String(),
 	}
 	if lang := n.GetLang(); lang != "" {
-		root.Attr = []html.Attribute{
-			{
-				Key: langKey,
-				Val: lang,
-			},
-		}
+		root.Attr = append(root.Attr, html.Attribute{
+			Key: langKey,
+			Val: lang,
+		})
+	}
+	if dir := n.GetDir(); dir != "" {
+		root.Attr = append(root.Attr, html.Attribute{
+			Key: dirKey,
+			Val: dir,
+		})
 	}
 	if head != nil {
 		root.AppendChild(head)
 	}
 	root.AppendChild(body)
 
-	wg.Wait()
-	images := make(map[string]io.Reader, len(imgPointers))
-	for k, v := range imgPointers {
+	state.wg.Wait()
+	if len(state.renamed) > 0 {
+		renameImgNodes(root, state.renamed)
+		for filename, newName := range state.renamed {
+			state.images[newName] = state.images[filename]
+			delete(state.images, filename)
+		}
+	}
+	if len(state.dropped) > 0 {
+		dropped := immutable.SetLiteral(state.dropped...)
+		removeImgNodes(root, dropped)
+		for filename := range dropped.All() {
+			delete(state.images, filename)
+		}
+	}
+	images := make(map[string]io.Reader, len(state.images))
+	for k, v := range state.images {
 		var reader io.Reader
 		if v != nil && *v != nil {
 			reader = *v
@@ -317,9 +676,226 @@ func (n *Node) Readable(ctx context.Context, args ReadableArgs) (*html.Node, map
 		}
 		images[k] = reader
 	}
+	dedupImages(root, images)
 	return root, images, err
 }
 
+// dedupImages removes the images with identical content from images, and
+// repoints the img nodes using them to the one with the smallest filename.
+//
+// The same image is sometimes served under different urls (for example with
+// different query strings), which can only be detected after they are
+// downloaded.
+func dedupImages(root *html.Node, images map[string]io.Reader) {
+	seen := make(map[[sha256.Size]byte]string, len(images))
+	replaced := make(map[string]string)
+	for _, filename := range slices.Sorted(maps.Keys(images)) {
+		data, err := io.ReadAll(images[filename])
+		images[filename] = bytes.NewReader(data)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if existing, ok := seen[hash]; ok {
+			replaced[filename] = existing
+			delete(images, filename)
+			continue
+		}
+		seen[hash] = filename
+	}
+	if len(replaced) > 0 {
+		replaceImgSrcs(root, replaced)
+	}
+}
+
+// replaceImgSrcs replaces the src of all the img nodes under node according to
+// replaced map.
+func replaceImgSrcs(node *html.Node, replaced map[string]string) {
+	for c := range node.Descendants() {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Img {
+			continue
+		}
+		for i, attr := range c.Attr {
+			if attr.Key != imgSrc {
+				continue
+			}
+			if to, ok := replaced[attr.Val]; ok {
+				c.Attr[i].Val = to
+			}
+		}
+	}
+}
+
+// readableBody returns the readable body node of document n.
+func (n *Node) readableBody(ctx context.Context, state *readableState) (*html.Node, error) {
+	articleNode := n.findArticleNode(ctx, *state.args)
+	article, err := articleNode.readableRecursive(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	if article == nil {
+		body, err := n.FindFirstAtomNode(atom.Body).readableRecursive(ctx, state)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			return nil, ErrNoBody
+		}
+		return body, nil
+	}
+	body := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Body,
+		Data:     atom.Body.String(),
+	}
+	body.AppendChild(article)
+	return body, nil
+}
+
+// appendNextPages follows the next pages of document n, and appends their
+// readable content to body.
+//
+// Failures on the next pages are logged and stop the following, but are not
+// returned as the content of the previous pages is still usable.
+func (n *Node) appendNextPages(ctx context.Context, state *readableState, body *html.Node) {
+	visited := map[string]bool{
+		state.baseURL.String(): true,
+	}
+	page := n
+	for range state.args.FollowNextPages {
+		next := page.GetNextPageURL()
+		if next == "" {
+			return
+		}
+		nextURL, err := url.Parse(next)
+		if err != nil {
+			slog.DebugContext(ctx, "Invalid next page url", "err", err, "url", next)
+			return
+		}
+		nextURL = state.baseURL.ResolveReference(nextURL)
+		nextURL.Fragment = ""
+		if visited[nextURL.String()] {
+			return
+		}
+		visited[nextURL.String()] = true
+
+		root, lastURL, err := GetHTML(ctx, GetHTMLArgs{
+			URL:         nextURL.String(),
+			UserAgent:   state.args.UserAgent,
+			CookieJar:   state.args.CookieJar,
+			HostPolicy:  state.args.HostPolicy,
+			RateLimiter: state.args.RateLimiter,
+			Client:      state.args.Client,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get next page", "err", err, "url", nextURL.String())
+			return
+		}
+		visited[lastURL.String()] = true
+		state.baseURL = lastURL
+		pageBody, err := root.readableBody(ctx, state)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get readable next page", "err", err, "url", lastURL.String())
+			return
+		}
+		for c := pageBody.FirstChild; c != nil; {
+			next := c.NextSibling
+			pageBody.RemoveChild(c)
+			body.AppendChild(c)
+			c = next
+		}
+		page = root
+	}
+}
+
+// ogImageNode returns an img node for the og:image of document n, or nil if
+// it doesn't have a usable one.
+func (n *Node) ogImageNode(ctx context.Context, state *readableState) *html.Node {
+	srcURL := tryParseImgURL(n.GetOGImageURL())
+	if srcURL == nil || (srcURL.Host == "" && srcURL.Path == "") {
+		return nil
+	}
+	srcURL = state.baseURL.ResolveReference(srcURL)
+	return &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Img,
+		Data:     atom.Img.String(),
+		Attr: []html.Attribute{
+			{
+				Key: imgSrc,
+				Val: state.addImage(ctx, srcURL),
+			},
+			{
+				Key: "alt",
+			},
+		},
+	}
+}
+
+// findArticleNode returns the node to be used as article based on
+// args.ArticleStrategy, or nil if none of the candidates qualifies.
+func (n *Node) findArticleNode(ctx context.Context, args ReadableArgs) *Node {
+	var candidates []*Node
+	switch args.ArticleStrategy {
+	default:
+		candidates = []*Node{n.FindFirstAtomNode(atom.Article)}
+	case ArticlePreferMain:
+		candidates = []*Node{
+			n.FindFirstAtomNode(atom.Main),
+			n.FindFirstAtomNode(atom.Article),
+		}
+	case ArticleLargest:
+		candidates = []*Node{n.findLargestAtomNode(ctx, atom.Article)}
+	}
+	for _, node := range candidates {
+		if node == nil {
+			continue
+		}
+		if node.isArticle(ctx, args) {
+			return node
+		}
+	}
+	return nil
+}
+
+// isArticle returns whether n passes the MinArticleNodes and MinArticleText
+// checks.
+func (n *Node) isArticle(ctx context.Context, args ReadableArgs) bool {
+	if args.MinArticleNodes > 0 {
+		count, hasMin := n.countRecursive(args.MinArticleNodes)
+		slog.DebugContext(ctx, "found article node", "atom", n.Data, "nodes", count, "min", args.MinArticleNodes, "hasMin", hasMin)
+		if !hasMin {
+			return false
+		}
+	}
+	if args.MinArticleText > 0 {
+		length, hasMin := n.textRecursive(args.MinArticleText)
+		slog.DebugContext(ctx, "found article node", "atom", n.Data, "text", length, "min", args.MinArticleText, "hasMin", hasMin)
+		if !hasMin {
+			return false
+		}
+	}
+	return true
+}
+
+// findLargestAtomNode returns the node with DataAtom == a and the most readable
+// nodes under it.
+//
+// When there are ties, the first one wins.
+func (n *Node) findLargestAtomNode(ctx context.Context, a atom.Atom) *Node {
+	var largest *Node
+	maxCount := -1
+	for node := range n.FindAllAtomNodes(a) {
+		count, _ := node.countRecursive(math.MaxInt)
+		slog.DebugContext(ctx, "found candidate node", "atom", node.Data, "nodes", count)
+		if count > maxCount {
+			largest = node
+			maxCount = count
+		}
+	}
+	return largest
+}
+
 var allowedSrcSchemes = immutable.SetLiteral(
 	"", // important for relative image urls
 	"https",
@@ -382,6 +958,44 @@ func findSrcURLFromIMGNode(
 	return tryParseImgSrcset(node.Attr[srcsetIndex].Val)
 }
 
+// textRecursive counts the non-whitespace characters of the text under the
+// readable nodes of n, the same way countRecursive counts the nodes.
+func (n *Node) textRecursive(minLength int) (length int, hasMin bool) {
+	if n == nil {
+		return 0, false
+	}
+	node := n.AsNode()
+	switch node.Type {
+	default:
+		return 0, false
+
+	case html.TextNode:
+		for _, r := range node.Data {
+			if !unicode.IsSpace(r) {
+				length++
+			}
+		}
+		if length >= minLength {
+			return 0, true
+		}
+		return length, false
+
+	case html.ElementNode:
+		if _, ok := atoms[node.DataAtom]; !ok {
+			// Not an atom we want to keep.
+			return 0, false
+		}
+		for c := range n.Children() {
+			subLength, hit := c.textRecursive(minLength - length)
+			if hit {
+				return 0, true
+			}
+			length += subLength
+		}
+		return length, false
+	}
+}
+
 func (n *Node) countRecursive(minCount int) (count int, hasMin bool) {
 	if n == nil {
 		return 0, false
@@ -431,18 +1045,7 @@ func (n *Node) countRecursive(minCount int) (count int, hasMin bool) {
 	}
 }
 
-func (n *Node) readableRecursive(
-	ctx context.Context,
-	wg *sync.WaitGroup,
-	baseURL *url.URL,
-	userAgent string,
-	imagesDir string,
-	images map[string]*io.Reader,
-	imgMapping map[string]string,
-	imgCounter *int,
-	gray bool,
-	fitImage int,
-) (*html.Node, error) {
+func (n *Node) readableRecursive(ctx context.Context, state *readableState) (*html.Node, error) {
 	if n == nil {
 		return nil, nil
 	}
@@ -465,27 +1068,17 @@ func (n *Node) readableRecursive(
 		}, nil
 
 	case html.ElementNode:
-		if node.DataAtom == atom.Noscript {
-			child := node.FirstChild
-			if child == nil || child != node.LastChild || child.Type != html.TextNode {
-				// We only care about a single TextNode inside noscript.
-				return nil, nil
-			}
-			childNode, err := html.Parse(strings.NewReader(child.Data))
-			if err != nil {
-				slog.DebugContext(
-					ctx,
-					"Failed to parse noscript data",
-					"err", err,
-					"data", child.Data,
-				)
-			}
-			if img := FromNode(childNode).FindFirstAtomNode(atom.Img); img != nil {
-				node = img.AsNode()
-			} else {
-				// No img node found
+		if state.consent.matches(&node) {
+			return nil, nil
+		}
+		switch node.DataAtom {
+		case atom.Noscript:
+			return n.readableNoscript(ctx, state)
+		case atom.Svg:
+			if state.args.SkipImages {
 				return nil, nil
 			}
+			return readableSVG(ctx, &node, state), nil
 		}
 		// Copy key fields.
 		newNode := &html.Node{
@@ -511,6 +1104,8 @@ func (n *Node) readableRecursive(
 			i := len(newNode.Attr)
 			if newNode.DataAtom == atom.Img && imgSrcAlternatives.Contains(attr.Key) {
 				altSrcIndices = append(altSrcIndices, i)
+			} else if imgAtoms.Contains(newNode.DataAtom) && state.keepImgDimensions() && isImgDimension(attr) {
+				attr.Val = strings.TrimSpace(attr.Val)
 			} else if !attrs.Contains(attr.Key) {
 				continue
 			}
@@ -522,44 +1117,30 @@ func (n *Node) readableRecursive(
 				srcsetIndex = i
 			}
 		}
+		if imgAtoms.Contains(newNode.DataAtom) && state.args.SkipImages {
+			return imgAltTextNode(newNode, state.args), nil
+		}
 		if imgAtoms.Contains(newNode.DataAtom) {
 			// Special handling for images.
 			newNode.DataAtom = atom.Img
 			newNode.Data = atom.Img.String()
-			srcURL := findSrcURLFromIMGNode(newNode, append([]int{srcIndex}, altSrcIndices...), srcsetIndex)
-			if srcURL == nil {
+			var filename string
+			if srcURL := findSrcURLFromIMGNode(newNode, append([]int{srcIndex}, altSrcIndices...), srcsetIndex); srcURL != nil {
+				filename = state.addImage(ctx, state.baseURL.ResolveReference(srcURL))
+			} else if srcIndex >= 0 {
+				filename = state.addDataURI(ctx, newNode.Attr[srcIndex].Val)
+			}
+			if filename == "" {
 				// No usable src, skip this image
 				return nil, nil
 			}
-			srcURL = baseURL.ResolveReference(srcURL)
-			src := srcURL.String()
 			if srcIndex < 0 {
 				srcIndex = len(newNode.Attr)
 				newNode.Attr = append(newNode.Attr, html.Attribute{
 					Key: imgSrc,
 				})
 			}
-			if filename, exists := imgMapping[src]; exists {
-				// This image url already appeared before, reuse the same local file.
-				newNode.Attr[srcIndex].Val = filename
-			} else {
-				*imgCounter++
-				ext := path.Ext(srcURL.Path)
-				if gray {
-					ext = jpgExt
-				}
-				filename = fmt.Sprintf("%03d", *imgCounter) + ext
-				filename = path.Join(imagesDir, filename)
-				newNode.Attr[srcIndex].Val = filename
-				imgMapping[src] = filename
-				reader := new(io.Reader)
-				images[filename] = reader
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					downloadImage(ctx, srcURL, userAgent, reader, gray, fitImage)
-				}()
-			}
+			newNode.Attr[srcIndex].Val = filename
 			// Remove srcset if they are there
 			if srcsetIndex >= 0 {
 				newNode.Attr = append(
@@ -576,7 +1157,7 @@ func (n *Node) readableRecursive(
 			return newNode, nil
 		}
 		for c := range n.Children() {
-			child, err := c.readableRecursive(ctx, wg, baseURL, userAgent, imagesDir, images, imgMapping, imgCounter, gray, fitImage)
+			child, err := c.readableRecursive(ctx, state)
 			if err != nil {
 				return nil, err
 			}
@@ -593,8 +1174,257 @@ func (n *Node) readableRecursive(
 	}
 }
 
-func downloadImage(ctx context.Context, src *url.URL, userAgent string, dest *io.Reader, gray bool, fitImage int) {
-	body, _, err := get(ctx, src, userAgent)
+// readableNoscript parses the inner html of noscript node n, and returns the
+// first usable img inside it.
+//
+// Depending on whether the document was parsed with scripting enabled, the
+// content of noscript could be either text nodes or element nodes, so we
+// render them back into html before parsing.
+func (n *Node) readableNoscript(ctx context.Context, state *readableState) (*html.Node, error) {
+	var sb strings.Builder
+	for c := range n.Children() {
+		child := c.AsNode()
+		if child.Type == html.TextNode {
+			sb.WriteString(child.Data)
+			continue
+		}
+		if err := html.Render(&sb, &child); err != nil {
+			slog.DebugContext(ctx, "Failed to render noscript child", "err", err)
+		}
+	}
+	data := sb.String()
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+	root, err := html.Parse(strings.NewReader(data))
+	if err != nil {
+		slog.DebugContext(
+			ctx,
+			"Failed to parse noscript data",
+			"err", err,
+			"data", data,
+		)
+		return nil, nil
+	}
+	for img := range FromNode(root).FindAllAtomNodes(atom.Img) {
+		newNode, err := img.readableRecursive(ctx, state)
+		if err != nil {
+			return nil, err
+		}
+		if newNode != nil {
+			return newNode, nil
+		}
+	}
+	// No usable img node found
+	return nil, nil
+}
+
+// imgAltTextNode returns a text node with the alt text of img node, or nil if
+// args.KeepImageAlt is false or it doesn't have alt text.
+func imgAltTextNode(node *html.Node, args *ReadableArgs) *html.Node {
+	if !args.KeepImageAlt || node.DataAtom != atom.Img {
+		return nil
+	}
+	for _, attr := range node.Attr {
+		if attr.Key == "alt" {
+			if alt := strings.TrimSpace(attr.Val); alt != "" {
+				return &html.Node{
+					Type: html.TextNode,
+					Data: alt,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// removeImgNodes removes all the img nodes with src in filenames from node's
+// descendants.
+func removeImgNodes(node *html.Node, filenames immutable.Set[string]) {
+	for c := node.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && c.DataAtom == atom.Img {
+			for _, attr := range c.Attr {
+				if attr.Key == imgSrc && filenames.Contains(attr.Val) {
+					node.RemoveChild(c)
+					break
+				}
+			}
+		} else {
+			removeImgNodes(c, filenames)
+		}
+		c = next
+	}
+}
+
+// renameImgNodes updates the src of the img nodes to the new filenames in
+// renamed.
+func renameImgNodes(node *html.Node, renamed map[string]string) {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Img {
+			for i, attr := range c.Attr {
+				if newName, ok := renamed[attr.Val]; ok && attr.Key == imgSrc {
+					c.Attr[i].Val = newName
+				}
+			}
+		} else {
+			renameImgNodes(c, renamed)
+		}
+	}
+}
+
+// getImage gets the image from src, with retries on transient errors.
+func getImage(ctx context.Context, src *url.URL, args *ReadableArgs) (io.ReadCloser, error) {
+	retries := args.ImageDownloadRetries
+	if retries == 0 {
+		retries = DefaultImageDownloadRetries
+	}
+	backoff := imageRetryBackoff
+	for attempt := 0; ; attempt++ {
+		body, _, err := get(ctx, src, getArgs{
+			userAgent:   args.imageUserAgent(),
+			referer:     args.imageReferer(),
+			cookieJar:   args.CookieJar,
+			hostPolicy:  args.HostPolicy,
+			rateLimiter: args.RateLimiter,
+			client:      args.Client,
+		})
+		if err == nil || attempt >= retries || !retryableImageError(ctx, err) {
+			return body, err
+		}
+		slog.WarnContext(
+			ctx,
+			"Retrying image download",
+			"err", err,
+			"url", src.String(),
+			"attempt", attempt+1,
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// imageUserAgent returns the User-Agent to be used to download images.
+func (args *ReadableArgs) imageUserAgent() string {
+	if args.ImageUserAgent != "" {
+		return args.ImageUserAgent
+	}
+	return args.UserAgent
+}
+
+// jpegQuality returns the quality of the jpegs encoded from grayscaled images.
+func (args *ReadableArgs) jpegQuality() int {
+	if args.JPEGQuality <= 0 {
+		return grayscale.DefaultJPEGQuality
+	}
+	return args.JPEGQuality
+}
+
+// imageMode returns the ImageMode to use, with default resolved.
+func (args *ReadableArgs) imageMode() ImageMode {
+	if args.ImageMode != ImageModeDefault {
+		return args.ImageMode
+	}
+	if args.Grayscale {
+		return ImageModeGray
+	}
+	return ImageModeColor
+}
+
+// imageExt returns the extension of the images encoded by encodeImage.
+func (args *ReadableArgs) imageExt() string {
+	if args.imageMode() == ImageModeBW {
+		return pngExt
+	}
+	return jpgExt
+}
+
+// encodeImage grayscales, downscales, and encodes img according to args.
+//
+// It should only be called when imageMode is not ImageModeColor, and the
+// encoded image uses imageExt.
+func (args *ReadableArgs) encodeImage(img image.Image) (*bytes.Buffer, error) {
+	if args.imageMode() == ImageModeBW {
+		gray := grayscale.Downscale(grayscale.Grayscale(img), args.FitImage)
+		gray16, ok := gray.(*image.Gray16)
+		if !ok {
+			gray16 = grayscale.Grayscale(gray)
+		}
+		level := args.ThresholdLevel
+		if level == 0 {
+			level = grayscale.DefaultThresholdLevel
+		}
+		if args.Dither {
+			return grayscale.ToPNG(grayscale.Dither(gray16, level))
+		}
+		return grayscale.ToPNG(grayscale.Threshold(gray16, level))
+	}
+	if args.Grayscale8 {
+		return grayscale.ToJPEGWithQuality(grayscale.Downscale8(grayscale.Grayscale8(img), args.FitImage), args.jpegQuality())
+	}
+	return grayscale.ToJPEGWithQuality(grayscale.Downscale(grayscale.Grayscale(img), args.FitImage), args.jpegQuality())
+}
+
+// flattenGIF returns the first frame of the gif data encoded as png.
+func flattenGIF(data []byte) (*bytes.Buffer, error) {
+	img, err := grayscale.FirstFrame(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return grayscale.ToPNG(img)
+}
+
+// consentSelectors returns ConsentSelectors, or DefaultConsentSelectors when
+// it's unset.
+func (args *ReadableArgs) consentSelectors() []string {
+	if args.ConsentSelectors == nil {
+		return DefaultConsentSelectors
+	}
+	return args.ConsentSelectors
+}
+
+// imageReferer returns the Referer header to be used to download images.
+func (args *ReadableArgs) imageReferer() string {
+	switch {
+	case args.NoImageReferer:
+		return ""
+	case args.ImageReferer != "":
+		return args.ImageReferer
+	case args.BaseURL != nil:
+		return args.BaseURL.String()
+	}
+	return ""
+}
+
+// retryableImageError returns true if err returned by get is worth retrying.
+func retryableImageError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrBlockedHost) {
+		return false
+	}
+	var code statusCodeError
+	if errors.As(err, &code) {
+		return code >= 500
+	}
+	// network errors
+	return true
+}
+
+// downloadImage downloads the image from src into dest.
+//
+// It returns false if the image should be dropped. When FlattenAnimated is set
+// in color mode, it also returns the extension sniffed from the content of
+// dest, as the extension from src could be wrong.
+func downloadImage(ctx context.Context, src *url.URL, args *ReadableArgs, dest *io.Reader) (keep bool, contentExt string) {
+	if args.PerImageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, args.PerImageTimeout)
+		defer cancel()
+	}
+	body, err := getImage(ctx, src, args)
 	if err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -602,16 +1432,69 @@ func downloadImage(ctx context.Context, src *url.URL, userAgent string, dest *io
 			"err", err,
 			"url", src.String(),
 		)
-		return
+		return true, ""
 	}
 	defer DrainAndClose(body)
-	if !gray {
+	if args.SVGMode == SVGRasterize {
+		r := bufio.NewReader(body)
+		peek, _ := r.Peek(contentTypePeekSize)
+		if isSVG(peek) {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				slog.ErrorContext(
+					ctx,
+					"Error while trying to read svg",
+					"err", err,
+					"url", src.String(),
+				)
+				return false, ""
+			}
+			buf, _, err := rasterizeSVG(data, args)
+			if err != nil {
+				slog.ErrorContext(
+					ctx,
+					"Error while trying to rasterize svg",
+					"err", err,
+					"url", src.String(),
+				)
+				return false, ""
+			}
+			*dest = buf
+			return true, ""
+		}
+		body = io.NopCloser(r)
+	}
+	if args.imageMode() == ImageModeColor {
 		buf := new(bytes.Buffer)
-		io.Copy(buf, body)
+		if _, err := io.Copy(buf, body); err != nil {
+			slog.ErrorContext(
+				ctx,
+				"Error while trying to read image",
+				"err", err,
+				"url", src.String(),
+			)
+			return true, ""
+		}
+		if args.FlattenAnimated && grayscale.IsGIF(buf.Bytes()) {
+			flat, err := flattenGIF(buf.Bytes())
+			if err != nil {
+				slog.ErrorContext(
+					ctx,
+					"Error while trying to flatten gif",
+					"err", err,
+					"url", src.String(),
+				)
+			} else {
+				buf = flat
+			}
+		}
+		if args.FlattenAnimated {
+			contentExt = imageExts[detectImageContentType(buf.Bytes())]
+		}
 		*dest = buf
-		return
+		return true, contentExt
 	}
-	img, orig, err := grayscale.FromReader(body)
+	img, orig, err := grayscale.Decode(body)
 	if err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -620,9 +1503,9 @@ func downloadImage(ctx context.Context, src *url.URL, userAgent string, dest *io
 			"url", src.String(),
 		)
 		*dest = orig
-		return
+		return true, ""
 	}
-	reader, err := grayscale.ToJPEG(grayscale.Downscale(img, fitImage))
+	reader, err := args.encodeImage(img)
 	if err != nil {
 		slog.ErrorContext(
 			ctx,
@@ -631,7 +1514,8 @@ func downloadImage(ctx context.Context, src *url.URL, userAgent string, dest *io
 			"url", src.String(),
 		)
 		*dest = orig
-		return
+		return true, ""
 	}
 	*dest = reader
+	return true, ""
 }
@@ -0,0 +1,1554 @@
+package url2epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// readableBody runs Readable on src and returns the rendered body.
+func readableBody(t *testing.T, src string, args ReadableArgs) string {
+	t.Helper()
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	node, _, err := FromNode(root).Readable(context.Background(), args)
+	if err != nil {
+		t.Fatalf("Readable failed: %v", err)
+	}
+	body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+	var sb strings.Builder
+	if err := html.Render(&sb, &body); err != nil {
+		t.Fatalf("html.Render failed: %v", err)
+	}
+	return sb.String()
+}
+
+const testMainHTML = `<html><body>
+<div>Site navigation</div>
+<main>
+<article><a href="/other">Related card</a></article>
+<h1>Title</h1>
+<p>First paragraph.</p>
+<p>Second paragraph.</p>
+<p>Third paragraph.</p>
+</main>
+<footer>Copyright</footer>
+</body></html>`
+
+func TestReadableArticleStrategy(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		args  ReadableArgs
+		want  string
+	}{
+		{
+			label: "first-article",
+			args: ReadableArgs{
+				ArticleStrategy: ArticleFirst,
+			},
+			want: `<body><article><a href="/other">Related card</a></article></body>`,
+		},
+		{
+			label: "first-article-fallback-body",
+			args: ReadableArgs{
+				ArticleStrategy: ArticleFirst,
+				MinArticleNodes: 5,
+			},
+			want: `<body><div>Site navigation</div><main><article><a href="/other">Related card</a></article><h1>Title</h1><p>First paragraph.</p><p>Second paragraph.</p><p>Third paragraph.</p></main><footer>Copyright</footer></body>`,
+		},
+		{
+			label: "prefer-main",
+			args: ReadableArgs{
+				ArticleStrategy: ArticlePreferMain,
+				MinArticleNodes: 5,
+			},
+			want: `<body><main><article><a href="/other">Related card</a></article><h1>Title</h1><p>First paragraph.</p><p>Second paragraph.</p><p>Third paragraph.</p></main></body>`,
+		},
+		{
+			label: "prefer-main-too-small",
+			args: ReadableArgs{
+				ArticleStrategy: ArticlePreferMain,
+				MinArticleNodes: 100,
+			},
+			want: `<body><div>Site navigation</div><main><article><a href="/other">Related card</a></article><h1>Title</h1><p>First paragraph.</p><p>Second paragraph.</p><p>Third paragraph.</p></main><footer>Copyright</footer></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := readableBody(t, testMainHTML, c.args); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadableArticleStrategyNoMain(t *testing.T) {
+	const src = `<html><body><div>nav</div><article><p>Content.</p></article></body></html>`
+	const want = `<body><article><p>Content.</p></article></body>`
+	if got := readableBody(t, src, ReadableArgs{ArticleStrategy: ArticlePreferMain}); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReadableArticleLargest(t *testing.T) {
+	const src = `<html><body>
+<article><h2>Teaser one</h2></article>
+<article><h2>Full post</h2><p>First paragraph.</p><p>Second paragraph with <em>emphasis</em>.</p></article>
+<article><h2>Teaser two</h2><p>Summary.</p></article>
+</body></html>`
+	for _, c := range []struct {
+		label string
+		args  ReadableArgs
+		want  string
+	}{
+		{
+			label: "first",
+			args: ReadableArgs{
+				ArticleStrategy: ArticleFirst,
+			},
+			want: `<body><article><h2>Teaser one</h2></article></body>`,
+		},
+		{
+			label: "largest",
+			args: ReadableArgs{
+				ArticleStrategy: ArticleLargest,
+			},
+			want: `<body><article><h2>Full post</h2><p>First paragraph.</p><p>Second paragraph with <em>emphasis</em>.</p></article></body>`,
+		},
+		{
+			label: "largest-too-small",
+			args: ReadableArgs{
+				ArticleStrategy: ArticleLargest,
+				MinArticleNodes: 100,
+			},
+			want: `<body><article><h2>Teaser one</h2></article><article><h2>Full post</h2><p>First paragraph.</p><p>Second paragraph with <em>emphasis</em>.</p></article><article><h2>Teaser two</h2><p>Summary.</p></article></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := readableBody(t, src, c.args); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadableMinArticleText(t *testing.T) {
+	const nodeRich = `<html><body>
+<article><div><span>a</span><span>b</span><span>c</span><span>d</span><span>e</span><span>f</span></div></article>
+<p>This is the real content of the page.</p>
+</body></html>`
+	const textRich = `<html><body>
+<article><p>This is the real content of the page.</p></article>
+<div>nav</div>
+</body></html>`
+	for _, c := range []struct {
+		label string
+		src   string
+		args  ReadableArgs
+		want  string
+	}{
+		{
+			label: "node-rich-nodes-only",
+			src:   nodeRich,
+			args: ReadableArgs{
+				MinArticleNodes: 5,
+			},
+			want: `<body><article><div><span>a</span><span>b</span><span>c</span><span>d</span><span>e</span><span>f</span></div></article></body>`,
+		},
+		{
+			label: "node-rich-text-poor",
+			src:   nodeRich,
+			args: ReadableArgs{
+				MinArticleNodes: 5,
+				MinArticleText:  20,
+			},
+			want: `<body><article><div><span>a</span><span>b</span><span>c</span><span>d</span><span>e</span><span>f</span></div></article><p>This is the real content of the page.</p></body>`,
+		},
+		{
+			label: "text-rich-node-poor",
+			src:   textRich,
+			args: ReadableArgs{
+				MinArticleNodes: 5,
+				MinArticleText:  20,
+			},
+			want: `<body><article><p>This is the real content of the page.</p></article><div>nav</div></body>`,
+		},
+		{
+			label: "text-rich-text-only",
+			src:   textRich,
+			args: ReadableArgs{
+				MinArticleText: 20,
+			},
+			want: `<body><article><p>This is the real content of the page.</p></article></body>`,
+		},
+		{
+			label: "whitespace-not-counted",
+			src:   textRich,
+			args: ReadableArgs{
+				// 30 non-whitespace characters in the article.
+				MinArticleText: 31,
+			},
+			want: `<body><article><p>This is the real content of the page.</p></article><div>nav</div></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := readableBody(t, c.src, c.args); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadableNoscript(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		label     string
+		src       string
+		scripting bool
+		want      string
+		images    map[string]string
+	}{
+		{
+			label:     "escaped-text",
+			src:       `<html><body><p><img data-lazy="foo.png"><noscript><img src="real.png" alt="real"></noscript></p></body></html>`,
+			scripting: true,
+			want:      `<body><p><img src="images/001.png" alt="real"/></p></body>`,
+			images: map[string]string{
+				"images/001.png": "image of /post/real.png",
+			},
+		},
+		{
+			label:     "element-children",
+			src:       `<html><body><p><noscript><img src="real.png" alt="real"></noscript></p></body></html>`,
+			scripting: false,
+			want:      `<body><p><img src="images/001.png" alt="real"/></p></body>`,
+			images: map[string]string{
+				"images/001.png": "image of /post/real.png",
+			},
+		},
+		{
+			label:     "multiple-nodes",
+			src:       `<html><body><p><noscript><span>Image:</span> <img alt="no src"> <img src="data:image/png;base64,AAAA"> <img srcset="small.jpg 100w, large.jpg 800w"></noscript></p></body></html>`,
+			scripting: true,
+			want:      `<body><p><img src="images/001.jpg"/></p></body>`,
+			images: map[string]string{
+				"images/001.jpg": "image of /post/large.jpg",
+			},
+		},
+		{
+			label:     "multiple-nodes-elements",
+			src:       `<html><body><p><noscript><span>Image:</span> <img alt="no src"> <img srcset="small.jpg 100w, large.jpg 800w"></noscript></p></body></html>`,
+			scripting: false,
+			want:      `<body><p><img src="images/001.jpg"/></p></body>`,
+			images: map[string]string{
+				"images/001.jpg": "image of /post/large.jpg",
+			},
+		},
+		{
+			label:     "no-img",
+			src:       `<html><body><p>Text<noscript>Please enable JavaScript.</noscript></p></body></html>`,
+			scripting: true,
+			want:      `<body><p>Text</p></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.ParseWithOptions(strings.NewReader(c.src), html.ParseOptionEnableScripting(c.scripting))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:   baseURL,
+				ImagesDir: "images",
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if len(images) != len(c.images) {
+				t.Errorf("got %d images, want %d", len(images), len(c.images))
+			}
+			for name, want := range c.images {
+				r, ok := images[name]
+				if !ok {
+					t.Errorf("image %q not found", name)
+					continue
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Errorf("Failed to read image %q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("image %q got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadableOGImageFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const head = `<head><meta property="og:image" content="/hero.jpg"></head>`
+	for _, c := range []struct {
+		label    string
+		src      string
+		fallback bool
+		want     string
+		images   int
+	}{
+		{
+			label:    "no-images",
+			src:      `<html>` + head + `<body><article><p>Text.</p></article></body></html>`,
+			fallback: true,
+			want:     `<body><img src="images/001.jpg" alt=""/><article><p>Text.</p></article></body>`,
+			images:   1,
+		},
+		{
+			label:    "disabled",
+			src:      `<html>` + head + `<body><article><p>Text.</p></article></body></html>`,
+			fallback: false,
+			want:     `<body><article><p>Text.</p></article></body>`,
+		},
+		{
+			label:    "has-images",
+			src:      `<html>` + head + `<body><article><p>Text.</p><img src="inline.png"></article></body></html>`,
+			fallback: true,
+			want:     `<body><article><p>Text.</p><img src="images/001.png"/></article></body>`,
+			images:   1,
+		},
+		{
+			label:    "no-og-image",
+			src:      `<html><head></head><body><article><p>Text.</p></article></body></html>`,
+			fallback: true,
+			want:     `<body><article><p>Text.</p></article></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:         baseURL,
+				ImagesDir:       "images",
+				OGImageFallback: c.fallback,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if len(images) != c.images {
+				t.Errorf("got %d images, want %d", len(images), c.images)
+			}
+		})
+	}
+}
+
+func TestGetOGImageURL(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want string
+	}{
+		{
+			src:  `<html><head><meta property="og:image" content=" https://example.com/a.jpg?x=1&amp;y=2 "></head><body></body></html>`,
+			want: "https://example.com/a.jpg?x=1&y=2",
+		},
+		{
+			src:  `<html><head><meta property="og:title" content="foo"></head><body></body></html>`,
+			want: "",
+		},
+	} {
+		root, err := html.Parse(strings.NewReader(c.src))
+		if err != nil {
+			t.Fatalf("html.Parse failed: %v", err)
+		}
+		if got := FromNode(root).GetOGImageURL(); got != c.want {
+			t.Errorf("GetOGImageURL(%q) got %q, want %q", c.src, got, c.want)
+		}
+	}
+}
+
+func TestTextLength(t *testing.T) {
+	for _, c := range []struct {
+		src  string
+		want int
+	}{
+		{
+			src:  `<html><body><p> Hello, <b>世界</b>! </p></body></html>`,
+			want: 9, // "Hello," + "世界" + "!"
+		},
+		{
+			src:  `<html><body>  <div id="root"></div>  </body></html>`,
+			want: 0,
+		},
+	} {
+		root, err := html.Parse(strings.NewReader(c.src))
+		if err != nil {
+			t.Fatalf("html.Parse failed: %v", err)
+		}
+		if got := FromNode(root).TextLength(); got != c.want {
+			t.Errorf("TextLength(%q) got %d, want %d", c.src, got, c.want)
+		}
+	}
+}
+
+func TestReadableSkipImages(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const src = `<html><head><meta property="og:image" content="/hero.jpg"></head><body><article>
+<p>Text<img src="a.jpg" alt="An image"></p>
+<picture><source srcset="b.webp 800w"><img src="b.jpg"></picture>
+<p><noscript><img src="c.jpg" alt="Lazy image"></noscript></p>
+<p><amp-img src="d.jpg" alt="AMP image"></amp-img></p>
+<p>Icon<svg viewBox="0 0 1 1"><rect width="1" height="1"></rect></svg><img src="data:image/gif;base64,R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7" alt="Inline image"></p>
+<figure><picture><source srcset="e.webp"><img src="e.jpg" alt="Figure image"></picture><figcaption>A <em>caption</em></figcaption></figure>
+</article></body></html>`
+	for _, c := range []struct {
+		label string
+		alt   bool
+		want  string
+	}{
+		{
+			label: "drop",
+			want:  `<body><article><p>Text</p><p>Icon</p><figure><figcaption>A <em>caption</em></figcaption></figure></article></body>`,
+		},
+		{
+			label: "alt",
+			alt:   true,
+			want:  `<body><article><p>TextAn image</p><p>Lazy image</p><p>AMP image</p><p>IconInline image</p><figure><picture>Figure image</picture><figcaption>A <em>caption</em></figcaption></figure></article></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			requests.Store(0)
+			root, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:         baseURL,
+				ImagesDir:       "images",
+				SkipImages:      true,
+				KeepImageAlt:    c.alt,
+				OGImageFallback: true,
+				SVGMode:         SVGPreserve,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if len(images) != 0 {
+				t.Errorf("got images %v, want none", images)
+			}
+			if got := requests.Load(); got != 0 {
+				t.Errorf("got %d image requests, want 0", got)
+			}
+		})
+	}
+}
+
+func TestReadableMaxConcurrentImages(t *testing.T) {
+	const numImages = 20
+
+	var current, peak atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		// Give other downloads a chance to overlap with this one.
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`<html><body><article>`)
+	for i := range numImages {
+		fmt.Fprintf(&sb, `<p><img src="%d.png"></p>`, i)
+	}
+	sb.WriteString(`</article></body></html>`)
+	src := sb.String()
+
+	for _, c := range []struct {
+		label string
+		max   int
+		want  int64
+	}{
+		{
+			label: "default",
+			want:  DefaultMaxConcurrentImages,
+		},
+		{
+			label: "custom",
+			max:   3,
+			want:  3,
+		},
+		{
+			label: "serial",
+			max:   1,
+			want:  1,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			peak.Store(0)
+			root, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			_, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:             baseURL,
+				ImagesDir:           "images",
+				SVGMode:             SVGPreserve,
+				MaxConcurrentImages: c.max,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			if got := peak.Load(); got > c.want {
+				t.Errorf("peak concurrent downloads got %d, want <= %d", got, c.want)
+			}
+			if len(images) != numImages {
+				t.Fatalf("got %d images, want %d", len(images), numImages)
+			}
+			for name, r := range images {
+				if r == nil {
+					t.Errorf("image %q is not downloaded", name)
+				}
+			}
+		})
+	}
+}
+
+func TestReadablePerImageTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/slow.png") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const src = `<html><body><article><p><img src="fast.png"></p><p><img src="slow.png"></p><p><img src="other.png"></p></article></body></html>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	start := time.Now()
+	_, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+		BaseURL:         baseURL,
+		ImagesDir:       "images",
+		SVGMode:         SVGPreserve,
+		PerImageTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Readable failed: %v", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Readable took %v, slow image was not abandoned", took)
+	}
+	for name, want := range map[string]string{
+		"images/001.png": "image of /post/fast.png",
+		"images/002.png": "",
+		"images/003.png": "image of /post/other.png",
+	} {
+		r, ok := images[name]
+		if !ok {
+			t.Errorf("image %q not found", name)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("Failed to read image %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("image %q got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadableImageDownloadRetries(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		switch path.Base(r.URL.Path) {
+		case "flaky.png":
+			if n == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+		case "down.png":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		case "missing.png":
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		label    string
+		img      string
+		retries  int
+		want     string
+		requests int
+	}{
+		{
+			label:    "flaky",
+			img:      "flaky.png",
+			want:     "image of /flaky/flaky.png",
+			requests: 2,
+		},
+		{
+			label:    "flaky-no-retry",
+			img:      "flaky.png",
+			retries:  -1,
+			want:     "",
+			requests: 1,
+		},
+		{
+			label:    "down",
+			img:      "down.png",
+			want:     "",
+			requests: 2,
+		},
+		{
+			label:    "down-more-retries",
+			img:      "down.png",
+			retries:  2,
+			want:     "",
+			requests: 3,
+		},
+		{
+			label:    "missing",
+			img:      "missing.png",
+			retries:  2,
+			want:     "",
+			requests: 1,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			src := fmt.Sprintf(`<html><body><article><p><img src="/%s/%s"></p></article></body></html>`, c.label, c.img)
+			root, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			_, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:              baseURL,
+				ImagesDir:            "images",
+				SVGMode:              SVGPreserve,
+				ImageDownloadRetries: c.retries,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			r, ok := images["images/001.png"]
+			if !ok {
+				t.Fatalf("image not found: %v", images)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Failed to read image: %v", err)
+			}
+			if string(got) != c.want {
+				t.Errorf("image got %q, want %q", got, c.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := requests["/"+c.label+"/"+c.img]; got != c.requests {
+				t.Errorf("got %d requests, want %d", got, c.requests)
+			}
+		})
+	}
+}
+
+func TestReadableImageHeaders(t *testing.T) {
+	type headers struct {
+		userAgent string
+		referer   string
+	}
+	var mu sync.Mutex
+	got := make(map[string]headers)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got[r.URL.Path] = headers{
+			userAgent: r.Header.Get("user-agent"),
+			referer:   r.Header.Get("referer"),
+		}
+		mu.Unlock()
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		label string
+		args  ReadableArgs
+		want  headers
+	}{
+		{
+			label: "default",
+			args: ReadableArgs{
+				UserAgent: "page-ua",
+			},
+			want: headers{
+				userAgent: "page-ua",
+				referer:   baseURL.String(),
+			},
+		},
+		{
+			label: "override",
+			args: ReadableArgs{
+				UserAgent:      "page-ua",
+				ImageUserAgent: "image-ua",
+				ImageReferer:   "https://example.com/",
+			},
+			want: headers{
+				userAgent: "image-ua",
+				referer:   "https://example.com/",
+			},
+		},
+		{
+			label: "no-referer",
+			args: ReadableArgs{
+				UserAgent:      "page-ua",
+				ImageReferer:   "https://example.com/",
+				NoImageReferer: true,
+			},
+			want: headers{
+				userAgent: "page-ua",
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			src := fmt.Sprintf(`<html><body><article><p><img src="/%s/a.png"></p></article></body></html>`, c.label)
+			root, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			args := c.args
+			args.BaseURL = baseURL
+			args.ImagesDir = "images"
+			args.SVGMode = SVGPreserve
+			if _, _, err := FromNode(root).Readable(context.Background(), args); err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := got["/"+c.label+"/a.png"]; got != c.want {
+				t.Errorf("headers got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadableImageHotlinkProtection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("referer") == "" {
+			http.Error(w, "hotlinking not allowed", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		label     string
+		noReferer bool
+		want      string
+	}{
+		{
+			label: "default",
+			want:  "image of /img/a.png",
+		},
+		{
+			label:     "no-referer",
+			noReferer: true,
+			want:      "",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(`<html><body><article><p><img src="/img/a.png"></p></article></body></html>`))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			_, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:        baseURL,
+				ImagesDir:      "images",
+				SVGMode:        SVGPreserve,
+				NoImageReferer: c.noReferer,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			r, ok := images["images/001.png"]
+			if !ok {
+				t.Fatalf("image not found: %v", images)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Failed to read image: %v", err)
+			}
+			if string(got) != c.want {
+				t.Errorf("image got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadableDataURI(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	pngData := pngBuf.Bytes()
+	pngBase64 := base64.StdEncoding.EncodeToString(pngData)
+
+	for _, c := range []struct {
+		label    string
+		src      string
+		gray     bool
+		want     string
+		filename string
+		jpeg     bool
+	}{
+		{
+			label:    "png",
+			src:      `data:image/png;base64,` + pngBase64,
+			want:     `<body><p><img src="images/001.png"/></p></body>`,
+			filename: "images/001.png",
+		},
+		{
+			label:    "wrong-media-type",
+			src:      `data:image/jpeg;base64,` + pngBase64,
+			want:     `<body><p><img src="images/001.png"/></p></body>`,
+			filename: "images/001.png",
+		},
+		{
+			label:    "gray",
+			src:      `data:image/png;base64,` + pngBase64,
+			gray:     true,
+			want:     `<body><p><img src="images/001.jpg"/></p></body>`,
+			filename: "images/001.jpg",
+			jpeg:     true,
+		},
+		{
+			label: "not-image-data",
+			src:   `data:image/png;base64,AAAA`,
+			want:  `<body><p>Text</p></body>`,
+		},
+		{
+			label: "not-image-type",
+			src:   `data:text/plain;base64,` + pngBase64,
+			want:  `<body><p>Text</p></body>`,
+		},
+		{
+			label: "bad-base64",
+			src:   `data:image/png;base64,!!!`,
+			want:  `<body><p>Text</p></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			src := `<html><body><p>Text<img src="` + c.src + `"></p></body></html>`
+			if c.filename != "" {
+				src = `<html><body><p><img src="` + c.src + `"></p></body></html>`
+			}
+			root, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				ImagesDir: "images",
+				Grayscale: c.gray,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if c.filename == "" {
+				if len(images) != 0 {
+					t.Errorf("got %d images, want 0", len(images))
+				}
+				return
+			}
+			if len(images) != 1 {
+				t.Errorf("got %d images, want 1", len(images))
+			}
+			r, ok := images[c.filename]
+			if !ok {
+				t.Fatalf("image %q not found", c.filename)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Failed to read image %q: %v", c.filename, err)
+			}
+			if c.jpeg {
+				if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+					t.Errorf("image %q is not a valid jpeg: %v", c.filename, err)
+				}
+				return
+			}
+			if !bytes.Equal(got, pngData) {
+				t.Errorf("image %q got %x, want %x", c.filename, got, pngData)
+			}
+		})
+	}
+}
+
+func TestReadableDedupImages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ignore the query string, so different urls return the same content.
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const src = `<html><body><article><p><img src="a.png?w=600"></p><p><img src="b.png"></p><p><img src="a.png?w=1200"></p><p><img src="a.png?w=600"></p></article></body></html>`
+	root, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+		BaseURL:   baseURL,
+		ImagesDir: "images",
+		SVGMode:   SVGPreserve,
+	})
+	if err != nil {
+		t.Fatalf("Readable failed: %v", err)
+	}
+	body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+	var sb strings.Builder
+	if err := html.Render(&sb, &body); err != nil {
+		t.Fatalf("html.Render failed: %v", err)
+	}
+	const want = `<body><article><p><img src="images/001.png"/></p><p><img src="images/002.png"/></p><p><img src="images/001.png"/></p><p><img src="images/001.png"/></p></article></body>`
+	if got := sb.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	wantImages := map[string]string{
+		"images/001.png": "image of /post/a.png",
+		"images/002.png": "image of /post/b.png",
+	}
+	if len(images) != len(wantImages) {
+		t.Errorf("got %d images, want %d", len(images), len(wantImages))
+	}
+	for name, want := range wantImages {
+		r, ok := images[name]
+		if !ok {
+			t.Errorf("image %q not found", name)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("Failed to read image %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("image %q got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadableImgDimensions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "image of "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const src = `<html><body><article><p><img src="a.png" width="640" height=" 480 " alt="A"></p><p><img src="b.png" width="100%" height="auto"></p><picture><source srcset="c.webp" width="320" height="240"><img src="c.jpg"></picture></article></body></html>`
+	for _, c := range []struct {
+		label string
+		args  ReadableArgs
+		want  string
+	}{
+		{
+			label: "no-transform",
+			args: ReadableArgs{
+				BaseURL:   baseURL,
+				ImagesDir: "images",
+			},
+			want: `<body><article><p><img src="images/001.png" width="640" height="480" alt="A"/></p><p><img src="images/002.png"/></p><picture><img width="320" height="240" src="images/003.webp"/><img src="images/004.jpg"/></picture></article></body>`,
+		},
+		{
+			label: "grayscale",
+			args: ReadableArgs{
+				BaseURL:   baseURL,
+				ImagesDir: "images",
+				Grayscale: true,
+			},
+			want: `<body><article><p><img src="images/001.jpg" alt="A"/></p><p><img src="images/002.jpg"/></p><picture><img src="images/003.jpg"/><img src="images/004.jpg"/></picture></article></body>`,
+		},
+		{
+			label: "fit",
+			args: ReadableArgs{
+				BaseURL:   baseURL,
+				ImagesDir: "images",
+				FitImage:  100,
+			},
+			want: `<body><article><p><img src="images/001.png" alt="A"/></p><p><img src="images/002.png"/></p><picture><img src="images/003.webp"/><img src="images/004.jpg"/></picture></article></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := readableBody(t, src, c.args); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetNextPageURL(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		src   string
+		want  string
+	}{
+		{
+			label: "link",
+			src:   `<html><head><link rel="prev" href="/1"><link rel="next" href="/3"></head><body><a rel="next" href="/4">Next</a></body></html>`,
+			want:  "/3",
+		},
+		{
+			label: "a",
+			src:   `<html><head></head><body><a href="/other">Other</a><a rel="nofollow Next" href=" /2 ">Next</a></body></html>`,
+			want:  "/2",
+		},
+		{
+			label: "empty-href",
+			src:   `<html><head><link rel="next" href=""></head><body><a rel="next" href="/2">Next</a></body></html>`,
+			want:  "/2",
+		},
+		{
+			label: "none",
+			src:   `<html><head><link rel="nextpage" href="/2"></head><body><a href="/2">Next</a></body></html>`,
+			want:  "",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			if got := FromNode(root).GetNextPageURL(); got != c.want {
+				t.Errorf("GetNextPageURL got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestGetDescription(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		src   string
+		want  string
+	}{
+		{
+			label: "og",
+			src:   `<html><head><meta name="description" content="Meta description"><meta property="og:description" content="OG &amp; description"></head><body></body></html>`,
+			want:  "OG & description",
+		},
+		{
+			label: "fallback",
+			src:   `<html><head><meta property="og:description" content=""><meta name="description" content=" Meta &lt;description&gt; "></head><body></body></html>`,
+			want:  "Meta <description>",
+		},
+		{
+			label: "none",
+			src:   `<html><head><meta name="author" content="Author"></head><body><p>Text</p></body></html>`,
+			want:  "",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			if got := FromNode(root).GetDescription(); got != c.want {
+				t.Errorf("GetDescription got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadableFollowNextPages(t *testing.T) {
+	pages := map[string]string{
+		// Two pages, with the second one linking back to the first one.
+		"/article/1": `<html><head><link rel="next" href="2"></head><body><nav>Menu</nav><article><p>Page one.</p><img src="a.png"></article></body></html>`,
+		"/article/2": `<html><head></head><body><nav>Menu</nav><article><p>Page two.</p><img src="/img/b.png"></article><a rel="next" href="1">Next</a></body></html>`,
+	}
+	for i := 1; i <= 5; i++ {
+		pages[fmt.Sprintf("/chain/%d", i)] = fmt.Sprintf(`<html><head><link rel="next" href="%d"></head><body><article><p>Chain %d.</p></article></body></html>`, i+1, i)
+	}
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		if page, ok := pages[r.URL.Path]; ok {
+			io.WriteString(w, page)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".png") {
+			io.WriteString(w, "image of "+r.URL.Path)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, c := range []struct {
+		label  string
+		path   string
+		follow int
+		want   string
+		images map[string]string
+		pages  []string
+	}{
+		{
+			label:  "two-pages",
+			path:   "/article/1",
+			follow: 10,
+			want:   `<body><article><p>Page one.</p><img src="images/001.png"/></article><article><p>Page two.</p><img src="images/002.png"/></article></body>`,
+			images: map[string]string{
+				"images/001.png": "image of /article/a.png",
+				"images/002.png": "image of /img/b.png",
+			},
+			pages: []string{"/article/1", "/article/2"},
+		},
+		{
+			label: "disabled",
+			path:  "/article/1",
+			want:  `<body><article><p>Page one.</p><img src="images/001.png"/></article></body>`,
+			images: map[string]string{
+				"images/001.png": "image of /article/a.png",
+			},
+			pages: []string{"/article/1"},
+		},
+		{
+			label:  "cap",
+			path:   "/chain/1",
+			follow: 2,
+			want:   `<body><article><p>Chain 1.</p></article><article><p>Chain 2.</p></article><article><p>Chain 3.</p></article></body>`,
+			pages:  []string{"/chain/1", "/chain/2", "/chain/3"},
+		},
+		{
+			label:  "not-found",
+			path:   "/chain/4",
+			follow: 10,
+			want:   `<body><article><p>Chain 4.</p></article><article><p>Chain 5.</p></article></body>`,
+			pages:  []string{"/chain/4", "/chain/5", "/chain/6"},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+			root, baseURL, err := GetHTML(context.Background(), GetHTMLArgs{
+				URL: srv.URL + c.path,
+			})
+			if err != nil {
+				t.Fatalf("GetHTML failed: %v", err)
+			}
+			node, images, err := root.Readable(context.Background(), ReadableArgs{
+				BaseURL:         baseURL,
+				ImagesDir:       "images",
+				SVGMode:         SVGPreserve,
+				FollowNextPages: c.follow,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if len(images) != len(c.images) {
+				t.Errorf("got %d images, want %d", len(images), len(c.images))
+			}
+			for name, want := range c.images {
+				r, ok := images[name]
+				if !ok {
+					t.Errorf("image %q not found", name)
+					continue
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Errorf("Failed to read image %q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("image %q got %q, want %q", name, got, want)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			var gotPages []string
+			for _, path := range requests {
+				if !strings.HasSuffix(path, ".png") {
+					gotPages = append(gotPages, path)
+				}
+			}
+			if !slices.Equal(gotPages, c.pages) {
+				t.Errorf("requested pages got %v, want %v", gotPages, c.pages)
+			}
+		})
+	}
+}
+
+func TestReadableDir(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(`<html lang="he"><head></head><body dir="rtl"><article><p>שלום</p></article></body></html>`))
+	if err != nil {
+		t.Fatalf("html.Parse failed: %v", err)
+	}
+	node, _, err := FromNode(root).Readable(context.Background(), ReadableArgs{})
+	if err != nil {
+		t.Fatalf("Readable failed: %v", err)
+	}
+	readable := FromNode(node)
+	if got, want := readable.GetLang(), "he"; got != want {
+		t.Errorf("GetLang got %q, want %q", got, want)
+	}
+	if got, want := readable.GetDir(), "rtl"; got != want {
+		t.Errorf("GetDir got %q, want %q", got, want)
+	}
+}
+
+func TestReadableImageMode(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 8, 8))
+	for x := range 8 {
+		for y := range 8 {
+			src.SetGray(x, y, color.Gray{Y: uint8(x * 32)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		label   string
+		args    ReadableArgs
+		wantExt string
+		bw      bool
+	}{
+		{
+			label:   "default",
+			wantExt: ".png",
+		},
+		{
+			label: "grayscale",
+			args: ReadableArgs{
+				Grayscale: true,
+			},
+			wantExt: ".jpg",
+		},
+		{
+			label: "color-overrides-grayscale",
+			args: ReadableArgs{
+				Grayscale: true,
+				ImageMode: ImageModeColor,
+			},
+			wantExt: ".png",
+		},
+		{
+			label: "bw",
+			args: ReadableArgs{
+				ImageMode: ImageModeBW,
+			},
+			wantExt: ".png",
+			bw:      true,
+		},
+		{
+			label: "bw-dither",
+			args: ReadableArgs{
+				ImageMode: ImageModeBW,
+				Dither:    true,
+			},
+			wantExt: ".png",
+			bw:      true,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(`<html><body><article><p><img src="/a.png"></p></article></body></html>`))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			args := c.args
+			args.BaseURL = baseURL
+			args.ImagesDir = "images"
+			_, images, err := FromNode(root).Readable(context.Background(), args)
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("got %d images, want 1: %v", len(images), images)
+			}
+			for filename, reader := range images {
+				if ext := path.Ext(filename); ext != c.wantExt {
+					t.Errorf("ext of %q got %q, want %q", filename, ext, c.wantExt)
+				}
+				if !c.bw {
+					continue
+				}
+				img, err := png.Decode(reader)
+				if err != nil {
+					t.Fatalf("png.Decode failed: %v", err)
+				}
+				bounds := img.Bounds()
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+						if gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y; gray != 0 && gray != 255 {
+							t.Fatalf("Pixel (%d, %d) got %d, want 0 or 255", x, y, gray)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadableFlattenAnimated(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	var frames []*image.Paletted
+	for i := range 2 {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		for x := range 4 {
+			for y := range 4 {
+				frame.SetColorIndex(x, y, uint8(i))
+			}
+		}
+		frames = append(frames, frame)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{
+		Image: frames,
+		Delay: []int{10, 10},
+	}); err != nil {
+		t.Fatalf("gif.EncodeAll failed: %v", err)
+	}
+	// Has the gif header but fails to decode.
+	broken := []byte("GIF89a\x04\x00\x04\x00broken")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.gif" {
+			w.Write(broken)
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL + "/post/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		label   string
+		src     string
+		flatten bool
+		wantExt string
+		// The content is expected to be kept as-is.
+		want []byte
+	}{
+		{
+			label:   "default",
+			src:     "/a.gif",
+			wantExt: ".gif",
+			want:    buf.Bytes(),
+		},
+		{
+			label:   "flatten",
+			src:     "/a.gif",
+			flatten: true,
+			wantExt: ".png",
+		},
+		{
+			label:   "flatten-no-ext",
+			src:     "/a",
+			flatten: true,
+			wantExt: ".png",
+		},
+		{
+			label:   "flatten-failed",
+			src:     "/broken.gif",
+			flatten: true,
+			wantExt: ".gif",
+			want:    broken,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(`<html><body><article><p><img src="` + c.src + `"></p></article></body></html>`))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:         baseURL,
+				ImagesDir:       "images",
+				FlattenAnimated: c.flatten,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("got %d images, want 1: %v", len(images), images)
+			}
+			for filename, reader := range images {
+				if ext := path.Ext(filename); ext != c.wantExt {
+					t.Errorf("ext of %q got %q, want %q", filename, ext, c.wantExt)
+				}
+				var sb strings.Builder
+				if err := html.Render(&sb, node); err != nil {
+					t.Fatalf("html.Render failed: %v", err)
+				}
+				if want := `src="` + filename + `"`; !strings.Contains(sb.String(), want) {
+					t.Errorf("Readable html %q does not contain %q", sb.String(), want)
+				}
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("Failed to read %q: %v", filename, err)
+				}
+				if c.want != nil {
+					if !bytes.Equal(data, c.want) {
+						t.Errorf("%q got %d bytes, want the original %d bytes", filename, len(data), len(c.want))
+					}
+					continue
+				}
+				if _, err := gif.DecodeAll(bytes.NewReader(data)); err == nil {
+					t.Errorf("%q is still a gif", filename)
+				}
+				img, err := png.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("png.Decode failed: %v", err)
+				}
+				if got, want := img.Bounds(), image.Rect(0, 0, 4, 4); got != want {
+					t.Errorf("bounds got %v, want %v", got, want)
+				}
+				if r, _, _, _ := img.At(0, 0).RGBA(); r != 0 {
+					t.Errorf("(0, 0) got red %#x, want black from the first frame", r)
+				}
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -26,12 +27,17 @@ import (
 const (
 	// api urls
 	APIBase         = "https://internal.cloud.remarkable.com/sync/v2"
-	APIDownload     = APIBase + "/signed-urls/downloads"
-	APIUpload       = APIBase + "/signed-urls/uploads"
-	APISyncComplete = APIBase + "/sync-complete"
+	APIDownload     = APIBase + APIPathDownload
+	APIUpload       = APIBase + APIPathUpload
+	APISyncComplete = APIBase + APIPathSyncComplete
+
+	// api paths relative to APIBase
+	APIPathDownload     = "/signed-urls/downloads"
+	APIPathUpload       = "/signed-urls/uploads"
+	APIPathSyncComplete = "/sync-complete"
 
 	// magic strings used in index files.
-	IndexFileFirstMagic    = "3"
+	IndexFileFirstMagic    = IndexSchemaV3
 	RootEntryUnused1Magic  = "80000000"
 	IndexEntryUnused1Magic = "0"
 
@@ -43,6 +49,25 @@ const (
 	GCSPathBytes  = 32
 )
 
+// Known index schema versions, which is the first line of the index files.
+//
+// Only IndexSchemaV3 is supported when modifying the root index.
+// IndexSchemaV4 adds a summary line ("0:.:<num entries>:<total size>") after
+// the first line, which is recognized and skipped when reading index files.
+const (
+	IndexSchemaV3 = "3"
+	IndexSchemaV4 = "4"
+
+	indexSchemaV4SummaryPrefix = "0:.:"
+)
+
+// ErrUnsupportedSchema is the error returned when the root index on
+// reMarkable cloud uses a schema version we cannot safely modify.
+//
+// Modifying the root index with an older schema could lead to uploads that
+// "succeeded" but never show up on the device, so we refuse to do that.
+var ErrUnsupportedSchema = errors.New("rmapi: unsupported index schema")
+
 // APIRequest defines the request json format for reMarkable 1.5 API.
 type APIRequest struct {
 	Method string `json:"http_method"`
@@ -73,6 +98,10 @@ type APIResponse struct {
 	// parsed as a timestamp. In such case Expires will be zero time.
 	RawExpires string
 
+	// The max size of the file to be uploaded with this response, parsed from
+	// maxuploadsize_bytes. 0 means it's not advertised.
+	MaxUploadSize int64
+
 	Headers map[string]string
 }
 
@@ -127,6 +156,7 @@ func (resp *APIResponse) UnmarshalJSON(data []byte) error {
 
 	if n, ok := m[APIResponseMaxUploadSizeBytes].(json.Number); ok {
 		if i, err := n.Int64(); err == nil && i > 0 {
+			resp.MaxUploadSize = i
 			resp.Headers["x-goog-content-length-range"] = fmt.Sprintf("0,%d", i)
 		}
 	}
@@ -142,6 +172,20 @@ func (resp *APIResponse) Err() error {
 	return nil
 }
 
+// CheckUploadSize checks size against the max upload size advertised by
+// reMarkable cloud in the API response, if any.
+//
+// It returns an UploadTooLargeError if size exceeds it.
+func (resp *APIResponse) CheckUploadSize(size int64) error {
+	if resp.MaxUploadSize > 0 && size > resp.MaxUploadSize {
+		return UploadTooLargeError{
+			Size:          size,
+			MaxUploadSize: resp.MaxUploadSize,
+		}
+	}
+	return nil
+}
+
 // ToRequest creates http request from the API response.
 func (resp APIResponse) ToRequest(ctx context.Context, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, resp.Method, resp.URL, body)
@@ -167,7 +211,7 @@ func (c *Client) Download15(ctx context.Context, path string) (*http.Response, e
 	if err := json.NewEncoder(buf).Encode(payload); err != nil {
 		return nil, fmt.Errorf("rmapi.Client.Download15: failed to json encode api request: %w", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, APIDownload, buf)
+	req, err := http.NewRequest(http.MethodPost, c.apiURL(APIPathDownload), buf)
 	if err != nil {
 		return nil, fmt.Errorf("rmapi.Client.Download15: failed to create api request: %w", err)
 	}
@@ -176,6 +220,9 @@ func (c *Client) Download15(ctx context.Context, path string) (*http.Response, e
 		return nil, fmt.Errorf("rmapi.Client.Download15: failed to execute http request: %w", err)
 	}
 	defer url2epub.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rmapi.Client.Download15: http status for api request: %d/%s, %q", resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024))
+	}
 	var respPayload APIResponse
 	if err := json.NewDecoder(resp.Body).Decode(&respPayload); err != nil {
 		return nil, fmt.Errorf("rmapi.Client.Download15: failed to json decode api response: %w", err)
@@ -184,7 +231,7 @@ func (c *Client) Download15(ctx context.Context, path string) (*http.Response, e
 	if err != nil {
 		return nil, fmt.Errorf("rmapi.Client.Download15: failed to create gcs request: %w", err)
 	}
-	return http.DefaultClient.Do(req.WithContext(ctx))
+	return httpClient.Do(req.WithContext(ctx))
 }
 
 // IndexEntry defines an entry in the index file in reMarkable 1.5 API.
@@ -235,16 +282,31 @@ func ParseIndexEntry(line string) (IndexEntry, error) {
 // DownloadIndex downloads and parses an index file by the GCS path in
 // reMarkable 1.5 API.
 func (c *Client) DownloadIndex(ctx context.Context, path string) ([]IndexEntry, error) {
+	entries, _, err := c.DownloadIndexSchema(ctx, path)
+	return entries, err
+}
+
+// DownloadIndexSchema is DownloadIndex but also returns the schema version of
+// the index file.
+func (c *Client) DownloadIndexSchema(ctx context.Context, path string) (entries []IndexEntry, schema string, err error) {
 	resp, err := c.Download15(ctx, path)
 	if err != nil {
-		return nil, fmt.Errorf("rmapi.Client.DownloadIndex failed to download %q: %w", path, err)
+		return nil, "", fmt.Errorf("rmapi.Client.DownloadIndex failed to download %q: %w", path, err)
 	}
 	defer url2epub.DrainAndClose(resp.Body)
-	var entries []IndexEntry
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("rmapi.Client.DownloadIndex failed to download %q: %w", path, ParseGCSError(resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024)))
+	}
 	scanner := bufio.NewScanner(resp.Body)
+	first := true
 	for scanner.Scan() {
 		text := scanner.Text()
-		if text == IndexFileFirstMagic {
+		if first {
+			first = false
+			schema = strings.TrimSpace(text)
+			continue
+		}
+		if schema == IndexSchemaV4 && strings.HasPrefix(text, indexSchemaV4SummaryPrefix) {
 			continue
 		}
 		entry, err := ParseIndexEntry(text)
@@ -254,24 +316,48 @@ func (c *Client) DownloadIndex(ctx context.Context, path string) ([]IndexEntry,
 		}
 		entries = append(entries, entry)
 	}
-	return entries, nil
+	return entries, schema, nil
 }
 
 // DownloadRoot downloads and parses the root file in reMarkable 1.5 API.
 func (c *Client) DownloadRoot(ctx context.Context) (entries []IndexEntry, generation string, err error) {
+	entries, generation, _, err = c.DownloadRootSchema(ctx)
+	return entries, generation, err
+}
+
+// DownloadRootSchema is DownloadRoot but also returns the schema version of the
+// root index file.
+//
+// Callers intend to modify the root index should check the returned schema
+// with CheckSchema first.
+func (c *Client) DownloadRootSchema(ctx context.Context) (entries []IndexEntry, generation string, schema string, err error) {
 	resp, err := c.Download15(ctx, "root")
 	if err != nil {
-		return nil, "", fmt.Errorf("rmapi.Client.DownloadRoot: failed to get root file id: %w", err)
+		return nil, "", "", fmt.Errorf("rmapi.Client.DownloadRoot: failed to get root file id: %w", err)
 	}
 	defer url2epub.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("rmapi.Client.DownloadRoot: failed to get root file id: %w", ParseGCSError(resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024)))
+	}
 	generation = resp.Header.Get(HeaderRootGeneration)
 	var id strings.Builder
 	if _, err := io.Copy(&id, resp.Body); err != nil {
-		return nil, generation, fmt.Errorf("rmapi.Client.DownloadRoot: failed to read root file id: %w", err)
+		return nil, generation, "", fmt.Errorf("rmapi.Client.DownloadRoot: failed to read root file id: %w", err)
 	}
 	url2epub.DrainAndClose(resp.Body)
-	entries, err = c.DownloadIndex(ctx, id.String())
-	return entries, generation, err
+	entries, schema, err = c.DownloadIndexSchema(ctx, id.String())
+	return entries, generation, schema, err
+}
+
+// CheckSchema checks whether the schema version returned by
+// DownloadRootSchema is supported when modifying the root index.
+//
+// It returns an error wrapping ErrUnsupportedSchema if it's not supported.
+func CheckSchema(schema string) error {
+	if schema == IndexSchemaV3 {
+		return nil
+	}
+	return fmt.Errorf("%w: %q (only %q is supported)", ErrUnsupportedSchema, schema, IndexSchemaV3)
 }
 
 var bufPool = sync.Pool{
@@ -283,7 +369,16 @@ var bufPool = sync.Pool{
 // Upload15 is the "low-level" api that uploads a file in reMarkable Cloud API 1.5.
 //
 // It returns the GCS path (sha256 of the content) and the size.
+//
+// Large files are uploaded with GCS resumable uploads when possible,
+// see Client.ResumableUploadThreshold for more details.
 func (c *Client) Upload15(ctx context.Context, content io.Reader) (path string, size int64, err error) {
+	return c.upload15Progress(ctx, content, nil)
+}
+
+// upload15Progress is Upload15 with an optional progress callback, called
+// with the bytes sent as the content is being uploaded.
+func (c *Client) upload15Progress(ctx context.Context, content io.Reader, progress func(sent, total int64)) (path string, size int64, err error) {
 	buf, ok := content.(*bytes.Buffer)
 	if !ok {
 		buf = bufPool.Get().(*bytes.Buffer)
@@ -297,21 +392,57 @@ func (c *Client) Upload15(ctx context.Context, content io.Reader) (path string,
 	path = hex.EncodeToString(hash[:])
 	size = int64(buf.Len())
 
+	if threshold := c.resumableUploadThreshold(); threshold > 0 && size > threshold {
+		err := c.uploadResumable(ctx, path, buf.Bytes(), progress)
+		if err == nil {
+			return path, size, nil
+		}
+		if !errors.Is(err, errResumableNotPermitted) {
+			return "", 0, fmt.Errorf("rmapi.Client.Upload15: %w", err)
+		}
+		slog.DebugContext(ctx, "rmapi.Client.Upload15: Resumable upload not permitted, fallback to single PUT", "err", err, "path", path, "size", size)
+	}
+
 	payload := APIRequest{
 		Method: http.MethodPut,
 		Path:   path,
 	}
-	return path, size, c.upload15(ctx, payload, buf, nil)
+	var body io.Reader = buf
+	if progress != nil {
+		body = &progressReader{
+			r:        buf,
+			total:    size,
+			progress: progress,
+		}
+	}
+	return path, size, c.upload15(ctx, payload, body, size, nil)
+}
+
+// progressReader reports the bytes read from r to progress.
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.sent += int64(n)
+		pr.progress(pr.sent, pr.total)
+	}
+	return n, err
 }
 
-func (c *Client) upload15(ctx context.Context, apiPayload interface{}, content io.Reader, extraHeaders map[string]string) error {
+func (c *Client) upload15(ctx context.Context, apiPayload interface{}, content io.Reader, size int64, extraHeaders map[string]string) error {
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
 	if err := json.NewEncoder(buf).Encode(apiPayload); err != nil {
 		return fmt.Errorf("rmapi.Client.upload15: failed to json encode api request: %w", err)
 	}
-	req, err := http.NewRequest(http.MethodPost, APIUpload, buf)
+	req, err := http.NewRequest(http.MethodPost, c.apiURL(APIPathUpload), buf)
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.upload15: failed to create api request: %w", err)
 	}
@@ -327,6 +458,10 @@ func (c *Client) upload15(ctx context.Context, apiPayload interface{}, content i
 	if err := payload.Err(); err != nil {
 		return fmt.Errorf("rmapi.Client.upload15: %w", err)
 	}
+	// Fail before uploading anything if GCS is going to reject it.
+	if err := payload.CheckUploadSize(size); err != nil {
+		return fmt.Errorf("rmapi.Client.upload15: %w", err)
+	}
 	for k, v := range extraHeaders {
 		payload.Headers[k] = v
 	}
@@ -334,13 +469,15 @@ func (c *Client) upload15(ctx context.Context, apiPayload interface{}, content i
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.upload15: failed to create GCS upload request: %w, payload: %+v", err, payload)
 	}
-	resp, err = http.DefaultClient.Do(req.WithContext(ctx))
+	// http.NewRequest can't infer it when content is wrapped.
+	req.ContentLength = size
+	resp, err = httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.upload15: failed to execute GCS upload request: %w, payload: %+v", err, payload)
 	}
 	defer url2epub.DrainAndClose(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("rmapi.Client.upload15: http status for GCS upload: %d/%s, %q", resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024))
+		return fmt.Errorf("rmapi.Client.upload15: GCS upload failed: %w", ParseGCSError(resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024)))
 	}
 	return nil
 }
@@ -382,7 +519,7 @@ func (c *Client) UpdateRoot(ctx context.Context, generation string, root string)
 		Generation: gen,
 		Root:       root,
 	}
-	if err := c.upload15(ctx, payload, strings.NewReader(root), map[string]string{
+	if err := c.upload15(ctx, payload, strings.NewReader(root), int64(len(root)), map[string]string{
 		"x-goog-if-generation-match": generation,
 	}); err != nil {
 		return fmt.Errorf("rmapi.Client.UpdateRoot: failed to update root file: %w", err)
@@ -400,7 +537,7 @@ func (c *Client) syncComplete(ctx context.Context, generation int64) error {
 	if err := json.NewEncoder(buf).Encode(payload); err != nil {
 		return fmt.Errorf("rmapi.Client.syncComplete: failed to json encode request payload: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, APISyncComplete, buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL(APIPathSyncComplete), buf)
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.syncComplete: failed to create http request: %w", err)
 	}
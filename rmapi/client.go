@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,11 +14,35 @@ import (
 	"go.yhsif.com/url2epub"
 )
 
+// Default urls used to register and refresh tokens.
 const (
-	registerURL = `https://webapp-prod.cloud.remarkable.engineering/token/json/2/device/new`
-	refreshURL  = `https://webapp-prod.cloud.remarkable.engineering/token/json/2/user/new`
+	DefaultRegisterURL = `https://webapp-prod.cloud.remarkable.engineering/token/json/2/device/new`
+	DefaultRefreshURL  = `https://webapp-prod.cloud.remarkable.engineering/token/json/2/user/new`
 )
 
+// ErrTokenExpired is the error returned when reMarkable cloud rejects the
+// refresh token, usually because it's expired or revoked by the user.
+var ErrTokenExpired = errors.New("rmapi: refresh token expired or revoked")
+
+// ErrTemporary is the error returned when reMarkable cloud fails the request
+// for reasons other than the refresh token, for example rate limiting or
+// server errors, so the request can be retried later.
+var ErrTemporary = errors.New("rmapi: temporary error, try again later")
+
+// The http client used to send requests to reMarkable cloud.
+var httpClient = &http.Client{
+	Transport: url2epub.NewTransport(url2epub.DefaultTransportTimeouts),
+}
+
+// SetTransportTimeouts sets the timeouts of the http client used by this
+// package, which uses url2epub.DefaultTransportTimeouts by default.
+//
+// It's not safe to be called concurrently with other functions of this
+// package, and is usually called during initialization.
+func SetTransportTimeouts(timeouts url2epub.TransportTimeouts) {
+	httpClient.Transport = url2epub.NewTransport(timeouts)
+}
+
 // RegisterArgs defines args to be used with Register.
 type RegisterArgs struct {
 	// A token got from either https://my.remarkable.com/device/desktop/connect or
@@ -27,6 +52,13 @@ type RegisterArgs struct {
 	// A description of this device, usually something like "desktop-linux",
 	// "mobile-android".
 	Description string
+
+	// Optional, override DefaultRegisterURL.
+	RegisterURL string
+
+	// Optional, set to the returned *Client.
+	APIBase    string
+	RefreshURL string
 }
 
 type registerPayload struct {
@@ -53,6 +85,10 @@ func Register(ctx context.Context, args RegisterArgs) (*Client, error) {
 		return nil, fmt.Errorf("rmapi.Register: unable to encode json payload: %w", err)
 	}
 
+	registerURL := args.RegisterURL
+	if registerURL == "" {
+		registerURL = DefaultRegisterURL
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, registerURL, payload)
 	if err != nil {
 		return nil, fmt.Errorf("rmapi.Register: unable to create http request: %w", err)
@@ -63,6 +99,8 @@ func Register(ctx context.Context, args RegisterArgs) (*Client, error) {
 	}
 	return &Client{
 		RefreshToken: refresh,
+		APIBase:      args.APIBase,
+		RefreshURL:   args.RefreshURL,
 	}, nil
 }
 
@@ -73,11 +111,49 @@ func Register(ctx context.Context, args RegisterArgs) (*Client, error) {
 type Client struct {
 	RefreshToken string
 
+	// Optional overrides of the API endpoints, for example to test against a
+	// fake server, or when reMarkable changes their endpoints.
+	//
+	// When empty, APIBase and DefaultRefreshURL will be used.
+	APIBase    string
+	RefreshURL string
+
+	// Optional, files larger than ResumableUploadThreshold bytes are uploaded by
+	// Upload15 with GCS resumable uploads in chunks of ResumableChunkSize bytes,
+	// if the signed url returned by reMarkable cloud permits. Otherwise (and for
+	// smaller files) they are uploaded with a single PUT request.
+	//
+	// 0 means DefaultResumableUploadThreshold, negative values disable resumable
+	// uploads.
+	ResumableUploadThreshold int64
+	// Optional, <=0 means DefaultResumableChunkSize.
+	//
+	// It will be rounded up to multiples of 256KiB as required by GCS.
+	ResumableChunkSize int64
+
+	// Optional, the number of times to retry updating the root index when it's
+	// changed by other clients in the meantime (generation mismatch).
+	//
+	// 0 means DefaultRootUpdateRetries, negative values disable retries.
+	RootUpdateRetries int
+
 	token string
 }
 
+func (c *Client) apiURL(path string) string {
+	base := c.APIBase
+	if base == "" {
+		base = APIBase
+	}
+	return base + path
+}
+
 // Refresh refreshes the token.
 func (c *Client) Refresh(ctx context.Context) error {
+	refreshURL := c.RefreshURL
+	if refreshURL == "" {
+		refreshURL = DefaultRefreshURL
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, refreshURL, nil)
 	if err != nil {
 		return fmt.Errorf("rmapi.Refresh: unable to create http request: %w", err)
@@ -88,12 +164,37 @@ func (c *Client) Refresh(ctx context.Context) error {
 	)
 	token, err := readToken(req, 4096)
 	if err != nil {
+		var se tokenStatusError
+		if errors.As(err, &se) {
+			switch se.code {
+			case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+				return fmt.Errorf("rmapi.Refresh: %w: %w", ErrTokenExpired, err)
+			default:
+				// For example 429 Too Many Requests, or 5xx.
+				return fmt.Errorf("rmapi.Refresh: %w: %w", ErrTemporary, err)
+			}
+		}
 		return fmt.Errorf("rmapi.Refresh: %w", err)
 	}
 	c.token = token
 	return nil
 }
 
+// Verify checks whether RefreshToken is still valid without uploading
+// anything, by refreshing the token and downloading the root index.
+//
+// It returns an error wrapping ErrTokenExpired if reMarkable cloud rejects the
+// refresh token.
+func (c *Client) Verify(ctx context.Context) error {
+	if err := c.Refresh(ctx); err != nil {
+		return fmt.Errorf("rmapi.Client.Verify: %w", err)
+	}
+	if _, _, err := c.DownloadRoot(ctx); err != nil {
+		return fmt.Errorf("rmapi.Client.Verify: %w", err)
+	}
+	return nil
+}
+
 // AutoRefresh refreshes the token when needed.
 func (c *Client) AutoRefresh(ctx context.Context) error {
 	if c.token != "" {
@@ -102,14 +203,27 @@ func (c *Client) AutoRefresh(ctx context.Context) error {
 	return c.Refresh(ctx)
 }
 
+// tokenStatusError is the error returned by readToken on non-200 responses.
+type tokenStatusError struct {
+	code   int
+	status string
+}
+
+func (e tokenStatusError) Error() string {
+	return "http status: " + e.status
+}
+
 func readToken(req *http.Request, size int) (string, error) {
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("http request failed: %w", err)
 	}
 	defer url2epub.DrainAndClose(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("http status: %s", resp.Status)
+		return "", tokenStatusError{
+			code:   resp.StatusCode,
+			status: resp.Status,
+		}
 	}
 	buf := make([]byte, size)
 	n, err := io.ReadFull(resp.Body, buf)
@@ -135,5 +249,5 @@ func (c *Client) Do(ctx context.Context, req *http.Request) (*http.Response, err
 	if err := c.setAuthHeader(ctx, req); err != nil {
 		return nil, err
 	}
-	return http.DefaultClient.Do(req.WithContext(ctx))
+	return httpClient.Do(req.WithContext(ctx))
 }
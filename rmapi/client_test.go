@@ -0,0 +1,122 @@
+package rmapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestClientEndpoints(t *testing.T) {
+	const (
+		refreshToken = "refresh"
+		token        = "token"
+	)
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		default:
+			http.NotFound(w, r)
+		case "/register":
+			w.Write([]byte(refreshToken))
+		case "/refresh":
+			if got, want := r.Header.Get("authorization"), "Bearer "+refreshToken; got != want {
+				t.Errorf("refresh authorization got %q want %q", got, want)
+			}
+			w.Write([]byte(token))
+		case "/sync" + APIPathSyncComplete:
+			if got, want := r.Header.Get("authorization"), "Bearer "+token; got != want {
+				t.Errorf("sync-complete authorization got %q want %q", got, want)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	client, err := Register(ctx, RegisterArgs{
+		Token:       "12345678",
+		Description: "desktop-linux",
+		RegisterURL: srv.URL + "/register",
+		APIBase:     srv.URL + "/sync",
+		RefreshURL:  srv.URL + "/refresh",
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if client.RefreshToken != refreshToken {
+		t.Errorf("RefreshToken got %q want %q", client.RefreshToken, refreshToken)
+	}
+	if err := client.syncComplete(ctx, 1); err != nil {
+		t.Errorf("syncComplete failed: %v", err)
+	}
+	want := []string{"/register", "/refresh", "/sync" + APIPathSyncComplete}
+	if len(paths) != len(want) {
+		t.Fatalf("paths got %q want %q", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("paths[%d] got %q want %q", i, paths[i], want[i])
+		}
+	}
+}
+
+func TestClientDefaultEndpoints(t *testing.T) {
+	var c Client
+	if got, want := c.apiURL(APIPathUpload), APIUpload; got != want {
+		t.Errorf("apiURL got %q want %q", got, want)
+	}
+}
+
+func TestClientVerify(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeServer(t)
+	f.addDocument("doc", Metadata{Type: "DocumentType", Name: "doc"}, nil)
+
+	t.Run("valid", func(t *testing.T) {
+		if err := f.client().Verify(ctx); err != nil {
+			t.Errorf("Verify got error %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		// The fake refresh endpoint returns 401 for unknown refresh tokens.
+		client := f.client()
+		client.RefreshToken = "expired-refresh-token"
+		if err := client.Verify(ctx); !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("Verify got error %v, want %v", err, ErrTokenExpired)
+		}
+	})
+
+	for _, c := range []struct {
+		code int
+		want error
+	}{
+		{code: http.StatusBadRequest, want: ErrTokenExpired},
+		{code: http.StatusForbidden, want: ErrTokenExpired},
+		{code: http.StatusNotFound, want: ErrTemporary},
+		{code: http.StatusRequestTimeout, want: ErrTemporary},
+		{code: http.StatusTooManyRequests, want: ErrTemporary},
+		{code: http.StatusInternalServerError, want: ErrTemporary},
+	} {
+		t.Run(strconv.Itoa(c.code), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "oops", c.code)
+			}))
+			t.Cleanup(srv.Close)
+			client := &Client{
+				RefreshToken: fakeRefreshToken,
+				RefreshURL:   srv.URL,
+			}
+			err := client.Verify(ctx)
+			if !errors.Is(err, c.want) {
+				t.Errorf("Verify got error %v, want %v", err, c.want)
+			}
+			if c.want != ErrTokenExpired && errors.Is(err, ErrTokenExpired) {
+				t.Errorf("Verify got error %v, want not %v", err, ErrTokenExpired)
+			}
+		})
+	}
+}
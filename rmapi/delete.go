@@ -0,0 +1,31 @@
+package rmapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrDocumentNotFound is the error returned by Delete when the document is not
+// in the root index.
+var ErrDocumentNotFound = errors.New("rmapi: document not found in root index")
+
+// Delete removes the document with id from reMarkable.
+//
+// Only the entry of the document is removed from the root index, the files of
+// the document are left for reMarkable to garbage collect.
+//
+// If the root index is changed concurrently, Delete retries with the new root
+// index, see Client.RootUpdateRetries.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.updateRootEntries(ctx, "rmapi.Client.Delete", func(entries []IndexEntry) ([]IndexEntry, error) {
+		trimmed := slices.DeleteFunc(entries, func(entry IndexEntry) bool {
+			return entry.Filename == id
+		})
+		if len(trimmed) == len(entries) {
+			return nil, fmt.Errorf("rmapi.Client.Delete: %w: %q", ErrDocumentNotFound, id)
+		}
+		return trimmed, nil
+	})
+}
@@ -0,0 +1,73 @@
+package rmapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	for _, c := range []struct {
+		label     string
+		id        string
+		conflicts int
+		err       error
+		updates   int
+	}{
+		{
+			label:   "deleted",
+			id:      "target",
+			updates: 1,
+		},
+		{
+			label: "not-found",
+			id:    "missing",
+			err:   ErrDocumentNotFound,
+		},
+		{
+			label:     "conflict-retried",
+			id:        "target",
+			conflicts: 1,
+			updates:   1,
+		},
+		{
+			label:     "conflict-exhausted",
+			id:        "target",
+			conflicts: DefaultRootUpdateRetries + 1,
+			err:       ErrGenerationConflict,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			keep := f.addDocument("keep", Metadata{Type: "DocumentType", Name: "keep"}, nil)
+			f.addDocument("target", Metadata{Type: "DocumentType", Name: "target"}, nil)
+			conflicts := c.conflicts
+			f.gcsHook = func(w http.ResponseWriter, r *http.Request, path string) bool {
+				if path == "root" && r.Method == http.MethodPut && conflicts > 0 {
+					// Simulate a concurrent root update from another client.
+					conflicts--
+					f.mu.Lock()
+					f.generation++
+					f.mu.Unlock()
+				}
+				return false
+			}
+
+			err := f.client().Delete(context.Background(), c.id)
+			if !errors.Is(err, c.err) {
+				t.Errorf("Delete got error %v, want %v", err, c.err)
+			}
+			if f.rootUpdates != c.updates {
+				t.Errorf("root updated %d times, want %d", f.rootUpdates, c.updates)
+			}
+			if c.updates == 0 {
+				return
+			}
+			entries := f.rootEntries()
+			if len(entries) != 1 || entries[0] != keep {
+				t.Errorf("root entries got %+v, want [%+v]", entries, keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package rmapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.yhsif.com/url2epub"
+)
+
+// ErrNoDocumentFile is the error returned by DownloadDocument when the
+// document has no epub or pdf file in its index.
+var ErrNoDocumentFile = errors.New("rmapi: no epub or pdf file in document index")
+
+// DownloadDocument downloads the epub or pdf file of the document with id from
+// reMarkable.
+//
+// On success, it's the caller's responsibility to close the returned
+// io.ReadCloser, preferably via url2epub.DrainAndClose.
+func (c *Client) DownloadDocument(ctx context.Context, id string) (io.ReadCloser, FileType, error) {
+	rootEntries, _, err := c.DownloadRoot(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rmapi.Client.DownloadDocument: %w", err)
+	}
+	var docEntry *IndexEntry
+	for i, entry := range rootEntries {
+		if entry.Filename == id {
+			docEntry = &rootEntries[i]
+			break
+		}
+	}
+	if docEntry == nil {
+		return nil, 0, fmt.Errorf("rmapi.Client.DownloadDocument: %w: %q", ErrDocumentNotFound, id)
+	}
+
+	indexEntries, err := c.DownloadIndex(ctx, docEntry.Path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rmapi.Client.DownloadDocument: %w", err)
+	}
+	var fileEntry IndexEntry
+	var ft FileType
+	for _, entry := range indexEntries {
+		if ft = fileTypeFromFilename(entry.Filename); ft != 0 {
+			fileEntry = entry
+			break
+		}
+	}
+	if ft == 0 {
+		return nil, 0, fmt.Errorf("rmapi.Client.DownloadDocument: %w: %q", ErrNoDocumentFile, id)
+	}
+
+	resp, err := c.Download15(ctx, fileEntry.Path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rmapi.Client.DownloadDocument: failed to download %q: %w", fileEntry.Filename, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer url2epub.DrainAndClose(resp.Body)
+		return nil, 0, fmt.Errorf("rmapi.Client.DownloadDocument: failed to download %q: %w", fileEntry.Filename, ParseGCSError(resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024)))
+	}
+	return resp.Body, ft, nil
+}
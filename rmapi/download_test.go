@@ -0,0 +1,73 @@
+package rmapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"go.yhsif.com/url2epub"
+)
+
+func TestDownloadDocument(t *testing.T) {
+	f := newFakeServer(t)
+	epubData := []byte("fake epub content")
+	pdfData := []byte("fake pdf content")
+	f.addDocument("epub-doc", Metadata{Type: "DocumentType", Name: "epub"}, map[string][]byte{
+		".content": []byte("{}"),
+		".epub":    epubData,
+	})
+	f.addDocument("pdf-doc", Metadata{Type: "DocumentType", Name: "pdf"}, map[string][]byte{
+		".pdf": pdfData,
+	})
+	f.addDocument("dir", Metadata{Type: "CollectionType", Name: "dir"}, map[string][]byte{
+		".content": []byte("{}"),
+	})
+
+	for _, c := range []struct {
+		id   string
+		want []byte
+		ft   FileType
+		err  error
+	}{
+		{
+			id:   "epub-doc",
+			want: epubData,
+			ft:   FileTypeEpub,
+		},
+		{
+			id:   "pdf-doc",
+			want: pdfData,
+			ft:   FileTypePdf,
+		},
+		{
+			id:  "dir",
+			err: ErrNoDocumentFile,
+		},
+		{
+			id:  "missing",
+			err: ErrDocumentNotFound,
+		},
+	} {
+		t.Run(c.id, func(t *testing.T) {
+			body, ft, err := f.client().DownloadDocument(context.Background(), c.id)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("DownloadDocument got error %v, want %v", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			defer url2epub.DrainAndClose(body)
+			if ft != c.ft {
+				t.Errorf("FileType got %v, want %v", ft, c.ft)
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+			if string(got) != string(c.want) {
+				t.Errorf("Content got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
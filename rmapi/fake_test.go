@@ -0,0 +1,332 @@
+package rmapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	fakeRefreshToken = "fake-refresh-token"
+	fakeToken        = "fake-token"
+
+	fakeRefreshPath = "/token/refresh"
+	fakeAPIPath     = "/sync"
+	fakeGCSPath     = "/gcs/"
+
+	fakeUploadIDQuery = "upload_id"
+)
+
+// fakeServer is an in-memory fake of the reMarkable cloud API 1.5 and the GCS
+// signed urls it returns.
+type fakeServer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	blobs      map[string][]byte
+	generation int64
+	// number of successful root updates
+	rootUpdates int
+	// the max upload size to advertise, <=0 means not advertised
+	maxUploadSize int64
+	// all the (non-root) paths uploaded, in order
+	uploads []string
+	// whether to return signed urls for resumable uploads when requested
+	resumable bool
+	// in progress resumable upload sessions, keyed by upload id
+	sessions map[string][]byte
+	// all the content-range headers of the resumable upload requests, in order
+	chunks []string
+
+	// optional hook called on every GCS request before it's handled,
+	// return true to indicate the request is already handled.
+	gcsHook func(w http.ResponseWriter, r *http.Request, path string) bool
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	f := &fakeServer{
+		t:          t,
+		blobs:      make(map[string][]byte),
+		sessions:   make(map[string][]byte),
+		generation: 1,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(fakeRefreshPath, f.handleRefresh)
+	mux.HandleFunc(fakeAPIPath+APIPathDownload, f.handleSignedURL(http.MethodGet))
+	mux.HandleFunc(fakeAPIPath+APIPathUpload, f.handleSignedURL(http.MethodPut))
+	mux.HandleFunc(fakeAPIPath+APIPathSyncComplete, f.handleSyncComplete)
+	mux.HandleFunc(fakeGCSPath, f.handleGCS)
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	f.setRoot(IndexSchemaV3, nil)
+	return f
+}
+
+func (f *fakeServer) client() *Client {
+	return &Client{
+		RefreshToken: fakeRefreshToken,
+		APIBase:      f.srv.URL + fakeAPIPath,
+		RefreshURL:   f.srv.URL + fakeRefreshPath,
+	}
+}
+
+func (f *fakeServer) put(data []byte) string {
+	path := sha256Hex(data)
+	f.blobs[path] = data
+	return path
+}
+
+// setRoot replaces the current root index with the given entries.
+func (f *fakeServer) setRoot(schema string, entries []IndexEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var buf bytes.Buffer
+	buf.WriteString(schema + "\n")
+	if schema == IndexSchemaV4 {
+		fmt.Fprintf(&buf, "%s%d:0\n", indexSchemaV4SummaryPrefix, len(entries))
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "%s:%s:%s:%d:%d\n", entry.Path, entry.Unused1, entry.Filename, entry.NumFiles, entry.Size)
+	}
+	f.blobs["root"] = []byte(f.put(buf.Bytes()))
+}
+
+// addDocument adds a document with the given metadata and files into the
+// current root.
+func (f *fakeServer) addDocument(id string, meta Metadata, files map[string][]byte) IndexEntry {
+	f.t.Helper()
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		f.t.Fatalf("Failed to marshal metadata: %v", err)
+	}
+	f.mu.Lock()
+	index := []IndexEntry{{
+		Path:     f.put(metaData),
+		Unused1:  IndexEntryUnused1Magic,
+		Filename: id + MetadataSuffix,
+		Size:     int64(len(metaData)),
+	}}
+	for name, data := range files {
+		index = append(index, IndexEntry{
+			Path:     f.put(data),
+			Unused1:  IndexEntryUnused1Magic,
+			Filename: id + name,
+			Size:     int64(len(data)),
+		})
+	}
+	entry := IndexEntry{
+		Path:     f.put(GenerateIndex(index).Bytes()),
+		Unused1:  RootEntryUnused1Magic,
+		Filename: id,
+		NumFiles: int64(len(index)),
+	}
+	f.mu.Unlock()
+	f.setRoot(IndexSchemaV3, append(f.rootEntries(), entry))
+	return entry
+}
+
+// rootEntries parses and returns the current root index entries.
+func (f *fakeServer) rootEntries() []IndexEntry {
+	f.t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var entries []IndexEntry
+	for i, line := range strings.Split(string(f.blobs[string(f.blobs["root"])]), "\n") {
+		if i == 0 || line == "" || strings.HasPrefix(line, indexSchemaV4SummaryPrefix) {
+			continue
+		}
+		entry, err := ParseIndexEntry(line)
+		if err != nil {
+			f.t.Fatalf("Failed to parse root index line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (f *fakeServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if got, want := r.Header.Get("authorization"), "Bearer "+fakeRefreshToken; got != want {
+		http.Error(w, "bad refresh token", http.StatusUnauthorized)
+		return
+	}
+	io.WriteString(w, fakeToken)
+}
+
+func (f *fakeServer) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	if got, want := r.Header.Get("authorization"), "Bearer "+fakeToken; got != want {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (f *fakeServer) handleSignedURL(method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !f.checkAuth(w, r) {
+			return
+		}
+		var req UpdateRootRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		method := method
+		if method == http.MethodPut && req.Method == http.MethodPost && f.resumable {
+			method = http.MethodPost
+		}
+		resp := map[string]any{
+			APIResponseKeyPath:    req.Path,
+			APIResponseKeyURL:     f.srv.URL + fakeGCSPath + req.Path,
+			APIResponseKeyMethod:  method,
+			APIResponseKeyExpires: "2100-01-01T00:00:00Z",
+		}
+		if method != http.MethodGet && f.maxUploadSize > 0 {
+			resp[APIResponseMaxUploadSizeBytes] = f.maxUploadSize
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (f *fakeServer) handleSyncComplete(w http.ResponseWriter, r *http.Request) {
+	if !f.checkAuth(w, r) {
+		return
+	}
+	io.WriteString(w, "{}")
+}
+
+func (f *fakeServer) handleGCS(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, fakeGCSPath)
+	if hook := f.gcsHook; hook != nil && hook(w, r, path) {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+
+	case http.MethodGet:
+		data, ok := f.blobs[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if path == "root" {
+			w.Header().Set(HeaderRootGeneration, strconv.FormatInt(f.generation, 10))
+		}
+		w.Write(data)
+
+	case http.MethodPost:
+		if r.Header.Get(headerResumable) != "start" {
+			http.Error(w, "missing "+headerResumable, http.StatusBadRequest)
+			return
+		}
+		id := strconv.Itoa(len(f.sessions) + 1)
+		f.sessions[id] = []byte{}
+		w.Header().Set(headerLocation, f.srv.URL+fakeGCSPath+path+"?"+fakeUploadIDQuery+"="+id)
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodPut:
+		if id := r.URL.Query().Get(fakeUploadIDQuery); id != "" {
+			f.handleChunk(w, r, path, id)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if path == "root" {
+			if got, want := r.Header.Get("x-goog-if-generation-match"), strconv.FormatInt(f.generation, 10); got != want {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				io.WriteString(w, `<?xml version='1.0' encoding='UTF-8'?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold.</Message></Error>`)
+				return
+			}
+			if _, ok := f.blobs[string(data)]; !ok {
+				http.Error(w, "root points to unknown index", http.StatusBadRequest)
+				return
+			}
+			f.generation++
+			f.rootUpdates++
+		} else {
+			if len(data) == 0 {
+				http.Error(w, "empty file", http.StatusBadRequest)
+				return
+			}
+			if got := sha256Hex(data); got != path {
+				http.Error(w, fmt.Sprintf("path %q does not match content hash %q", path, got), http.StatusBadRequest)
+				return
+			}
+			f.uploads = append(f.uploads, path)
+		}
+		f.blobs[path] = data
+	}
+}
+
+// handleChunk handles a chunk of resumable upload, f.mu must be held.
+func (f *fakeServer) handleChunk(w http.ResponseWriter, r *http.Request, path, id string) {
+	data, ok := f.sessions[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	contentRange := r.Header.Get(headerContentRange)
+	f.chunks = append(f.chunks, contentRange)
+	var first, last, total int64
+	if n, _ := fmt.Sscanf(contentRange, "bytes */%d", &total); n == 1 {
+		// status query
+	} else if n, _ := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &total); n == 3 {
+		chunk, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if first != int64(len(data)) || last-first+1 != int64(len(chunk)) {
+			http.Error(w, fmt.Sprintf("bad content-range %q with %d bytes persisted and %d bytes chunk", contentRange, len(data), len(chunk)), http.StatusBadRequest)
+			return
+		}
+		if last+1 < total && len(chunk)%resumableChunkUnit != 0 {
+			http.Error(w, fmt.Sprintf("chunk size %d is not multiples of %d", len(chunk), resumableChunkUnit), http.StatusBadRequest)
+			return
+		}
+		data = append(data, chunk...)
+		f.sessions[id] = data
+	} else {
+		http.Error(w, fmt.Sprintf("bad content-range %q", contentRange), http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(data)) < total {
+		if len(data) > 0 {
+			w.Header().Set(headerRange, fmt.Sprintf("bytes=0-%d", len(data)-1))
+		}
+		w.WriteHeader(statusResumeIncomplete)
+		return
+	}
+	if got := sha256Hex(data); got != path {
+		http.Error(w, fmt.Sprintf("path %q does not match content hash %q", path, got), http.StatusBadRequest)
+		return
+	}
+	delete(f.sessions, id)
+	f.blobs[path] = data
+	f.uploads = append(f.uploads, path)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
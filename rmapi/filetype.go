@@ -1,6 +1,7 @@
 package rmapi
 
 import (
+	"encoding/json"
 	"strings"
 	"text/template"
 )
@@ -29,8 +30,27 @@ func (ft FileType) Ext() string {
 	}
 }
 
+// fileTypeFromFilename infers the FileType from the file extension of name.
+//
+// It returns the zero FileType when the extension is not recognized.
+func fileTypeFromFilename(name string) FileType {
+	for _, ft := range []FileType{FileTypeEpub, FileTypePdf} {
+		if strings.HasSuffix(name, ft.Ext()) {
+			return ft
+		}
+	}
+	return 0
+}
+
+var tmplFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
 var (
-	tmplEpub = template.Must(template.New("content").Parse(`{
+	tmplEpub = template.Must(template.New("content").Funcs(tmplFuncs).Parse(`{
   "coverPageNumber": -1,
   "documentMetadata": {},
   "dummyDocument": false,
@@ -42,18 +62,20 @@ var (
   "orientation": "portrait",
   "originalPageCount": -1,
   "pageCount": 0,
-  "redirectionPageMap": [],
+  "redirectionPageMap": [],{{if .Tags}}
+  "tags": {{json .Tags}},{{end}}
   "textAlignment": "left",
   "textScale": 1,
   "transform": {}
 }
 `))
 
-	tmplPdf = template.Must(template.New("content").Parse(`{
+	tmplPdf = template.Must(template.New("content").Funcs(tmplFuncs).Parse(`{
   "fileType": "pdf",
   "fontName": "{{.Font}}",
   "margins": 100,
-  "orientation": "portrait",
+  "orientation": "portrait",{{if .Tags}}
+  "tags": {{json .Tags}},{{end}}
   "textAlignment": "left",
   "textScale": 1,
   "transform": {}
@@ -64,6 +86,9 @@ var (
 // ContentArgs defines the args to population InitialContent.
 type ContentArgs struct {
 	Font string
+
+	// Optional tags to be attached to the document.
+	Tags []Tag
 }
 
 // InitialContent returns the initial .content file for the given FileType.
@@ -0,0 +1,115 @@
+package rmapi
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUploadTooLarge is the error wrapped by UploadTooLargeError.
+var ErrUploadTooLarge = errors.New("rmapi: file is larger than the max upload size")
+
+// UploadTooLargeError is the error returned when the file to upload is larger
+// than the max upload size advertised by reMarkable cloud, before uploading it.
+type UploadTooLargeError struct {
+	Size          int64
+	MaxUploadSize int64
+}
+
+func (e UploadTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d > %d", ErrUploadTooLarge, e.Size, e.MaxUploadSize)
+}
+
+// Unwrap returns ErrUploadTooLarge.
+func (e UploadTooLargeError) Unwrap() error {
+	return ErrUploadTooLarge
+}
+
+// GCSError is the error returned by GCS requests (uploads and downloads via
+// the signed urls) with non-200 status.
+//
+// Code and Message are parsed from the response body when possible.
+// GCS usually returns XML error bodies like:
+//
+//	<?xml version='1.0' encoding='UTF-8'?>
+//	<Error><Code>PreconditionFailed</Code><Message>...</Message></Error>
+//
+// but JSON error bodies are also recognized.
+type GCSError struct {
+	StatusCode int
+	Status     string
+
+	Code    string
+	Message string
+
+	// The raw (possibly truncated) response body.
+	Body string
+}
+
+func (ge GCSError) Error() string {
+	if ge.Code == "" && ge.Message == "" {
+		return fmt.Sprintf("gcs http status %d/%s: %q", ge.StatusCode, ge.Status, ge.Body)
+	}
+	return fmt.Sprintf("gcs http status %d/%s: code=%q, message=%q", ge.StatusCode, ge.Status, ge.Code, ge.Message)
+}
+
+type gcsXMLError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+	Details string   `xml:"Details"`
+}
+
+type gcsJSONError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Errors  []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// ParseGCSError parses the response body of a failed GCS request into
+// GCSError.
+//
+// If the body cannot be parsed, the returned GCSError will only have
+// StatusCode, Status and Body set.
+func ParseGCSError(statusCode int, status string, body string) GCSError {
+	ge := GCSError{
+		StatusCode: statusCode,
+		Status:     status,
+		Body:       body,
+	}
+	trimmed := strings.TrimSpace(body)
+	switch {
+	case strings.HasPrefix(trimmed, "<"):
+		var e gcsXMLError
+		if err := xml.Unmarshal([]byte(trimmed), &e); err == nil {
+			ge.Code = e.Code
+			ge.Message = e.Message
+			if ge.Message == "" {
+				ge.Message = e.Details
+			}
+		}
+	case strings.HasPrefix(trimmed, "{"):
+		var e gcsJSONError
+		if err := json.Unmarshal([]byte(trimmed), &e); err == nil {
+			ge.Code = e.Error.Status
+			ge.Message = e.Error.Message
+			if len(e.Error.Errors) > 0 {
+				if ge.Code == "" {
+					ge.Code = e.Error.Errors[0].Reason
+				}
+				if ge.Message == "" {
+					ge.Message = e.Error.Errors[0].Message
+				}
+			}
+		}
+	}
+	return ge
+}
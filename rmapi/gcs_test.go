@@ -0,0 +1,66 @@
+package rmapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestParseGCSError(t *testing.T) {
+	for _, c := range []struct {
+		label   string
+		body    string
+		code    string
+		message string
+	}{
+		{
+			label:   "xml-precondition",
+			body:    `<?xml version='1.0' encoding='UTF-8'?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold.</Message><Details>Condition failed: x-goog-if-generation-match</Details></Error>`,
+			code:    "PreconditionFailed",
+			message: "At least one of the pre-conditions you specified did not hold.",
+		},
+		{
+			label: "xml-too-large",
+			body: `<?xml version='1.0' encoding='UTF-8'?>
+<Error>
+  <Code>EntityTooLarge</Code>
+  <Details>Your proposed upload is larger than the maximum object size specified in your Policy Document.</Details>
+</Error>`,
+			code:    "EntityTooLarge",
+			message: "Your proposed upload is larger than the maximum object size specified in your Policy Document.",
+		},
+		{
+			label:   "json",
+			body:    `{"error":{"code":429,"message":"The rate of change requests to the object is too high.","errors":[{"reason":"rateLimitExceeded","message":"too high"}]}}`,
+			code:    "rateLimitExceeded",
+			message: "The rate of change requests to the object is too high.",
+		},
+		{
+			label: "plain",
+			body:  "empty file",
+		},
+		{
+			label: "bad-xml",
+			body:  "<Error><Code>",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			ge := ParseGCSError(http.StatusBadRequest, "400 Bad Request", c.body)
+			if ge.Code != c.code {
+				t.Errorf("Code got %q want %q", ge.Code, c.code)
+			}
+			if ge.Message != c.message {
+				t.Errorf("Message got %q want %q", ge.Message, c.message)
+			}
+			if ge.Body != c.body {
+				t.Errorf("Body got %q want %q", ge.Body, c.body)
+			}
+
+			var target GCSError
+			if !errors.As(fmt.Errorf("wrapped: %w", ge), &target) {
+				t.Errorf("errors.As failed on wrapped %v", ge)
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package rmapi
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"go.yhsif.com/url2epub"
 )
@@ -20,13 +23,85 @@ var RootDisplayName = "<ROOT>"
 // When error is nil, the map is guaranteed to have at least an entry of
 // "" -> RootDisplayName.
 func (c *Client) ListDirs(ctx context.Context) (map[string]string, error) {
+	items, err := c.listMetadata(ctx, "rmapi.ListDirs", true)
+	if err != nil {
+		return nil, err
+	}
+	return resolveDirs(items), nil
+}
+
+// DocumentInfo is a document returned by ListDocuments.
+type DocumentInfo struct {
+	ID   string
+	Name string
+
+	// The id of the parent directory, "" for root.
+	Parent string
+	// The display name of the parent directory, as returned by ListDirs.
+	ParentPath string
+
+	LastModified time.Time
+}
+
+// ListDocuments lists all the documents (not directories) on user's
+// reMarkable account, sorted by their ParentPath and then Name.
+func (c *Client) ListDocuments(ctx context.Context) ([]DocumentInfo, error) {
+	items, err := c.listMetadata(ctx, "rmapi.ListDocuments", false)
+	if err != nil {
+		return nil, err
+	}
+	dirs := resolveDirs(items)
+	var docs []DocumentInfo
+	for id, item := range items {
+		if item.Type != "DocumentType" {
+			continue
+		}
+		docs = append(docs, DocumentInfo{
+			ID:           id,
+			Name:         item.Name,
+			Parent:       item.Parent,
+			ParentPath:   resolveName(item.Parent, items, dirs),
+			LastModified: time.Time(item.LastModified),
+		})
+	}
+	slices.SortFunc(docs, func(a, b DocumentInfo) int {
+		return cmp.Or(
+			cmp.Compare(a.ParentPath, b.ParentPath),
+			cmp.Compare(a.Name, b.Name),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+	return docs, nil
+}
+
+// resolveDirs returns the directories in items in the format of ListDirs.
+func resolveDirs(items map[string]*Metadata) map[string]string {
+	m := make(map[string]string)
+	m[""] = RootDisplayName
+	for k, item := range items {
+		if item.Type == "CollectionType" {
+			m[k] = resolveName(k, items, m)
+		}
+	}
+	return m
+}
+
+// listMetadata downloads the metadata of all the root entries, in the format
+// of <id> -> metadata.
+//
+// When dirsOnly is true, only the metadata of directories are returned, and
+// the root entries that can't be directories are skipped to save some
+// requests.
+//
+// op is used as the prefix of the error and the logs.
+func (c *Client) listMetadata(ctx context.Context, op string, dirsOnly bool) (map[string]*Metadata, error) {
 	rootEntries, _, err := c.DownloadRoot(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("rmapi.ListDirs: %w", err)
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 	items := make(map[string]*Metadata)
 	for _, entry := range rootEntries {
-		if entry.NumFiles > 2 {
+		if dirsOnly && entry.NumFiles > 2 {
 			// Directories should ot have more than 2 files (metadata + empty content
 			// file), so we can skip every root entry with >2 files to save some
 			// requests.
@@ -36,7 +111,7 @@ func (c *Client) ListDirs(ctx context.Context) (map[string]string, error) {
 		if err != nil {
 			slog.ErrorContext(
 				ctx,
-				"rmapi.ListDirs: failed to download index file",
+				op+": failed to download index file",
 				"err", err,
 				"path", entry.Path,
 				"uuid", entry.Filename,
@@ -52,7 +127,7 @@ func (c *Client) ListDirs(ctx context.Context) (map[string]string, error) {
 			if err != nil {
 				slog.ErrorContext(
 					ctx,
-					"rmapi.ListDirs: failed to download file for index",
+					op+": failed to download file for index",
 					"err", err,
 					"suffix", MetadataSuffix,
 					"index", fmt.Sprintf("%+v", index),
@@ -66,7 +141,7 @@ func (c *Client) ListDirs(ctx context.Context) (map[string]string, error) {
 			}(); err != nil {
 				slog.ErrorContext(
 					ctx,
-					"rmapi.ListDirs: failed to parse file for index",
+					op+": failed to parse file for index",
 					"err", err,
 					"suffix", MetadataSuffix,
 					"index", fmt.Sprintf("%+v", index),
@@ -74,7 +149,7 @@ func (c *Client) ListDirs(ctx context.Context) (map[string]string, error) {
 				continue
 			}
 			metadataFound = true
-			if meta.Type == "CollectionType" {
+			if !dirsOnly || meta.Type == "CollectionType" {
 				items[entry.Filename] = &meta
 			}
 			break
@@ -82,19 +157,14 @@ func (c *Client) ListDirs(ctx context.Context) (map[string]string, error) {
 		if !metadataFound {
 			slog.WarnContext(
 				ctx,
-				"rmapi.ListDirs: file not found for entry",
+				op+": file not found for entry",
 				"lastErr", err,
 				"suffix", MetadataSuffix,
 				"entry", fmt.Sprintf("%+v", entry),
 			)
 		}
 	}
-	m := make(map[string]string)
-	m[""] = RootDisplayName
-	for k := range items {
-		m[k] = resolveName(k, items, m)
-	}
-	return m, nil
+	return items, nil
 }
 
 func resolveName(k string, items map[string]*Metadata, m map[string]string) string {
@@ -0,0 +1,90 @@
+package rmapi
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestListDocuments(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	f := newFakeServer(t)
+	f.addDocument("dir-a", Metadata{Type: "CollectionType", Name: "A"}, nil)
+	f.addDocument("dir-b", Metadata{Type: "CollectionType", Name: "B", Parent: "dir-a"}, nil)
+	docFiles := map[string][]byte{
+		".content": []byte("{}"),
+		".epub":    []byte("epub"),
+	}
+	f.addDocument("doc-root", Metadata{
+		Type:         "DocumentType",
+		Name:         "Root doc",
+		LastModified: TimestampMillisecond(modTime),
+	}, docFiles)
+	f.addDocument("doc-b", Metadata{
+		Type:         "DocumentType",
+		Name:         "Nested doc",
+		Parent:       "dir-b",
+		LastModified: TimestampMillisecond(modTime),
+	}, docFiles)
+	f.addDocument("doc-a", Metadata{
+		Type:         "DocumentType",
+		Name:         "Doc",
+		Parent:       "dir-a",
+		LastModified: TimestampMillisecond(modTime),
+	}, docFiles)
+
+	client := f.client()
+	ctx := context.Background()
+
+	docs, err := client.ListDocuments(ctx)
+	if err != nil {
+		t.Fatalf("ListDocuments failed: %v", err)
+	}
+	want := []DocumentInfo{
+		{
+			ID:           "doc-root",
+			Name:         "Root doc",
+			ParentPath:   RootDisplayName,
+			LastModified: modTime,
+		},
+		{
+			ID:           "doc-a",
+			Name:         "Doc",
+			Parent:       "dir-a",
+			ParentPath:   "A",
+			LastModified: modTime,
+		},
+		{
+			ID:           "doc-b",
+			Name:         "Nested doc",
+			Parent:       "dir-b",
+			ParentPath:   "A/B",
+			LastModified: modTime,
+		},
+	}
+	if !slices.EqualFunc(docs, want, func(a, b DocumentInfo) bool {
+		return a.ID == b.ID &&
+			a.Name == b.Name &&
+			a.Parent == b.Parent &&
+			a.ParentPath == b.ParentPath &&
+			a.LastModified.Equal(b.LastModified)
+	}) {
+		t.Errorf("ListDocuments got %+v, want %+v", docs, want)
+	}
+
+	// ListDirs should still only return the directories.
+	dirs, err := client.ListDirs(ctx)
+	if err != nil {
+		t.Fatalf("ListDirs failed: %v", err)
+	}
+	wantDirs := map[string]string{
+		"":      RootDisplayName,
+		"dir-a": "A",
+		"dir-b": "A/B",
+	}
+	if !maps.Equal(dirs, wantDirs) {
+		t.Errorf("ListDirs got %v, want %v", dirs, wantDirs)
+	}
+}
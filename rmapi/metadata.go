@@ -57,4 +57,29 @@ type Metadata struct {
 	Parent       string               `json:"parent"`
 	Version      int                  `json:"version"`
 	LastModified TimestampMillisecond `json:"lastModified"`
+
+	// Pinned is shown as "favorites" on the device.
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// Tag defines a single tag of a document.
+//
+// Note that tags are stored in the .content file instead of the .metadata file.
+type Tag struct {
+	Name      string
+	Timestamp time.Time
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// Unlike TimestampMillisecond, the timestamp of a tag is encoded as a json
+// number instead of a json string.
+func (t Tag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name      string `json:"name"`
+		Timestamp int64  `json:"timestamp"`
+	}{
+		Name:      t.Name,
+		Timestamp: t.Timestamp.UnixMilli(),
+	})
 }
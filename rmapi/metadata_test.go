@@ -0,0 +1,98 @@
+package rmapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMetadataMarshal(t *testing.T) {
+	for _, c := range []struct {
+		label  string
+		pinned bool
+		want   any
+	}{
+		{
+			label:  "not-pinned",
+			pinned: false,
+			want:   nil,
+		},
+		{
+			label:  "pinned",
+			pinned: true,
+			want:   true,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			data, err := json.Marshal(Metadata{
+				Type:   "DocumentType",
+				Name:   "foo",
+				Pinned: c.pinned,
+			})
+			if err != nil {
+				t.Fatalf("json.Marshal failed: %v", err)
+			}
+			var m map[string]any
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("json.Unmarshal %q failed: %v", data, err)
+			}
+			if got := m["pinned"]; got != c.want {
+				t.Errorf("pinned got %#v want %#v in %s", got, c.want, data)
+			}
+			if got, want := m["visibleName"], "foo"; got != want {
+				t.Errorf("visibleName got %#v want %#v in %s", got, want, data)
+			}
+		})
+	}
+}
+
+func TestInitialContentTags(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	for _, ft := range []FileType{FileTypeEpub, FileTypePdf} {
+		t.Run(ft.Ext(), func(t *testing.T) {
+			t.Run("no-tags", func(t *testing.T) {
+				content, err := ft.InitialContent(ContentArgs{})
+				if err != nil {
+					t.Fatalf("InitialContent failed: %v", err)
+				}
+				var m map[string]any
+				if err := json.Unmarshal([]byte(content), &m); err != nil {
+					t.Fatalf("json.Unmarshal %q failed: %v", content, err)
+				}
+				if _, ok := m["tags"]; ok {
+					t.Errorf("Unexpected tags in %s", content)
+				}
+			})
+
+			t.Run("tags", func(t *testing.T) {
+				content, err := ft.InitialContent(ContentArgs{
+					Tags: []Tag{
+						{Name: "url2epub", Timestamp: ts},
+						{Name: `"quoted"`, Timestamp: ts},
+					},
+				})
+				if err != nil {
+					t.Fatalf("InitialContent failed: %v", err)
+				}
+				var m struct {
+					Tags []struct {
+						Name      string `json:"name"`
+						Timestamp int64  `json:"timestamp"`
+					} `json:"tags"`
+				}
+				if err := json.Unmarshal([]byte(content), &m); err != nil {
+					t.Fatalf("json.Unmarshal %q failed: %v", content, err)
+				}
+				if len(m.Tags) != 2 {
+					t.Fatalf("Expected 2 tags, got %+v", m.Tags)
+				}
+				if got, want := m.Tags[1].Name, `"quoted"`; got != want {
+					t.Errorf("tag name got %q want %q", got, want)
+				}
+				if got, want := m.Tags[0].Timestamp, ts.UnixMilli(); got != want {
+					t.Errorf("tag timestamp got %d want %d", got, want)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package rmapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.yhsif.com/url2epub"
+)
+
+// Defaults of resumable uploads.
+const (
+	// DefaultResumableUploadThreshold is the default
+	// Client.ResumableUploadThreshold.
+	DefaultResumableUploadThreshold = 32 << 20
+
+	// DefaultResumableChunkSize is the default Client.ResumableChunkSize.
+	DefaultResumableChunkSize = 8 << 20
+
+	// GCS requires all the chunks except the last one to be multiples of 256KiB.
+	resumableChunkUnit = 256 << 10
+
+	// Max number of consecutive failures of a single chunk.
+	resumableMaxRetries = 3
+)
+
+// Headers and status codes used by GCS resumable uploads.
+const (
+	headerResumable    = "x-goog-resumable"
+	headerContentRange = "content-range"
+	headerRange        = "range"
+	headerLocation     = "location"
+
+	// GCS uses 308 to indicate that the upload is incomplete,
+	// which is not a redirect.
+	statusResumeIncomplete = http.StatusPermanentRedirect
+)
+
+// errResumableNotPermitted is the error returned by uploadResumable when the
+// signed url returned by reMarkable cloud does not allow resumable uploads.
+var errResumableNotPermitted = errors.New("rmapi: resumable upload not permitted")
+
+func (c *Client) resumableUploadThreshold() int64 {
+	if c.ResumableUploadThreshold == 0 {
+		return DefaultResumableUploadThreshold
+	}
+	return c.ResumableUploadThreshold
+}
+
+func (c *Client) resumableChunkSize() int64 {
+	size := c.ResumableChunkSize
+	if size <= 0 {
+		size = DefaultResumableChunkSize
+	}
+	// Round up to multiples of resumableChunkUnit.
+	return (size + resumableChunkUnit - 1) / resumableChunkUnit * resumableChunkUnit
+}
+
+// uploadResumable uploads data to GCS path using GCS resumable uploads.
+//
+// It returns an error wrapping errResumableNotPermitted if the signed url
+// returned by reMarkable cloud cannot be used to start a resumable upload, in
+// which case the caller should fallback to the single PUT upload.
+//
+// If progress is non-nil, it's called with the bytes persisted by GCS after
+// each chunk.
+func (c *Client) uploadResumable(ctx context.Context, path string, data []byte, progress func(sent, total int64)) error {
+	size := int64(len(data))
+	sessionURL, err := c.startResumable(ctx, path, size)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := c.resumableChunkSize()
+	var offset int64
+	var failures int
+	for {
+		end := min(offset+chunkSize, size)
+		done, persisted, err := putChunk(ctx, sessionURL, data[offset:end], offset, size)
+		if err != nil {
+			failures++
+			if failures > resumableMaxRetries {
+				return fmt.Errorf("rmapi.Client.uploadResumable: failed to upload chunk at offset %d after %d retries: %w", offset, resumableMaxRetries, err)
+			}
+			slog.DebugContext(
+				ctx,
+				"rmapi.Client.uploadResumable: chunk failed, querying upload status",
+				"err", err,
+				"path", path,
+				"offset", offset,
+				"failures", failures,
+			)
+			// Ask GCS how much it actually persisted, and resume from there.
+			done, persisted, err = putChunk(ctx, sessionURL, nil, 0, size)
+			if err != nil {
+				slog.DebugContext(ctx, "rmapi.Client.uploadResumable: failed to query upload status", "err", err, "path", path)
+				continue
+			}
+		} else {
+			failures = 0
+		}
+		if progress != nil {
+			progress(persisted, size)
+		}
+		if done {
+			return nil
+		}
+		offset = persisted
+	}
+}
+
+// startResumable starts a resumable upload session for size bytes and returns
+// the session url.
+func (c *Client) startResumable(ctx context.Context, path string, size int64) (string, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	if err := json.NewEncoder(buf).Encode(APIRequest{
+		Method: http.MethodPost,
+		Path:   path,
+	}); err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: failed to json encode api request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.apiURL(APIPathUpload), buf)
+	if err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: failed to create api request: %w", err)
+	}
+	resp, err := c.Do(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: failed to execute http request: %w", err)
+	}
+	defer url2epub.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("rmapi.Client.startResumable: http status for api request: %d/%s, %q", resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024))
+	}
+	var payload APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: failed to json decode api response: %w", err)
+	}
+	if err := payload.Err(); err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: %w: %w", errResumableNotPermitted, err)
+	}
+	if payload.URL == "" {
+		return "", fmt.Errorf("rmapi.Client.startResumable: no signed url in api response: %+v", payload)
+	}
+	if err := payload.CheckUploadSize(size); err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: %w", err)
+	}
+	if payload.Method != http.MethodPost {
+		return "", fmt.Errorf("rmapi.Client.startResumable: %w: signed url is for %q", errResumableNotPermitted, payload.Method)
+	}
+
+	payload.Headers[headerResumable] = "start"
+	req, err = payload.ToRequest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: failed to create GCS request: %w, payload: %+v", err, payload)
+	}
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("rmapi.Client.startResumable: failed to execute GCS request: %w, payload: %+v", err, payload)
+	}
+	defer url2epub.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		err := ParseGCSError(resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return "", fmt.Errorf("rmapi.Client.startResumable: %w: %w", errResumableNotPermitted, err)
+		}
+		return "", fmt.Errorf("rmapi.Client.startResumable: %w", err)
+	}
+	sessionURL := resp.Header.Get(headerLocation)
+	if sessionURL == "" {
+		return "", fmt.Errorf("rmapi.Client.startResumable: %w: no session url returned", errResumableNotPermitted)
+	}
+	return sessionURL, nil
+}
+
+// putChunk uploads chunk at offset of the total size to the resumable upload
+// session.
+//
+// When chunk is nil, it queries the status of the upload session instead.
+//
+// It returns whether the whole upload is done, and if not, the number of bytes
+// persisted by GCS so far.
+func putChunk(ctx context.Context, sessionURL string, chunk []byte, offset, size int64) (done bool, persisted int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, sessionURL, bytes.NewReader(chunk))
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to create http request: %w", err)
+	}
+	if chunk == nil {
+		req.Header.Set(headerContentRange, fmt.Sprintf("bytes */%d", size))
+	} else {
+		req.Header.Set(headerContentRange, fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(chunk))-1, size))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to execute http request: %w", err)
+	}
+	defer url2epub.DrainAndClose(resp.Body)
+	switch resp.StatusCode {
+	default:
+		return false, 0, ParseGCSError(resp.StatusCode, resp.Status, readUpTo(resp.Body, 1024))
+
+	case http.StatusOK, http.StatusCreated:
+		return true, size, nil
+
+	case statusResumeIncomplete:
+		persisted, err := parseRangeHeader(resp.Header.Get(headerRange))
+		if err != nil {
+			return false, 0, err
+		}
+		return false, persisted, nil
+	}
+}
+
+// parseRangeHeader parses the range header returned by GCS resumable uploads
+// (e.g. "bytes=0-1023") into the number of bytes persisted.
+//
+// Empty range header means nothing is persisted yet.
+func parseRangeHeader(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	_, last, ok := strings.Cut(strings.TrimPrefix(s, "bytes="), "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid range header %q", s)
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range header %q: %w", s, err)
+	}
+	return n + 1, nil
+}
@@ -0,0 +1,196 @@
+package rmapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUpload15Resumable(t *testing.T) {
+	const size = 2*resumableChunkUnit + 100
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	fullChunks := []string{
+		fmt.Sprintf("bytes 0-%d/%d", resumableChunkUnit-1, size),
+		fmt.Sprintf("bytes %d-%d/%d", resumableChunkUnit, 2*resumableChunkUnit-1, size),
+		fmt.Sprintf("bytes %d-%d/%d", 2*resumableChunkUnit, size-1, size),
+	}
+
+	for _, c := range []struct {
+		label     string
+		resumable bool
+		threshold int64
+		// fail the nth chunk request (1-based) once, 0 means never fail.
+		failChunk int
+		want      []string
+	}{
+		{
+			label:     "resumable",
+			resumable: true,
+			threshold: 1,
+			want:      fullChunks,
+		},
+		{
+			label:     "resumable-retry",
+			resumable: true,
+			threshold: 1,
+			failChunk: 2,
+			want: []string{
+				fullChunks[0],
+				fmt.Sprintf("bytes */%d", size),
+				fullChunks[1],
+				fullChunks[2],
+			},
+		},
+		{
+			label:     "not-permitted",
+			threshold: 1,
+		},
+		{
+			label:     "below-threshold",
+			resumable: true,
+		},
+		{
+			label:     "disabled",
+			resumable: true,
+			threshold: -1,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			f.resumable = c.resumable
+			var chunkRequests int
+			f.gcsHook = func(w http.ResponseWriter, r *http.Request, path string) bool {
+				if r.Method != http.MethodPut || r.URL.Query().Get(fakeUploadIDQuery) == "" {
+					return false
+				}
+				chunkRequests++
+				if chunkRequests == c.failChunk {
+					http.Error(w, "try again later", http.StatusServiceUnavailable)
+					return true
+				}
+				return false
+			}
+			client := f.client()
+			client.ResumableUploadThreshold = c.threshold
+			client.ResumableChunkSize = 1
+
+			path, gotSize, err := client.Upload15(context.Background(), bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Upload15 failed: %v", err)
+			}
+			if want := sha256Hex(data); path != want {
+				t.Errorf("Upload15 path got %q want %q", path, want)
+			}
+			if gotSize != size {
+				t.Errorf("Upload15 size got %d want %d", gotSize, size)
+			}
+			if !bytes.Equal(f.blobs[path], data) {
+				t.Errorf("Uploaded content does not match")
+			}
+			if !slices.Equal(f.chunks, c.want) {
+				t.Errorf("Chunks got %q want %q", f.chunks, c.want)
+			}
+		})
+	}
+}
+
+func TestStartResumableAPIError(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		code  int
+		body  string
+		want  string
+	}{
+		{
+			label: "unauthorized",
+			code:  http.StatusUnauthorized,
+			body:  "bad token",
+			want:  "401",
+		},
+		{
+			label: "server-error",
+			code:  http.StatusInternalServerError,
+			body:  "oops",
+			want:  "500",
+		},
+		{
+			label: "no-url",
+			code:  http.StatusOK,
+			body:  `{"method":"POST"}`,
+			want:  "no signed url",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.code)
+				io.WriteString(w, c.body)
+			}))
+			t.Cleanup(api.Close)
+			client := f.client()
+			client.APIBase = api.URL
+			if err := client.Refresh(context.Background()); err != nil {
+				t.Fatalf("Refresh failed: %v", err)
+			}
+
+			_, err := client.startResumable(context.Background(), "path", 10)
+			if err == nil {
+				t.Fatal("startResumable got no error")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("startResumable got error %v, want it to contain %q", err, c.want)
+			}
+			if errors.Is(err, errResumableNotPermitted) {
+				t.Errorf("startResumable got error %v, want not %v", err, errResumableNotPermitted)
+			}
+		})
+	}
+}
+
+func TestParseRangeHeader(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   int64
+		err    bool
+	}{
+		{
+			header: "",
+			want:   0,
+		},
+		{
+			header: "bytes=0-262143",
+			want:   262144,
+		},
+		{
+			header: "bytes=0-",
+			err:    true,
+		},
+		{
+			header: "foo",
+			err:    true,
+		},
+	} {
+		t.Run(c.header, func(t *testing.T) {
+			got, err := parseRangeHeader(c.header)
+			if c.err {
+				if err == nil {
+					t.Errorf("parseRangeHeader(%q) got %d, want error", c.header, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRangeHeader(%q) failed: %v", c.header, err)
+			}
+			if got != c.want {
+				t.Errorf("parseRangeHeader(%q) got %d want %d", c.header, got, c.want)
+			}
+		})
+	}
+}
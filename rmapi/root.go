@@ -0,0 +1,99 @@
+package rmapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ErrGenerationConflict is the error returned when updating the root index
+// keeps failing because other clients changed it in the meantime, after all
+// the retries.
+var ErrGenerationConflict = errors.New("rmapi: root index changed concurrently")
+
+// DefaultRootUpdateRetries is the default value of Client.RootUpdateRetries.
+const DefaultRootUpdateRetries = 3
+
+// The backoff before the first retry of updating the root index, doubled for
+// every retry after that.
+const rootUpdateBackoff = 100 * time.Millisecond
+
+func (c *Client) rootUpdateRetries() int {
+	if c.RootUpdateRetries == 0 {
+		return DefaultRootUpdateRetries
+	}
+	return max(c.RootUpdateRetries, 0)
+}
+
+// updateRootEntries downloads the current root index, uploads the new root
+// index with the entries returned by mutate, and updates the root to it.
+//
+// When the root index is changed by other clients in the meantime (generation
+// mismatch), it starts over with the new root index, so mutate could be called
+// multiple times. After all the retries, the returned error wraps
+// ErrGenerationConflict.
+//
+// caller is used as the prefix of the returned errors.
+func (c *Client) updateRootEntries(
+	ctx context.Context,
+	caller string,
+	mutate func(entries []IndexEntry) ([]IndexEntry, error),
+) error {
+	retries := c.rootUpdateRetries()
+	backoff := rootUpdateBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.updateRootEntriesOnce(ctx, caller, mutate)
+		if !isGenerationConflict(err) {
+			return err
+		}
+		if attempt >= retries {
+			return fmt.Errorf("%s: %w after %d attempts: %w", caller, ErrGenerationConflict, attempt+1, err)
+		}
+		slog.WarnContext(
+			ctx,
+			"Retrying root update on generation conflict",
+			"err", err,
+			"caller", caller,
+			"attempt", attempt+1,
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) updateRootEntriesOnce(
+	ctx context.Context,
+	caller string,
+	mutate func(entries []IndexEntry) ([]IndexEntry, error),
+) error {
+	entries, generation, schema, err := c.DownloadRootSchema(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to get current root: %w", caller, err)
+	}
+	if err := CheckSchema(schema); err != nil {
+		return fmt.Errorf("%s: %w", caller, err)
+	}
+	entries, err = mutate(entries)
+	if err != nil {
+		return err
+	}
+	rootPath, _, err := c.Upload15(ctx, GenerateIndex(entries))
+	if err != nil {
+		return fmt.Errorf("%s: failed to upload root index: %w", caller, err)
+	}
+	return c.UpdateRoot(ctx, generation, rootPath)
+}
+
+// isGenerationConflict returns true if err is from updating the root with a
+// stale generation.
+func isGenerationConflict(err error) bool {
+	var ge GCSError
+	return errors.As(err, &ge) && ge.StatusCode == http.StatusPreconditionFailed
+}
@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // UploadArgs defines the args used by Upload function.
 type UploadArgs struct {
-	ID    string
+	ID string
+	// Title is used as the visible name of the document, after NFC normalized,
+	// with control characters stripped and trimmed to maxTitleLength.
 	Title string
 
 	Data io.Reader
@@ -21,17 +28,63 @@ type UploadArgs struct {
 	// Optional
 	ParentID    string
 	ContentArgs ContentArgs
+
+	// Optional, pin the document (show it in favorites on the device).
+	Pinned bool
+
+	// Optional, when set to true, Upload downloads the root index again after
+	// updating it, to verify that the uploaded document is actually there.
+	//
+	// If it's not there, ErrUploadNotVisible will be returned.
+	VerifyVisible bool
+
+	// Optional, called as the blobs of the document are uploaded in order, with
+	// the stages defined by the UploadStage* constants.
+	//
+	// For UploadStageFile it's called as the bytes of Data are being sent, for
+	// UploadStageRoot it's called with 0 bytes after the root index is updated,
+	// and for the other stages it's called once after the blob is uploaded.
+	Progress func(stage string, bytesSent, total int64)
 }
 
+// The stages reported to UploadArgs.Progress, in order.
+const (
+	UploadStageMetadata = "metadata"
+	UploadStageContent  = "content"
+	UploadStagePagedata = "pagedata"
+	UploadStageFile     = "file"
+	UploadStageIndex    = "index"
+	UploadStageRoot     = "root"
+)
+
+func (args UploadArgs) reportProgress(stage string, bytesSent, total int64) {
+	if args.Progress != nil {
+		args.Progress(stage, bytesSent, total)
+	}
+}
+
+// ErrUploadNotVisible is the error returned by Upload when VerifyVisible is
+// set and the uploaded document is not found in the root index after the
+// upload.
+var ErrUploadNotVisible = errors.New("rmapi: uploaded document not visible in root index")
+
 const (
 	// reMarkable used to accept empty pagedata files,
 	// but starting from sometime around 2022-01-22 they stopped accepting the
 	// uploading of any empty files (with an "empty file" error in the upload api
 	// response), so we have to make it non-empty somehow.
 	defaultPagedata = "\n"
+
+	// The max length (in runes) of the visible name of the uploaded documents.
+	maxTitleLength = 200
+	// The suffix to indicate that the title is trimmed.
+	titleEllipsis = "…"
 )
 
 // Upload uploads a document to reMarkable.
+//
+// If the root index is changed concurrently, Upload retries adding the
+// document to the new root index, see Client.RootUpdateRetries.
 func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	now := time.Now()
 	var entries []IndexEntry
@@ -39,10 +92,11 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	metaName := args.ID + MetadataSuffix
 	meta := Metadata{
 		Type:         "DocumentType",
-		Name:         args.Title,
+		Name:         cleanTitle(args.Title),
 		Parent:       args.ParentID,
 		Version:      1,
 		LastModified: TimestampMillisecond(now),
+		Pinned:       args.Pinned,
 	}
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(meta); err != nil {
@@ -52,6 +106,7 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.Upload: failed to upload %s: %w", metaName, err)
 	}
+	args.reportProgress(UploadStageMetadata, metaSize, metaSize)
 	entries = append(entries, IndexEntry{
 		Path:     metaPath,
 		Unused1:  IndexEntryUnused1Magic,
@@ -68,6 +123,7 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.Upload: failed to upload %s: %w", contentName, err)
 	}
+	args.reportProgress(UploadStageContent, contentSize, contentSize)
 	entries = append(entries, IndexEntry{
 		Path:     contentPath,
 		Unused1:  IndexEntryUnused1Magic,
@@ -80,6 +136,7 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.Upload: failed to upload %s: %w", pagedataName, err)
 	}
+	args.reportProgress(UploadStagePagedata, pagedataSize, pagedataSize)
 	entries = append(entries, IndexEntry{
 		Path:     pagedataPath,
 		Unused1:  IndexEntryUnused1Magic,
@@ -88,7 +145,13 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	})
 
 	fileName := args.ID + args.Type.Ext()
-	filePath, fileSize, err := c.Upload15(ctx, args.Data)
+	var fileProgress func(sent, total int64)
+	if args.Progress != nil {
+		fileProgress = func(sent, total int64) {
+			args.Progress(UploadStageFile, sent, total)
+		}
+	}
+	filePath, fileSize, err := c.upload15Progress(ctx, args.Data, fileProgress)
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.Upload: failed to upload %s: %w", fileName, err)
 	}
@@ -100,10 +163,11 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 	})
 
 	indexName := args.ID
-	indexPath, _, err := c.Upload15(ctx, GenerateIndex(entries))
+	indexPath, indexSize, err := c.Upload15(ctx, GenerateIndex(entries))
 	if err != nil {
 		return fmt.Errorf("rmapi.Client.Upload: failed to upload %s: %w", indexName, err)
 	}
+	args.reportProgress(UploadStageIndex, indexSize, indexSize)
 	newEntry := IndexEntry{
 		Path:     indexPath,
 		Unused1:  RootEntryUnused1Magic,
@@ -111,14 +175,68 @@ func (c *Client) Upload(ctx context.Context, args UploadArgs) error {
 		NumFiles: int64(len(entries)),
 	}
 
-	rootEntries, generation, err := c.DownloadRoot(ctx)
-	if err != nil {
-		return fmt.Errorf("rmapi.Client.Upload: failed to get current root: %w", err)
+	if err := c.updateRootEntries(ctx, "rmapi.Client.Upload", func(entries []IndexEntry) ([]IndexEntry, error) {
+		return append(entries, newEntry), nil
+	}); err != nil {
+		return err
+	}
+	args.reportProgress(UploadStageRoot, 0, 0)
+	if args.VerifyVisible {
+		return c.verifyVisible(ctx, newEntry)
 	}
-	rootEntries = append(rootEntries, newEntry)
-	rootPath, _, err := c.Upload15(ctx, GenerateIndex(rootEntries))
+	return nil
+}
+
+func (c *Client) verifyVisible(ctx context.Context, entry IndexEntry) error {
+	rootEntries, _, err := c.DownloadRoot(ctx)
 	if err != nil {
-		return fmt.Errorf("rmapi.Client.Upload: failed to upload %s: %w", indexName, err)
+		return fmt.Errorf("rmapi.Client.Upload: failed to get root for verification: %w", err)
+	}
+	for _, e := range rootEntries {
+		if e.Filename == entry.Filename && e.Path == entry.Path {
+			return nil
+		}
+	}
+	return fmt.Errorf("rmapi.Client.Upload: %w: %q", ErrUploadNotVisible, entry.Filename)
+}
+
+// cleanTitle cleans title to be used as the visible name of the document.
+//
+// It replaces invalid utf-8 sequences, strips control characters (newlines and
+// tabs become spaces), NFC normalizes it, and trims it to maxTitleLength
+// without breaking combining character sequences.
+func cleanTitle(title string) string {
+	title = strings.ToValidUTF8(title, "\uFFFD")
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title)
+	title = strings.TrimSpace(title)
+
+	title = norm.NFC.String(title)
+	if utf8.RuneCountInString(title) <= maxTitleLength {
+		return title
+	}
+
+	limit := maxTitleLength - utf8.RuneCountInString(titleEllipsis)
+	var it norm.Iter
+	it.InitString(norm.NFC, title)
+	var sb strings.Builder
+	var length int
+	for !it.Done() {
+		// Each segment is a starter with its combining characters,
+		// so we never cut in the middle of them.
+		segment := it.Next()
+		length += utf8.RuneCount(segment)
+		if length > limit {
+			break
+		}
+		sb.Write(segment)
 	}
-	return c.UpdateRoot(ctx, generation, rootPath)
+	return strings.TrimSpace(sb.String()) + titleEllipsis
 }
@@ -0,0 +1,384 @@
+package rmapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestUploadSchema(t *testing.T) {
+	const id = "11111111-2222-3333-4444-555555555555"
+	for _, c := range []struct {
+		schema string
+		err    error
+	}{
+		{
+			schema: IndexSchemaV3,
+		},
+		{
+			schema: IndexSchemaV4,
+			err:    ErrUnsupportedSchema,
+		},
+	} {
+		t.Run(c.schema, func(t *testing.T) {
+			f := newFakeServer(t)
+			existing := f.addDocument("existing", Metadata{Type: "DocumentType", Name: "existing"}, nil)
+			f.setRoot(c.schema, []IndexEntry{existing})
+
+			client := f.client()
+			ctx := context.Background()
+
+			// Reading should work regardless of the schema.
+			entries, _, schema, err := client.DownloadRootSchema(ctx)
+			if err != nil {
+				t.Fatalf("DownloadRootSchema failed: %v", err)
+			}
+			if schema != c.schema {
+				t.Errorf("schema got %q want %q", schema, c.schema)
+			}
+			if len(entries) != 1 || entries[0] != existing {
+				t.Errorf("root entries got %+v want [%+v]", entries, existing)
+			}
+
+			err = client.Upload(ctx, UploadArgs{
+				ID:    id,
+				Title: "title",
+				Data:  strings.NewReader("epub"),
+				Type:  FileTypeEpub,
+			})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Upload got error %v want %v", err, c.err)
+			}
+			if c.err != nil {
+				if f.rootUpdates != 0 {
+					t.Errorf("root updated %d times on unsupported schema", f.rootUpdates)
+				}
+				return
+			}
+			if f.rootUpdates != 1 {
+				t.Errorf("root updated %d times, want 1", f.rootUpdates)
+			}
+			var found bool
+			for _, entry := range f.rootEntries() {
+				if entry.Filename == id {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%q not found in root after upload: %+v", id, f.rootEntries())
+			}
+		})
+	}
+}
+
+func TestUploadVerifyVisible(t *testing.T) {
+	const id = "11111111-2222-3333-4444-555555555555"
+	for _, c := range []struct {
+		label  string
+		ignore bool
+		verify bool
+		err    error
+	}{
+		{
+			label:  "visible",
+			verify: true,
+		},
+		{
+			label:  "not-visible",
+			ignore: true,
+			verify: true,
+			err:    ErrUploadNotVisible,
+		},
+		{
+			label:  "not-verified",
+			ignore: true,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			if c.ignore {
+				// Simulate a root update that "succeeded" but never took effect.
+				f.gcsHook = func(w http.ResponseWriter, r *http.Request, path string) bool {
+					return path == "root" && r.Method == http.MethodPut
+				}
+			}
+			err := f.client().Upload(context.Background(), UploadArgs{
+				ID:            id,
+				Title:         "title",
+				Data:          strings.NewReader("epub"),
+				Type:          FileTypeEpub,
+				VerifyVisible: c.verify,
+			})
+			if !errors.Is(err, c.err) {
+				t.Errorf("Upload got error %v want %v", err, c.err)
+			}
+		})
+	}
+}
+
+func TestUploadGenerationConflict(t *testing.T) {
+	const id = "11111111-2222-3333-4444-555555555555"
+	for _, c := range []struct {
+		label     string
+		retries   int
+		conflicts int
+		err       error
+		updates   int
+	}{
+		{
+			label:     "retried",
+			conflicts: 1,
+			updates:   1,
+		},
+		{
+			label:     "exhausted",
+			conflicts: DefaultRootUpdateRetries + 1,
+			err:       ErrGenerationConflict,
+		},
+		{
+			label:     "no-retries",
+			retries:   -1,
+			conflicts: 1,
+			err:       ErrGenerationConflict,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			existing := f.addDocument("existing", Metadata{Type: "DocumentType", Name: "existing"}, nil)
+			conflicts := c.conflicts
+			f.gcsHook = func(w http.ResponseWriter, r *http.Request, path string) bool {
+				if path == "root" && r.Method == http.MethodPut && conflicts > 0 {
+					// Simulate a concurrent root update from another client, right
+					// before ours.
+					conflicts--
+					f.mu.Lock()
+					f.generation++
+					f.mu.Unlock()
+				}
+				return false
+			}
+
+			client := f.client()
+			client.RootUpdateRetries = c.retries
+			err := client.Upload(context.Background(), UploadArgs{
+				ID:    id,
+				Title: "title",
+				Data:  strings.NewReader("epub"),
+				Type:  FileTypeEpub,
+			})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Upload got error %v want %v", err, c.err)
+			}
+			if f.rootUpdates != c.updates {
+				t.Errorf("root updated %d times, want %d", f.rootUpdates, c.updates)
+			}
+			if c.updates == 0 {
+				return
+			}
+			entries := f.rootEntries()
+			if len(entries) != 2 || !slices.Contains(entries, existing) {
+				t.Errorf("root entries got %+v, want 2 entries including %+v", entries, existing)
+			}
+			var found bool
+			for _, entry := range entries {
+				if entry.Filename == id {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%q not found in root after upload: %+v", id, entries)
+			}
+		})
+	}
+}
+
+func TestCleanTitle(t *testing.T) {
+	// "e" followed by combining acute accent, which is "é" after NFC.
+	const decomposed = "é"
+	// "a" with combining characters that have no precomposed forms.
+	const combining = "ạ̰̈"
+
+	for _, c := range []struct {
+		label string
+		title string
+		want  string
+	}{
+		{
+			label: "plain",
+			title: "Hello, world",
+			want:  "Hello, world",
+		},
+		{
+			label: "nfc",
+			title: "Caf" + decomposed,
+			want:  "Café",
+		},
+		{
+			label: "control",
+			title: " Hello,\n\tworld\x00\x1b! ",
+			want:  "Hello,  world!",
+		},
+		{
+			label: "invalid-utf8",
+			title: "foo\xffbar",
+			want:  "foo�bar",
+		},
+		{
+			label: "long-combining",
+			// each of them is 3 runes after NFC, 300 runes in total.
+			title: strings.Repeat(combining, 100),
+			// 66 complete sequences (198 runes), the 67th one would be cut in the
+			// middle.
+			want: strings.Repeat("\u1ea1\u0330\u0308", 66) + titleEllipsis,
+		},
+		{
+			label: "long-decomposed",
+			title: strings.Repeat(decomposed, 300),
+			want:  strings.Repeat("é", maxTitleLength-1) + titleEllipsis,
+		},
+		{
+			label: "exact-length",
+			title: strings.Repeat("a", maxTitleLength),
+			want:  strings.Repeat("a", maxTitleLength),
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			got := cleanTitle(c.title)
+			if got != c.want {
+				t.Errorf("cleanTitle(%q) got %q, want %q", c.title, got, c.want)
+			}
+			if n := utf8.RuneCountInString(got); n > maxTitleLength {
+				t.Errorf("cleanTitle(%q) got %d runes, want <= %d", c.title, n, maxTitleLength)
+			}
+		})
+	}
+}
+
+func TestUpload15TooLarge(t *testing.T) {
+	const maxSize = 10
+	for _, c := range []struct {
+		label     string
+		resumable bool
+		threshold int64
+	}{
+		{
+			label:     "single-put",
+			threshold: -1,
+		},
+		{
+			label:     "resumable",
+			resumable: true,
+			threshold: 1,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			f.maxUploadSize = maxSize
+			f.resumable = c.resumable
+			client := f.client()
+			client.ResumableUploadThreshold = c.threshold
+			ctx := context.Background()
+
+			_, _, err := client.Upload15(ctx, bytes.NewBufferString("this is longer than 10 bytes"))
+			var tooLarge UploadTooLargeError
+			if !errors.As(err, &tooLarge) {
+				t.Fatalf("Upload15 got error %v, want %T", err, tooLarge)
+			}
+			if !errors.Is(err, ErrUploadTooLarge) {
+				t.Errorf("Upload15 got error %v, want %v", err, ErrUploadTooLarge)
+			}
+			if tooLarge.MaxUploadSize != maxSize {
+				t.Errorf("MaxUploadSize got %d, want %d", tooLarge.MaxUploadSize, maxSize)
+			}
+			if len(f.uploads) != 0 || len(f.chunks) != 0 {
+				t.Errorf("Got uploads %q and chunks %q, want none", f.uploads, f.chunks)
+			}
+
+			if _, _, err := client.Upload15(ctx, bytes.NewBufferString("small")); err != nil {
+				t.Errorf("Upload15 with small file got error %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	const id = "11111111-2222-3333-4444-555555555555"
+	const size = 2*resumableChunkUnit + 100
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	wantStages := []string{
+		UploadStageMetadata,
+		UploadStageContent,
+		UploadStagePagedata,
+		UploadStageFile,
+		UploadStageIndex,
+		UploadStageRoot,
+	}
+
+	for _, c := range []struct {
+		label     string
+		resumable bool
+		threshold int64
+		// The bytes sent reported for the file stage, nil means only check the
+		// last one.
+		wantFileSent []int64
+	}{
+		{
+			label:     "single-put",
+			threshold: -1,
+		},
+		{
+			label:        "resumable",
+			resumable:    true,
+			threshold:    1,
+			wantFileSent: []int64{resumableChunkUnit, 2 * resumableChunkUnit, size},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			f := newFakeServer(t)
+			f.resumable = c.resumable
+			client := f.client()
+			client.ResumableUploadThreshold = c.threshold
+			client.ResumableChunkSize = resumableChunkUnit
+
+			var stages []string
+			var fileSent []int64
+			if err := client.Upload(context.Background(), UploadArgs{
+				ID:    id,
+				Title: "title",
+				Data:  bytes.NewReader(data),
+				Type:  FileTypeEpub,
+				Progress: func(stage string, bytesSent, total int64) {
+					if len(stages) == 0 || stages[len(stages)-1] != stage {
+						stages = append(stages, stage)
+					}
+					if stage != UploadStageFile {
+						return
+					}
+					if total != size {
+						t.Errorf("Got total %d for file stage, want %d", total, size)
+					}
+					if n := len(fileSent); n > 0 && bytesSent < fileSent[n-1] {
+						t.Errorf("Got bytes sent %d after %d", bytesSent, fileSent[n-1])
+					}
+					fileSent = append(fileSent, bytesSent)
+				},
+			}); err != nil {
+				t.Fatalf("Upload got error %v", err)
+			}
+			if !slices.Equal(stages, wantStages) {
+				t.Errorf("Got stages %q, want %q", stages, wantStages)
+			}
+			if c.wantFileSent != nil && !slices.Equal(fileSent, c.wantFileSent) {
+				t.Errorf("Got file bytes sent %v, want %v", fileSent, c.wantFileSent)
+			}
+			if n := len(fileSent); n == 0 || fileSent[n-1] != size {
+				t.Errorf("Got file bytes sent %v, want to end with %d", fileSent, size)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package url2epub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+)
+
+const (
+	webpMediaType = "image/webp"
+	avifMediaType = "image/avif"
+)
+
+// The file extensions of the raster image content types we support.
+var imageExts = map[string]string{
+	"image/bmp":   ".bmp",
+	"image/gif":   ".gif",
+	"image/jpeg":  jpgExt,
+	"image/png":   pngExt,
+	webpMediaType: ".webp",
+	avifMediaType: ".avif",
+}
+
+// detectImageContentType is a more complete version of http.DetectContentType
+// for images.
+//
+// It recognizes webp, avif, and svg, which http.DetectContentType either
+// doesn't support or reports as non-image types, and falls back to
+// http.DetectContentType for everything else.
+func detectImageContentType(data []byte) string {
+	if len(data) > contentTypePeekSize {
+		data = data[:contentTypePeekSize]
+	}
+	switch {
+	case isWebP(data):
+		return webpMediaType
+	case isAVIF(data):
+		return avifMediaType
+	case isSVG(data):
+		return svgMediaType
+	}
+	return http.DetectContentType(data)
+}
+
+// isWebP returns true if data starts with a RIFF header of WEBP form type.
+func isWebP(data []byte) bool {
+	return len(data) >= 12 &&
+		bytes.Equal(data[:4], []byte("RIFF")) &&
+		bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+var avifBrands = [][]byte{
+	[]byte("avif"),
+	[]byte("avis"),
+}
+
+// isAVIF returns true if data starts with an ISO BMFF ftyp box with avif as
+// either the major brand or one of the compatible brands.
+func isAVIF(data []byte) bool {
+	if len(data) < 12 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return false
+	}
+	size := binary.BigEndian.Uint32(data[:4])
+	if size < 16 || size%4 != 0 {
+		return false
+	}
+	box := data[8:min(int(size), len(data))]
+	// major brand (4 bytes), minor version (4 bytes), compatible brands (4 bytes
+	// each).
+	for i := 0; i+4 <= len(box); i += 4 {
+		if i == 4 {
+			// minor version
+			continue
+		}
+		for _, brand := range avifBrands {
+			if bytes.Equal(box[i:i+4], brand) {
+				return true
+			}
+		}
+	}
+	return false
+}
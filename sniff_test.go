@@ -0,0 +1,94 @@
+package url2epub
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testWebPHeader = "RIFF\x24\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00"
+	testAVIFHeader = "\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf\x00\x00\x00\x00meta"
+	// major brand is mif1, with avif as a compatible brand.
+	testAVIFCompatHeader = "\x00\x00\x00\x20ftypmif1\x00\x00\x00\x00mif1avifmiafMA1B\x00\x00\x00\x00meta"
+	// heic is not avif.
+	testHEICHeader = "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic\x00\x00\x00\x00meta"
+)
+
+func TestDetectImageContentType(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		data  string
+		want  string
+	}{
+		{
+			label: "webp",
+			data:  testWebPHeader,
+			want:  "image/webp",
+		},
+		{
+			label: "avif",
+			data:  testAVIFHeader,
+			want:  "image/avif",
+		},
+		{
+			label: "avif-compatible-brand",
+			data:  testAVIFCompatHeader,
+			want:  "image/avif",
+		},
+		{
+			label: "heic",
+			data:  testHEICHeader,
+			want:  "application/octet-stream",
+		},
+		{
+			label: "svg",
+			data:  `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+			want:  "image/svg+xml",
+		},
+		{
+			label: "jpeg",
+			data:  "\xff\xd8\xff\xe0 jpeg",
+			want:  "image/jpeg",
+		},
+		{
+			label: "riff-wav",
+			data:  "RIFF\x24\x00\x00\x00WAVEfmt ",
+			want:  "audio/wave",
+		},
+		{
+			label: "truncated",
+			data:  "RIFF",
+			want:  "text/plain; charset=utf-8",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := detectImageContentType([]byte(c.data)); got != c.want {
+				t.Errorf("detectImageContentType(%q) got %q, want %q", c.data, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEpubImageMediaTypes(t *testing.T) {
+	buf := testEpub(t, EpubArgs{
+		Title: "Hello",
+		Images: map[string]io.Reader{
+			"images/001.webp": strings.NewReader(testWebPHeader),
+			"images/002.avif": bytes.NewBufferString(testAVIFHeader),
+		},
+	})
+	if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+		t.Errorf("ValidateEpub got %v", errs)
+	}
+	opf := testEpubOpf(t, buf)
+	for _, want := range []string{
+		`href="images/001.webp" media-type="image/webp"`,
+		`href="images/002.avif" media-type="image/avif"`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("opf does not contain %q:\n%s", want, opf)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package url2epub
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	svgExt       = ".svg"
+	pngExt       = ".png"
+	svgMediaType = "image/svg+xml"
+
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+)
+
+// SVGMode defines how Readable handles svg images, both inline svg elements
+// and img elements with data:image/svg+xml src.
+type SVGMode int
+
+// SVGMode values.
+const (
+	// Drop all svg images.
+	SVGDrop SVGMode = iota
+
+	// Keep inline svg elements in the html, and save data uri svg images as
+	// svg files.
+	SVGPreserve
+
+	// Rasterize all svg images, including the ones downloaded from img src,
+	// for broader e-reader support.
+	//
+	// The rasterized images respect Grayscale, ImageMode and FitImage args. Images failed
+	// to rasterize are dropped.
+	SVGRasterize
+)
+
+const (
+	// SVG sizes are in css pixels (96 dpi), render them at 2x for e-ink screens,
+	// which are usually around 200-300 dpi.
+	svgRasterizeScale = 2
+	// The max width/height of rasterized svg images.
+	svgRasterizeMaxSize = 2048
+	// The size to use when the svg doesn't specify one.
+	svgRasterizeDefaultSize = 512
+)
+
+// The elements inside svg that we never keep.
+var svgDropElements = map[string]bool{
+	"script":        true,
+	"foreignObject": true,
+}
+
+// readableSVG handles inline svg node based on state.args.SVGMode.
+func readableSVG(ctx context.Context, node *html.Node, state *readableState) *html.Node {
+	switch state.args.SVGMode {
+	default:
+		return nil
+
+	case SVGPreserve:
+		return copySVG(node)
+
+	case SVGRasterize:
+		var buf bytes.Buffer
+		if err := html.Render(&buf, copySVG(node)); err != nil {
+			slog.DebugContext(ctx, "Failed to render inline svg", "err", err)
+			return nil
+		}
+		filename := state.addRasterizedSVG(ctx, buf.Bytes())
+		if filename == "" {
+			return nil
+		}
+		return &html.Node{
+			Type:     html.ElementNode,
+			DataAtom: atom.Img,
+			Data:     atom.Img.String(),
+			Attr: []html.Attribute{
+				{
+					Key: imgSrc,
+					Val: filename,
+				},
+				{
+					Key: "alt",
+				},
+			},
+		}
+	}
+}
+
+// addRasterizedSVG rasterizes svg data and adds it as an image, and returns its
+// local filename.
+//
+// It returns empty string if the rasterization failed.
+func (state *readableState) addRasterizedSVG(ctx context.Context, data []byte) string {
+	buf, ext, err := rasterizeSVG(data, state.args)
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to rasterize svg", "err", err)
+		return ""
+	}
+	return state.addImageData(buf.Bytes(), ext)
+}
+
+// addSVGDataURI adds the data:image/svg+xml src as an image, and returns its
+// local filename.
+//
+// It returns empty string if src is not a svg data uri, or SVGMode is
+// SVGDrop.
+func (state *readableState) addSVGDataURI(ctx context.Context, src string) string {
+	if state.args.SVGMode == SVGDrop {
+		return ""
+	}
+	mediaType, data, ok := parseDataURI(src)
+	if !ok || mediaType != svgMediaType {
+		return ""
+	}
+	if len(data) == 0 {
+		slog.DebugContext(ctx, "Empty svg data uri", "src", src)
+		return ""
+	}
+	if state.args.SVGMode == SVGRasterize {
+		return state.addRasterizedSVG(ctx, data)
+	}
+	return state.addImageData(data, svgExt)
+}
+
+// isSVG returns true if data (or the beginning of it) looks like a svg file.
+func isSVG(data []byte) bool {
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if bytes.HasPrefix(data, []byte("<svg")) {
+		return true
+	}
+	if !bytes.HasPrefix(data, []byte("<?xml")) && !bytes.HasPrefix(data, []byte("<!")) {
+		return false
+	}
+	// Skip the xml declaration, doctype and comments.
+	return bytes.Contains(data, []byte("<svg"))
+}
+
+// rasterizeSVG renders svg data into an image encoded according to args.
+//
+// When args.Grayscale is true (or with ImageModeGray or ImageModeBW), the image
+// is processed by args.encodeImage. Otherwise it's encoded as png.
+func rasterizeSVG(data []byte, args *ReadableArgs) (_ *bytes.Buffer, ext string, err error) {
+	defer func() {
+		// oksvg is not battle tested against arbitrary input.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("url2epub.rasterizeSVG: panic: %v", r)
+		}
+	}()
+
+	if !isSVG(data) {
+		return nil, "", errors.New("url2epub.rasterizeSVG: not a svg file")
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, "", fmt.Errorf("url2epub.rasterizeSVG: failed to parse svg: %w", err)
+	}
+	w, h := icon.ViewBox.W, icon.ViewBox.H
+	if w <= 0 || h <= 0 {
+		w, h = svgRasterizeDefaultSize, svgRasterizeDefaultSize
+	}
+	scale := float64(svgRasterizeScale)
+	if longest := max(w, h) * scale; longest > svgRasterizeMaxSize {
+		scale *= svgRasterizeMaxSize / longest
+	}
+	width := int(math.Ceil(w * scale))
+	height := int(math.Ceil(h * scale))
+	if width <= 0 || height <= 0 {
+		return nil, "", fmt.Errorf("url2epub.rasterizeSVG: invalid size %dx%d", width, height)
+	}
+	icon.SetTarget(0, 0, float64(width), float64(height))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	// e-readers don't do transparency well, use white background.
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	scanner := rasterx.NewScannerGV(width, height, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(width, height, scanner), 1)
+
+	if args.imageMode() != ImageModeColor {
+		buf, err := args.encodeImage(img)
+		if err != nil {
+			return nil, "", fmt.Errorf("url2epub.rasterizeSVG: failed to encode image: %w", err)
+		}
+		return buf, args.imageExt(), nil
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, "", fmt.Errorf("url2epub.rasterizeSVG: failed to encode png: %w", err)
+	}
+	return buf, pngExt, nil
+}
+
+// copySVG makes a deep copy of svg node with scripts and event handlers
+// removed, and the namespaces needed by xhtml added.
+func copySVG(node *html.Node) *html.Node {
+	var hasXLink bool
+	svg := copySVGRecursive(node, &hasXLink)
+	var hasXmlns, hasXmlnsXLink bool
+	for _, attr := range svg.Attr {
+		switch {
+		case attr.Namespace == "" && attr.Key == "xmlns":
+			hasXmlns = true
+		case attr.Namespace == "xmlns" && attr.Key == "xlink":
+			hasXmlnsXLink = true
+		}
+	}
+	if !hasXmlns {
+		svg.Attr = append([]html.Attribute{
+			{
+				Key: "xmlns",
+				Val: svgNamespace,
+			},
+		}, svg.Attr...)
+	}
+	if hasXLink && !hasXmlnsXLink {
+		svg.Attr = append(svg.Attr, html.Attribute{
+			Namespace: "xmlns",
+			Key:       "xlink",
+			Val:       xlinkNamespace,
+		})
+	}
+	return svg
+}
+
+func copySVGRecursive(node *html.Node, hasXLink *bool) *html.Node {
+	newNode := &html.Node{
+		Type:      node.Type,
+		DataAtom:  node.DataAtom,
+		Data:      node.Data,
+		Namespace: node.Namespace,
+	}
+	for _, attr := range node.Attr {
+		if strings.HasPrefix(strings.ToLower(attr.Key), "on") {
+			continue
+		}
+		if attr.Namespace == "xlink" {
+			*hasXLink = true
+		}
+		newNode.Attr = append(newNode.Attr, attr)
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode && c.Type != html.TextNode {
+			continue
+		}
+		if c.Type == html.ElementNode && svgDropElements[c.Data] {
+			continue
+		}
+		newNode.AppendChild(copySVGRecursive(c, hasXLink))
+	}
+	return newNode
+}
+
+// parseDataURI parses a data uri as defined in RFC 2397.
+//
+// The returned mediaType is lower cased without parameters.
+func parseDataURI(s string) (mediaType string, data []byte, ok bool) {
+	const prefix = "data:"
+	s = strings.TrimSpace(s)
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	header, payload, ok := strings.Cut(s[len(prefix):], ",")
+	if !ok {
+		return "", nil, false
+	}
+	params := strings.Split(header, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(params[0]))
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	var isBase64 bool
+	for _, param := range params[1:] {
+		if strings.EqualFold(strings.TrimSpace(param), "base64") {
+			isBase64 = true
+		}
+	}
+	if isBase64 {
+		payload, err := url.PathUnescape(payload)
+		if err != nil {
+			return "", nil, false
+		}
+		payload = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, payload)
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+			if err != nil {
+				return "", nil, false
+			}
+		}
+		return mediaType, data, true
+	}
+	decoded, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, false
+	}
+	return mediaType, []byte(decoded), true
+}
@@ -0,0 +1,309 @@
+package url2epub
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	testInlineSVG = `<html><body><p>Before<svg viewBox="0 0 10 10" onclick="alert(1)"><script>alert(2)</script><use xlink:href="#a"></use><circle cx="5" cy="5" r="4"></circle></svg>After</p></body></html>`
+
+	testSVGData = `<svg xmlns="http://www.w3.org/2000/svg"><rect width="1" height="1"/></svg>`
+
+	// Used in wanted images to indicate that it should be a png.
+	testPNG = "png"
+)
+
+func checkPNG(t *testing.T, name string, data []byte) {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Errorf("image %q is not a valid png: %v", name, err)
+		return
+	}
+	if img.Bounds().Dx() == 0 || img.Bounds().Dy() == 0 {
+		t.Errorf("image %q is empty: %v", name, img.Bounds())
+	}
+}
+
+func TestReadableSVG(t *testing.T) {
+	dataURIs := map[string]string{
+		"base64":  "data:image/svg+xml;base64," + "PHN2ZyB4bWxucz0iaHR0cDovL3d3dy53My5vcmcvMjAwMC9zdmciPjxyZWN0IHdpZHRoPSIxIiBoZWlnaHQ9IjEiLz48L3N2Zz4=",
+		"escaped": "data:image/svg+xml;charset=utf-8,%3Csvg%20xmlns%3D%22http%3A%2F%2Fwww.w3.org%2F2000%2Fsvg%22%3E%3Crect%20width%3D%221%22%20height%3D%221%22%2F%3E%3C%2Fsvg%3E",
+	}
+
+	for _, c := range []struct {
+		label  string
+		src    string
+		mode   SVGMode
+		want   string
+		images map[string]string
+	}{
+		{
+			label: "inline-drop",
+			src:   testInlineSVG,
+			mode:  SVGDrop,
+			want:  `<body><p>BeforeAfter</p></body>`,
+		},
+		{
+			label: "inline-preserve",
+			src:   testInlineSVG,
+			mode:  SVGPreserve,
+			want:  `<body><p>Before<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10" xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a"></use><circle cx="5" cy="5" r="4"></circle></svg>After</p></body>`,
+		},
+		{
+			label: "inline-rasterize",
+			src:   testInlineSVG,
+			mode:  SVGRasterize,
+			want:  `<body><p>Before<img src="images/001.png" alt=""/>After</p></body>`,
+			images: map[string]string{
+				"images/001.png": testPNG,
+			},
+		},
+		{
+			label: "data-uri-drop",
+			src:   `<html><body><p>Text<img src="` + dataURIs["base64"] + `" alt="logo"></p></body></html>`,
+			mode:  SVGDrop,
+			want:  `<body><p>Text</p></body>`,
+		},
+		{
+			label: "data-uri-base64",
+			src:   `<html><body><p><img src="` + dataURIs["base64"] + `" alt="logo"></p></body></html>`,
+			mode:  SVGPreserve,
+			want:  `<body><p><img src="images/001.svg" alt="logo"/></p></body>`,
+			images: map[string]string{
+				"images/001.svg": testSVGData,
+			},
+		},
+		{
+			label: "data-uri-escaped",
+			src:   `<html><body><p><img src="` + dataURIs["escaped"] + `" alt="logo"></p></body></html>`,
+			mode:  SVGRasterize,
+			want:  `<body><p><img src="images/001.png" alt="logo"/></p></body>`,
+			images: map[string]string{
+				"images/001.png": testPNG,
+			},
+		},
+		{
+			label: "data-uri-rasterize-failed",
+			src:   `<html><body><p>Text<img src="data:image/svg+xml,not%20svg" alt="logo"></p></body></html>`,
+			mode:  SVGRasterize,
+			want:  `<body><p>Text</p></body>`,
+		},
+		{
+			label: "data-uri-not-svg",
+			src:   `<html><body><p>Text<img src="data:image/png;base64,AAAA" alt="logo"></p></body></html>`,
+			mode:  SVGPreserve,
+			want:  `<body><p>Text</p></body>`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(c.src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				ImagesDir: "images",
+				SVGMode:   c.mode,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if len(images) != len(c.images) {
+				t.Errorf("got %d images, want %d", len(images), len(c.images))
+			}
+			for name, want := range c.images {
+				r, ok := images[name]
+				if !ok {
+					t.Errorf("image %q not found", name)
+					continue
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Errorf("Failed to read image %q: %v", name, err)
+				}
+				if want == testPNG {
+					checkPNG(t, name, got)
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("image %q got %q, want %q", name, got, want)
+				}
+			}
+
+			// Make sure the generated epub is still valid.
+			buf := testEpub(t, EpubArgs{
+				Title:  "SVG",
+				Node:   node,
+				Images: images,
+			})
+			if errs := ValidateEpub(bytes.NewReader(buf.Bytes()), int64(buf.Len())); len(errs) != 0 {
+				t.Errorf("ValidateEpub got %v", errs)
+			}
+		})
+	}
+}
+
+func TestParseDataURI(t *testing.T) {
+	for _, c := range []struct {
+		uri       string
+		ok        bool
+		mediaType string
+		data      string
+	}{
+		{
+			uri:       "data:image/svg+xml;base64,PHN2Zy8+",
+			ok:        true,
+			mediaType: "image/svg+xml",
+			data:      "<svg/>",
+		},
+		{
+			uri:       "DATA:Image/SVG+XML;charset=utf-8;base64,PHN2ZyAvPg",
+			ok:        true,
+			mediaType: "image/svg+xml",
+			data:      "<svg />",
+		},
+		{
+			uri:       "data:image/svg+xml,%3Csvg/%3E",
+			ok:        true,
+			mediaType: "image/svg+xml",
+			data:      "<svg/>",
+		},
+		{
+			uri:       "data:,hello",
+			ok:        true,
+			mediaType: "text/plain",
+			data:      "hello",
+		},
+		{
+			uri: "https://example.com/foo.svg",
+		},
+		{
+			uri: "data:image/svg+xml;base64",
+		},
+		{
+			uri: "data:image/png;base64,!!!",
+		},
+	} {
+		t.Run(c.uri, func(t *testing.T) {
+			mediaType, data, ok := parseDataURI(c.uri)
+			if ok != c.ok {
+				t.Fatalf("ok got %v, want %v", ok, c.ok)
+			}
+			if mediaType != c.mediaType {
+				t.Errorf("mediaType got %q, want %q", mediaType, c.mediaType)
+			}
+			if string(data) != c.data {
+				t.Errorf("data got %q, want %q", data, c.data)
+			}
+		})
+	}
+}
+
+func TestReadableSVGRasterizeDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		default:
+			http.NotFound(w, r)
+		case "/good.svg":
+			io.WriteString(w, `<?xml version="1.0"?>`+"\n"+`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="50" viewBox="0 0 100 50"><rect width="100" height="50" fill="black"/></svg>`)
+		case "/bad.svg":
+			io.WriteString(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 0 0">`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const src = `<html><body><p>Text<img src="/good.svg"><img src="/bad.svg"></p></body></html>`
+	for _, c := range []struct {
+		label      string
+		gray       bool
+		fit        int
+		want       string
+		name       string
+		wantWidth  int
+		wantHeight int
+	}{
+		{
+			label:      "png",
+			want:       `<body><p>Text<img src="images/001.png"/></p></body>`,
+			name:       "images/001.png",
+			wantWidth:  200,
+			wantHeight: 100,
+		},
+		{
+			label:      "gray-fit",
+			gray:       true,
+			fit:        50,
+			want:       `<body><p>Text<img src="images/001.jpg"/></p></body>`,
+			name:       "images/001.jpg",
+			wantWidth:  50,
+			wantHeight: 25,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			root, err := html.Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("html.Parse failed: %v", err)
+			}
+			node, images, err := FromNode(root).Readable(context.Background(), ReadableArgs{
+				BaseURL:   baseURL,
+				ImagesDir: "images",
+				SVGMode:   SVGRasterize,
+				Grayscale: c.gray,
+				FitImage:  c.fit,
+			})
+			if err != nil {
+				t.Fatalf("Readable failed: %v", err)
+			}
+			body := FromNode(node).FindFirstAtomNode(atom.Body).AsNode()
+			var sb strings.Builder
+			if err := html.Render(&sb, &body); err != nil {
+				t.Fatalf("html.Render failed: %v", err)
+			}
+			if got := sb.String(); got != c.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, c.want)
+			}
+			if len(images) != 1 {
+				t.Errorf("got %d images, want 1", len(images))
+			}
+			r, ok := images[c.name]
+			if !ok {
+				t.Fatalf("image %q not found", c.name)
+			}
+			decode := png.Decode
+			if c.gray {
+				decode = jpeg.Decode
+			}
+			img, err := decode(r)
+			if err != nil {
+				t.Fatalf("Failed to decode %q: %v", c.name, err)
+			}
+			if got := img.Bounds(); got.Dx() != c.wantWidth || got.Dy() != c.wantHeight {
+				t.Errorf("image size got %dx%d, want %dx%d", got.Dx(), got.Dy(), c.wantWidth, c.wantHeight)
+			}
+		})
+	}
+}
@@ -48,14 +48,38 @@ type Bot struct {
 	GlobalURLPrefix string
 	WebhookPrefix   string
 
+	// Optional, an extra secret mixed into the hash of the webhook path.
+	//
+	// Changing it changes the webhook path without changing the token, to
+	// invalidate a leaked webhook path. When empty, the webhook path is derived
+	// from the token alone.
+	WebhookSecret string
+
+	// The http client used to send requests to telegram, optional.
+	//
+	// If nil, a client with url2epub.DefaultTransportTimeouts will be used.
+	// Set it to a client with Timeout to bound the latency of telegram calls.
+	HTTPClient *http.Client
+
 	hashOnce   sync.Once
 	hashPrefix string
 }
 
+var defaultHTTPClient = &http.Client{
+	Transport: url2epub.NewTransport(url2epub.DefaultTransportTimeouts),
+}
+
 func (b *Bot) String() string {
 	return b.Token
 }
 
+func (b *Bot) httpClient() *http.Client {
+	if b.HTTPClient != nil {
+		return b.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
 func (b *Bot) getURL(endpoint string) string {
 	return fmt.Sprintf("%s%s/%s", urlPrefix, b.String(), endpoint)
 }
@@ -66,6 +90,7 @@ func (b *Bot) postRequest(
 	endpoint string,
 	body io.Reader,
 	contentType string,
+	result any,
 ) (code int, err error) {
 	start := time.Now()
 	defer func() {
@@ -89,7 +114,7 @@ func (b *Bot) postRequest(
 	}
 	req.Header.Set("Content-Type", contentType)
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = b.httpClient().Do(req)
 	if resp != nil && resp.Body != nil {
 		defer url2epub.DrainAndClose(resp.Body)
 	}
@@ -105,8 +130,26 @@ func (b *Bot) postRequest(
 			resp.StatusCode,
 			buf,
 		)
+		return code, err
 	}
-	return code, err
+	if result != nil {
+		var wrapper apiResponse
+		wrapper.Result = result
+		if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
+			return code, fmt.Errorf("tgbot.PostRequest: failed to decode %s response: %w", endpoint, err)
+		}
+		if !wrapper.OK {
+			return code, fmt.Errorf("%s failed: %s", endpoint, wrapper.Description)
+		}
+	}
+	return code, nil
+}
+
+// apiResponse is the response of telegram bot api calls.
+type apiResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description,omitempty"`
+	Result      any    `json:"result,omitempty"`
 }
 
 // PostRequest use POST method to send a request to telegram
@@ -115,7 +158,7 @@ func (b *Bot) PostRequest(
 	endpoint string,
 	params url.Values,
 ) (code int, err error) {
-	return b.postRequest(ctx, endpoint, strings.NewReader(params.Encode()), postFormContentType)
+	return b.postRequest(ctx, endpoint, strings.NewReader(params.Encode()), postFormContentType, nil)
 }
 
 // PostRequestJSON use POST method to send a request to telegram in JSON encoding.
@@ -129,31 +172,88 @@ func (b *Bot) PostRequestJSON(
 	if err := json.NewEncoder(buf).Encode(payload); err != nil {
 		return 0, fmt.Errorf("tgbot.Bot.PostRequestJSON: failed to json encode payload: %w", err)
 	}
-	return b.postRequest(ctx, endpoint, buf, jsonContentType)
+	return b.postRequest(ctx, endpoint, buf, jsonContentType, nil)
+}
+
+// SendMessageArgs defines the args used by SendMessage.
+type SendMessageArgs struct {
+	ChatID int64
+	Text   string
+
+	// Optional, the id of the message to reply to.
+	ReplyTo *int64
+
+	// Optional, the inline keyboard attached to the message.
+	Markup *InlineKeyboardMarkup
+
+	// Optional, when it's non-empty (ParseModeHTML or ParseModeMarkdownV2), Text
+	// must be escaped accordingly.
+	ParseMode string
+
+	// Optional, when it's nil telegram's default is used.
+	LinkPreview *LinkPreviewOptions
 }
 
 // SendMessage sents a telegram messsage.
-func (b *Bot) SendMessage(
+func (b *Bot) SendMessage(ctx context.Context, args SendMessageArgs) (code int, err error) {
+	values := url.Values{}
+	values.Add("chat_id", strconv.FormatInt(args.ChatID, 10))
+	values.Add("text", args.Text)
+	if args.ParseMode != "" {
+		values.Add("parse_mode", args.ParseMode)
+	}
+	if args.ReplyTo != nil {
+		params, err := json.Marshal(ReplyParameters{
+			MessageID:                *args.ReplyTo,
+			AllowSendingWithoutReply: true,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("tgbot.SendMessage: failed to create ReplyParameters: %w", err)
+		}
+		values.Add("reply_parameters", string(params))
+	}
+	if args.LinkPreview != nil {
+		options, err := json.Marshal(args.LinkPreview)
+		if err != nil {
+			return 0, fmt.Errorf("tgbot.SendMessage: failed to create LinkPreviewOptions: %w", err)
+		}
+		values.Add("link_preview_options", string(options))
+	}
+	if args.Markup != nil {
+		if err := args.Markup.Validate(); err != nil {
+			return 0, fmt.Errorf("tgbot.SendMessage: %w", err)
+		}
+		var sb strings.Builder
+		if err := json.NewEncoder(&sb).Encode(*args.Markup); err != nil {
+			return 0, fmt.Errorf("tgbot.SendMessage: failed to create InlineKeyboardMarkup: %w", err)
+		}
+		values.Add("reply_markup", sb.String())
+	}
+	return b.PostRequest(ctx, "sendMessage", values)
+}
+
+// EditMessageReplyMarkup replaces the inline keyboard of a previously sent
+// message.
+func (b *Bot) EditMessageReplyMarkup(
 	ctx context.Context,
-	id int64,
-	msg string,
-	replyTo *int64,
+	chatID int64,
+	messageID int64,
 	markup *InlineKeyboardMarkup,
 ) (code int, err error) {
 	values := url.Values{}
-	values.Add("chat_id", strconv.FormatInt(id, 10))
-	values.Add("text", msg)
-	if replyTo != nil {
-		values.Add("reply_to", strconv.FormatInt(*replyTo, 10))
-	}
+	values.Add("chat_id", strconv.FormatInt(chatID, 10))
+	values.Add("message_id", strconv.FormatInt(messageID, 10))
 	if markup != nil {
+		if err := markup.Validate(); err != nil {
+			return 0, fmt.Errorf("tgbot.EditMessageReplyMarkup: %w", err)
+		}
 		var sb strings.Builder
 		if err := json.NewEncoder(&sb).Encode(*markup); err != nil {
-			return 0, fmt.Errorf("tgbot.SendMessage: failed to create InlineKeyboardMarkup: %w", err)
+			return 0, fmt.Errorf("tgbot.EditMessageReplyMarkup: failed to create InlineKeyboardMarkup: %w", err)
 		}
 		values.Add("reply_markup", sb.String())
 	}
-	return b.PostRequest(ctx, "sendMessage", values)
+	return b.PostRequest(ctx, "editMessageReplyMarkup", values)
 }
 
 // ReplyCallback sents an answerCallbackQuery request.
@@ -168,7 +268,11 @@ func (b *Bot) ReplyCallback(ctx context.Context, id string, msg string) (code in
 
 func (b *Bot) initHashPrefix(ctx context.Context) {
 	b.hashOnce.Do(func() {
-		hash := sha512.Sum512_224([]byte(b.String()))
+		key := b.String()
+		if b.WebhookSecret != "" {
+			key += "\x00" + b.WebhookSecret
+		}
+		hash := sha512.Sum512_224([]byte(key))
 		b.hashPrefix = b.WebhookPrefix + base64.URLEncoding.EncodeToString(hash[:])
 		slog.DebugContext(ctx, fmt.Sprintf("hashPrefix == %s", b.hashPrefix))
 	})
@@ -186,12 +290,87 @@ func (b *Bot) ValidateWebhookURL(r *http.Request) bool {
 	return r.URL.Path == b.hashPrefix
 }
 
+// Update types to be used in SetWebhook's allowedUpdates.
+const (
+	UpdateTypeMessage       = "message"
+	UpdateTypeEditedMessage = "edited_message"
+	UpdateTypeCallbackQuery = "callback_query"
+	UpdateTypeInlineQuery   = "inline_query"
+)
+
+// SetWebhookArgs defines the args used by SetWebhook.
+type SetWebhookArgs struct {
+	// The max number of concurrent connections telegram makes to the webhook.
+	MaxConn int
+
+	// Optional, restricts the update types telegram sends to the webhook.
+	// When it's nil, it's not sent and telegram keeps using the previous setting.
+	// When it's an empty non-nil slice, all update types are allowed.
+	AllowedUpdates []string
+
+	// Optional, when it's true, telegram discards all the updates queued before
+	// this call.
+	DropPendingUpdates bool
+}
+
 // SetWebhook sets webhook with telegram.
-func (b *Bot) SetWebhook(ctx context.Context, webhookMaxConn int) (code int, err error) {
+func (b *Bot) SetWebhook(ctx context.Context, args SetWebhookArgs) (code int, err error) {
 	b.initHashPrefix(ctx)
 
 	values := url.Values{}
 	values.Add("url", b.getWebhookURL(ctx))
-	values.Add("max_connections", fmt.Sprintf("%d", webhookMaxConn))
+	values.Add("max_connections", fmt.Sprintf("%d", args.MaxConn))
+	if args.AllowedUpdates != nil {
+		data, err := json.Marshal(args.AllowedUpdates)
+		if err != nil {
+			return 0, fmt.Errorf("tgbot.SetWebhook: failed to encode allowed_updates: %w", err)
+		}
+		values.Add("allowed_updates", string(data))
+	}
+	if args.DropPendingUpdates {
+		values.Add("drop_pending_updates", "true")
+	}
 	return b.PostRequest(ctx, "setWebhook", values)
 }
+
+// The long polling timeout used by GetUpdates.
+const pollTimeout = 5 * time.Second
+
+// DeleteWebhook removes the webhook integration with telegram,
+// so that updates can be received via GetUpdates instead.
+//
+// It's meant for local development, webhook is still the preferred way in
+// production.
+func (b *Bot) DeleteWebhook(ctx context.Context) error {
+	if code, err := b.PostRequest(ctx, "deleteWebhook", url.Values{}); err != nil {
+		return fmt.Errorf("tgbot.DeleteWebhook: code = %d: %w", code, err)
+	}
+	return nil
+}
+
+// GetUpdates long polls updates from telegram.
+//
+// offset should be the ID of the last handled update plus one,
+// to confirm the updates before it.
+//
+// It only works when there's no webhook set (see DeleteWebhook).
+// It blocks for up to 5 seconds when there are no new updates, so the timeout
+// of HTTPClient (if any) should be longer than that.
+func (b *Bot) GetUpdates(ctx context.Context, offset int64) ([]Update, error) {
+	values := url.Values{}
+	if offset != 0 {
+		values.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	values.Add("timeout", strconv.Itoa(int(pollTimeout.Seconds())))
+	var updates []Update
+	if code, err := b.postRequest(
+		ctx,
+		"getUpdates",
+		strings.NewReader(values.Encode()),
+		postFormContentType,
+		&updates,
+	); err != nil {
+		return nil, fmt.Errorf("tgbot.GetUpdates: code = %d: %w", code, err)
+	}
+	return updates, nil
+}
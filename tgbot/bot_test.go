@@ -0,0 +1,368 @@
+package tgbot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestBotHTTPClient(t *testing.T) {
+	var got *http.Request
+	var body string
+	bot := &Bot{
+		Token: "token",
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				got = req
+				buf, err := io.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				body = string(buf)
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(`{"ok":true}`)),
+				}, nil
+			}),
+		},
+	}
+	replyTo := int64(456)
+	code, err := bot.SendMessage(context.Background(), SendMessageArgs{
+		ChatID:      123,
+		Text:        "<b>hello</b>",
+		ReplyTo:     &replyTo,
+		ParseMode:   ParseModeHTML,
+		LinkPreview: &LinkPreviewOptions{IsDisabled: true},
+	})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("code got %d want %d", code, http.StatusOK)
+	}
+	if got == nil {
+		t.Fatal("HTTPClient was not used")
+	}
+	if want := "https://api.telegram.org/bottoken/sendMessage"; got.URL.String() != want {
+		t.Errorf("url got %q want %q", got.URL, want)
+	}
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		t.Fatalf("Failed to parse body %q: %v", body, err)
+	}
+	if got, want := values.Get("chat_id"), "123"; got != want {
+		t.Errorf("chat_id got %q want %q", got, want)
+	}
+	if got, want := values.Get("text"), "<b>hello</b>"; got != want {
+		t.Errorf("text got %q want %q", got, want)
+	}
+	if got, want := values.Get("parse_mode"), ParseModeHTML; got != want {
+		t.Errorf("parse_mode got %q want %q", got, want)
+	}
+	if got, want := values.Get("reply_parameters"), `{"message_id":456,"allow_sending_without_reply":true}`; got != want {
+		t.Errorf("reply_parameters got %q want %q", got, want)
+	}
+	if got, want := values.Get("link_preview_options"), `{"is_disabled":true}`; got != want {
+		t.Errorf("link_preview_options got %q want %q", got, want)
+	}
+}
+
+func TestBotHTTPClientError(t *testing.T) {
+	bot := &Bot{
+		Token: "token",
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Body:       io.NopCloser(strings.NewReader(`{"ok":false}`)),
+				}, nil
+			}),
+		},
+	}
+	code, err := bot.ReplyCallback(context.Background(), "id", "")
+	if err == nil {
+		t.Error("Expected error, got nil")
+	}
+	if code != http.StatusBadRequest {
+		t.Errorf("code got %d want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	for _, c := range []struct {
+		label  string
+		token  string
+		prefix string
+		want   string
+	}{
+		{
+			label:  "token",
+			token:  "token",
+			prefix: "/webhook/",
+			want:   "/webhook/pDkEVnUZDaehhTIdvZXmSpiRPMrnUqp-F_Esrg==",
+		},
+		{
+			label: "no-prefix",
+			token: "token",
+			want:  "pDkEVnUZDaehhTIdvZXmSpiRPMrnUqp-F_Esrg==",
+		},
+		{
+			label:  "empty-token",
+			prefix: "/webhook/",
+			want:   "/webhook/btDdAoBvqJ4l3gYMGdOshsq7h9ag3dBcMzuE9A==",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			ctx := context.Background()
+			bot := &Bot{
+				Token:           c.token,
+				GlobalURLPrefix: "https://example.com",
+				WebhookPrefix:   c.prefix,
+			}
+			if got, want := bot.getWebhookURL(ctx), "https://example.com"+c.want; got != want {
+				t.Errorf("getWebhookURL got %q want %q", got, want)
+			}
+			// The hash prefix should be stable for the same token.
+			other := &Bot{
+				Token:         c.token,
+				WebhookPrefix: c.prefix,
+			}
+			other.initHashPrefix(ctx)
+			if other.hashPrefix != bot.hashPrefix {
+				t.Errorf("hashPrefix not stable: %q vs %q", other.hashPrefix, bot.hashPrefix)
+			}
+
+			for _, v := range []struct {
+				path string
+				want bool
+			}{
+				{path: c.want, want: true},
+				{path: c.want + "/", want: false},
+				{path: strings.TrimSuffix(c.want, "=="), want: false},
+				{path: "/webhook/", want: false},
+				{path: "/", want: false},
+				{path: "/webhook/" + strings.Repeat("A", 40), want: false},
+			} {
+				r := (&http.Request{URL: &url.URL{Path: v.path}}).WithContext(ctx)
+				if got := bot.ValidateWebhookURL(r); got != v.want {
+					t.Errorf("ValidateWebhookURL(%q) got %v want %v", v.path, got, v.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookURLDifferentTokens(t *testing.T) {
+	ctx := context.Background()
+	a := &Bot{Token: "token-a", WebhookPrefix: "/webhook/"}
+	b := &Bot{Token: "token-b", WebhookPrefix: "/webhook/"}
+	a.initHashPrefix(ctx)
+	b.initHashPrefix(ctx)
+	if a.hashPrefix == b.hashPrefix {
+		t.Fatalf("Different tokens got the same hashPrefix %q", a.hashPrefix)
+	}
+	r := (&http.Request{URL: &url.URL{Path: a.hashPrefix}}).WithContext(ctx)
+	if b.ValidateWebhookURL(r) {
+		t.Errorf("Bot b accepted webhook path %q of bot a", a.hashPrefix)
+	}
+}
+
+func TestSetWebhook(t *testing.T) {
+	for _, c := range []struct {
+		label          string
+		allowedUpdates []string
+		dropPending    bool
+		want           string
+		wantSet        bool
+		wantDrop       string
+	}{
+		{
+			label: "nil",
+		},
+		{
+			label:          "empty",
+			allowedUpdates: []string{},
+			want:           `[]`,
+			wantSet:        true,
+		},
+		{
+			label:          "restricted",
+			allowedUpdates: []string{UpdateTypeMessage, UpdateTypeCallbackQuery},
+			want:           `["message","callback_query"]`,
+			wantSet:        true,
+		},
+		{
+			label:       "drop-pending",
+			dropPending: true,
+			wantDrop:    "true",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			values := setWebhookValues(t, c.allowedUpdates, c.dropPending)
+			if got, want := values.Get("url"), "https://example.com/webhook/pDkEVnUZDaehhTIdvZXmSpiRPMrnUqp-F_Esrg=="; got != want {
+				t.Errorf("url got %q want %q", got, want)
+			}
+			if got, want := values.Get("max_connections"), "10"; got != want {
+				t.Errorf("max_connections got %q want %q", got, want)
+			}
+			if got := values.Has("allowed_updates"); got != c.wantSet {
+				t.Errorf("allowed_updates set got %v want %v", got, c.wantSet)
+			}
+			if got := values.Get("allowed_updates"); got != c.want {
+				t.Errorf("allowed_updates got %q want %q", got, c.want)
+			}
+			if got := values.Get("drop_pending_updates"); got != c.wantDrop {
+				t.Errorf("drop_pending_updates got %q want %q", got, c.wantDrop)
+			}
+		})
+	}
+}
+
+// setWebhookValues calls SetWebhook and returns the form values sent.
+func setWebhookValues(t *testing.T, allowedUpdates []string, dropPendingUpdates bool) url.Values {
+	t.Helper()
+	var values url.Values
+	bot := &Bot{
+		Token:           "token",
+		GlobalURLPrefix: "https://example.com",
+		WebhookPrefix:   "/webhook/",
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				buf, err := io.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				values, err = url.ParseQuery(string(buf))
+				if err != nil {
+					return nil, err
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(`{"ok":true}`)),
+				}, nil
+			}),
+		},
+	}
+	if _, err := bot.SetWebhook(context.Background(), SetWebhookArgs{
+		MaxConn:            10,
+		AllowedUpdates:     allowedUpdates,
+		DropPendingUpdates: dropPendingUpdates,
+	}); err != nil {
+		t.Fatalf("SetWebhook failed: %v", err)
+	}
+	return values
+}
+
+// fakeAPI returns a Bot that sends all the requests to handler.
+func fakeAPI(handler func(endpoint string, values url.Values) string) *Bot {
+	return &Bot{
+		Token: "token",
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				buf, err := io.ReadAll(req.Body)
+				if err != nil {
+					return nil, err
+				}
+				values, err := url.ParseQuery(string(buf))
+				if err != nil {
+					return nil, err
+				}
+				endpoint := strings.TrimPrefix(req.URL.Path, "/bottoken/")
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(handler(endpoint, values))),
+				}, nil
+			}),
+		},
+	}
+}
+
+func TestGetUpdates(t *testing.T) {
+	var gotEndpoint string
+	var gotValues url.Values
+	bot := fakeAPI(func(endpoint string, values url.Values) string {
+		gotEndpoint = endpoint
+		gotValues = values
+		return `{"ok":true,"result":[{"update_id":42,"message":{"message_id":1,"chat":{"id":123},"text":"hello"}},{"update_id":43,"callback_query":{"id":"cb","data":"foo"}}]}`
+	})
+	updates, err := bot.GetUpdates(context.Background(), 42)
+	if err != nil {
+		t.Fatalf("GetUpdates failed: %v", err)
+	}
+	if gotEndpoint != "getUpdates" {
+		t.Errorf("endpoint got %q want %q", gotEndpoint, "getUpdates")
+	}
+	if got, want := gotValues.Get("offset"), "42"; got != want {
+		t.Errorf("offset got %q want %q", got, want)
+	}
+	if got, want := gotValues.Get("timeout"), "5"; got != want {
+		t.Errorf("timeout got %q want %q", got, want)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("got %d updates, want 2: %#v", len(updates), updates)
+	}
+	if got := updates[0]; got.ID != 42 || got.Message == nil || got.Message.Text != "hello" || got.Message.Chat.ID != 123 {
+		t.Errorf("updates[0] got %#v", got)
+	}
+	if got := updates[1]; got.ID != 43 || got.Callback == nil || got.Callback.Data != "foo" {
+		t.Errorf("updates[1] got %#v", got)
+	}
+}
+
+func TestGetUpdatesNotOK(t *testing.T) {
+	bot := fakeAPI(func(endpoint string, values url.Values) string {
+		if values.Has("offset") {
+			t.Errorf("offset should not be set when it's 0, got %q", values.Get("offset"))
+		}
+		return `{"ok":false,"description":"Conflict: can't use getUpdates method while webhook is active"}`
+	})
+	if _, err := bot.GetUpdates(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "webhook is active") {
+		t.Errorf("Expected webhook is active error, got %v", err)
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	var gotEndpoint string
+	bot := fakeAPI(func(endpoint string, values url.Values) string {
+		gotEndpoint = endpoint
+		return `{"ok":true,"result":true}`
+	})
+	if err := bot.DeleteWebhook(context.Background()); err != nil {
+		t.Fatalf("DeleteWebhook failed: %v", err)
+	}
+	if gotEndpoint != "deleteWebhook" {
+		t.Errorf("endpoint got %q want %q", gotEndpoint, "deleteWebhook")
+	}
+}
+
+func TestWebhookURLSecret(t *testing.T) {
+	ctx := context.Background()
+	plain := &Bot{Token: "token", WebhookPrefix: "/webhook/"}
+	secret := &Bot{Token: "token", WebhookPrefix: "/webhook/", WebhookSecret: "secret"}
+	rotated := &Bot{Token: "token", WebhookPrefix: "/webhook/", WebhookSecret: "rotated"}
+	plain.initHashPrefix(ctx)
+	secret.initHashPrefix(ctx)
+	rotated.initHashPrefix(ctx)
+	if plain.hashPrefix == secret.hashPrefix || secret.hashPrefix == rotated.hashPrefix {
+		t.Fatalf("WebhookSecret did not change hashPrefix: %q, %q, %q", plain.hashPrefix, secret.hashPrefix, rotated.hashPrefix)
+	}
+	for _, path := range []string{plain.hashPrefix, secret.hashPrefix} {
+		r := (&http.Request{URL: &url.URL{Path: path}}).WithContext(ctx)
+		if rotated.ValidateWebhookURL(r) {
+			t.Errorf("Rotated bot accepted old webhook path %q", path)
+		}
+	}
+	r := (&http.Request{URL: &url.URL{Path: rotated.hashPrefix}}).WithContext(ctx)
+	if !rotated.ValidateWebhookURL(r) {
+		t.Errorf("Rotated bot rejected its own webhook path %q", rotated.hashPrefix)
+	}
+}
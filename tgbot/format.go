@@ -0,0 +1,67 @@
+package tgbot
+
+import (
+	"strings"
+)
+
+// Supported parse modes of message text.
+//
+// See https://core.telegram.org/bots/api#formatting-options.
+const (
+	ParseModeHTML       = "HTML"
+	ParseModeMarkdownV2 = "MarkdownV2"
+)
+
+var htmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&quot;",
+)
+
+// EscapeHTML escapes s to be used as either text or attribute value in
+// messages with ParseModeHTML.
+func EscapeHTML(s string) string {
+	return htmlEscaper.Replace(s)
+}
+
+var markdownV2Escaper = strings.NewReplacer(
+	`\`, `\\`,
+	"_", `\_`,
+	"*", `\*`,
+	"[", `\[`,
+	"]", `\]`,
+	"(", `\(`,
+	")", `\)`,
+	"~", `\~`,
+	"`", "\\`",
+	">", `\>`,
+	"#", `\#`,
+	"+", `\+`,
+	"-", `\-`,
+	"=", `\=`,
+	"|", `\|`,
+	"{", `\{`,
+	"}", `\}`,
+	".", `\.`,
+	"!", `\!`,
+)
+
+// EscapeMarkdownV2 escapes s to be used as text in messages with
+// ParseModeMarkdownV2.
+//
+// For the url part of inline links, use EscapeMarkdownV2URL instead.
+func EscapeMarkdownV2(s string) string {
+	return markdownV2Escaper.Replace(s)
+}
+
+var markdownV2URLEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	")", `\)`,
+)
+
+// EscapeMarkdownV2URL escapes s to be used as the url part of inline links
+// (inside the parentheses) in messages with ParseModeMarkdownV2.
+func EscapeMarkdownV2URL(s string) string {
+	return markdownV2URLEscaper.Replace(s)
+}
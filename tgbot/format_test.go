@@ -0,0 +1,87 @@
+package tgbot
+
+import (
+	"testing"
+)
+
+func TestEscapeHTML(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want string
+	}{
+		{
+			s:    "plain title",
+			want: "plain title",
+		},
+		{
+			s:    `<b>"Tom & Jerry"</b>`,
+			want: "&lt;b&gt;&quot;Tom &amp; Jerry&quot;&lt;/b&gt;",
+		},
+		{
+			s:    "https://example.com/?a=1&b=<2>",
+			want: "https://example.com/?a=1&amp;b=&lt;2&gt;",
+		},
+		{
+			s:    "&amp;",
+			want: "&amp;amp;",
+		},
+	} {
+		t.Run(c.s, func(t *testing.T) {
+			if got := EscapeHTML(c.s); got != c.want {
+				t.Errorf("EscapeHTML(%q) got %q, want %q", c.s, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want string
+	}{
+		{
+			s:    "plain title",
+			want: "plain title",
+		},
+		{
+			s:    "_*[]()~`>#+-=|{}.!",
+			want: "\\_\\*\\[\\]\\(\\)\\~\\`\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!",
+		},
+		{
+			s:    `C:\path`,
+			want: `C:\\path`,
+		},
+		{
+			s:    "Hello, world! (v1.2)",
+			want: `Hello, world\! \(v1\.2\)`,
+		},
+	} {
+		t.Run(c.s, func(t *testing.T) {
+			if got := EscapeMarkdownV2(c.s); got != c.want {
+				t.Errorf("EscapeMarkdownV2(%q) got %q, want %q", c.s, got, c.want)
+			}
+		})
+	}
+}
+
+func TestEscapeMarkdownV2URL(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want string
+	}{
+		{
+			s:    "https://example.com/a_b.html?x=1",
+			want: "https://example.com/a_b.html?x=1",
+		},
+		{
+			s:    `https://en.wikipedia.org/wiki/Go_(programming_language)\`,
+			want: `https://en.wikipedia.org/wiki/Go_(programming_language\)\\`,
+		},
+	} {
+		t.Run(c.s, func(t *testing.T) {
+			if got := EscapeMarkdownV2URL(c.s); got != c.want {
+				t.Errorf("EscapeMarkdownV2URL(%q) got %q, want %q", c.s, got, c.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,10 @@
 package tgbot
 
+import (
+	"errors"
+	"fmt"
+)
+
 // Update is a update from telegram webhook.
 type Update struct {
 	ID       int64          `json:"update_id,omitempty"`
@@ -30,9 +35,44 @@ type Message struct {
 
 	Entities []MessageEntity `json:"entities,omitempty"`
 
+	// Used instead of Text and Entities by the messages with media,
+	// for example forwarded channel posts with photos.
+	Caption         string          `json:"caption,omitempty"`
+	CaptionEntities []MessageEntity `json:"caption_entities,omitempty"`
+
+	// The link preview of the message, if any.
+	LinkPreviewOptions *LinkPreviewOptions `json:"link_preview_options,omitempty"`
+
+	// Only set for forwarded messages.
+	ForwardOrigin *MessageOrigin `json:"forward_origin,omitempty"`
+
 	ReplyTo *Message `json:"reply_to_message,omitempty"`
 }
 
+// Supported MessageOrigin types.
+const (
+	MessageOriginUser       = "user"
+	MessageOriginHiddenUser = "hidden_user"
+	MessageOriginChat       = "chat"
+	MessageOriginChannel    = "channel"
+)
+
+// MessageOrigin describes the origin of a forwarded message.
+type MessageOrigin struct {
+	Type string `json:"type,omitempty"`
+	Date int64  `json:"date,omitempty"`
+
+	// Only set for MessageOriginUser.
+	SenderUser *User `json:"sender_user,omitempty"`
+	// Only set for MessageOriginHiddenUser.
+	SenderUserName string `json:"sender_user_name,omitempty"`
+	// Only set for MessageOriginChat.
+	SenderChat *Chat `json:"sender_chat,omitempty"`
+	// Only set for MessageOriginChannel.
+	Chat      *Chat `json:"chat,omitempty"`
+	MessageID int64 `json:"message_id,omitempty"`
+}
+
 // User is a telegram user.
 type User struct {
 	ID        int64  `json:"id,omitempty"`
@@ -57,28 +97,77 @@ type ReplyMessage struct {
 	ChatID int64  `json:"chat_id,omitempty"`
 	Text   string `json:"text,omitempty"`
 
+	// Optional, ParseModeHTML or ParseModeMarkdownV2.
+	ParseMode string `json:"parse_mode,omitempty"`
+
 	ReplyParameters *ReplyParameters `json:"reply_parameters,omitempty"`
 
+	LinkPreviewOptions *LinkPreviewOptions `json:"link_preview_options,omitempty"`
+
 	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 
 	// Deprecated, use ReplyParameters instead.
 	ReplyTo int64 `json:"reply_to_message_id,omitempty"`
 }
 
+// ReplyParameters describes the message to reply to (quote).
 type ReplyParameters struct {
 	MessageID                int64 `json:"message_id"`
 	AllowSendingWithoutReply bool  `json:"allow_sending_without_reply,omitempty"`
 }
 
+// LinkPreviewOptions controls the link preview of a message.
+type LinkPreviewOptions struct {
+	IsDisabled bool `json:"is_disabled,omitempty"`
+
+	// The url used for the link preview, only set on received messages when
+	// it's different from the first url in the message.
+	URL string `json:"url,omitempty"`
+}
+
 // InlineKeyboardMarkup is used to provide single choice replies.
 type InlineKeyboardMarkup struct {
 	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard,omitempty"`
 }
 
+// Validate checks all the buttons in the markup.
+//
+// It's safe to call Validate on nil markup.
+func (m *InlineKeyboardMarkup) Validate() error {
+	if m == nil {
+		return nil
+	}
+	for i, row := range m.InlineKeyboard {
+		for j, button := range row {
+			if err := button.Validate(); err != nil {
+				return fmt.Errorf("tgbot.InlineKeyboardMarkup.Validate: button [%d][%d]: %w", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
 // InlineKeyboardButton represents a single choice inside InlineKeyboardMarkup.
+//
+// Exactly one of Data and URL must be set.
 type InlineKeyboardButton struct {
 	Text string `json:"text,omitempty"`
 	Data string `json:"callback_data,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Validate checks that the button is acceptable by telegram.
+func (b InlineKeyboardButton) Validate() error {
+	if b.Text == "" {
+		return errors.New("empty text")
+	}
+	if b.Data != "" && b.URL != "" {
+		return fmt.Errorf("button %q has both callback_data and url", b.Text)
+	}
+	if b.Data == "" && b.URL == "" {
+		return fmt.Errorf("button %q has neither callback_data nor url", b.Text)
+	}
+	return nil
 }
 
 // CallbackQuery is the callback from InlineKeyboardButton.
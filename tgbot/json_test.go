@@ -0,0 +1,101 @@
+package tgbot
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInlineKeyboardMarkupValidate(t *testing.T) {
+	for _, c := range []struct {
+		label   string
+		markup  *InlineKeyboardMarkup
+		wantErr bool
+	}{
+		{
+			label: "nil",
+		},
+		{
+			label: "callback",
+			markup: &InlineKeyboardMarkup{
+				InlineKeyboard: [][]InlineKeyboardButton{
+					{{Text: "foo", Data: "foo"}},
+				},
+			},
+		},
+		{
+			label: "url",
+			markup: &InlineKeyboardMarkup{
+				InlineKeyboard: [][]InlineKeyboardButton{
+					{{Text: "foo", Data: "foo"}, {Text: "bar", URL: "https://example.com/"}},
+				},
+			},
+		},
+		{
+			label: "both",
+			markup: &InlineKeyboardMarkup{
+				InlineKeyboard: [][]InlineKeyboardButton{
+					{{Text: "foo", Data: "foo"}},
+					{{Text: "bar", Data: "bar", URL: "https://example.com/"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			label: "neither",
+			markup: &InlineKeyboardMarkup{
+				InlineKeyboard: [][]InlineKeyboardButton{
+					{{Text: "foo"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			label: "no-text",
+			markup: &InlineKeyboardMarkup{
+				InlineKeyboard: [][]InlineKeyboardButton{
+					{{URL: "https://example.com/"}},
+				},
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			err := c.markup.Validate()
+			if c.wantErr && err == nil {
+				t.Error("Expected error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInlineKeyboardButtonJSON(t *testing.T) {
+	for _, c := range []struct {
+		label  string
+		button InlineKeyboardButton
+		want   string
+	}{
+		{
+			label:  "callback",
+			button: InlineKeyboardButton{Text: "foo", Data: "bar"},
+			want:   `{"text":"foo","callback_data":"bar"}`,
+		},
+		{
+			label:  "url",
+			button: InlineKeyboardButton{Text: "foo", URL: "https://example.com/"},
+			want:   `{"text":"foo","url":"https://example.com/"}`,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			got, err := json.Marshal(c.button)
+			if err != nil {
+				t.Fatalf("json.Marshal failed: %v", err)
+			}
+			if string(got) != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
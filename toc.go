@@ -0,0 +1,135 @@
+package url2epub
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The heading levels to be included in the table of contents.
+var tocHeadingLevels = map[atom.Atom]int{
+	atom.H1: 1,
+	atom.H2: 2,
+	atom.H3: 3,
+}
+
+const tocIDPrefix = "toc-"
+
+// epubTOCItem is an entry in the table of contents of the epub.
+type epubTOCItem struct {
+	// Both Title and Href are already html escaped.
+	Title string
+	Href  string
+
+	Children []*epubTOCItem
+
+	level int
+	id    string
+}
+
+// buildEpubTOC builds the table of contents from the h1-h3 headings in root.
+//
+// Headings without id attributes will have them assigned. The Href of the
+// items are set later by setEpubTOCHrefs. It returns nil when there are no
+// (non-empty) headings in root.
+func buildEpubTOC(root *html.Node) []*epubTOCItem {
+	if root == nil {
+		return nil
+	}
+
+	ids := make(map[string]bool)
+	var headings []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if id := getAttr(n, "id"); id != "" {
+				ids[id] = true
+			}
+			if _, ok := tocHeadingLevels[n.DataAtom]; ok {
+				headings = append(headings, n)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	var items []*epubTOCItem
+	// The last item at each level, as the potential parents of the next item.
+	var stack []*epubTOCItem
+	var counter int
+	for _, h := range headings {
+		title := headingText(h)
+		if title == "" {
+			continue
+		}
+		id := getAttr(h, "id")
+		if id == "" {
+			for {
+				counter++
+				id = fmt.Sprintf("%s%d", tocIDPrefix, counter)
+				if !ids[id] {
+					break
+				}
+			}
+			ids[id] = true
+			h.Attr = append(h.Attr, html.Attribute{
+				Key: "id",
+				Val: id,
+			})
+		}
+		item := &epubTOCItem{
+			Title: html.EscapeString(title),
+			level: tocHeadingLevels[h.DataAtom],
+			id:    id,
+		}
+		for len(stack) > 0 && stack[len(stack)-1].level >= item.level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			items = append(items, item)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, item)
+		}
+		stack = append(stack, item)
+	}
+	return items
+}
+
+// setEpubTOCHrefs sets the Href of items to the anchors in the xhtml files
+// containing them, with paths mapping the ids to the paths of the files.
+func setEpubTOCHrefs(items []*epubTOCItem, paths map[string]string) {
+	for _, item := range items {
+		item.Href = html.EscapeString(paths[item.id] + "#" + item.id)
+		setEpubTOCHrefs(item.Children, paths)
+	}
+}
+
+// headingText returns the text content of n with whitespaces collapsed.
+func headingText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
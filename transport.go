@@ -0,0 +1,76 @@
+package url2epub
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportTimeouts defines the timeouts of the phases of an http request
+// before reading the response body.
+//
+// They are used to fail fast on dead servers, without consuming the whole
+// deadline from the context. Zero values mean no timeout for that phase.
+type TransportTimeouts struct {
+	// The timeout of establishing the tcp connection.
+	Dial time.Duration
+
+	// The timeout of the TLS handshake.
+	TLSHandshake time.Duration
+
+	// The timeout of waiting for the response headers after the request is
+	// fully written.
+	ResponseHeader time.Duration
+}
+
+// DefaultTransportTimeouts is the TransportTimeouts used by default.
+var DefaultTransportTimeouts = TransportTimeouts{
+	Dial:           5 * time.Second,
+	TLSHandshake:   5 * time.Second,
+	ResponseHeader: 10 * time.Second,
+}
+
+const (
+	// The keep alive period of the tcp connections, same as
+	// http.DefaultTransport.
+	transportKeepAlive = 30 * time.Second
+
+	// The max number of idle connections to keep per host.
+	//
+	// The default of http.Transport is 2, which causes the connections to churn
+	// when downloading images from the same host concurrently.
+	transportMaxIdleConnsPerHost = 16
+
+	// How long to keep the idle connections, same as http.DefaultTransport.
+	transportIdleConnTimeout = 90 * time.Second
+)
+
+// NewTransport returns a clone of http.DefaultTransport with timeouts set,
+// and more idle connections kept for reuse.
+//
+// The transport also enforces the HostPolicy of GetHTML and Readable on the
+// resolved addresses.
+func NewTransport(timeouts TransportTimeouts) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:        timeouts.Dial,
+		KeepAlive:      transportKeepAlive,
+		ControlContext: checkDialAddress,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = timeouts.TLSHandshake
+	transport.ResponseHeaderTimeout = timeouts.ResponseHeader
+	transport.MaxIdleConnsPerHost = transportMaxIdleConnsPerHost
+	transport.IdleConnTimeout = transportIdleConnTimeout
+	return transport
+}
+
+// SetTransportTimeouts sets the timeouts of the http client used by GetHTML
+// and Readable (when no custom client is given), which uses
+// DefaultTransportTimeouts by default.
+//
+// It's not safe to be called concurrently with GetHTML or Readable, and is
+// usually called during initialization.
+func SetTransportTimeouts(timeouts TransportTimeouts) {
+	client.Transport = NewTransport(timeouts)
+}
@@ -0,0 +1,57 @@
+package url2epub
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewTransport(t *testing.T) {
+	timeouts := TransportTimeouts{
+		Dial:           time.Second,
+		TLSHandshake:   2 * time.Second,
+		ResponseHeader: 50 * time.Millisecond,
+	}
+	transport := NewTransport(timeouts)
+	if transport == http.DefaultTransport {
+		t.Error("NewTransport returned http.DefaultTransport")
+	}
+	if got, want := transport.TLSHandshakeTimeout, timeouts.TLSHandshake; got != want {
+		t.Errorf("TLSHandshakeTimeout got %v, want %v", got, want)
+	}
+	if got, want := transport.ResponseHeaderTimeout, timeouts.ResponseHeader; got != want {
+		t.Errorf("ResponseHeaderTimeout got %v, want %v", got, want)
+	}
+	if got, want := transport.MaxIdleConnsPerHost, transportMaxIdleConnsPerHost; got != want {
+		t.Errorf("MaxIdleConnsPerHost got %v, want %v", got, want)
+	}
+
+	// A server that accepts the request but never responds.
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		close(done)
+	})
+
+	c := &http.Client{Transport: transport}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected error from a server never responding, got nil")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Request was not failed by ResponseHeader timeout: %v, took %v", err, time.Since(start))
+	}
+}
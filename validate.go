@@ -0,0 +1,190 @@
+package url2epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+type containerXML struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfXML struct {
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+const xhtmlMediaType = "application/xhtml+xml"
+
+// ValidateEpub does some structural checks on an epub file.
+//
+// It's not a full epubcheck, but it checks the things that are known to cause
+// problems on e-readers, for example:
+//
+// - mimetype must be the first file, stored uncompressed with the correct
+// content.
+//
+// - META-INF/container.xml must point to an existing opf file.
+//
+// - All the items in opf manifest must exist, and all spine items must be in
+// the manifest.
+//
+// - All the xhtml files must be well-formed xml.
+//
+// It returns all the problems found, or nil if none found.
+func ValidateEpub(r io.ReaderAt, size int64) []error {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return []error{fmt.Errorf("epub: not a valid zip file: %w", err)}
+	}
+	var errs []error
+	files := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+
+	errs = append(errs, validateMimetype(z)...)
+
+	container, err := decodeZipXML[containerXML](files, epubContainerFilename)
+	if err != nil {
+		return append(errs, err)
+	}
+	if len(container.Rootfiles) == 0 {
+		return append(errs, fmt.Errorf("epub: no rootfile in %q", epubContainerFilename))
+	}
+	for _, rootfile := range container.Rootfiles {
+		errs = append(errs, validateOpf(files, rootfile.FullPath)...)
+	}
+	return errs
+}
+
+func validateMimetype(z *zip.Reader) []error {
+	if len(z.File) == 0 {
+		return []error{errors.New("epub: empty zip file")}
+	}
+	f := z.File[0]
+	if f.Name != epubMimetypeFilename {
+		return []error{fmt.Errorf("epub: first file is %q instead of %q", f.Name, epubMimetypeFilename)}
+	}
+	var errs []error
+	if f.Method != zip.Store {
+		errs = append(errs, fmt.Errorf("epub: %q is compressed with method %d instead of stored", f.Name, f.Method))
+	}
+	content, err := readZipFile(f)
+	if err != nil {
+		return append(errs, err)
+	}
+	if string(content) != EpubMimeType {
+		errs = append(errs, fmt.Errorf("epub: %q has content %q instead of %q", f.Name, content, EpubMimeType))
+	}
+	return errs
+}
+
+func validateOpf(files map[string]*zip.File, opfPath string) []error {
+	opf, err := decodeZipXML[opfXML](files, opfPath)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	dir := path.Dir(opfPath)
+	ids := make(map[string]bool, len(opf.Manifest))
+	var hasNav bool
+	for _, item := range opf.Manifest {
+		if ids[item.ID] {
+			errs = append(errs, fmt.Errorf("epub: duplicate manifest item id %q", item.ID))
+		}
+		ids[item.ID] = true
+		if strings.Contains(" "+item.Properties+" ", " nav ") {
+			hasNav = true
+		}
+		if item.MediaType == "" || item.MediaType == "application/octet-stream" {
+			errs = append(errs, fmt.Errorf("epub: manifest item %q has unusable media-type %q", item.Href, item.MediaType))
+		}
+		filename := path.Join(dir, item.Href)
+		f := files[filename]
+		if f == nil {
+			errs = append(errs, fmt.Errorf("epub: manifest item %q not found in zip", filename))
+			continue
+		}
+		if item.MediaType == xhtmlMediaType {
+			if err := validateXML(f); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if !hasNav {
+		errs = append(errs, errors.New("epub: no nav item in manifest"))
+	}
+	if len(opf.Spine) == 0 {
+		errs = append(errs, errors.New("epub: empty spine"))
+	}
+	for _, itemref := range opf.Spine {
+		if !ids[itemref.IDRef] {
+			errs = append(errs, fmt.Errorf("epub: spine itemref %q not found in manifest", itemref.IDRef))
+		}
+	}
+	return errs
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("epub: unable to open %q: %w", f.Name, err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("epub: unable to read %q: %w", f.Name, err)
+	}
+	return content, nil
+}
+
+func decodeZipXML[T any](files map[string]*zip.File, name string) (*T, error) {
+	f := files[name]
+	if f == nil {
+		return nil, fmt.Errorf("epub: %q not found in zip", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("epub: unable to open %q: %w", name, err)
+	}
+	defer r.Close()
+	v := new(T)
+	if err := xml.NewDecoder(r).Decode(v); err != nil {
+		return nil, fmt.Errorf("epub: unable to parse %q: %w", name, err)
+	}
+	return v, nil
+}
+
+func validateXML(f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("epub: unable to open %q: %w", f.Name, err)
+	}
+	defer r.Close()
+	decoder := xml.NewDecoder(r)
+	for {
+		_, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("epub: %q is not well-formed xml: %w", f.Name, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package url2epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+const testArticleHTML = `<html lang="en"><head><title>Hello</title></head><body><article><h1>Hello &amp; welcome</h1><p>Some<br>text&nbsp;here.</p><img src="images/001.jpg"></article></body></html>`
+
+func testEpub(t *testing.T, args EpubArgs) *bytes.Buffer {
+	t.Helper()
+	if args.Node == nil && len(args.Sections) == 0 {
+		node, err := html.Parse(strings.NewReader(testArticleHTML))
+		if err != nil {
+			t.Fatalf("html.Parse failed: %v", err)
+		}
+		args.Node = node
+	}
+	buf := new(bytes.Buffer)
+	args.Dest = buf
+	if _, err := Epub(args); err != nil {
+		t.Fatalf("Epub failed: %v", err)
+	}
+	return buf
+}
+
+// testEpubOpf returns the content of the opf file in the epub.
+func testEpubOpf(t *testing.T, buf *bytes.Buffer) string {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader failed: %v", err)
+	}
+	f, err := z.Open(epubOpfFullpath)
+	if err != nil {
+		t.Fatalf("Failed to open opf: %v", err)
+	}
+	defer f.Close()
+	opf, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Failed to read opf: %v", err)
+	}
+	return string(opf)
+}
+
+type testZipFile struct {
+	name    string
+	content string
+	method  uint16
+}
+
+func testZip(t *testing.T, files []testZipFile) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	z := zip.NewWriter(buf)
+	for _, f := range files {
+		w, err := z.CreateHeader(&zip.FileHeader{
+			Name:   f.name,
+			Method: f.method,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create %q: %v", f.name, err)
+		}
+		io.WriteString(w, f.content)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatalf("Failed to close zip: %v", err)
+	}
+	return buf
+}
+
+const (
+	testOpf = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+ <manifest>
+  <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+  <item id="article" href="article.xhtml" media-type="application/xhtml+xml"/>
+ </manifest>
+ <spine>
+  <itemref idref="article"/>
+ </spine>
+</package>`
+	testXHTML = `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>hi</p></body></html>`
+)
+
+func TestValidateEpub(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		data  func(t *testing.T) *bytes.Buffer
+		want  []string
+	}{
+		{
+			label: "generated",
+			data: func(t *testing.T) *bytes.Buffer {
+				return testEpub(t, EpubArgs{
+					Title:  "Hello",
+					Author: "Me",
+					Images: map[string]io.Reader{
+						"images/001.jpg": bytes.NewReader([]byte("\xff\xd8\xff\xe0 jpeg")),
+					},
+				})
+			},
+		},
+		{
+			label: "not-zip",
+			data: func(*testing.T) *bytes.Buffer {
+				return bytes.NewBufferString("not a zip")
+			},
+			want: []string{"not a valid zip"},
+		},
+		{
+			label: "broken",
+			data: func(t *testing.T) *bytes.Buffer {
+				return testZip(t, []testZipFile{
+					{name: epubMimetypeFilename, content: EpubMimeType, method: zip.Deflate},
+					{name: epubContainerFilename, content: epubContainerContent, method: zip.Deflate},
+					{name: epubOpfFullpath, content: testOpf, method: zip.Deflate},
+					{name: "content/nav.xhtml", content: testXHTML, method: zip.Deflate},
+				})
+			},
+			want: []string{
+				"compressed",
+				`"content/article.xhtml" not found`,
+			},
+		},
+		{
+			label: "bad-xhtml",
+			data: func(t *testing.T) *bytes.Buffer {
+				return testZip(t, []testZipFile{
+					{name: epubMimetypeFilename, content: EpubMimeType, method: zip.Store},
+					{name: epubContainerFilename, content: epubContainerContent, method: zip.Deflate},
+					{name: epubOpfFullpath, content: strings.ReplaceAll(testOpf, `idref="article"`, `idref="foo"`), method: zip.Deflate},
+					{name: "content/nav.xhtml", content: testXHTML, method: zip.Deflate},
+					{name: "content/article.xhtml", content: `<html><body><p>unclosed</body></html>`, method: zip.Deflate},
+				})
+			},
+			want: []string{
+				"not well-formed",
+				`spine itemref "foo"`,
+			},
+		},
+		{
+			label: "wrong-mimetype",
+			data: func(t *testing.T) *bytes.Buffer {
+				return testZip(t, []testZipFile{
+					{name: epubContainerFilename, content: epubContainerContent, method: zip.Deflate},
+					{name: epubMimetypeFilename, content: EpubMimeType, method: zip.Store},
+				})
+			},
+			want: []string{
+				"first file",
+				`"content/content.opf" not found`,
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			data := c.data(t)
+			errs := ValidateEpub(bytes.NewReader(data.Bytes()), int64(data.Len()))
+			if len(errs) != len(c.want) {
+				t.Fatalf("ValidateEpub got %d errors %v, want %d %q", len(errs), errs, len(c.want), c.want)
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), c.want[i]) {
+					t.Errorf("errs[%d] got %v, want to contain %q", i, err, c.want[i])
+				}
+			}
+		})
+	}
+}
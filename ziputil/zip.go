@@ -6,22 +6,39 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 )
 
 // WriteFile writes a single file inside a zip archive.
 func WriteFile(z *zip.Writer, filename string, src io.WriterTo) error {
+	return WriteFileAt(z, filename, time.Time{}, src)
+}
+
+// StoreFile is similar to WriteFile except it uses Store instead of Deflate.
+func StoreFile(z *zip.Writer, filename string, src io.WriterTo) error {
+	return StoreFileAt(z, filename, time.Time{}, src)
+}
+
+// WriteFileAt is similar to WriteFile except it also sets the modification
+// time of the file to modTime.
+//
+// Zero modTime means no modification time, which is the same as WriteFile.
+func WriteFileAt(z *zip.Writer, filename string, modTime time.Time, src io.WriterTo) error {
 	header := &zip.FileHeader{
-		Name:   filename,
-		Method: zip.Deflate,
+		Name:     filename,
+		Method:   zip.Deflate,
+		Modified: modTime,
 	}
 	return write(z, header, src)
 }
 
-// StoreFile is similar to WriteFile except it uses Store instead of Deflate.
-func StoreFile(z *zip.Writer, filename string, src io.WriterTo) error {
+// StoreFileAt is similar to WriteFileAt except it uses Store instead of
+// Deflate.
+func StoreFileAt(z *zip.Writer, filename string, modTime time.Time, src io.WriterTo) error {
 	header := &zip.FileHeader{
-		Name:   filename,
-		Method: zip.Store,
+		Name:     filename,
+		Method:   zip.Store,
+		Modified: modTime,
 	}
 	return write(z, header, src)
 }